@@ -3,8 +3,11 @@
 package common
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
@@ -14,10 +17,14 @@ const (
 	// Location of APIs
 	RegistryAPILoc = "/registry"
 	DataAPILoc     = "/data"
+	DeadLettersLoc = "/deadletters"
 	// QueryPage parameters
 	ParamPage        = "page"
 	ParamPerPage     = "perPage"
+	ParamCursor      = "cursor"
 	ParamLimit       = "limit"
+	ParamOffset      = "offset"
+	ParamStream      = "stream"
 	ParamFrom        = "from"
 	ParamTo          = "to"
 	ParamSort        = "sort"
@@ -25,6 +32,14 @@ const (
 	ParamCount       = "count"
 	ParamAggr        = "aggr"
 	ParamWindow      = "window"
+	ParamFill        = "fill"
+	ParamResample    = "resample"
+	ParamAlign       = "align"
+	ParamTZ          = "tz"
+	ParamTransform   = "transform"
+	ParamUnit        = "unit"
+	ParamSource      = "source"
+	ParamTopic       = "topic"
 
 	// Values for ParamSort
 	Asc  = "asc"  // ascending
@@ -42,8 +57,11 @@ var (
 	// Default MIME type for all responses
 	DefaultMIMEType string
 
-	// supported aggregates
-	supportedAggregates = []string{"mean", "sum", "min", "max", "count"}
+	// supported aggregates, in addition to the percentiles
+	supportedAggregates = []string{"mean", "sum", "min", "max", "count", "median", "stddev", "variance", "first", "last", "spread",
+		"time_true", "ratio_true", "transitions", "count_distinct", "mode"}
+	// aggregates of boolean and string states, which do not apply to numeric series
+	stateAggregates = []string{"time_true", "ratio_true", "transitions", "count_distinct", "mode"}
 	// supported period suffixes
 	supportedPeriods = []string{"m", "h", "d", "w"}
 
@@ -65,12 +83,38 @@ func SupportedPeriod(p string) bool {
 		// empty means no retention
 		return true
 	}
-	// Create regexp: ^[0-9]*(h|d|w|m)$
+	// Create regexp: ^[0-9]+(h|d|w|m)$
 	intervals := strings.Join(supportedPeriods, "|")
-	re := regexp.MustCompile("^[0-9]*(" + intervals + ")$")
+	re := regexp.MustCompile("^[0-9]+(" + intervals + ")$")
 	return re.MatchString(p)
 }
 
+// ParsePeriod converts a supported period (e.g. 30m, 12h, 7d, 2w) to a duration. Empty period results in zero duration
+func ParsePeriod(p string) (time.Duration, error) {
+	if p == "" {
+		return 0, nil
+	}
+	if !SupportedPeriod(p) {
+		return 0, fmt.Errorf("unsupported period: %s", p)
+	}
+	n, err := strconv.Atoi(p[:len(p)-1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid period %s: %s", p, err)
+	}
+	var unit time.Duration
+	switch p[len(p)-1:] {
+	case "m":
+		unit = time.Minute
+	case "h":
+		unit = time.Hour
+	case "d":
+		unit = 24 * time.Hour
+	case "w":
+		unit = 7 * 24 * time.Hour
+	}
+	return time.Duration(n) * unit, nil
+}
+
 // SupportedPeriods returns supported periods
 func SupportedPeriods() []string {
 	var periods []string
@@ -80,9 +124,32 @@ func SupportedPeriods() []string {
 
 // SupportedAggregate validates an aggregate
 func SupportedAggregate(a string) bool {
+	if _, ok := ParsePercentile(a); ok {
+		return true
+	}
 	return stringInSlice(a, supportedAggregates)
 }
 
+// NumericAggregate validates an aggregate of numeric series
+func NumericAggregate(a string) bool {
+	return SupportedAggregate(a) && !stringInSlice(a, stateAggregates)
+}
+
+// ParsePercentile parses a percentile aggregate, e.g. p90 or p99.9, and returns the corresponding quantile (e.g. 0.9 or 0.999)
+func ParsePercentile(a string) (float64, bool) {
+	if !strings.HasPrefix(a, "p") {
+		return 0, false
+	}
+	if strings.Trim(a[1:], "0123456789.") != "" {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(a[1:], 64)
+	if err != nil || p > 100 {
+		return 0, false
+	}
+	return p / 100, true
+}
+
 func stringInSlice(a string, list []string) bool {
 	for _, b := range list {
 		if b == a {
@@ -46,6 +46,8 @@ type HTTPConf struct {
 	PublicEndpoint string `json:"publicEndpoint"`
 	BindAddr       string `json:"bindAddr"`
 	BindPort       uint16 `json:"bindPort"`
+	// AllowedOrigins of the web pages which may open WebSocket streams, besides the service itself. * allows all.
+	AllowedOrigins []string `json:"allowedOrigins"`
 }
 
 // Web GUI Config
@@ -58,6 +60,11 @@ type WebConfig struct {
 // Registry config
 type RegConf struct {
 	Backend RegBackendConf `json:"backend"`
+	// IndexedMeta lists the meta keys which are indexed by the LevelDB backend to speed up searches (e.g. building)
+	IndexedMeta []string `json:"indexedMeta"`
+	// ExportSecrets includes the credentials of the sources in the export of the registry. It requires auth to be enabled,
+	// so that the export can be restricted to admins by the authorization rules
+	ExportSecrets bool `json:"exportSecrets"`
 }
 
 // Registry backend config
@@ -72,6 +79,34 @@ type DataConf struct {
 	// RetentionPeriods is deprecated, will be removed from v0.6.0. Use registry.retentionPeriods instead.
 	RetentionPeriods []string `json:"retentionPeriods"`
 	AutoRegistration bool     `json:"autoRegistration"`
+	// Duplicates is the default policy for submitted records whose time is already taken: overwrite (default), keep_first, reject or sequence
+	Duplicates string `json:"duplicates"`
+	// Queue of the submitted data, which is written in batches
+	Queue QueueConf `json:"queue"`
+	// DeadLetters keeps the rejected MQTT messages and HTTP submissions, to be replayed
+	DeadLetters DeadLettersConf `json:"deadLetters"`
+}
+
+// Dead letters config
+type DeadLettersConf struct {
+	// Size is the maximum number of dead letters, after which the oldest ones are dropped. 0 disables the dead letters.
+	Size int `json:"size"`
+}
+
+// Ingestion queue config
+type QueueConf struct {
+	// Size is the maximum number of records queued in memory. 0 disables the queue, each submission is written in a transaction of its own.
+	Size int `json:"size"`
+	// BatchSize is the maximum number of records written in a transaction (default 1000)
+	BatchSize int `json:"batchSize"`
+	// BatchDelay is the time in milliseconds for which a batch waits for more records, unless it is full (default 100)
+	BatchDelay int `json:"batchDelay"`
+	// SpillFile, if set, stores the MQTT data which does not fit in memory, up to SpillSize records.
+	// The position of the data written from it is kept in SpillFile.offset.
+	SpillFile string `json:"spillFile"`
+	SpillSize int    `json:"spillSize"`
+	// RetryAfter is the time in seconds after which HTTP clients are asked to retry if the queue is full (default 1)
+	RetryAfter int `json:"retryAfter"`
 }
 
 // Data backend config
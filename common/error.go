@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 
 	uuid "github.com/satori/go.uuid"
 	"google.golang.org/grpc/codes"
@@ -73,6 +74,23 @@ func (e *UnsupportedMediaTypeError) Title() string {
 	return http.StatusText(http.StatusUnsupportedMediaType)
 }
 
+// Service Unavailable, e.g. if the service is overloaded
+type ServiceUnavailableError struct {
+	S string
+	// RetryAfter is the time in seconds after which the request may be retried, 0 if unknown
+	RetryAfter int
+}
+
+func (e *ServiceUnavailableError) Error() string { return e.S }
+
+func (e *ServiceUnavailableError) HttpStatus() int { return http.StatusServiceUnavailable }
+
+func (e *ServiceUnavailableError) GrpcStatus() codes.Code { return codes.Unavailable }
+
+func (e *ServiceUnavailableError) Title() string {
+	return http.StatusText(http.StatusServiceUnavailable)
+}
+
 // HttpErrorResponse writes error to HTTP ResponseWriter
 func HttpErrorResponse(err Error, w http.ResponseWriter) {
 	// Problem Details for HTTP APIs (RFC 7807)
@@ -109,6 +127,9 @@ func HttpErrorResponse(err Error, w http.ResponseWriter) {
 
 		log.Printf("ERROR: %s: %s\n", e.Instance, err)
 	}
+	if unavailable, ok := err.(*ServiceUnavailableError); ok && unavailable.RetryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(unavailable.RetryAfter))
+	}
 	b, _ := json.Marshal(e)
 	w.Header().Set("Content-Type", "application/problem+json;version="+APIVersion)
 	w.WriteHeader(status)
@@ -0,0 +1,110 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package common
+
+import (
+	"fmt"
+	"math"
+)
+
+// unit is a unit of measurement, which converts to the coherent unit of its quantity by value*scale + offset
+type unit struct {
+	quantity      string
+	scale, offset float64
+}
+
+// units are the units of the SenML units registry (RFC 8428 and the secondary units of RFC 8798),
+// and UCUM codes of customary (imperial and US) units, which the registry does not cover.
+// Units with a quantity of their own are valid, but only convertible to themselves.
+var units = map[string]unit{
+	// length
+	"m": {"length", 1, 0}, "mm": {"length", 1e-3, 0}, "cm": {"length", 1e-2, 0}, "km": {"length", 1e3, 0},
+	"[in_i]": {"length", 0.0254, 0}, "[ft_i]": {"length", 0.3048, 0}, "[yd_i]": {"length", 0.9144, 0}, "[mi_i]": {"length", 1609.344, 0},
+	// mass
+	"kg": {"mass", 1, 0}, "g": {"mass", 1e-3, 0}, "[lb_av]": {"mass", 0.45359237, 0}, "[oz_av]": {"mass", 0.028349523125, 0},
+	// time
+	"s": {"time", 1, 0}, "ms": {"time", 1e-3, 0}, "min": {"time", 60, 0}, "h": {"time", 3600, 0},
+	// temperature
+	"K": {"temperature", 1, 0}, "Cel": {"temperature", 1, 273.15}, "[degF]": {"temperature", 5.0 / 9, 273.15 - 32*5.0/9},
+	// frequency
+	"Hz": {"frequency", 1, 0}, "MHz": {"frequency", 1e6, 0}, "1/s": {"frequency", 1, 0}, "1/min": {"frequency", 1.0 / 60, 0},
+	// angle
+	"rad": {"angle", 1, 0}, "deg": {"angle", math.Pi / 180, 0},
+	// pressure
+	"Pa": {"pressure", 1, 0}, "hPa": {"pressure", 100, 0}, "bar": {"pressure", 1e5, 0}, "[psi]": {"pressure", 6894.757293168361, 0},
+	// energy
+	"J": {"energy", 1, 0}, "Wh": {"energy", 3600, 0}, "kWh": {"energy", 3.6e6, 0}, "[Btu_IT]": {"energy", 1055.05585262, 0},
+	// power
+	"W": {"power", 1, 0}, "kW": {"power", 1e3, 0}, "[HP]": {"power", 745.69987158227022, 0},
+	"dBW": {"power level", 1, 0}, "dBm": {"power level", 1, -30},
+	// apparent and reactive power and energy
+	"VA": {"apparent power", 1, 0}, "kVA": {"apparent power", 1e3, 0},
+	"VAs": {"apparent energy", 1, 0}, "kVAh": {"apparent energy", 3.6e6, 0},
+	"var": {"reactive power", 1, 0}, "kvar": {"reactive power", 1e3, 0},
+	"vars": {"reactive energy", 1, 0}, "varh": {"reactive energy", 3600, 0}, "kvarh": {"reactive energy", 3.6e6, 0},
+	// electric charge, current and potential
+	"C": {"charge", 1, 0}, "Ah": {"charge", 3600, 0},
+	"A": {"current", 1, 0}, "mA": {"current", 1e-3, 0},
+	"V": {"voltage", 1, 0}, "mV": {"voltage", 1e-3, 0},
+	// area and volume
+	"m2": {"area", 1, 0},
+	"m3": {"volume", 1, 0}, "l": {"volume", 1e-3, 0}, "[gal_us]": {"volume", 0.003785411784, 0},
+	// velocity, acceleration and flow
+	"m/s": {"velocity", 1, 0}, "km/h": {"velocity", 1 / 3.6, 0}, "m/h": {"velocity", 1.0 / 3600, 0}, "mm/h": {"velocity", 1e-3 / 3600, 0},
+	"[mi_i]/h": {"velocity", 0.44704, 0}, "[kn_i]": {"velocity", 1852.0 / 3600, 0},
+	"m/s2": {"acceleration", 1, 0},
+	"m3/s": {"flow", 1, 0}, "l/s": {"flow", 1e-3, 0}, "[gal_us]/min": {"flow", 0.003785411784 / 60, 0},
+	// energy per distance, e.g. of vehicles
+	"J/m": {"energy per distance", 1, 0}, "Wh/km": {"energy per distance", 3.6, 0},
+	// information
+	"B": {"information", 1, 0}, "bit": {"information", 0.125, 0}, "KiB": {"information", 1024, 0}, "GB": {"information", 1e9, 0},
+	"bit/s": {"data rate", 1, 0}, "B/s": {"data rate", 8, 0}, "Mbit/s": {"data rate", 1e6, 0}, "MB/s": {"data rate", 8e6, 0},
+	// concentrations and ratios
+	"kg/m3": {"density", 1, 0}, "ug/m3": {"density", 1e-9, 0},
+	"/": {"ratio", 1, 0}, "%": {"ratio", 1e-2, 0}, "/100": {"ratio", 1e-2, 0}, "/1000": {"ratio", 1e-3, 0}, "ppm": {"ratio", 1e-6, 0},
+	// quantities without conversions
+	"cd": {"cd", 1, 0}, "mol": {"mol", 1, 0}, "sr": {"sr", 1, 0}, "N": {"N", 1, 0}, "F": {"F", 1, 0}, "Ohm": {"Ohm", 1, 0},
+	"S": {"S", 1, 0}, "Wb": {"Wb", 1, 0}, "T": {"T", 1, 0}, "H": {"H", 1, 0}, "lm": {"lm", 1, 0}, "lx": {"lx", 1, 0},
+	"Bq": {"Bq", 1, 0}, "Gy": {"Gy", 1, 0}, "Sv": {"Sv", 1, 0}, "kat": {"kat", 1, 0}, "W/m2": {"W/m2", 1, 0},
+	"cd/m2": {"cd/m2", 1, 0}, "lat": {"lat", 1, 0}, "lon": {"lon", 1, 0}, "pH": {"pH", 1, 0}, "dB": {"dB", 1, 0},
+	"Bspl": {"Bspl", 1, 0}, "count": {"count", 1, 0}, "%RH": {"%RH", 1, 0}, "%EL": {"%EL", 1, 0}, "EL": {"EL", 1, 0},
+	"beat/min": {"beat/min", 1, 0}, "beats": {"beats", 1, 0}, "S/m": {"S/m", 1, 0},
+}
+
+// ValidUnit checks if a unit is in the SenML units registry or a supported UCUM customary unit. Empty means no unit.
+func ValidUnit(u string) bool {
+	if u == "" {
+		return true
+	}
+	_, found := units[u]
+	return found
+}
+
+// UnitConversion is the linear conversion of values from one unit to another: value*Scale + Offset
+type UnitConversion struct {
+	Scale, Offset float64
+}
+
+// ConvertUnit returns the conversion between two units of the same quantity, e.g. from Cel to [degF]
+func ConvertUnit(from, to string) (UnitConversion, error) {
+	if from == to {
+		return UnitConversion{Scale: 1}, nil
+	}
+	f, found := units[from]
+	if !found {
+		return UnitConversion{}, fmt.Errorf("unknown unit: %q", from)
+	}
+	t, found := units[to]
+	if !found {
+		return UnitConversion{}, fmt.Errorf("unknown unit: %q", to)
+	}
+	if f.quantity != t.quantity {
+		return UnitConversion{}, fmt.Errorf("unit %s cannot be converted to %s", from, to)
+	}
+	return UnitConversion{Scale: f.scale / t.scale, Offset: (f.offset - t.offset) / t.scale}, nil
+}
+
+// Apply converts a value
+func (c UnitConversion) Apply(v float64) float64 {
+	return v*c.Scale + c.Offset
+}
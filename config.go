@@ -54,6 +54,9 @@ func loadConfig(confPath *string, ignoreEnv bool) (*common.Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	if conf.Registry.ExportSecrets && !conf.Auth.Enabled {
+		return nil, fmt.Errorf("Registry exportSecrets requires auth to be enabled")
+	}
 
 	// VALIDATE DATA API CONFIG
 	// Check if backend is supported
@@ -65,7 +68,18 @@ func loadConfig(confPath *string, ignoreEnv bool) (*common.Config, error) {
 	if err != nil {
 		return nil, err
 	}
-
+	if !registry.ValidDuplicatesPolicy(conf.Data.Duplicates) {
+		return nil, fmt.Errorf("Data duplicates policy is not supported: %s", conf.Data.Duplicates)
+	}
+	if q := conf.Data.Queue; q.Size < 0 || q.BatchSize < 0 || q.BatchDelay < 0 || q.SpillSize < 0 || q.RetryAfter < 0 {
+		return nil, fmt.Errorf("Data queue sizes and times must not be negative")
+	}
+	if conf.Data.Queue.SpillFile != "" && conf.Data.Queue.SpillSize == 0 {
+		return nil, fmt.Errorf("Data queue spillSize has to be defined with spillFile")
+	}
+	if conf.Data.DeadLetters.Size < 0 {
+		return nil, fmt.Errorf("Data deadLetters size must not be negative")
+	}
 
 	// VALIDATE SERVICE CATALOG CONFIG
 	if conf.ServiceCatalog.Enabled {
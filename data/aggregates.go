@@ -0,0 +1,373 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+	"github.com/mattn/go-sqlite3"
+)
+
+// AggregateSeparator separates the name of a series and the aggregation function in the records of queries with multiple aggregates
+const AggregateSeparator = ":"
+
+// DRIVER_SQLITE3_AGGR is the SQLite driver with the aggregate and math functions which SQLite does not provide
+const DRIVER_SQLITE3_AGGR = "sqlite3_hds"
+
+func init() {
+	sql.Register(DRIVER_SQLITE3_AGGR, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			aggregators := map[string]interface{}{
+				"hds_quantile":   newQuantileAggregator,
+				"hds_variance":   newVarianceAggregator,
+				"hds_stddev":     newStddevAggregator,
+				"hds_first":      newFirstAggregator,
+				"hds_last":       newLastAggregator,
+				"hds_first_text": newFirstTextAggregator,
+				"hds_last_text":  newLastTextAggregator,
+				"hds_mode":       newModeAggregator,
+			}
+			for name, impl := range aggregators {
+				if err := conn.RegisterAggregator(name, impl, true); err != nil {
+					return fmt.Errorf("error registering aggregate %s: %s", name, err)
+				}
+			}
+			for name, impl := range sqliteMathFunctions {
+				if err := conn.RegisterFunc(name, impl, true); err != nil {
+					return fmt.Errorf("error registering function %s: %s", name, err)
+				}
+			}
+			return nil
+		},
+	})
+}
+
+// AggregateName returns the name of the records holding an aggregate of a series, e.g. Kitchen/Temperature:max
+func AggregateName(series, aggr string) string {
+	return series + AggregateSeparator + aggr
+}
+
+// resultSeries maps the names of the records returned by a query to their series, with the type and unit of the aggregates.
+// With multiple aggregates, each series has a record name per aggregate.
+func resultSeries(q Query, series []*registry.TimeSeries) map[string]*registry.TimeSeries {
+	names := make(map[string]*registry.TimeSeries, len(series)*len(q.AggrFuncs))
+	for _, ts := range series {
+		switch len(q.AggrFuncs) {
+		case 0:
+			names[ts.Name] = ts
+		case 1:
+			names[ts.Name] = aggregateResult(ts, q.AggrFuncs[0])
+		default:
+			for _, aggr := range q.AggrFuncs {
+				names[AggregateName(ts.Name, aggr)] = aggregateResult(ts, aggr)
+			}
+		}
+	}
+	return names
+}
+
+// aggregateType returns the type of an aggregate over values of the given type, or false if it does not apply to them.
+// Numeric aggregates apply to floats only. Count, first and last apply to any type, the others are meant for states:
+// time_true and ratio_true for booleans, transitions and count_distinct for booleans and strings, mode for strings.
+func aggregateType(aggr string, t registry.ValueType) (registry.ValueType, bool) {
+	switch aggr {
+	case "count":
+		return registry.Float, true
+	case "first", "last":
+		return t, t != registry.Data
+	case "time_true", "ratio_true":
+		return registry.Float, t == registry.Bool
+	case "transitions", "count_distinct":
+		return registry.Float, t == registry.Bool || t == registry.String
+	case "mode":
+		return registry.String, t == registry.String
+	}
+	return registry.Float, t == registry.Float
+}
+
+// aggregateResult returns the series describing the records of an aggregate, which differ in type and unit for some aggregates
+func aggregateResult(ts *registry.TimeSeries, aggr string) *registry.TimeSeries {
+	unit := ts.Unit
+	switch aggr {
+	case "time_true":
+		unit = "s"
+	case "ratio_true":
+		unit = "/"
+	case "transitions", "count_distinct":
+		unit = ""
+	}
+	t, _ := aggregateType(aggr, ts.Type)
+	if t == ts.Type && unit == ts.Unit {
+		return ts
+	}
+	result := *ts
+	result.Type, result.Unit = t, unit
+	return &result
+}
+
+// statefulAggregates checks if any of the aggregates depends on the neighbouring records,
+// which are provided by the duration, prev_value and carried columns of the aggregated data
+func statefulAggregates(aggrs []string) bool {
+	for _, aggr := range aggrs {
+		switch aggr {
+		case "time_true", "ratio_true", "transitions":
+			return true
+		}
+	}
+	return false
+}
+
+// timeTrue returns the SQL expression of the time in the true state, including the state carried into the window
+func timeTrue(value string) string {
+	return fmt.Sprintf("SUM(CASE WHEN %s THEN duration ELSE 0 END)+SUM(CASE WHEN prev_value THEN carried ELSE 0 END)", value)
+}
+
+// aggregateExpr returns the SQL expression of an aggregate over the given value and time columns, whose values are of type t.
+// The stateful aggregates use the duration of each state, i.e. the time until the next record or the end of the window,
+// the value of the previous record, and the time for which its state is carried into the window.
+func aggregateExpr(d sqlDialect, aggr string, t registry.ValueType, value, time string) string {
+	if q, ok := common.ParsePercentile(aggr); ok {
+		return d.quantile(value, q)
+	}
+	switch aggr {
+	case "mean":
+		return fmt.Sprintf("AVG(%s)", value)
+	case "sum":
+		return fmt.Sprintf("SUM(%s)", value)
+	case "min":
+		return fmt.Sprintf("MIN(%s)", value)
+	case "max":
+		return fmt.Sprintf("MAX(%s)", value)
+	case "count":
+		return fmt.Sprintf("COUNT(%s)", value)
+	case "median":
+		return d.quantile(value, 0.5)
+	case "stddev":
+		return d.stddev(value)
+	case "variance":
+		return d.variance(value)
+	case "first":
+		return d.first(value, time, t)
+	case "last":
+		return d.last(value, time, t)
+	case "spread":
+		return fmt.Sprintf("(MAX(%[1]s)-MIN(%[1]s))", value)
+	case "time_true":
+		return timeTrue(value)
+	case "ratio_true":
+		// the share of true records if the states have no duration, e.g. a single record at the end of the window
+		return fmt.Sprintf("COALESCE((%s)/NULLIF(SUM(duration)+SUM(carried),0), AVG(CASE WHEN %s THEN 1.0 ELSE 0.0 END))", timeTrue(value), value)
+	case "transitions":
+		return fmt.Sprintf("SUM(CASE WHEN prev_value IS NOT NULL AND %s <> prev_value THEN 1 ELSE 0 END)", value)
+	case "count_distinct":
+		return fmt.Sprintf("COUNT(DISTINCT %s)", value)
+	case "mode":
+		return d.mode(value)
+	default:
+		panic("Invalid aggregation:" + aggr)
+	}
+}
+
+// floatArg converts an argument of the SQLite aggregates, which may be stored as integer
+func floatArg(v interface{}) (float64, error) {
+	switch f := v.(type) {
+	case float64:
+		return f, nil
+	case int64:
+		return float64(f), nil
+	}
+	return 0, fmt.Errorf("unexpected argument of type %T", v)
+}
+
+// quantileAggregator calculates a quantile with linear interpolation between the closest values, as PERCENTILE_CONT
+type quantileAggregator struct {
+	values []float64
+	q      float64
+}
+
+func newQuantileAggregator() *quantileAggregator {
+	return &quantileAggregator{}
+}
+
+func (a *quantileAggregator) Step(value, q interface{}) error {
+	v, err := floatArg(value)
+	if err != nil {
+		return err
+	}
+	a.q, err = floatArg(q)
+	if err != nil {
+		return err
+	}
+	a.values = append(a.values, v)
+	return nil
+}
+
+func (a *quantileAggregator) Done() float64 {
+	return quantile(a.values, a.q)
+}
+
+// quantile sorts the values and returns the interpolated quantile
+func quantile(values []float64, q float64) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sort.Float64s(values)
+	pos := q * float64(len(values)-1)
+	lower := math.Floor(pos)
+	if int(lower) == len(values)-1 {
+		return values[len(values)-1]
+	}
+	return values[int(lower)] + (pos-lower)*(values[int(lower)+1]-values[int(lower)])
+}
+
+// varianceAggregator calculates the sample variance with Welford's algorithm
+type varianceAggregator struct {
+	n        int
+	mean, m2 float64
+	stddev   bool // true to return the standard deviation instead
+}
+
+func newVarianceAggregator() *varianceAggregator {
+	return &varianceAggregator{}
+}
+
+func newStddevAggregator() *varianceAggregator {
+	return &varianceAggregator{stddev: true}
+}
+
+func (a *varianceAggregator) Step(value interface{}) error {
+	v, err := floatArg(value)
+	if err != nil {
+		return err
+	}
+	a.n++
+	delta := v - a.mean
+	a.mean += delta / float64(a.n)
+	a.m2 += delta * (v - a.mean)
+	return nil
+}
+
+// Done returns the variance or standard deviation, which are zero for a single value
+func (a *varianceAggregator) Done() float64 {
+	if a.n < 2 {
+		return 0
+	}
+	if a.stddev {
+		return math.Sqrt(a.m2 / float64(a.n-1))
+	}
+	return a.m2 / float64(a.n-1)
+}
+
+// firstAggregator returns the value with the earliest time
+type firstAggregator struct {
+	found       bool
+	value, time float64
+	later       bool // true to return the value with the latest time instead
+}
+
+func newFirstAggregator() *firstAggregator {
+	return &firstAggregator{}
+}
+
+func newLastAggregator() *firstAggregator {
+	return &firstAggregator{later: true}
+}
+
+func (a *firstAggregator) Step(value, time interface{}) error {
+	v, err := floatArg(value)
+	if err != nil {
+		return err
+	}
+	t, err := floatArg(time)
+	if err != nil {
+		return err
+	}
+	if !a.found || (a.later && t > a.time) || (!a.later && t < a.time) {
+		a.found, a.value, a.time = true, v, t
+	}
+	return nil
+}
+
+func (a *firstAggregator) Done() float64 {
+	return a.value
+}
+
+// textArg converts a text argument of the SQLite aggregates
+func textArg(v interface{}) (string, error) {
+	switch s := v.(type) {
+	case string:
+		return s, nil
+	case []byte:
+		return string(s), nil
+	}
+	return "", fmt.Errorf("unexpected argument of type %T", v)
+}
+
+// firstTextAggregator is the firstAggregator of text values
+type firstTextAggregator struct {
+	found bool
+	value string
+	time  float64
+	later bool
+}
+
+func newFirstTextAggregator() *firstTextAggregator {
+	return &firstTextAggregator{}
+}
+
+func newLastTextAggregator() *firstTextAggregator {
+	return &firstTextAggregator{later: true}
+}
+
+func (a *firstTextAggregator) Step(value, time interface{}) error {
+	v, err := textArg(value)
+	if err != nil {
+		return err
+	}
+	t, err := floatArg(time)
+	if err != nil {
+		return err
+	}
+	if !a.found || (a.later && t > a.time) || (!a.later && t < a.time) {
+		a.found, a.value, a.time = true, v, t
+	}
+	return nil
+}
+
+func (a *firstTextAggregator) Done() string {
+	return a.value
+}
+
+// modeAggregator returns the most frequent value, and the smallest one of equally frequent values as MODE in PostgreSQL
+type modeAggregator struct {
+	counts map[string]int
+}
+
+func newModeAggregator() *modeAggregator {
+	return &modeAggregator{counts: make(map[string]int)}
+}
+
+func (a *modeAggregator) Step(value interface{}) error {
+	v, err := textArg(value)
+	if err != nil {
+		return err
+	}
+	a.counts[v]++
+	return nil
+}
+
+func (a *modeAggregator) Done() string {
+	var mode string
+	max := 0
+	for v, n := range a.counts {
+		if n > max || (n == max && v < mode) {
+			mode, max = v, n
+		}
+	}
+	return mode
+}
@@ -6,13 +6,13 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cskr/pubsub"
 	"github.com/farshidtz/senml/v2"
 	"github.com/linksmart/historical-datastore/common"
 	"github.com/linksmart/historical-datastore/registry"
-	errors2 "github.com/syndtr/goleveldb/leveldb/errors"
 )
 
 type Controller struct {
@@ -20,6 +20,8 @@ type Controller struct {
 	storage          Storage
 	autoRegistration bool
 	pubSub           *pubsub.PubSub
+	// deadLetters keeps the rejected submissions, if set
+	deadLetters DeadLetterStore
 }
 
 // NewAPI returns the configured Data API
@@ -29,7 +31,8 @@ func NewController(registry registry.Controller, storage Storage, autoRegistrati
 }
 
 //TODO: Return right code in return so that right code is returned by callers. e.g. Grpc code or http error responses.
-func (c Controller) Submit(ctx context.Context, senmlPack senml.Pack, ids []string) common.Error {
+// Submit returns the report of the records whose time was taken, per series
+func (c Controller) Submit(ctx context.Context, senmlPack senml.Pack, ids []string) (map[string]Duplicates, common.Error) {
 	const Y3K = 32503680000 //Year 3000 BC, beyond which the time values are not taken
 	//series := make(map[string]*registry.TimeSeries)
 	nameTS := make(map[string]*registry.TimeSeries)
@@ -38,7 +41,7 @@ func (c Controller) Submit(ctx context.Context, senmlPack senml.Pack, ids []stri
 		for _, id := range ids {
 			ts, err := c.registry.Get(id)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			nameTS[ts.Name] = ts
 		}
@@ -51,21 +54,21 @@ func (c Controller) Submit(ctx context.Context, senmlPack senml.Pack, ids []stri
 	for _, r := range senmlPack {
 		// validate time. This is to make sure, timestamps are not set to precisions other than milliseconds.
 		if r.Time > Y3K {
-			return &common.BadRequestError{S: fmt.Sprintf("invalid senml entry %s: unix time value in seconds is too far in the future: %f", r.Name, r.Time)}
+			return nil, &common.BadRequestError{S: fmt.Sprintf("invalid senml entry %s: unix time value in seconds is too far in the future: %f", r.Name, r.Time)}
 		}
 
 		// search for the registry entry
 		ts, found := nameTS[r.Name]
 		if !found && fromSeriesList {
-			return &common.BadRequestError{S: fmt.Sprintf("senml entry %s does not match the provided time series", r.Name)}
+			return nil, &common.BadRequestError{S: fmt.Sprintf("senml entry %s does not match the provided time series", r.Name)}
 		}
 		if !found {
 			var err error
 			ts, err = c.registry.Get(r.Name)
 			if err != nil {
-				if errors.Is(err, errors2.ErrNotFound) {
+				if _, notFound := err.(*common.NotFoundError); notFound {
 					if !c.autoRegistration {
-						return &common.NotFoundError{S: fmt.Sprintf("Time series with name %v is not registered.", r.Name)}
+						return nil, &common.NotFoundError{S: fmt.Sprintf("Time series with name %v is not registered.", r.Name)}
 					}
 
 					// Register a  time series with this name
@@ -85,20 +88,30 @@ func (c Controller) Submit(ctx context.Context, senmlPack senml.Pack, ids []stri
 					}
 					addedDS, err := c.registry.Add(newTS)
 					if err != nil {
-						return &common.BadRequestError{S: fmt.Sprintf("Error registering %v in the registry: %v", r.Name, err)}
+						return nil, &common.BadRequestError{S: fmt.Sprintf("Error registering %v in the registry: %v", r.Name, err)}
 					}
 					ts = addedDS
 				} else {
-					return &common.InternalError{S: err.Error()}
+					return nil, &common.InternalError{S: err.Error()}
 				}
 			}
 			nameTS[r.Name] = ts
 		}
 
+		if ts.Source.SrcType == registry.Series {
+			return nil, &common.BadRequestError{S: fmt.Sprintf("data of the rollup series %s is derived from %s and cannot be submitted", ts.Name, ts.Source.Series)}
+		}
+		if ts.Source.SrcType == registry.Virtual {
+			return nil, &common.BadRequestError{S: fmt.Sprintf("data of the virtual series %s is computed from its inputs and cannot be submitted", ts.Name)}
+		}
+
 		err := validateRecordAgainstRegistry(r, ts)
 
 		if err != nil {
-			return &common.BadRequestError{S: fmt.Sprintf("Error validating the record: %v", err)}
+			return nil, &common.BadRequestError{S: fmt.Sprintf("Error validating the record: %v", err)}
+		}
+		if err := convertRecordUnit(&r, ts); err != nil {
+			return nil, &common.BadRequestError{S: fmt.Sprintf("Error validating the record: %v", err)}
 		}
 
 		// Prepare for storage
@@ -110,23 +123,37 @@ func (c Controller) Submit(ctx context.Context, senmlPack senml.Pack, ids []stri
 	}
 
 	// Add data to the storage
-	err := c.storage.Submit(ctx, data, nameTS)
+	report, err := c.storage.Submit(ctx, data, nameTS)
 	if err != nil {
-		return &common.InternalError{S: "error writing data to the database: " + err.Error()}
+		if errors.Is(err, ErrDuplicate) {
+			return nil, &common.ConflictError{S: "error writing data to the database: " + err.Error()}
+		}
+		if queue, ok := c.storage.(*IngestQueue); ok && errors.Is(err, ErrQueueFull) {
+			return nil, &common.ServiceUnavailableError{S: "error queueing data: " + err.Error(), RetryAfter: queue.RetryAfter()}
+		}
+		return nil, &common.InternalError{S: "error writing data to the database: " + err.Error()}
 	}
 
 	//notify subsribers
 	for name, pack := range data {
 		c.pubSub.Pub(pack, name)
 	}
-	return nil
+	return report, nil
 }
 
 func (c Controller) QueryPage(ctx context.Context, q Query, ids []string) (pack senml.Pack, total *int, retErr common.Error) {
+	pack, total, _, retErr = c.queryStreamOrPage(ctx, q, ids, nil)
+	return pack, total, retErr
+}
+
+// QueryPageCursor is QueryPage returning the cursor of the next page, if it differs from the position of the last record
+// of the page. The cursors of processed queries carry the state of the processing.
+func (c Controller) QueryPageCursor(ctx context.Context, q Query, ids []string) (pack senml.Pack, total *int, next *Cursor, retErr common.Error) {
 	return c.queryStreamOrPage(ctx, q, ids, nil)
 }
+
 func (c Controller) QueryStream(ctx context.Context, q Query, ids []string, sendFunc sendFunction) (retErr common.Error) {
-	_, _, retErr = c.queryStreamOrPage(ctx, q, ids, sendFunc)
+	_, _, _, retErr = c.queryStreamOrPage(ctx, q, ids, sendFunc)
 	return retErr
 }
 
@@ -137,6 +164,9 @@ func (c Controller) Delete(ctx context.Context, seriesNames []string, from time.
 		if err != nil {
 			return err
 		}
+		if ts.Source.SrcType == registry.Virtual {
+			return &common.BadRequestError{S: fmt.Sprintf("data of the virtual series %s is computed from its inputs and cannot be deleted", ts.Name)}
+		}
 		series = append(series, ts)
 	}
 	if len(series) == 0 {
@@ -149,7 +179,32 @@ func (c Controller) Delete(ctx context.Context, seriesNames []string, from time.
 	return nil
 }
 
+// Latest returns the most recent record of each series
+func (c Controller) Latest(ctx context.Context, seriesNames []string) (senml.Pack, common.Error) {
+	var series []*registry.TimeSeries
+	for _, seriesName := range seriesNames {
+		ts, err := c.registry.Get(seriesName)
+		if err != nil {
+			return nil, err
+		}
+		series = append(series, ts)
+	}
+	if len(series) == 0 {
+		return nil, &common.NotFoundError{S: "None of the specified time series could be retrieved from the registry."}
+	}
+	pack, err := c.storage.Latest(ctx, series...)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, &common.BadRequestError{S: "timeout trying to prepare a response for the given query"}
+		} else {
+			return nil, &common.InternalError{S: "Error retrieving the latest values from the database: " + err.Error()}
+		}
+	}
+	return pack, nil
+}
+
 func (c Controller) Count(ctx context.Context, q Query, seriesNames []string) (total int, retErr common.Error) {
+	q = q.withAggrFuncs()
 	var series []*registry.TimeSeries
 	for _, seriesName := range seriesNames {
 		ts, err := c.registry.Get(seriesName)
@@ -161,7 +216,23 @@ func (c Controller) Count(ctx context.Context, q Query, seriesNames []string) (t
 	if len(series) == 0 {
 		return 0, &common.NotFoundError{S: "None of the specified time series could be retrieved from the registry."}
 	}
-	total, err := c.storage.Count(ctx, q, series...)
+	if err := checkAggregates(q, series); err != nil {
+		return 0, &common.BadRequestError{S: err.Error()}
+	}
+	if !q.Calendar.IsZero() {
+		if _, err := q.calendarWindows(); err != nil {
+			return 0, &common.BadRequestError{S: err.Error()}
+		}
+	}
+	if err := checkProcessing(q, series); err != nil {
+		return 0, &common.BadRequestError{S: err.Error()}
+	}
+	var err error
+	if q.processed() {
+		total, err = c.countProcessed(ctx, q, series)
+	} else {
+		total, err = c.storage.Count(ctx, q, series...)
+	}
 
 	if err != nil {
 		if errors.Is(err, context.DeadlineExceeded) {
@@ -173,34 +244,55 @@ func (c Controller) Count(ctx context.Context, q Query, seriesNames []string) (t
 	return total, nil
 }
 
-func (c Controller) queryStreamOrPage(ctx context.Context, q Query, seriesNames []string, sendFunc sendFunction) (pack senml.Pack, total *int, retErr common.Error) {
+func (c Controller) queryStreamOrPage(ctx context.Context, q Query, seriesNames []string, sendFunc sendFunction) (pack senml.Pack, total *int, next *Cursor, retErr common.Error) {
+	q = q.withAggrFuncs()
 	var series []*registry.TimeSeries
 	for _, seriesName := range seriesNames {
 		ts, err := c.registry.Get(seriesName)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 		series = append(series, ts)
 	}
 
 	if len(series) == 0 {
-		return nil, nil, &common.NotFoundError{S: "None of the specified time series could be retrieved from the registry."}
+		return nil, nil, nil, &common.NotFoundError{S: "None of the specified time series could be retrieved from the registry."}
+	}
+	if err := checkAggregates(q, series); err != nil {
+		return nil, nil, nil, &common.BadRequestError{S: err.Error()}
+	}
+	if !q.Calendar.IsZero() {
+		if _, err := q.calendarWindows(); err != nil {
+			return nil, nil, nil, &common.BadRequestError{S: err.Error()}
+		}
+	}
+	if err := checkProcessing(q, series); err != nil {
+		return nil, nil, nil, &common.BadRequestError{S: err.Error()}
+	}
+	if q.Cursor != nil {
+		if _, found := resultSeries(q, series)[q.Cursor.Series]; !found {
+			return nil, nil, nil, &common.BadRequestError{S: "The cursor does not belong to the queried time series."}
+		}
 	}
 
 	var err error
-	if sendFunc == nil {
+	if q.processed() {
+		pack, total, next, err = c.queryProcessed(ctx, q, series, sendFunc)
+	} else if sendFunc == nil {
 		pack, total, err = c.storage.QueryPage(ctx, q, series...)
 	} else {
 		err = c.storage.QueryStream(ctx, q, sendFunc, series...)
 	}
 	if err != nil {
-		if errors.Is(err, context.DeadlineExceeded) {
-			return nil, nil, &common.BadRequestError{S: "timeout trying to prepare a response for the given query"}
+		if errors.Is(err, errTransformsPending) {
+			return nil, nil, nil, &common.BadRequestError{S: err.Error()}
+		} else if errors.Is(err, context.DeadlineExceeded) {
+			return nil, nil, nil, &common.BadRequestError{S: "timeout trying to prepare a response for the given query"}
 		} else {
-			return nil, nil, &common.InternalError{S: "Error retrieving data from the database: " + err.Error()}
+			return nil, nil, nil, &common.InternalError{S: "Error retrieving data from the database: " + err.Error()}
 		}
 	}
-	return pack, total, nil
+	return pack, total, next, nil
 }
 
 func (c Controller) Subscribe(seriesNames ...string) (chan interface{}, common.Error) {
@@ -210,12 +302,66 @@ func (c Controller) Subscribe(seriesNames ...string) (chan interface{}, common.E
 			return nil, err
 		}
 	}
+	subscribers.Inc()
 	return c.pubSub.Sub(seriesNames...), nil
 }
 
+// Unsubscribe removes a subscription. It must be called once for each subscription
 func (c Controller) Unsubscribe(channel chan interface{}, names ...string) {
+	subscribers.Dec()
 	c.pubSub.Unsub(channel, names...)
 }
+
+// duplicatesPolicy returns the policy of a series for the records whose time is taken, following the storage
+func (c Controller) duplicatesPolicy(ts *registry.TimeSeries) string {
+	if storage, ok := c.storage.(policyStorage); ok {
+		return storage.policyOf(ts)
+	}
+	return duplicatesPolicy(ts, "")
+}
+
+// SubscriptionBufferSize is the number of packs buffered for each subscriber
+const SubscriptionBufferSize = 100
+
+// SubscribeBuffered subscribes to the series using a per-client buffer so that the publisher is not stuck
+// because of slow clients. If the buffer overflows, the client is unsubscribed and the returned channel is closed.
+// The returned function must be called to unsubscribe when the client is gone.
+func (c Controller) SubscribeBuffered(seriesNames ...string) (<-chan senml.Pack, func(), common.Error) {
+	ch, err := c.Subscribe(seriesNames...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			c.Unsubscribe(ch, seriesNames...)
+		})
+	}
+
+	buffer := make(chan senml.Pack, SubscriptionBufferSize)
+	go func() {
+		defer close(buffer)
+		for res := range ch {
+			pack, ok := res.(senml.Pack)
+			if !ok {
+				continue
+			}
+			if len(buffer) == SubscriptionBufferSize {
+				log.Printf("pubsub buffer overflow. unsubscribing for the data events: %v", seriesNames)
+				subscriptionOverflows.Inc()
+				// a publisher may be blocked sending to the channel, so it is read until pubsub closes it
+				go unsubscribe()
+				for range ch {
+				}
+				break
+			}
+			buffer <- pack
+		}
+	}()
+
+	return buffer, unsubscribe, nil
+}
 func parseDenormParams(denormStrings []string) (denormMask DenormMask, err error) {
 
 	for _, field := range denormStrings {
@@ -255,20 +401,85 @@ func parseToValue(from string) (time.Time, error) {
 	}
 }
 
-func parseAggregationParams(aggr, window string) (aggrFunction string, duration time.Duration, err error) {
+// parseAggregationParams parses the comma-separated aggregation functions and the window size, a duration or a calendar period
+func parseAggregationParams(aggr, window string) (aggrFunctions []string, duration time.Duration, calendar CalendarPeriod, err error) {
 	if aggr == "" && window == "" { // nothing to parse
 		return
 	} else if aggr == "" || window == "" {
-		return "", 0, fmt.Errorf("aggregation function and window size must be set together")
+		return nil, 0, CalendarPeriod{}, fmt.Errorf("aggregation function and window size must be set together")
 	}
 
-	if !common.SupportedAggregate(aggr) {
-		return "", 0, fmt.Errorf("unsupported aggregation function: %s", aggrFunction)
+	aggrFunctions, err = parseAggregates(strings.Split(aggr, ","))
+	if err != nil {
+		return nil, 0, CalendarPeriod{}, err
 	}
 
-	duration, err = time.ParseDuration(window)
+	duration, calendar, err = parseWindow(window)
 	if err != nil {
-		return "", 0, fmt.Errorf("invalid aggregation window: %s", window)
+		return nil, 0, CalendarPeriod{}, err
+	}
+	return aggrFunctions, duration, calendar, nil
+}
+
+// parseFillParams parses the gap filling and resampling parameters of a query, after the aggregation parameters
+func parseFillParams(q *Query, fill, resample string) (err error) {
+	if len(q.AggrFuncs) != 0 && q.AggrWindow <= 0 && q.Calendar.IsZero() {
+		return fmt.Errorf("invalid aggregation window: %s", q.AggrWindow)
+	}
+	if resample != "" {
+		if len(q.AggrFuncs) != 0 {
+			return fmt.Errorf("resampling cannot be combined with aggregation")
+		}
+		q.Resample, q.Calendar, err = parseWindow(resample)
+		if err != nil || (q.Resample <= 0 && q.Calendar.IsZero()) {
+			return fmt.Errorf("invalid resampling interval: %s", resample)
+		}
+		q.Fill = Fill{Method: FillLinear}
+	}
+	if fill != "" {
+		if len(q.AggrFuncs) == 0 && !q.resampled() {
+			return fmt.Errorf("fill requires aggregation or resampling")
+		}
+		q.Fill, err = ParseFill(fill)
+		if err != nil {
+			return err
+		}
+		if q.resampled() && q.Fill.Method == FillNone {
+			return fmt.Errorf("resampled points cannot be filled with %s", FillNone)
+		}
+	}
+	return nil
+}
+
+// checkAggregates checks if the aggregates of a query apply to the types of the series, which must all be of the same type
+func checkAggregates(q Query, series []*registry.TimeSeries) error {
+	if len(q.AggrFuncs) == 0 {
+		return nil
+	}
+	for _, ts := range series {
+		if ts.Type != series[0].Type {
+			return fmt.Errorf("aggregated series must have the same type: %s is %s, %s is %s", series[0].Name, series[0].Type, ts.Name, ts.Type)
+		}
+		for _, aggr := range q.AggrFuncs {
+			if _, ok := aggregateType(aggr, ts.Type); !ok {
+				return fmt.Errorf("aggregation function %s is not supported for %s series %s", aggr, ts.Type, ts.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseAggregates validates a list of aggregation functions, each of which may be given once
+func parseAggregates(aggrs []string) ([]string, error) {
+	seen := make(map[string]bool, len(aggrs))
+	for _, aggr := range aggrs {
+		if !common.SupportedAggregate(aggr) {
+			return nil, fmt.Errorf("unsupported aggregation function: %s", aggr)
+		}
+		if seen[aggr] {
+			return nil, fmt.Errorf("duplicate aggregation function: %s", aggr)
+		}
+		seen[aggr] = true
 	}
-	return aggr, duration, nil
+	return aggrs, nil
 }
@@ -0,0 +1,103 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/farshidtz/senml/v2"
+)
+
+// Cursor is the position of the last record of a page, after which the next page continues.
+// Unlike page numbers, cursors are not affected by the data written between the requests.
+type Cursor struct {
+	Time   float64 `json:"t"`
+	Series string  `json:"n"`
+	// Seq counts the records of the series at the time of the cursor before its record,
+	// as the records of series with the sequence policy may share their times
+	Seq int `json:"q,omitempty"`
+	// State of a processed query at the cursor, from which the next page is processed without the data before it
+	State *processingState `json:"s,omitempty"`
+}
+
+// processingState is the state of the gap filling and of the transforms of a query at a cursor
+type processingState struct {
+	Fill       map[string]fillNeighbour     `json:"f,omitempty"`
+	Transforms []map[string]*transformState `json:"tr,omitempty"`
+	// Inputs is the number of records of the series at the time of the cursor which reached the transforms
+	Inputs int `json:"i,omitempty"`
+}
+
+// Encode returns the opaque representation of the cursor used in the links
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor parses an encoded cursor
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %s", err)
+	}
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Series == "" {
+		return nil, fmt.Errorf("invalid cursor: %s", s)
+	}
+	return &c, nil
+}
+
+// cursorAfter returns the cursor positioned at the last record of a page, which follows the cursor of the page, if any
+func cursorAfter(pack senml.Pack, prev *Cursor) *Cursor {
+	if len(pack) == 0 {
+		return nil
+	}
+	// denormalized times are restored exactly, as the base time and the times of the page are close to each other
+	normalized := pack.Clone()
+	normalized.Normalize()
+	c := &Cursor{}
+	if prev != nil {
+		c.Time, c.Series, c.Seq = prev.Time, prev.Series, prev.Seq
+	}
+	for _, r := range normalized {
+		c.advance(r)
+	}
+	return c
+}
+
+// advance moves the cursor to the record following it
+func (c *Cursor) advance(r senml.Record) {
+	if r.Time == c.Time && r.Name == c.Series {
+		c.Seq++
+		return
+	}
+	c.Time, c.Series, c.Seq = r.Time, r.Name, 0
+}
+
+// before checks if the cursor is positioned before a record, in the given order of time.
+// The records at the time and of the series of the cursor are left to cursorFilter.
+func (c Cursor) before(r senml.Record, asc bool) bool {
+	if r.Time == c.Time {
+		return r.Name > c.Series
+	}
+	return (r.Time > c.Time) == asc
+}
+
+// cursorFilter selects the records after a cursor, leaving out a number of records at the time and of the series of the cursor
+type cursorFilter struct {
+	cursor  Cursor
+	asc     bool
+	skip    int
+	skipped int
+}
+
+// after checks if the next record comes after the cursor
+func (f *cursorFilter) after(r senml.Record) bool {
+	if r.Time == f.cursor.Time && r.Name == f.cursor.Series {
+		f.skipped++
+		return f.skipped > f.skip
+	}
+	return f.cursor.before(r, f.asc)
+}
@@ -54,12 +54,40 @@ type Query struct {
 	// Denormalize is a set of flags to be set based on the fields to be denormalized (Base field)
 	Denormalize DenormMask
 
-	// AggrFunc is the function performing the aggregation
+	// AggrFuncs are the functions performing the aggregation, computed together for each window.
+	// With multiple functions, the name of each record is suffixed with its function (see AggregateName)
+	AggrFuncs []string
+
+	// AggrFunc is the function performing the aggregation.
+	//
+	// Deprecated: use AggrFuncs. AggrFunc is used only if AggrFuncs is empty.
 	AggrFunc string
 
 	// AggrWindow is the duration for aggregation
 	AggrWindow time.Duration
 
+	// Calendar is the period of calendar windows, which replaces AggrWindow or Resample
+	Calendar CalendarPeriod
+
+	// Align is the alignment of the windows with a fixed duration: AlignTo (default) or AlignEpoch
+	Align string
+
+	// Location is the time zone of the calendar windows. UTC if nil
+	Location *time.Location
+
+	// Fill is the method filling the aggregation windows without data, and the resampled points
+	Fill Fill
+
+	// Resample is the interval of the points of a resampled query, which returns one point per interval
+	// between From and To, aligned to To as the aggregation windows
+	Resample time.Duration
+
+	// Transforms are applied in order to the consecutive records of each series, after the aggregation and gap filling
+	Transforms []Transform
+
+	// Unit converts the numeric results to another unit of the same quantity, e.g. W to kW, before the gap filling and transforms
+	Unit string
+
 	// Limit is applicable only for streamed queries
 	Limit int
 
@@ -69,7 +97,20 @@ type Query struct {
 	// Page is applicable only for paginated queries
 	Page int
 
+	// Cursor is the position after which the page starts. If set, Page is ignored.
+	// Applicable only for paginated queries
+	Cursor *Cursor
+
 	// Count: if enabled, it will return the total number of entries to the query.
 	// applicable only for paginated queries
 	Count bool
 }
+
+// withAggrFuncs returns the query with the deprecated AggrFunc moved to AggrFuncs
+func (q Query) withAggrFuncs() Query {
+	if len(q.AggrFuncs) == 0 && q.AggrFunc != "" {
+		q.AggrFuncs = []string{q.AggrFunc}
+	}
+	q.AggrFunc = ""
+	return q
+}
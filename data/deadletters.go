@@ -0,0 +1,344 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+	"github.com/linksmart/service-catalog/v2/utils"
+)
+
+// Sources of dead letters
+const (
+	DeadLetterMQTT = "mqtt"
+	DeadLetterHTTP = "http"
+)
+
+// the table does not clash with those of the series, whose names start with a letter or a digit
+const deadLettersTable = "_dead_letters"
+
+// ErrDeadLetterNotFound is returned if a dead letter does not exist, e.g. because it was dropped to make room for newer ones
+var ErrDeadLetterNotFound = errors.New("dead letter not found")
+
+// DeadLetter is a submission which was rejected, kept to be inspected and replayed
+type DeadLetter struct {
+	ID      int64     `json:"id"`
+	Arrival time.Time `json:"arrival"`
+	// Source is mqtt or http
+	Source string `json:"source"`
+	// Broker and Topic of MQTT messages
+	Broker      string `json:"broker,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	ContentType string `json:"contentType"`
+	Payload     []byte `json:"payload"`
+	Reason      string `json:"reason"`
+}
+
+// DeadLetterFilter selects dead letters by source, topic and arrival time. Empty fields match all.
+type DeadLetterFilter struct {
+	Source, Topic string
+	From, To      time.Time
+}
+
+// DeadLetterStore keeps the rejected submissions, up to a maximum number after which the oldest ones are dropped
+type DeadLetterStore interface {
+	Add(ctx context.Context, l DeadLetter) error
+	Get(ctx context.Context, id int64) (*DeadLetter, error)
+	// List returns a page of the dead letters, the newest first, and the total number of them
+	List(ctx context.Context, f DeadLetterFilter, page, perPage int) ([]DeadLetter, int, error)
+	Delete(ctx context.Context, id int64) error
+}
+
+// senmlDeadLetter returns a dead letter with the given records as payload, for the submissions which were decoded before they were rejected
+func senmlDeadLetter(l DeadLetter, data map[string]senml.Pack) DeadLetter {
+	var pack senml.Pack
+	for _, records := range data {
+		pack = append(pack, records...)
+	}
+	l.ContentType = senml.MediaTypeSenmlJSON
+	l.Payload, _ = codec.Encode(senml.MediaTypeSenmlJSON, pack)
+	return l
+}
+
+// keepDeadLetter keeps a rejected submission in a store, which is nil if dead letters are disabled.
+// Errors are only logged, as the submission failed anyway.
+func keepDeadLetter(store DeadLetterStore, l DeadLetter) {
+	if store == nil {
+		return
+	}
+	err := store.Add(context.Background(), l)
+	if err != nil {
+		log.Printf("Error keeping the rejected submission as dead letter: %s", err)
+	}
+}
+
+// sqlDeadLetters keeps the dead letters in a table of the data database
+type sqlDeadLetters struct {
+	s     *SqlStorage
+	table string
+	size  int
+}
+
+// NewDeadLetterStore returns a store keeping up to size dead letters in the database of the given storage
+func NewDeadLetterStore(storage *SqlStorage, size int) (DeadLetterStore, error) {
+	d := &sqlDeadLetters{s: storage, table: storage.dialect.table(deadLettersTable), size: size}
+	_, err := storage.pool.Exec(storage.dialect.deadLettersTableStmt(d.table))
+	if err != nil {
+		return nil, fmt.Errorf("error creating the table of the dead letters: %s", err)
+	}
+	return d, nil
+}
+
+func (d *sqlDeadLetters) Add(ctx context.Context, l DeadLetter) error {
+	if l.Arrival.IsZero() {
+		l.Arrival = time.Now()
+	}
+	defer d.s.lockWrites()()
+	tx, err := d.s.pool.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt := fmt.Sprintf("INSERT INTO %s (arrival, source, broker, topic, content_type, payload, reason) VALUES (?, ?, ?, ?, ?, ?, ?)", d.table)
+	_, err = tx.ExecContext(ctx, d.s.dialect.rebind(stmt),
+		ToSenmlTime(l.Arrival), l.Source, l.Broker, l.Topic, l.ContentType, l.Payload, l.Reason)
+	if err == nil {
+		// drop the oldest ones
+		stmt = fmt.Sprintf("DELETE FROM %[1]s WHERE id <= (SELECT MAX(id) FROM %[1]s) - ?", d.table)
+		_, err = tx.ExecContext(ctx, d.s.dialect.rebind(stmt), d.size)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *sqlDeadLetters) Get(ctx context.Context, id int64) (*DeadLetter, error) {
+	stmt := fmt.Sprintf("SELECT id, arrival, source, broker, topic, content_type, payload, reason FROM %s WHERE id = ?", d.table)
+	rows, err := d.s.pool.QueryContext(ctx, d.s.dialect.rebind(stmt), id)
+	if err != nil {
+		return nil, err
+	}
+	letters, err := scanDeadLetters(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(letters) == 0 {
+		return nil, ErrDeadLetterNotFound
+	}
+	return &letters[0], nil
+}
+
+func (d *sqlDeadLetters) List(ctx context.Context, f DeadLetterFilter, page, perPage int) ([]DeadLetter, int, error) {
+	conditions := []string{"arrival >= ?", "arrival <= ?"}
+	args := []interface{}{ToSenmlTime(f.From), ToSenmlTime(f.To)}
+	if f.To.IsZero() {
+		conditions = conditions[:1]
+		args = args[:1]
+	}
+	if f.Source != "" {
+		conditions = append(conditions, "source = ?")
+		args = append(args, f.Source)
+	}
+	if f.Topic != "" {
+		conditions = append(conditions, "topic = ?")
+		args = append(args, f.Topic)
+	}
+	where := strings.Join(conditions, " AND ")
+
+	var total int
+	stmt := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE %s", d.table, where)
+	err := d.s.pool.QueryRowContext(ctx, d.s.dialect.rebind(stmt), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	stmt = fmt.Sprintf("SELECT id, arrival, source, broker, topic, content_type, payload, reason FROM %s WHERE %s ORDER BY id DESC LIMIT ? OFFSET ?",
+		d.table, where)
+	rows, err := d.s.pool.QueryContext(ctx, d.s.dialect.rebind(stmt), append(args, perPage, (page-1)*perPage)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	letters, err := scanDeadLetters(rows)
+	if err != nil {
+		return nil, 0, err
+	}
+	return letters, total, nil
+}
+
+func (d *sqlDeadLetters) Delete(ctx context.Context, id int64) error {
+	defer d.s.lockWrites()()
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE id = ?", d.table)
+	res, err := d.s.pool.ExecContext(ctx, d.s.dialect.rebind(stmt), id)
+	if err != nil {
+		return err
+	}
+	if deleted, err := res.RowsAffected(); err == nil && deleted == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+func scanDeadLetters(rows *sql.Rows) ([]DeadLetter, error) {
+	defer rows.Close()
+	var letters []DeadLetter
+	for rows.Next() {
+		var l DeadLetter
+		var arrival float64
+		var broker, topic, contentType, reason sql.NullString
+		err := rows.Scan(&l.ID, &arrival, &l.Source, &broker, &topic, &contentType, &l.Payload, &reason)
+		if err != nil {
+			return nil, err
+		}
+		l.Arrival = FromSenmlTime(arrival).UTC()
+		l.Broker, l.Topic, l.ContentType, l.Reason = broker.String, topic.String, contentType.String, reason.String
+		letters = append(letters, l)
+	}
+	return letters, rows.Err()
+}
+
+// UseDeadLetters keeps the submissions rejected by the HTTP API in the given store, and enables browsing and replaying them
+func (c *Controller) UseDeadLetters(store DeadLetterStore) {
+	c.deadLetters = store
+}
+
+func (c Controller) deadLetterError(err error) common.Error {
+	if errors.Is(err, ErrDeadLetterNotFound) {
+		return &common.NotFoundError{S: err.Error()}
+	}
+	return &common.InternalError{S: "error accessing the dead letters: " + err.Error()}
+}
+
+// DeadLetters returns a page of the dead letters matching a filter, the newest first, and the total number of them
+func (c Controller) DeadLetters(ctx context.Context, f DeadLetterFilter, page, perPage int) ([]DeadLetter, int, common.Error) {
+	if c.deadLetters == nil {
+		return nil, 0, &common.NotFoundError{S: "dead letters are not enabled"}
+	}
+	letters, total, err := c.deadLetters.List(ctx, f, page, perPage)
+	if err != nil {
+		return nil, 0, c.deadLetterError(err)
+	}
+	return letters, total, nil
+}
+
+// DeadLetter returns a dead letter
+func (c Controller) DeadLetter(ctx context.Context, id int64) (*DeadLetter, common.Error) {
+	if c.deadLetters == nil {
+		return nil, &common.NotFoundError{S: "dead letters are not enabled"}
+	}
+	l, err := c.deadLetters.Get(ctx, id)
+	if err != nil {
+		return nil, c.deadLetterError(err)
+	}
+	return l, nil
+}
+
+// DeleteDeadLetter deletes a dead letter, e.g. after it was inspected and is not to be replayed
+func (c Controller) DeleteDeadLetter(ctx context.Context, id int64) common.Error {
+	if c.deadLetters == nil {
+		return &common.NotFoundError{S: "dead letters are not enabled"}
+	}
+	if err := c.deadLetters.Delete(ctx, id); err != nil {
+		return c.deadLetterError(err)
+	}
+	return nil
+}
+
+// ReplayDeadLetter submits the payload of a dead letter again, e.g. after registering the missing time series, and deletes it if that succeeds.
+// The records are checked against the registry as those submitted through the HTTP API.
+func (c Controller) ReplayDeadLetter(ctx context.Context, id int64) (map[string]Duplicates, common.Error) {
+	l, retErr := c.DeadLetter(ctx, id)
+	if retErr != nil {
+		return nil, retErr
+	}
+	var pack senml.Pack
+	if l.Source == DeadLetterMQTT && l.ContentType != senml.MediaTypeSenmlJSON && l.ContentType != senml.MediaTypeSenmlCBOR {
+		pack, retErr = c.decodeMQTTDeadLetter(l)
+		if retErr != nil {
+			return nil, retErr
+		}
+	} else {
+		decoder, err := getDecoderForContentType(l.ContentType)
+		if err != nil {
+			return nil, &common.UnsupportedMediaTypeError{S: fmt.Sprintf("the payload of dead letter %d cannot be decoded: %s", id, err)}
+		}
+		pack, err = decoder(l.Payload)
+		if err != nil {
+			return nil, &common.BadRequestError{S: fmt.Sprintf("error parsing the payload of dead letter %d: %s", id, err)}
+		}
+	}
+	report, retErr := c.Submit(ctx, pack, nil)
+	if retErr != nil {
+		return nil, retErr
+	}
+	if err := c.deadLetters.Delete(ctx, id); err != nil && !errors.Is(err, ErrDeadLetterNotFound) {
+		return report, c.deadLetterError(err)
+	}
+	return report, nil
+}
+
+// decodeMQTTDeadLetter decodes the payload of an MQTT message which failed to decode, following the current formats
+// of the series receiving its topic, e.g. after their templates were fixed. Only the series whose format has the media type
+// of the letter are decoded, as the records of the others were stored on arrival.
+func (c Controller) decodeMQTTDeadLetter(l *DeadLetter) (senml.Pack, common.Error) {
+	subscription := &Subscription{url: l.Broker, topic: l.Topic, series: make(map[string]registry.TimeSeries)}
+	for page := 1; ; page++ {
+		series, total, err := c.registry.Filter("source.topic", utils.FOpEquals, l.Topic, page, registry.MaxPerPage)
+		if err != nil {
+			return nil, err
+		}
+		for _, ts := range series {
+			if ts.Source.MQTTSource != nil && ts.Source.BrokerURL == l.Broker && mqttContentTypes[mqttFormat(ts)] == l.ContentType {
+				subscription.series[ts.Name] = ts
+			}
+		}
+		if page*registry.MaxPerPage >= total {
+			break
+		}
+	}
+	if len(subscription.series) == 0 {
+		return nil, &common.NotFoundError{S: fmt.Sprintf("no time series in the format of dead letter %d receives its topic %s", l.ID, l.Topic)}
+	}
+	pack, _, errs := subscription.decode(l.Payload, l.Arrival)
+	if len(errs) != 0 {
+		return nil, &common.BadRequestError{S: fmt.Sprintf("error parsing the payload of dead letter %d: %s", l.ID, errs[0].err)}
+	}
+	return pack, nil
+}
+
+// ReplayDeadLetters replays the dead letters matching a filter, the oldest first. It returns the number of replayed
+// ones and the errors of the others by id.
+func (c Controller) ReplayDeadLetters(ctx context.Context, f DeadLetterFilter) (replayed int, failed map[int64]string, retErr common.Error) {
+	var ids []int64
+	for page := 1; ; page++ {
+		letters, total, retErr := c.DeadLetters(ctx, f, page, MaxPerPage)
+		if retErr != nil {
+			return 0, nil, retErr
+		}
+		for _, l := range letters {
+			ids = append(ids, l.ID)
+		}
+		if page*MaxPerPage >= total {
+			break
+		}
+	}
+	failed = make(map[int64]string)
+	for i := len(ids) - 1; i >= 0; i-- {
+		_, err := c.ReplayDeadLetter(ctx, ids[i])
+		if err != nil {
+			failed[ids[i]] = err.Error()
+			continue
+		}
+		replayed++
+	}
+	return replayed, failed, nil
+}
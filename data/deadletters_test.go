@@ -0,0 +1,254 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func TestDeadLetterStore(t *testing.T) {
+	funcName := "TestDeadLetterStore"
+	fileName, disconnectFunc, dataStorage, _, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	store, err := NewDeadLetterStore(dataStorage.(*SqlStorage), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	arrival := time.Date(2020, 7, 6, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 4; i++ {
+		err := store.Add(ctx, DeadLetter{
+			Arrival:     arrival.Add(time.Duration(i) * time.Hour),
+			Source:      DeadLetterMQTT,
+			Broker:      "tcp://localhost:1883",
+			Topic:       fmt.Sprintf("sensors/%d", i%2),
+			ContentType: senml.MediaTypeSenmlJSON,
+			Payload:     []byte(fmt.Sprintf(`[{"n":"sensor","v":%d}]`, i)),
+			Reason:      "Time series not found: sensor",
+		})
+		if err != nil {
+			t.Fatalf("Error adding dead letter %d: %s", i, err)
+		}
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		letters, total, err := store.List(ctx, DeadLetterFilter{}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 3 || len(letters) != 3 {
+			t.Fatalf("Expected the 3 newest dead letters, got %d of %d", len(letters), total)
+		}
+		if string(letters[0].Payload) != `[{"n":"sensor","v":3}]` || string(letters[2].Payload) != `[{"n":"sensor","v":1}]` {
+			t.Errorf("Expected the newest dead letters first, got %s and %s", letters[0].Payload, letters[2].Payload)
+		}
+		if !letters[0].Arrival.Equal(arrival.Add(3 * time.Hour)) {
+			t.Errorf("Expected arrival %s, got %s", arrival.Add(3*time.Hour), letters[0].Arrival)
+		}
+	})
+
+	t.Run("filtered", func(t *testing.T) {
+		letters, total, err := store.List(ctx, DeadLetterFilter{Topic: "sensors/1"}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 2 || len(letters) != 2 {
+			t.Errorf("Expected 2 dead letters of topic sensors/1, got %d of %d", len(letters), total)
+		}
+		_, total, err = store.List(ctx, DeadLetterFilter{From: arrival.Add(2 * time.Hour), To: arrival.Add(2 * time.Hour)}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 {
+			t.Errorf("Expected 1 dead letter arrived at %s, got %d", arrival.Add(2*time.Hour), total)
+		}
+		_, total, err = store.List(ctx, DeadLetterFilter{Source: DeadLetterHTTP}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 0 {
+			t.Errorf("Expected no dead letters of HTTP, got %d", total)
+		}
+	})
+
+	t.Run("get and delete", func(t *testing.T) {
+		letters, _, err := store.List(ctx, DeadLetterFilter{}, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := store.Get(ctx, letters[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.Broker != "tcp://localhost:1883" || l.Topic != "sensors/1" || l.Reason != "Time series not found: sensor" {
+			t.Errorf("Unexpected dead letter: %+v", l)
+		}
+		err = store.Delete(ctx, l.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.Get(ctx, l.ID); err != ErrDeadLetterNotFound {
+			t.Errorf("Expected the dead letter to be deleted, got %v", err)
+		}
+		if err := store.Delete(ctx, l.ID); err != ErrDeadLetterNotFound {
+			t.Errorf("Expected the dead letter not to be found, got %v", err)
+		}
+	})
+}
+
+func TestAPI_DeadLetters(t *testing.T) {
+	funcName := "TestAPI_DeadLetters"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	store, err := NewDeadLetterStore(dataStorage.(*SqlStorage), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := NewController(regController, dataStorage, false)
+	controller.UseDeadLetters(store)
+	api := NewAPI(*controller)
+
+	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
+	r.Methods("POST").Path("/data").HandlerFunc(api.SubmitWithoutID)
+	r.Methods("GET").Path("/deadletters").HandlerFunc(api.DeadLetters)
+	r.Methods("POST").Path("/deadletters/replay").HandlerFunc(api.ReplayDeadLetters)
+	r.Methods("GET").Path("/deadletters/{id:[0-9]+}").HandlerFunc(api.DeadLetter)
+	r.Methods("GET").Path("/deadletters/{id:[0-9]+}/payload").HandlerFunc(api.DeadLetterPayload)
+	r.Methods("POST").Path("/deadletters/{id:[0-9]+}/replay").HandlerFunc(api.ReplayDeadLetter)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	listDeadLetters := func(t *testing.T) DeadLetterList {
+		res, err := http.Get(server.URL + "/deadletters")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, res.StatusCode)
+		}
+		var list DeadLetterList
+		if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+
+	// submissions to a series which is not registered are rejected
+	payloads := []string{
+		`[{"n":"kitchen/temp","t":1594000800,"v":21.5}]`,
+		`[{"n":"kitchen/temp","t":1594000860,"v":21.7}]`,
+	}
+	for _, payload := range payloads {
+		res, err := http.Post(server.URL+"/data", senml.MediaTypeSenmlJSON, bytes.NewBufferString(payload))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Expected status %d, got %d", http.StatusNotFound, res.StatusCode)
+		}
+	}
+	list := listDeadLetters(t)
+	if list.Total != 2 {
+		t.Fatalf("Expected 2 dead letters, got %d", list.Total)
+	}
+	newest := list.DeadLetters[0]
+	if newest.Source != DeadLetterHTTP || newest.ContentType != senml.MediaTypeSenmlJSON || string(newest.Payload) != payloads[1] {
+		t.Errorf("Unexpected dead letter: %+v", newest)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s/deadletters/%d/payload", server.URL, newest.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	// the content type set by the client is not served
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "application/octet-stream" ||
+		res.Header.Get("X-Content-Type-Options") != "nosniff" || !strings.HasPrefix(res.Header.Get("Content-Disposition"), "attachment") {
+		t.Errorf("Expected the payload as a download, got status %d and headers %v", res.StatusCode, res.Header)
+	}
+
+	// replaying fails until the series is registered
+	replayURL := fmt.Sprintf("%s/deadletters/%d/replay", server.URL, newest.ID)
+	res, err = http.Post(replayURL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusNotFound, res.StatusCode)
+	}
+	ts, addErr := regController.Add(registry.TimeSeries{Name: "kitchen/temp", Type: registry.Float})
+	if addErr != nil {
+		t.Fatal(addErr)
+	}
+	res, err = http.Post(replayURL, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, res.StatusCode)
+	}
+	res, err = http.Get(fmt.Sprintf("%s/deadletters/%d", server.URL, newest.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the replayed dead letter to be deleted, got status %d", res.StatusCode)
+	}
+
+	// the remaining ones
+	res, err = http.Post(server.URL+"/deadletters/replay?source="+DeadLetterHTTP, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result ReplayResult
+	err = json.NewDecoder(res.Body).Decode(&result)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Replayed != 1 || len(result.Failed) != 0 {
+		t.Errorf("Expected 1 dead letter to be replayed, got %+v", result)
+	}
+	if list := listDeadLetters(t); list.Total != 0 {
+		t.Errorf("Expected no dead letters, got %d", list.Total)
+	}
+	if stored := countStored(t, dataStorage, ts); stored != 2 {
+		t.Errorf("Expected 2 records to be stored, got %d", stored)
+	}
+}
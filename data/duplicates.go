@@ -0,0 +1,82 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// ErrDuplicate is returned if a submission is rejected because the time of a record is taken, following the reject policy
+var ErrDuplicate = errors.New("duplicate time")
+
+// Duplicates reports how the submitted records of a series whose time was taken were handled
+type Duplicates struct {
+	Policy string
+	// Count of the records whose time was taken by a stored record or by another record of the submission.
+	// The stored records are not looked up under the overwrite policy.
+	Count int
+}
+
+// duplicatesPolicy returns the policy of a series, or the given default one
+func duplicatesPolicy(ts *registry.TimeSeries, defaultPolicy string) string {
+	if ts.Duplicates != "" {
+		return ts.Duplicates
+	}
+	if defaultPolicy != "" {
+		return defaultPolicy
+	}
+	return registry.DuplicatesOverwrite
+}
+
+// uniqueTimes resolves the records with the same time within a pack following a policy,
+// returning the records to be written and the number of records whose time was repeated
+func uniqueTimes(pack senml.Pack, policy string) (senml.Pack, int) {
+	if policy == registry.DuplicatesSequence {
+		// all of them are written, and counted while they are numbered
+		return pack, 0
+	}
+	// index of the record kept for each time
+	kept := make(map[float64]int, len(pack))
+	for i, r := range pack {
+		if _, found := kept[r.Time]; !found || policy == registry.DuplicatesOverwrite {
+			kept[r.Time] = i
+		}
+	}
+	if len(kept) == len(pack) {
+		return pack, 0
+	}
+	unique := make(senml.Pack, 0, len(kept))
+	for i, r := range pack {
+		if kept[r.Time] == i {
+			unique = append(unique, r)
+		}
+	}
+	return unique, len(pack) - len(unique)
+}
+
+// duplicatesHeader formats the reports of a submission as values of the X-Duplicates header, e.g. kitchen/temp;policy=keep_first;count=2
+func duplicatesHeader(report map[string]Duplicates) []string {
+	values := make([]string, 0, len(report))
+	for name, d := range report {
+		values = append(values, fmt.Sprintf("%s;policy=%s;count=%d", name, d.Policy, d.Count))
+	}
+	sort.Strings(values)
+	return values
+}
+
+// duplicatesSummary describes the series with duplicates in a report, for the logs. It is empty if there are none.
+func duplicatesSummary(report map[string]Duplicates) string {
+	var parts []string
+	for _, value := range duplicatesHeader(report) {
+		if !strings.HasSuffix(value, ";count=0") {
+			parts = append(parts, value)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
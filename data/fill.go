@@ -0,0 +1,309 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/farshidtz/senml/v2"
+)
+
+// Methods filling the aggregation windows without data and the resampled points
+const (
+	// FillNone omits the windows without data
+	FillNone = "none"
+	// FillNull returns records without a value
+	FillNull = "null"
+	// FillPrevious repeats the value of the previous window or record
+	FillPrevious = "previous"
+	// FillLinear interpolates linearly between the values around the gap
+	FillLinear = "linear"
+	// FillConstant sets a constant value, which is given instead of the method name
+	FillConstant = "constant"
+)
+
+// gridTolerance is the difference of times in seconds up to which a window or record is at a point of the grid
+const gridTolerance = 1e-6
+
+// MaxGridPoints is the maximum number of windows or resampled points of a gap-filled query
+const MaxGridPoints = 100000
+
+// errPageFull stops reading the stored data once the page or the stream is complete
+var errPageFull = errors.New("page is full")
+
+// Fill is the method filling the gaps of a query
+type Fill struct {
+	Method string
+	// Value of the constant fill
+	Value float64
+}
+
+// ParseFill parses the name of a fill method or a constant value
+func ParseFill(s string) (Fill, error) {
+	switch s {
+	case FillNone, FillNull, FillPrevious, FillLinear:
+		return Fill{Method: s}, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return Fill{}, fmt.Errorf("invalid fill: %s. Supported are %s, %s, %s, %s or a number", s, FillNone, FillNull, FillPrevious, FillLinear)
+	}
+	return Fill{Method: FillConstant, Value: v}, nil
+}
+
+// String returns the fill as accepted by ParseFill
+func (f Fill) String() string {
+	if f.Method == FillConstant {
+		return strconv.FormatFloat(f.Value, 'g', -1, 64)
+	}
+	return f.Method
+}
+
+// gapFilled checks if the query returns a record per window or resampled point, filling the gaps
+func (q Query) gapFilled() bool {
+	return q.resampled() || (len(q.AggrFuncs) != 0 && q.Fill.Method != "" && q.Fill.Method != FillNone)
+}
+
+// grid are the times of the windows or resampled points of a gap-filled query, which are aligned as the aggregation windows.
+// The windows are labelled with their end, so that the last window may end after To. The resampled points are between From and To.
+type grid struct {
+	first float64
+	step  float64
+	n     int
+	// times of calendar windows, instead of first and step
+	times []float64
+}
+
+func newGrid(q Query) (grid, error) {
+	from, to := ToSenmlTime(q.From), ToSenmlTime(q.To)
+	if to < from {
+		return grid{}, nil
+	}
+	if !q.Calendar.IsZero() {
+		boundaries, err := q.calendarWindows()
+		if err != nil {
+			return grid{}, err
+		}
+		times := boundaries[1:]
+		if q.resampled() && times[len(times)-1] > to {
+			times = times[:len(times)-1]
+		}
+		return grid{times: times, n: len(times)}, nil
+	}
+
+	step := q.AggrWindow
+	if q.Resample != 0 {
+		step = q.Resample
+	}
+	g := grid{step: step.Seconds()}
+	var points float64
+	if q.Align == AlignEpoch {
+		g.first = math.Ceil(from/g.step) * g.step
+		last := math.Ceil(to/g.step) * g.step
+		if q.resampled() {
+			last = math.Floor(to/g.step) * g.step
+		}
+		if last >= g.first {
+			points = math.Round((last-g.first)/g.step) + 1
+		}
+	} else {
+		points = math.Floor((to-from)/g.step) + 1
+	}
+	if points > MaxGridPoints {
+		return grid{}, fmt.Errorf("the query covers more than %d windows or resampled points", MaxGridPoints)
+	}
+	g.n = int(points)
+	if q.Align != AlignEpoch {
+		g.first = to - float64(g.n-1)*g.step
+	}
+	return g, nil
+}
+
+// time returns the time of the i-th point, starting with the earliest one
+func (g grid) time(i int) float64 {
+	if g.times != nil {
+		return g.times[i]
+	}
+	return g.first + float64(i)*g.step
+}
+
+// index returns the index of the point at a time, or -1 if there is none
+func (g grid) index(t float64) int {
+	var i int
+	if g.times != nil {
+		i = sort.SearchFloat64s(g.times, t-gridTolerance)
+	} else if g.step != 0 {
+		i = int(math.Round((t - g.first) / g.step))
+	}
+	if i < 0 || i >= g.n || math.Abs(g.time(i)-t) > gridTolerance {
+		return -1
+	}
+	return i
+}
+
+// gapFiller produces a record per name and grid point out of the stored windows or records.
+// The stored records are added in the order of the query, and the filled ones are emitted per point in the order of the names.
+type gapFiller struct {
+	grid    grid
+	fill    Fill
+	asc     bool
+	names   []string
+	units   map[string]string
+	series  map[string]*filledSeries
+	emitted int // number of grid points already emitted, in the order of the query
+	emit    func(senml.Record) error
+	// resumed fillers take the neighbours of the first point from the state, instead of the records added before it
+	resumed bool
+	// neighbours of the names at the point which is emitted, see neighbours
+	current map[string]fillNeighbour
+}
+
+// fillNeighbour is the last record of a name which is added before a grid point, in the order of the query
+type fillNeighbour struct {
+	Found bool    `json:"f,omitempty"`
+	Time  float64 `json:"t,omitempty"`
+	Value float64 `json:"v,omitempty"`
+}
+
+// filledSeries holds the values of a name which are not yet emitted
+type filledSeries struct {
+	last fillNeighbour
+	// grid points, starting with the first one not yet emitted
+	pending []filledPoint
+}
+
+// filledPoint is the value of a grid point and the last record before it
+type filledPoint struct {
+	value *float64
+	last  fillNeighbour
+}
+
+// newGapFiller returns a filler emitting the grid points after the first start ones, in the order of the query.
+// If the filler starts after the first point, the neighbours of the names at the start are given.
+func newGapFiller(g grid, fill Fill, asc bool, names []string, units map[string]string, start int, neighbours map[string]fillNeighbour,
+	emit func(senml.Record) error) *gapFiller {
+	series := make(map[string]*filledSeries, len(names))
+	for _, name := range names {
+		series[name] = &filledSeries{last: neighbours[name]}
+	}
+	return &gapFiller{grid: g, fill: fill, asc: asc, names: names, units: units, series: series, emitted: start, emit: emit,
+		resumed: start != 0, current: make(map[string]fillNeighbour, len(names))}
+}
+
+// point returns the time of the k-th grid point in the order of the query
+func (f *gapFiller) point(k int) float64 {
+	if f.asc {
+		return f.grid.time(k)
+	}
+	return f.grid.time(f.grid.n - 1 - k)
+}
+
+// before checks if a time comes before a grid point in the order of the query
+func (f *gapFiller) before(t, point float64) bool {
+	if f.asc {
+		return t < point-gridTolerance
+	}
+	return t > point+gridTolerance
+}
+
+// add resolves the grid points up to the time of a stored record
+func (f *gapFiller) add(r senml.Record) error {
+	s, found := f.series[r.Name]
+	if !found || r.Value == nil {
+		return nil
+	}
+	if f.resumed && f.before(r.Time, f.point(f.emitted)) {
+		return nil
+	}
+	for k := f.emitted + len(s.pending); k < f.grid.n; k++ {
+		t := f.point(k)
+		if f.before(r.Time, t) {
+			break
+		}
+		p := filledPoint{last: s.last}
+		if math.Abs(t-r.Time) <= gridTolerance {
+			value := *r.Value
+			p.value = &value
+		} else {
+			p.value = f.gap(s, t, &r)
+		}
+		s.pending = append(s.pending, p)
+	}
+	s.last = fillNeighbour{Found: true, Time: r.Time, Value: *r.Value}
+	return f.flush()
+}
+
+// finish resolves the grid points after the last stored records
+func (f *gapFiller) finish() error {
+	for _, s := range f.series {
+		for k := f.emitted + len(s.pending); k < f.grid.n; k++ {
+			s.pending = append(s.pending, filledPoint{value: f.gap(s, f.point(k), nil), last: s.last})
+		}
+	}
+	return f.flush()
+}
+
+// gap returns the value of a grid point between the last record and the next one, which is nil after the last record
+func (f *gapFiller) gap(s *filledSeries, t float64, next *senml.Record) *float64 {
+	var value float64
+	switch f.fill.Method {
+	case FillConstant:
+		value = f.fill.Value
+	case FillPrevious:
+		// the previous record in time is the next one in descending order
+		if f.asc && s.last.Found {
+			value = s.last.Value
+		} else if !f.asc && next != nil {
+			value = *next.Value
+		} else {
+			return nil
+		}
+	case FillLinear:
+		// no extrapolation before the first and after the last record
+		if !s.last.Found || next == nil {
+			return nil
+		}
+		value = s.last.Value + (*next.Value-s.last.Value)*(t-s.last.Time)/(next.Time-s.last.Time)
+	default:
+		return nil
+	}
+	return &value
+}
+
+// flush emits the grid points which are resolved for all names
+func (f *gapFiller) flush() error {
+	for ; f.emitted < f.grid.n; f.emitted++ {
+		for _, name := range f.names {
+			if len(f.series[name].pending) == 0 {
+				return nil
+			}
+		}
+		t := f.point(f.emitted)
+		for _, name := range f.names {
+			f.current[name] = f.series[name].pending[0].last
+		}
+		for _, name := range f.names {
+			s := f.series[name]
+			p := s.pending[0]
+			s.pending = s.pending[1:]
+			err := f.emit(senml.Record{Name: name, Unit: f.units[name], Time: t, Value: p.value})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// neighbours returns the neighbours of the names at the point which is emitted, from which a filler can be resumed
+func (f *gapFiller) neighbours() map[string]fillNeighbour {
+	neighbours := make(map[string]fillNeighbour, len(f.current))
+	for name, n := range f.current {
+		neighbours[name] = n
+	}
+	return neighbours
+}
@@ -4,15 +4,20 @@ import (
 	"context"
 	"io"
 	"log"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
+	senml_protobuf "github.com/farshidtz/senml-protobuf/go"
 	"github.com/farshidtz/senml/v2"
 	"github.com/farshidtz/senml/v2/codec"
 	"github.com/linksmart/historical-datastore/common"
 	pbgo "github.com/linksmart/historical-datastore/protobuf/go"
+	"github.com/linksmart/historical-datastore/registry"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -45,12 +50,13 @@ func (a GrpcAPI) Submit(stream pbgo.Data_SubmitServer) error {
 		}
 		senmlPack := codec.ImportProtobufMessage(*message)
 
-		submitErr := a.c.Submit(stream.Context(), senmlPack, nil)
+		report, submitErr := a.c.Submit(stream.Context(), senmlPack, nil)
 		if submitErr != nil {
 			return status.Errorf(submitErr.GrpcStatus(), "Error submitting:"+submitErr.Error())
 		}
+		// the trailer accumulates the reports of all messages, in the format of the X-Duplicates header
+		stream.SetTrailer(metadata.MD{strings.ToLower(HeaderDuplicates): duplicatesHeader(report)})
 	}
-	return nil
 }
 
 func (a GrpcAPI) Query(request *pbgo.QueryRequest, stream pbgo.Data_QueryServer) (err error) {
@@ -74,17 +80,33 @@ func (a GrpcAPI) Query(request *pbgo.QueryRequest, stream pbgo.Data_QueryServer)
 	q.Limit = int(request.Limit)
 	q.Offset = int(request.Offset)
 
-	if request.Aggregator != "" {
-		q.AggrFunc = strings.ToLower(strings.TrimSpace(request.Aggregator))
-		if !common.SupportedAggregate(q.AggrFunc) {
-			return status.Errorf(codes.InvalidArgument, "Unknown aggregation function: %s", request.Aggregator)
+	if len(request.Aggregator) != 0 {
+		q.AggrFuncs, err = parseAggregates(normalizeAggregates(request.Aggregator))
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Error parsing aggregation functions: %s", err)
 		}
 
-		q.AggrWindow, err = time.ParseDuration(request.AggrInterval)
+		q.AggrWindow, q.Calendar, err = parseWindow(request.AggrInterval)
 		if err != nil {
 			return status.Errorf(codes.InvalidArgument, "Error parsing aggregation interval %s:%s ", request.AggrInterval, err.Error())
 		}
 	}
+	err = parseFillParams(&q, request.Fill, request.Resample)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Error parsing fill params: %s", err)
+	}
+	err = parseAlignmentParams(&q, request.Align, request.Tz)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Error parsing alignment params: %s", err)
+	}
+	q.Transforms, err = ParseTransforms(strings.Join(request.Transform, ","))
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "Error parsing transforms: %s", err)
+	}
+	q.Unit = request.Unit
+	if !common.ValidUnit(q.Unit) {
+		return status.Errorf(codes.InvalidArgument, "Error parsing unit: unknown unit %s", q.Unit)
+	}
 	ctx := stream.Context()
 	var sendFunc sendFunction = func(pack senml.Pack) error {
 		if ctx.Err() == context.Canceled || ctx.Err() == context.DeadlineExceeded {
@@ -116,17 +138,33 @@ func (a GrpcAPI) Count(ctx context.Context, request *pbgo.QueryRequest) (*pbgo.C
 	}
 
 	q.Limit = int(request.Limit)
-	if request.Aggregator != "" {
-		q.AggrFunc = strings.ToLower(strings.TrimSpace(request.Aggregator))
-		if !common.SupportedAggregate(q.AggrFunc) {
-			return nil, status.Errorf(codes.InvalidArgument, "Unknown aggregation function: %s", request.Aggregator)
+	if len(request.Aggregator) != 0 {
+		q.AggrFuncs, err = parseAggregates(normalizeAggregates(request.Aggregator))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "Error parsing aggregation functions: %s", err)
 		}
 
-		q.AggrWindow, err = time.ParseDuration(request.AggrInterval)
+		q.AggrWindow, q.Calendar, err = parseWindow(request.AggrInterval)
 		if err != nil {
 			return nil, status.Errorf(codes.InvalidArgument, "Error parsing aggregation interval %s:%s ", request.AggrInterval, err.Error())
 		}
 	}
+	err = parseFillParams(&q, request.Fill, request.Resample)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Error parsing fill params: %s", err)
+	}
+	err = parseAlignmentParams(&q, request.Align, request.Tz)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Error parsing alignment params: %s", err)
+	}
+	q.Transforms, err = ParseTransforms(strings.Join(request.Transform, ","))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Error parsing transforms: %s", err)
+	}
+	q.Unit = request.Unit
+	if !common.ValidUnit(q.Unit) {
+		return nil, status.Errorf(codes.InvalidArgument, "Error parsing unit: unknown unit %s", q.Unit)
+	}
 
 	total, queryErr := a.c.Count(ctx, q, request.Series)
 	if queryErr != nil {
@@ -157,47 +195,260 @@ func (a GrpcAPI) Delete(ctx context.Context, request *pbgo.DeleteRequest) (*pbgo
 	return &pbgo.Void{}, nil
 }
 
+func (a GrpcAPI) Latest(ctx context.Context, request *pbgo.LatestRequest) (*senml_protobuf.Message, error) {
+	pack, err := a.c.Latest(ctx, request.Series)
+	if err != nil {
+		return nil, status.Errorf(err.GrpcStatus(), "Error retrieving the latest values: "+err.Error())
+	}
+	message := codec.ExportProtobufMessage(pack)
+	return &message, nil
+}
+
+// Subscribe streams the submitted data of the requested series. If a from time is given, the stored data since then
+// is replayed before the live data. Live records which are identical to a recently replayed record are considered
+// delivered by the replay, other ones are sent even if they are older than the replayed ones, e.g. when backfilled.
+// Identical records are distinct under the sequence duplicates policy, so the records of such series are all sent,
+// and those stored during the replay may be sent twice.
+// The live data is buffered during the replay, up to replayBufferRecords records.
+// Clients which cannot keep up with the live data get a ResourceExhausted status with the time of the last delivered
+// record of each series, from which they can subscribe again.
 func (a GrpcAPI) Subscribe(request *pbgo.SubscribeRequest, stream pbgo.Data_SubscribeServer) error {
 	names := request.Series
-	ch, err := a.c.Subscribe(names...)
+	var from time.Time
+	if request.From != "" {
+		var err error
+		from, err = parseFromValue(request.From)
+		if err != nil {
+			return status.Errorf(codes.InvalidArgument, "Error parsing from value: "+err.Error())
+		}
+	}
+
+	// subscribe before the replay so that nothing is missed in between
+	packs, unsubscribe, err := a.c.SubscribeBuffered(names...)
 	if err != nil {
 		return status.Errorf(err.GrpcStatus(), "Error subscribing: %v", err)
 	}
-	defer a.c.Unsubscribe(ch, names...)
-
-	// Use a temporary buffer to store the subscribed measurements so that the publisher is not
-	// stuck because of a slow clients.
-	const PubSubBufferSize = 100
-	tempCh := make(chan interface{}, PubSubBufferSize)
+	defer unsubscribe()
+	// the headers confirm the subscription to the client, which may then rely on receiving the data submitted afterwards
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
 
 	ctx := stream.Context()
-	go func() {
-		defer close(tempCh)
-		for pack := range ch {
-			if len(tempCh) == PubSubBufferSize {
-				log.Printf("pubsub buffer overflow. unsubscribing for the data events: %v", names)
-				a.c.Unsubscribe(ch, names...)
-				break
+	// time of the last delivered record of each series
+	lastTimes := make(map[string]float64, len(names))
+	send := func(pack senml.Pack) error {
+		if len(pack) == 0 {
+			return nil
+		}
+		message := codec.ExportProtobufMessage(pack)
+		if err := stream.Send(&message); err != nil {
+			return err
+		}
+		for _, r := range pack {
+			lastTimes[r.Name] = r.Time
+		}
+		return nil
+	}
+
+	var replayed *replayedRecords
+	if request.From != "" {
+		replayed = newReplayedRecords(replayedRecordsWindow)
+		sequenced := make(map[string]bool, len(names))
+		for _, name := range names {
+			ts, err := a.c.registry.Get(name)
+			if err != nil {
+				return status.Errorf(err.GrpcStatus(), "Error replaying: "+err.Error())
 			}
-			tempCh <- pack
+			sequenced[name] = a.c.duplicatesPolicy(ts) == registry.DuplicatesSequence
 		}
-	}()
+		replayCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		stopBuffering := bufferLive(packs, cancel)
+		// up to the latest time supported by the queries
+		q := Query{From: from, To: time.Unix(0, math.MaxInt64), SortAsc: true, PerPage: MaxPerPage}
+		var sendFunc sendFunction = func(pack senml.Pack) error {
+			if replayCtx.Err() != nil {
+				return replayCtx.Err()
+			}
+			for _, r := range pack {
+				if !sequenced[r.Name] {
+					replayed.add(r)
+				}
+			}
+			return send(pack)
+		}
+		queryErr := a.c.QueryStream(replayCtx, q, names, sendFunc)
+		live, complete := stopBuffering()
+		if !complete && ctx.Err() == nil {
+			log.Printf("replay buffer overflow: streams: %v", names)
+			return overflowStatus(lastTimes)
+		}
+		if queryErr != nil {
+			return status.Errorf(queryErr.GrpcStatus(), "Error replaying: "+queryErr.Error())
+		}
+		for _, p := range live {
+			if err := send(replayed.notReplayed(p)); err != nil {
+				return err
+			}
+		}
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return ctx.Err()
-		case res := <-tempCh:
-			if p, ok := res.(senml.Pack); ok {
-				message := codec.ExportProtobufMessage(p)
-				if err := stream.Send(&message); err != nil {
-					return err
-				}
-			} else {
+		case p, ok := <-packs:
+			if !ok {
 				log.Printf("channel closed: streams: %v", names)
-				return nil
+				return overflowStatus(lastTimes)
+			}
+			if replayed != nil {
+				p = replayed.notReplayed(p)
+			}
+			if err := send(p); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// replayBufferRecords is the number of live records which are buffered for a subscriber while the stored data is replayed
+const replayBufferRecords = 10 * MaxPerPage
+
+// bufferLive reads the live packs while the stored data is replayed, as the replay may last longer than the subscription
+// buffer. If more than replayBufferRecords records arrive, or if the subscription is closed, it stops and calls cancel.
+// The returned function stops buffering and returns the buffered packs, and whether none was missed.
+func bufferLive(packs <-chan senml.Pack, cancel func()) func() ([]senml.Pack, bool) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	var buffered []senml.Pack
+	complete := true
+	go func() {
+		defer close(done)
+		records := 0
+		for {
+			select {
+			case <-stop:
+				return
+			case p, ok := <-packs:
+				if !ok || records+len(p) > replayBufferRecords {
+					complete = false
+					cancel()
+					return
+				}
+				buffered = append(buffered, p)
+				records += len(p)
 			}
 		}
+	}()
+	return func() ([]senml.Pack, bool) {
+		close(stop)
+		<-done
+		return buffered, complete
 	}
+}
+
+// replayedRecordsWindow is the number of the last replayed records which are compared with the live records.
+// Live records which were stored during the replay reach the subscriber shortly after, within a few pages.
+const replayedRecordsWindow = 10 * MaxPerPage
+
+// replayedRecords keeps the keys of the last replayed records, up to a limit
+type replayedRecords struct {
+	keys  map[replayedKey]int
+	order []replayedKey
+	next  int
+}
+
+// replayedKey identifies a record by its series, time and value
+type replayedKey struct {
+	name  string
+	time  float64
+	value string
+}
+
+func newReplayedRecords(limit int) *replayedRecords {
+	return &replayedRecords{
+		keys:  make(map[replayedKey]int, limit),
+		order: make([]replayedKey, 0, limit),
+	}
+}
 
+func recordKey(r senml.Record) replayedKey {
+	key := replayedKey{name: r.Name, time: r.Time}
+	switch {
+	case r.Value != nil:
+		key.value = strconv.FormatFloat(*r.Value, 'g', -1, 64)
+	case r.BoolValue != nil:
+		key.value = strconv.FormatBool(*r.BoolValue)
+	case r.StringValue != "":
+		key.value = "s:" + r.StringValue
+	case r.DataValue != "":
+		key.value = "d:" + r.DataValue
+	}
+	return key
+}
+
+// add keeps the key of a replayed record, forgetting the oldest one once the limit is reached
+func (rr *replayedRecords) add(r senml.Record) {
+	key := recordKey(r)
+	if len(rr.order) < cap(rr.order) {
+		rr.order = append(rr.order, key)
+	} else {
+		oldest := rr.order[rr.next]
+		if rr.keys[oldest]--; rr.keys[oldest] == 0 {
+			delete(rr.keys, oldest)
+		}
+		rr.order[rr.next] = key
+		rr.next = (rr.next + 1) % len(rr.order)
+	}
+	rr.keys[key]++
+}
+
+// notReplayed removes the records which were already sent during the replay
+func (rr *replayedRecords) notReplayed(pack senml.Pack) senml.Pack {
+	fresh := make(senml.Pack, 0, len(pack))
+	for _, r := range pack {
+		if rr.keys[recordKey(r)] > 0 {
+			continue
+		}
+		fresh = append(fresh, r)
+	}
+	return fresh
+}
+
+// overflowStatus returns the error for subscribers whose buffer overflowed, with the time of the last delivered record
+// of each series
+func overflowStatus(lastTimes map[string]float64) error {
+	st := status.New(codes.ResourceExhausted, "subscription buffer overflow")
+	details := &pbgo.SubscriptionOverflow{}
+	var earliest float64
+	for name, lastTime := range lastTimes {
+		if details.LastTimes == nil {
+			details.LastTimes = make(map[string]string, len(lastTimes))
+		}
+		details.LastTimes[name] = FromSenmlTime(lastTime).UTC().Format(time.RFC3339Nano)
+		if earliest == 0 || lastTime < earliest {
+			earliest = lastTime
+		}
+	}
+	if earliest != 0 {
+		details.LastTime = FromSenmlTime(earliest).UTC().Format(time.RFC3339Nano)
+	}
+	withDetails, err := st.WithDetails(details)
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// normalizeAggregates converts the requested aggregation functions to lower case, splitting comma-separated lists
+func normalizeAggregates(requested []string) []string {
+	var aggrs []string
+	for _, r := range requested {
+		for _, aggr := range strings.Split(r, ",") {
+			aggrs = append(aggrs, strings.ToLower(strings.TrimSpace(aggr)))
+		}
+	}
+	return aggrs
 }
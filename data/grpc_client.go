@@ -10,6 +10,8 @@ import (
 	"github.com/farshidtz/senml/v2/codec"
 	_go "github.com/linksmart/historical-datastore/protobuf/go"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type GrpcClient struct {
@@ -118,14 +120,43 @@ func (c *GrpcClient) Delete(seriesNames []string, from time.Time, to time.Time)
 	return nil
 }
 
+// Latest retrieves the most recent record of each series
+func (c *GrpcClient) Latest(ctx context.Context, seriesNames ...string) (senml.Pack, error) {
+	request := _go.LatestRequest{
+		Series: seriesNames,
+	}
+	message, err := c.Client.Latest(ctx, &request)
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving the latest values: %v", err)
+	}
+	return codec.ImportProtobufMessage(*message), nil
+}
+
 func (c *GrpcClient) Subscribe(ctx context.Context, seriesNames ...string) (chan ResponsePack, error) {
 	request := _go.SubscribeRequest{
 		Series: seriesNames,
 	}
-	stream, err := c.Client.Subscribe(ctx, &request)
+	return c.subscribe(ctx, &request)
+}
+
+// SubscribeFrom replays the stored data of the series since the given time before streaming the live data
+func (c *GrpcClient) SubscribeFrom(ctx context.Context, from time.Time, seriesNames ...string) (chan ResponsePack, error) {
+	request := _go.SubscribeRequest{
+		Series: seriesNames,
+		From:   from.Format(time.RFC3339Nano),
+	}
+	return c.subscribe(ctx, &request)
+}
+
+func (c *GrpcClient) subscribe(ctx context.Context, request *_go.SubscribeRequest) (chan ResponsePack, error) {
+	stream, err := c.Client.Subscribe(ctx, request)
 	if err != nil {
 		return nil, fmt.Errorf("error subscribing: %v", err)
 	}
+	// wait until the server has subscribed, so that the data submitted after returning is received
+	if _, err := stream.Header(); err != nil {
+		return nil, fmt.Errorf("error subscribing: %v", err)
+	}
 	ch := make(chan ResponsePack)
 	go func() {
 		defer close(ch)
@@ -144,6 +175,50 @@ func (c *GrpcClient) Subscribe(ctx context.Context, seriesNames ...string) (chan
 	return ch, err
 }
 
+// OverflowTime checks if a subscription was ended because the client could not keep up with the data.
+// It returns the earliest of the times of the last delivered records of the series, from which the client can subscribe
+// again without missing data.
+func OverflowTime(err error) (lastTime time.Time, overflow bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return time.Time{}, false
+	}
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*_go.SubscriptionOverflow); ok && d.LastTime != "" {
+			lastTime, err = time.Parse(time.RFC3339Nano, d.LastTime)
+			if err != nil {
+				return time.Time{}, true
+			}
+			return lastTime, true
+		}
+	}
+	return time.Time{}, true
+}
+
+// OverflowTimes checks if a subscription was ended because the client could not keep up with the data.
+// It returns the time of the last delivered record of each series, to skip the records received again after subscribing
+// from the time returned by OverflowTime.
+func OverflowTimes(err error) (lastTimes map[string]time.Time, overflow bool) {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != codes.ResourceExhausted {
+		return nil, false
+	}
+	for _, detail := range st.Details() {
+		if d, ok := detail.(*_go.SubscriptionOverflow); ok {
+			lastTimes = make(map[string]time.Time, len(d.LastTimes))
+			for name, value := range d.LastTimes {
+				lastTime, err := time.Parse(time.RFC3339Nano, value)
+				if err != nil {
+					continue
+				}
+				lastTimes[name] = lastTime
+			}
+			return lastTimes, true
+		}
+	}
+	return nil, true
+}
+
 func (c *GrpcClient) QueryStream(ctx context.Context, seriesNames []string, q Query) (chan ResponsePack, error) {
 	request := _go.QueryRequest{
 		Series:          seriesNames,
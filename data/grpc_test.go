@@ -21,17 +21,15 @@ func setupGrpcAPI(t *testing.T, dataStorage Storage, regController registry.Cont
 	tss := []registry.TimeSeries{
 		{
 			Name: "http://example.com/sensor1",
-			Unit: "degC",
+			Unit: "Cel",
 			Type: registry.Float,
 		},
 		{
 			Name: "http://example.com/sensor2",
-			Unit: "flag",
 			Type: registry.Bool,
 		},
 		{
 			Name: "http://example.com/sensor3",
-			Unit: "char",
 			Type: registry.String,
 		},
 	}
@@ -95,21 +93,19 @@ func TestGrpcSubmit(t *testing.T) {
 	v1 := 42.0
 	r1 := senml.Record{
 		Name:  "example.com/sensor1",
-		Unit:  "degC",
+		Unit:  "Cel",
 		Value: &v1,
 		Time:  1543059346.0,
 	}
 	v2 := true
 	r2 := senml.Record{
 		Name:      "example.com/sensor2",
-		Unit:      "flag",
 		BoolValue: &v2,
 		Time:      1543059346.0,
 	}
 	v3 := "test string"
 	r3 := senml.Record{
 		Name:        "example.com/sensor3",
-		Unit:        "char",
 		StringValue: v3,
 		Time:        1543059346.0,
 	}
@@ -162,21 +158,19 @@ func TestGrpcDelete(t *testing.T) {
 	v1 := 42.0
 	r1 := senml.Record{
 		Name:  "example.com/sensor1",
-		Unit:  "degC",
+		Unit:  "Cel",
 		Value: &v1,
 		Time:  1543059346.0,
 	}
 	v2 := true
 	r2 := senml.Record{
 		Name:      "example.com/sensor2",
-		Unit:      "flag",
 		BoolValue: &v2,
 		Time:      1543059346.0,
 	}
 	v3 := "test string"
 	r3 := senml.Record{
 		Name:        "example.com/sensor3",
-		Unit:        "char",
 		StringValue: v3,
 		Time:        1543059346.0,
 	}
@@ -184,7 +178,6 @@ func TestGrpcDelete(t *testing.T) {
 	deleteTime := 1543059350.0
 	r4 := senml.Record{
 		Name:        "example.com/sensor3",
-		Unit:        "char",
 		StringValue: v3,
 		Time:        1543059350.0,
 	}
@@ -243,21 +236,19 @@ func TestGrpcSubscribe(t *testing.T) {
 	v1 := 42.0
 	r1 := senml.Record{
 		Name:  "example.com/sensor1",
-		Unit:  "degC",
+		Unit:  "Cel",
 		Value: &v1,
 		Time:  1543059346.0,
 	}
 	v2 := true
 	r2 := senml.Record{
 		Name:      "example.com/sensor2",
-		Unit:      "flag",
 		BoolValue: &v2,
 		Time:      1543059346.0,
 	}
 	v3 := "test string"
 	r3 := senml.Record{
 		Name:        "example.com/sensor3",
-		Unit:        "char",
 		StringValue: v3,
 		Time:        1543059346.0,
 	}
@@ -311,3 +302,318 @@ func TestGrpcSubscribe(t *testing.T) {
 	}
 
 }
+
+func TestGrpcLatest(t *testing.T) {
+	funcName := "TestGrpcLatest"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	client := setupGrpcAPI(t, dataStorage, regController)
+
+	v1, v2 := 42.0, 43.0
+	records := senml.Pack{
+		{Name: "http://example.com/sensor1", Unit: "Cel", Value: &v1, Time: 1543059346.0},
+		{Name: "http://example.com/sensor1", Unit: "Cel", Value: &v2, Time: 1543059347.0},
+		{Name: "http://example.com/sensor3", StringValue: "test string", Time: 1543059346.0},
+	}
+	err = client.Submit(context.Background(), records)
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+
+	pack, err := client.Latest(context.Background(), "http://example.com/sensor1", "http://example.com/sensor2", "http://example.com/sensor3")
+	if err != nil {
+		t.Fatalf("Latest failed:%v", err)
+	}
+	pack.Normalize()
+	expected := senml.Pack{records[1], records[2]}
+	if len(pack) != len(expected) || !CompareRecords(expected[0], pack[0]) || !CompareRecords(expected[1], pack[1]) {
+		t.Errorf("Expected latest records %v, got %v", expected, pack)
+	}
+
+	_, err = client.Latest(context.Background(), "http://example.com/unknown")
+	if err == nil {
+		t.Errorf("Expected an error for a non-existing series")
+	}
+}
+
+func TestGrpcSubscribeFrom(t *testing.T) {
+	funcName := "TestGrpcSubscribeFrom"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	client := setupGrpcAPI(t, dataStorage, regController)
+
+	const name = "http://example.com/sensor1"
+	record := func(v float64, t float64) senml.Record {
+		return senml.Record{Name: name, Unit: "Cel", Value: &v, Time: 1543059346 + t}
+	}
+	err = client.Submit(context.Background(), senml.Pack{record(1, 1000), record(2, 2000), record(3, 3000)})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelFunc()
+	ch, err := client.SubscribeFrom(ctx, FromSenmlTime(1543059346+2000), name)
+	if err != nil {
+		t.Fatalf("Subscription failed: %v", err)
+	}
+
+	receive := func(expected ...senml.Record) {
+		var pack senml.Pack
+		for len(pack) < len(expected) {
+			response, ok := <-ch
+			if !ok {
+				t.Fatalf("Subscription closed after %v", pack)
+			}
+			if response.Err != nil {
+				t.Fatalf("Error while receiving stream: %v", response.Err)
+			}
+			pack = append(pack, response.Pack...)
+		}
+		if len(pack) != len(expected) {
+			t.Fatalf("Expected %d records, got %v", len(expected), pack)
+		}
+		for i := range expected {
+			if !CompareRecords(expected[i], pack[i]) {
+				t.Fatalf("Expected %v, got %v", expected, pack)
+			}
+		}
+	}
+
+	// the stored data is replayed
+	receive(record(2, 2000), record(3, 3000))
+
+	// live data which was already replayed is not sent again
+	err = client.Submit(context.Background(), senml.Pack{record(3, 3000)})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+	// backfilled data is sent even though it is older than the replayed data
+	err = client.Submit(context.Background(), senml.Pack{record(5, 2500)})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+	err = client.Submit(context.Background(), senml.Pack{record(4, 4000)})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+	receive(record(5, 2500), record(4, 4000))
+}
+
+func TestGrpcSubscribeFrom_Sequenced(t *testing.T) {
+	funcName := "TestGrpcSubscribeFrom_Sequenced"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	client := setupGrpcAPI(t, dataStorage, regController)
+
+	const name = "http://example.com/sequenced"
+	_, addErr := regController.Add(registry.TimeSeries{Name: name, Type: registry.Float, Duplicates: registry.DuplicatesSequence})
+	if addErr != nil {
+		t.Fatal(addErr)
+	}
+	v := 1.0
+	record := senml.Record{Name: name, Value: &v, Time: 1543059346}
+	err = client.Submit(context.Background(), senml.Pack{record})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelFunc()
+	ch, err := client.SubscribeFrom(ctx, FromSenmlTime(1543059346), name)
+	if err != nil {
+		t.Fatalf("Subscription failed: %v", err)
+	}
+	receive := func() {
+		response, ok := <-ch
+		if !ok {
+			t.Fatalf("Subscription closed")
+		}
+		if response.Err != nil {
+			t.Fatalf("Error while receiving stream: %v", response.Err)
+		}
+		if len(response.Pack) != 1 || !CompareRecords(response.Pack[0], record) {
+			t.Fatalf("Expected %v, got %v", record, response.Pack)
+		}
+	}
+	receive()
+
+	// an identical record is a new one under the sequence policy
+	err = client.Submit(context.Background(), senml.Pack{record})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+	receive()
+}
+
+// pausedStorage starts streaming the queried data once released
+type pausedStorage struct {
+	Storage
+	release chan struct{}
+}
+
+func (s pausedStorage) QueryStream(ctx context.Context, q Query, sendFunc sendFunction, series ...*registry.TimeSeries) error {
+	<-s.release
+	return s.Storage.QueryStream(ctx, q, sendFunc, series...)
+}
+
+func TestGrpcSubscribeFrom_LiveDuringReplay(t *testing.T) {
+	funcName := "TestGrpcSubscribeFrom_LiveDuringReplay"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	storage := pausedStorage{Storage: dataStorage, release: make(chan struct{})}
+	client := setupGrpcAPI(t, storage, regController)
+
+	const name = "http://example.com/sensor1"
+	record := func(v float64, t float64) senml.Record {
+		return senml.Record{Name: name, Unit: "Cel", Value: &v, Time: 1543059346 + t}
+	}
+	err = client.Submit(context.Background(), senml.Pack{record(0, 0)})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+
+	ctx, cancelFunc := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelFunc()
+	ch, err := client.SubscribeFrom(ctx, FromSenmlTime(1543059346), name)
+	if err != nil {
+		t.Fatalf("Subscription failed: %v", err)
+	}
+
+	// more packs are submitted during the replay than the subscription buffer holds
+	live := 3 * SubscriptionBufferSize
+	for i := 1; i <= live; i++ {
+		err = client.Submit(context.Background(), senml.Pack{record(float64(i), float64(i))})
+		if err != nil {
+			t.Fatalf("Submit failed:%v", err)
+		}
+	}
+	close(storage.release)
+
+	// the replay includes the live data, which is not sent again, and the subscription goes on
+	receive := func(count int) senml.Pack {
+		var pack senml.Pack
+		for len(pack) < count {
+			response, ok := <-ch
+			if !ok {
+				t.Fatalf("Subscription closed after %d records", len(pack))
+			}
+			if response.Err != nil {
+				t.Fatalf("Error while receiving stream after %d records: %v", len(pack), response.Err)
+			}
+			pack = append(pack, response.Pack...)
+		}
+		if len(pack) != count {
+			t.Fatalf("Expected %d records, got %d", count, len(pack))
+		}
+		return pack
+	}
+	pack := receive(live + 1)
+	err = client.Submit(context.Background(), senml.Pack{record(float64(live+1), float64(live+1))})
+	if err != nil {
+		t.Fatalf("Submit failed:%v", err)
+	}
+	pack = append(pack, receive(1)...)
+	for i := range pack {
+		if !CompareRecords(pack[i], record(float64(i), float64(i))) {
+			t.Fatalf("Expected %v, got %v", record(float64(i), float64(i)), pack[i])
+		}
+	}
+}
+
+func TestBufferLive(t *testing.T) {
+	packs := make(chan senml.Pack)
+	cancelled := make(chan struct{})
+	stop := bufferLive(packs, func() { close(cancelled) })
+	packs <- make(senml.Pack, replayBufferRecords)
+	packs <- make(senml.Pack, 1)
+	select {
+	case <-cancelled:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Expected the replay to be cancelled when the buffer overflows")
+	}
+	if buffered, complete := stop(); complete || len(buffered) != 1 {
+		t.Fatalf("Expected the buffer to be incomplete, got %d packs", len(buffered))
+	}
+}
+
+func TestReplayedRecords(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+	replayed := newReplayedRecords(2)
+	replayed.add(senml.Record{Name: "a", Time: 1, Value: value(1)})
+	replayed.add(senml.Record{Name: "b", Time: 1, Value: value(1)})
+
+	live := senml.Pack{
+		{Name: "a", Time: 1, Value: value(1)},
+		{Name: "a", Time: 1, Value: value(2)},
+		{Name: "a", Time: 0.5, Value: value(1)},
+		{Name: "b", Time: 1, Value: value(1)},
+	}
+	if fresh := replayed.notReplayed(live); len(fresh) != 2 || *fresh[0].Value != 2 || fresh[1].Time != 0.5 {
+		t.Fatalf("Expected the records which were not replayed, got %v", fresh)
+	}
+
+	// the oldest records are forgotten
+	replayed.add(senml.Record{Name: "c", Time: 1, Value: value(1)})
+	if fresh := replayed.notReplayed(live[:1]); len(fresh) != 1 {
+		t.Fatalf("Expected the forgotten record, got %v", fresh)
+	}
+	if fresh := replayed.notReplayed(live[3:]); len(fresh) != 0 {
+		t.Fatalf("Expected no records, got %v", fresh)
+	}
+}
+
+func TestGrpcSubscriptionOverflow(t *testing.T) {
+	err := overflowStatus(map[string]float64{"a": 1543059346.5, "b": 1543059340})
+	lastTime, overflow := OverflowTime(err)
+	if !overflow {
+		t.Fatal("Expected an overflow status")
+	}
+	if ToSenmlTime(lastTime) != 1543059340 {
+		t.Fatalf("Expected the earliest last time 1543059340, got %v", ToSenmlTime(lastTime))
+	}
+	lastTimes, _ := OverflowTimes(err)
+	if len(lastTimes) != 2 || ToSenmlTime(lastTimes["a"]) != 1543059346.5 || ToSenmlTime(lastTimes["b"]) != 1543059340 {
+		t.Fatalf("Unexpected last times of the series: %v", lastTimes)
+	}
+
+	if _, overflow := OverflowTime(fmt.Errorf("other error")); overflow {
+		t.Fatal("Expected no overflow for other errors")
+	}
+}
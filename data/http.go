@@ -40,6 +40,8 @@ const (
 // API describes the RESTful HTTP data API
 type API struct {
 	c Controller
+	// allowedOrigins may open WebSocket streams from other origins, see AllowOrigins
+	allowedOrigins []string
 }
 
 // NewAPI returns the configured Data API
@@ -47,7 +49,15 @@ func NewAPI(c Controller) *API {
 	return &API{c: c}
 }
 
-// QueryPage is a handler for querying data
+// AllowOrigins allows web pages of the given origins (e.g. https://example.com) to open WebSocket streams. * allows all of them.
+// Streams of other origins are refused, except for those of the service itself and of clients which send no Origin, i.e. not browsers.
+func (api *API) AllowOrigins(origins []string) {
+	api.allowedOrigins = origins
+}
+
+// Query is a handler for querying data
+// The format of the response is negotiated with the Accept header. The default is a JSON RecordSet;
+// with the other formats, the body is the SenML pack and the paging metadata is sent in the Link, X-Count and X-Took headers.
 // Expected parameters: id(s), optional: pagination, query string
 func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
@@ -58,6 +68,9 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 	// Parse id(s) and get sources from registry
 	ids := strings.Split(params["id"], common.IDSeparator)
 
+	w.Header().Set("Vary", "Accept")
+	encoder := getEncoderForAccept(r.Header.Get("Accept"))
+
 	// Parse query
 	q, err := ParseQueryParameters(r.Form)
 	if err != nil {
@@ -65,7 +78,12 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	data, total, err := api.c.QueryPage(r.Context(), q, ids)
+	if strings.EqualFold(r.Form.Get(common.ParamStream), "true") {
+		api.queryStream(w, r, q, ids, encoder)
+		return
+	}
+
+	data, total, next, err := api.c.QueryPageCursor(r.Context(), q, ids)
 	if err != nil {
 		common.HttpErrorResponse(err, w)
 		return
@@ -81,8 +99,13 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 
 	//If the response is already less than the number of elements supposed to be in a page,
 	//then it already means that we are in last page
+	//The next page continues after the last record of this one. The page number is kept for compatibility
 	if responseLength >= q.PerPage {
 		form.Set(common.ParamPage, strconv.Itoa(q.Page+1))
+		if next == nil {
+			next = cursorAfter(data, q.Cursor)
+		}
+		form.Set(common.ParamCursor, next.Encode())
 		form.Del(common.ParamCount)
 		nextLink = baseLink + form.Encode()
 	}
@@ -95,15 +118,50 @@ func (api *API) Query(w http.ResponseWriter, r *http.Request) {
 		Count:    total,
 	}
 
-	csvStr, errMarshal := json.Marshal(recordSet)
+	if encoder.encode == nil {
+		b, errMarshal := json.Marshal(recordSet)
+		if errMarshal != nil {
+			common.HttpErrorResponse(&common.InternalError{S: "Error marshalling recordset: " + errMarshal.Error()}, w)
+			return
+		}
+		w.Header().Add("Content-Type", common.DefaultMIMEType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+		return
+	}
+
+	b, errMarshal := encoder.encode(data)
 	if errMarshal != nil {
-		common.HttpErrorResponse(&common.InternalError{S: "Error marshalling recordset: " + errMarshal.Error()}, w)
+		common.HttpErrorResponse(&common.InternalError{S: "Error encoding the data: " + errMarshal.Error()}, w)
+		return
+	}
+	setPagingHeaders(w.Header(), recordSet)
+	w.Header().Add("Content-Type", encoder.mediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// Latest is a handler for retrieving the most recent record of each series
+// Expected parameters: id(s)
+func (api *API) Latest(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	ids := strings.Split(params["id"], common.IDSeparator)
+
+	pack, err := api.c.Latest(r.Context(), ids)
+	if err != nil {
+		common.HttpErrorResponse(err, w)
+		return
+	}
+
+	b, marshalErr := codec.EncodeJSON(pack)
+	if marshalErr != nil {
+		common.HttpErrorResponse(&common.InternalError{S: "Error marshalling the latest values: " + marshalErr.Error()}, w)
 		return
 	}
 
-	w.Header().Add("Content-Type", common.DefaultMIMEType)
+	w.Header().Add("Content-Type", "application/senml+json")
 	w.WriteHeader(http.StatusOK)
-	w.Write(csvStr)
+	w.Write(b)
 }
 
 func getRequestBodyReader(r *http.Request) (io.Reader, common.Error) {
@@ -151,23 +209,24 @@ func (api *API) Submit(w http.ResponseWriter, r *http.Request) {
 	}
 	decoder, err := getDecoderForContentType(contentType)
 	if err != nil {
-		common.HttpErrorResponse(&common.UnsupportedMediaTypeError{S: "Error parsing Content-Type:" + err.Error()}, w)
+		api.rejected(w, body, contentType, &common.UnsupportedMediaTypeError{S: "Error parsing Content-Type:" + err.Error()})
 		return
 	}
 
 	senmlPack, err := decoder(body)
 	if err != nil {
-		common.HttpErrorResponse(&common.BadRequestError{S: "Error parsing message body: " + err.Error()}, w)
+		api.rejected(w, body, contentType, &common.BadRequestError{S: "Error parsing message body: " + err.Error()})
 		return
 	}
 
 	params := mux.Vars(r)
 	// Parse id(s) and get time series from registry
 	ids := strings.Split(params["id"], common.IDSeparator)
-	submitErr := api.c.Submit(r.Context(), senmlPack, ids)
+	report, submitErr := api.c.Submit(r.Context(), senmlPack, ids)
 	if submitErr != nil {
-		common.HttpErrorResponse(submitErr, w)
+		api.rejected(w, body, contentType, submitErr)
 	} else {
+		w.Header()[HeaderDuplicates] = duplicatesHeader(report)
 		w.WriteHeader(http.StatusNoContent)
 	}
 	return
@@ -204,26 +263,35 @@ func (api *API) SubmitWithoutID(w http.ResponseWriter, r *http.Request) {
 
 	decoder, err := getDecoderForContentType(contentType)
 	if err != nil {
-		common.HttpErrorResponse(&common.UnsupportedMediaTypeError{S: "Error parsing Content-Type:" + err.Error()}, w)
+		api.rejected(w, body, contentType, &common.UnsupportedMediaTypeError{S: "Error parsing Content-Type:" + err.Error()})
 		return
 	}
 
 	senmlPack, err := decoder(body)
 	if err != nil {
-		common.HttpErrorResponse(&common.BadRequestError{S: "Error parsing message body: " + err.Error()}, w)
+		api.rejected(w, body, contentType, &common.BadRequestError{S: "Error parsing message body: " + err.Error()})
 		return
 	}
 
-	submitErr := api.c.Submit(r.Context(), senmlPack, nil)
+	report, submitErr := api.c.Submit(r.Context(), senmlPack, nil)
 	if submitErr != nil {
-		common.HttpErrorResponse(submitErr, w)
+		api.rejected(w, body, contentType, submitErr)
 	} else {
 		w.Header().Set("Content-Type", common.DefaultMIMEType)
+		w.Header()[HeaderDuplicates] = duplicatesHeader(report)
 		w.WriteHeader(http.StatusNoContent)
 	}
 	return
 }
 
+// rejected responds with the error of a rejected submission and keeps the payload as dead letter, unless the submission may be retried as it is
+func (api *API) rejected(w http.ResponseWriter, body []byte, contentType string, err common.Error) {
+	if _, retry := err.(*common.ServiceUnavailableError); !retry {
+		keepDeadLetter(api.c.deadLetters, DeadLetter{Source: DeadLetterHTTP, ContentType: contentType, Payload: body, Reason: err.Error()})
+	}
+	common.HttpErrorResponse(err, w)
+}
+
 func (api *API) Delete(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 	r.Context()
@@ -273,6 +341,7 @@ func getDecoderForContentType(contentType string) (decoder codec.Decoder, err er
 }
 
 func getFormFromQuery(q Query) (form url.Values) {
+	q = q.withAggrFuncs()
 	form = url.Values{}
 	if q.SortAsc {
 		form.Set(common.ParamSort, common.Asc)
@@ -289,6 +358,9 @@ func getFormFromQuery(q Query) (form url.Values) {
 	if q.PerPage > 0 {
 		form.Set(common.ParamPerPage, strconv.Itoa(q.PerPage))
 	}
+	if q.Cursor != nil {
+		form.Set(common.ParamCursor, q.Cursor.Encode())
+	}
 	if q.Count == true {
 		form.Set(common.ParamCount, strconv.FormatBool(q.Count))
 	}
@@ -310,9 +382,27 @@ func getFormFromQuery(q Query) (form url.Values) {
 		}
 	}
 
-	if q.AggrFunc != "" {
-		form.Set(common.ParamAggr, q.AggrFunc)
-		form.Set(common.ParamWindow, q.AggrWindow.String())
+	if len(q.AggrFuncs) != 0 {
+		form.Set(common.ParamAggr, strings.Join(q.AggrFuncs, ","))
+		form.Set(common.ParamWindow, windowString(q.AggrWindow, q.Calendar))
+	}
+	if q.resampled() {
+		form.Set(common.ParamResample, windowString(q.Resample, q.Calendar))
+	}
+	if q.Align != "" {
+		form.Set(common.ParamAlign, q.Align)
+	}
+	if q.Location != nil {
+		form.Set(common.ParamTZ, q.Location.String())
+	}
+	if q.Fill.Method != "" {
+		form.Set(common.ParamFill, q.Fill.String())
+	}
+	if len(q.Transforms) != 0 {
+		form.Set(common.ParamTransform, transformsString(q.Transforms))
+	}
+	if q.Unit != "" {
+		form.Set(common.ParamUnit, q.Unit)
 	}
 
 	return form
@@ -343,6 +433,13 @@ func ParseQueryParameters(form url.Values) (Query, common.Error) {
 		return Query{}, &common.BadRequestError{S: "Error parsing limit argument:" + err.Error()}
 	}
 
+	if cursor := form.Get(common.ParamCursor); cursor != "" {
+		q.Cursor, err = ParseCursor(cursor)
+		if err != nil {
+			return Query{}, &common.BadRequestError{S: err.Error()}
+		}
+	}
+
 	// sort
 	sort := form.Get(common.ParamSort)
 	if sort == common.Asc {
@@ -364,10 +461,40 @@ func ParseQueryParameters(form url.Values) (Query, common.Error) {
 		q.Count = true
 	}
 
+	// limit and offset of streamed queries
+	if limit := form.Get(common.ParamLimit); limit != "" {
+		q.Limit, err = strconv.Atoi(limit)
+		if err != nil || q.Limit < 0 {
+			return Query{}, &common.BadRequestError{S: fmt.Sprintf("invalid value for parameter %s: %s", common.ParamLimit, limit)}
+		}
+	}
+	if offset := form.Get(common.ParamOffset); offset != "" {
+		q.Offset, err = strconv.Atoi(offset)
+		if err != nil || q.Offset < 0 {
+			return Query{}, &common.BadRequestError{S: fmt.Sprintf("invalid value for parameter %s: %s", common.ParamOffset, offset)}
+		}
+	}
+
 	//get aggregation parameters
-	q.AggrFunc, q.AggrWindow, err = parseAggregationParams(form.Get(common.ParamAggr), form.Get(common.ParamWindow))
+	q.AggrFuncs, q.AggrWindow, q.Calendar, err = parseAggregationParams(form.Get(common.ParamAggr), form.Get(common.ParamWindow))
 	if err != nil {
 		return Query{}, &common.BadRequestError{S: fmt.Sprintf("error parsing aggregation params: %v", err)}
 	}
+	err = parseFillParams(&q, form.Get(common.ParamFill), form.Get(common.ParamResample))
+	if err != nil {
+		return Query{}, &common.BadRequestError{S: fmt.Sprintf("error parsing fill params: %v", err)}
+	}
+	err = parseAlignmentParams(&q, form.Get(common.ParamAlign), form.Get(common.ParamTZ))
+	if err != nil {
+		return Query{}, &common.BadRequestError{S: fmt.Sprintf("error parsing alignment params: %v", err)}
+	}
+	q.Transforms, err = ParseTransforms(form.Get(common.ParamTransform))
+	if err != nil {
+		return Query{}, &common.BadRequestError{S: fmt.Sprintf("error parsing transform params: %v", err)}
+	}
+	q.Unit = form.Get(common.ParamUnit)
+	if !common.ValidUnit(q.Unit) {
+		return Query{}, &common.BadRequestError{S: fmt.Sprintf("invalid value for parameter %s: unknown unit %s", common.ParamUnit, q.Unit)}
+	}
 	return q, nil
 }
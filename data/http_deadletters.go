@@ -0,0 +1,167 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// DeadLetterList is a page of the dead letters
+type DeadLetterList struct {
+	DeadLetters []DeadLetter `json:"deadLetters"`
+	Page        int          `json:"page"`
+	PerPage     int          `json:"per_page"`
+	Total       int          `json:"total"`
+}
+
+// ReplayResult is the result of replaying several dead letters
+type ReplayResult struct {
+	Replayed int `json:"replayed"`
+	// Failed are the errors of the dead letters which were rejected again, by id
+	Failed map[int64]string `json:"failed"`
+}
+
+// DeadLetters is a handler for listing the dead letters, the newest first
+// Expected parameters: optional: pagination, source, topic, from and to (arrival time)
+func (api *API) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	page, perPage, err := common.ParsePagingParams(r.Form.Get(common.ParamPage), r.Form.Get(common.ParamPerPage), MaxPerPage)
+	if err != nil {
+		common.HttpErrorResponse(&common.BadRequestError{S: err.Error()}, w)
+		return
+	}
+	f, filterErr := parseDeadLetterFilter(r)
+	if filterErr != nil {
+		common.HttpErrorResponse(filterErr, w)
+		return
+	}
+	letters, total, listErr := api.c.DeadLetters(r.Context(), f, page, perPage)
+	if listErr != nil {
+		common.HttpErrorResponse(listErr, w)
+		return
+	}
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	b, _ := json.Marshal(DeadLetterList{DeadLetters: letters, Page: page, PerPage: perPage, Total: total})
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
+
+// DeadLetter is a handler for retrieving a dead letter
+// Expected parameters: id
+func (api *API) DeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, idErr := parseDeadLetterID(r)
+	if idErr != nil {
+		common.HttpErrorResponse(idErr, w)
+		return
+	}
+	l, getErr := api.c.DeadLetter(r.Context(), id)
+	if getErr != nil {
+		common.HttpErrorResponse(getErr, w)
+		return
+	}
+	b, _ := json.Marshal(l)
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
+
+// DeadLetterPayload is a handler for retrieving the payload of a dead letter as it was received.
+// It is served as a download, as the content type of the letter was set by the client.
+// Expected parameters: id
+func (api *API) DeadLetterPayload(w http.ResponseWriter, r *http.Request) {
+	id, idErr := parseDeadLetterID(r)
+	if idErr != nil {
+		common.HttpErrorResponse(idErr, w)
+		return
+	}
+	l, getErr := api.c.DeadLetter(r.Context(), id)
+	if getErr != nil {
+		common.HttpErrorResponse(getErr, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="deadletter-%d"`, l.ID))
+	w.Write(l.Payload)
+}
+
+// DeleteDeadLetter is a handler for deleting a dead letter
+// Expected parameters: id
+func (api *API) DeleteDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, idErr := parseDeadLetterID(r)
+	if idErr != nil {
+		common.HttpErrorResponse(idErr, w)
+		return
+	}
+	if deleteErr := api.c.DeleteDeadLetter(r.Context(), id); deleteErr != nil {
+		common.HttpErrorResponse(deleteErr, w)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReplayDeadLetter is a handler for submitting the payload of a dead letter again, which is deleted if that succeeds
+// Expected parameters: id
+func (api *API) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) {
+	id, idErr := parseDeadLetterID(r)
+	if idErr != nil {
+		common.HttpErrorResponse(idErr, w)
+		return
+	}
+	report, replayErr := api.c.ReplayDeadLetter(r.Context(), id)
+	if replayErr != nil {
+		common.HttpErrorResponse(replayErr, w)
+		return
+	}
+	w.Header()[HeaderDuplicates] = duplicatesHeader(report)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ReplayDeadLetters is a handler for replaying the dead letters matching the filter, the oldest first
+// Expected parameters: optional: source, topic, from and to (arrival time)
+func (api *API) ReplayDeadLetters(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	f, filterErr := parseDeadLetterFilter(r)
+	if filterErr != nil {
+		common.HttpErrorResponse(filterErr, w)
+		return
+	}
+	replayed, failed, replayErr := api.c.ReplayDeadLetters(r.Context(), f)
+	if replayErr != nil {
+		common.HttpErrorResponse(replayErr, w)
+		return
+	}
+	b, _ := json.Marshal(ReplayResult{Replayed: replayed, Failed: failed})
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(b)
+}
+
+func parseDeadLetterID(r *http.Request) (int64, common.Error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, &common.BadRequestError{S: "invalid dead letter id: " + mux.Vars(r)["id"]}
+	}
+	return id, nil
+}
+
+func parseDeadLetterFilter(r *http.Request) (f DeadLetterFilter, retErr common.Error) {
+	var err error
+	f.From, err = parseFromValue(r.Form.Get(common.ParamFrom))
+	if err != nil {
+		return f, &common.BadRequestError{S: "Error parsing from argument: " + err.Error()}
+	}
+	f.To, err = parseToValue(r.Form.Get(common.ParamTo))
+	if err != nil {
+		return f, &common.BadRequestError{S: "Error parsing to argument: " + err.Error()}
+	}
+	f.Source = r.Form.Get(common.ParamSource)
+	f.Topic = r.Form.Get(common.ParamTopic)
+	return f, nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
+)
+
+const (
+	// MediaTypeProtobuf is the media type of the SenML protobuf encoding, which has no registered SenML media type
+	MediaTypeProtobuf = "application/x-protobuf"
+
+	// Headers with the paging metadata of non-JSON query responses. The links are given in the Link header.
+	HeaderCount = "X-Count"
+	HeaderTook  = "X-Took"
+
+	// HeaderDuplicates reports the duplicates policy of each series of a submission, and the number of records whose time was taken
+	HeaderDuplicates = "X-Duplicates"
+)
+
+// mediaTypeRecordSet is the default format of the query responses: a JSON RecordSet with the paging metadata
+const mediaTypeRecordSet = "application/json"
+
+// queryEncoder encodes the data of a query response
+type queryEncoder struct {
+	mediaType string
+	encode    codec.Encoder
+}
+
+func encodeCSVWithHeader(p senml.Pack, options ...codec.Option) ([]byte, error) {
+	return codec.EncodeCSV(p, append(options, codec.SetDefaultHeader)...)
+}
+
+// queryEncoders are the formats of the query responses, by accepted media type. The RecordSet has no encoder.
+var queryEncoders = map[string]queryEncoder{
+	"application/json":            {mediaType: mediaTypeRecordSet},
+	senml.MediaTypeSenmlJSON:      {senml.MediaTypeSenmlJSON, codec.EncodeJSON},
+	senml.MediaTypeSenmlCBOR:      {senml.MediaTypeSenmlCBOR, codec.EncodeCBOR},
+	"application/cbor":            {senml.MediaTypeSenmlCBOR, codec.EncodeCBOR},
+	senml.MediaTypeSenmlXML:       {senml.MediaTypeSenmlXML, codec.EncodeXML},
+	senml.MediaTypeCustomSenmlCSV: {senml.MediaTypeCustomSenmlCSV, encodeCSVWithHeader},
+	"text/csv":                    {"text/csv", encodeCSVWithHeader},
+	MediaTypeProtobuf:             {MediaTypeProtobuf, codec.EncodeProtobuf},
+	"application/protobuf":        {MediaTypeProtobuf, codec.EncodeProtobuf},
+}
+
+// getEncoderForAccept returns the format with the highest preference among those listed in the Accept header.
+// The other formats are only selected when they are listed explicitly: wildcards, unsupported types
+// (e.g. text/html of browsers) and malformed headers select the JSON RecordSet.
+func getEncoderForAccept(accept string) queryEncoder {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qValue, found := params["q"]; found {
+			q, err = strconv.ParseFloat(qValue, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mediaType, q})
+		}
+	}
+	// the specific types come before the wildcards of the same quality
+	sort.SliceStable(ranges, func(i, j int) bool {
+		if ranges[i].q != ranges[j].q {
+			return ranges[i].q > ranges[j].q
+		}
+		return !strings.HasSuffix(ranges[i].mediaType, "/*") && strings.HasSuffix(ranges[j].mediaType, "/*")
+	})
+
+	for _, r := range ranges {
+		if strings.HasSuffix(r.mediaType, "/*") {
+			// preferred to the types listed with a lower quality
+			break
+		}
+		if enc, found := queryEncoders[r.mediaType]; found {
+			return enc
+		}
+	}
+	return queryEncoders[mediaTypeRecordSet]
+}
+
+// setPagingHeaders sets the paging metadata of a RecordSet as response headers
+func setPagingHeaders(header http.Header, recordSet RecordSet) {
+	links := []string{fmt.Sprintf("<%s>; rel=\"self\"", recordSet.SelfLink)}
+	if recordSet.NextLink != "" {
+		links = append(links, fmt.Sprintf("<%s>; rel=\"next\"", recordSet.NextLink))
+	}
+	header.Set("Link", strings.Join(links, ", "))
+	if recordSet.Count != nil {
+		header.Set(HeaderCount, strconv.Itoa(*recordSet.Count))
+	}
+	header.Set(HeaderTook, strconv.FormatFloat(recordSet.TimeTook, 'f', -1, 64))
+}
+
+// streamFormat describes how the packs of a streamed query are written as a single document
+type streamFormat struct {
+	mediaType string
+	// begin, separator and end are written around and between the encoded packs
+	begin, separator, end []byte
+	// encodeRecords encodes the records of a pack without the enclosing container
+	encodeRecords func(p senml.Pack) ([]byte, error)
+}
+
+// streamFormats are the formats of the streamed query responses, by the media type of the negotiated encoder
+var streamFormats = map[string]streamFormat{
+	mediaTypeRecordSet:       senmlJSONStream,
+	senml.MediaTypeSenmlJSON: senmlJSONStream,
+	senml.MediaTypeSenmlCBOR: {
+		mediaType: senml.MediaTypeSenmlCBOR,
+		// indefinite-length array
+		begin: []byte{0x9f},
+		end:   []byte{0xff},
+		encodeRecords: func(p senml.Pack) ([]byte, error) {
+			b, err := codec.EncodeCBOR(p)
+			if err != nil {
+				return nil, err
+			}
+			return b[cborArrayHeaderLength(len(p)):], nil
+		},
+	},
+	senml.MediaTypeSenmlXML: {
+		mediaType: senml.MediaTypeSenmlXML,
+		begin:     []byte(`<sensml xmlns="urn:ietf:params:xml:ns:senml">`),
+		end:       []byte(`</sensml>`),
+		encodeRecords: func(p senml.Pack) ([]byte, error) {
+			// each record is marshalled as a senml element
+			return xml.Marshal(p)
+		},
+	},
+	senml.MediaTypeCustomSenmlCSV: csvStream(senml.MediaTypeCustomSenmlCSV),
+	"text/csv":                    csvStream("text/csv"),
+	MediaTypeProtobuf: {
+		mediaType: MediaTypeProtobuf,
+		// concatenated messages are merged, so the records add up to a single pack
+		encodeRecords: func(p senml.Pack) ([]byte, error) {
+			return codec.EncodeProtobuf(p)
+		},
+	},
+}
+
+var senmlJSONStream = streamFormat{
+	mediaType: senml.MediaTypeSenmlJSON,
+	begin:     []byte("["),
+	separator: []byte(","),
+	end:       []byte("]"),
+	encodeRecords: func(p senml.Pack) ([]byte, error) {
+		b, err := codec.EncodeJSON(p)
+		if err != nil {
+			return nil, err
+		}
+		return b[1 : len(b)-1], nil
+	},
+}
+
+func csvStream(mediaType string) streamFormat {
+	return streamFormat{
+		mediaType: mediaType,
+		begin:     []byte(codec.DefaultCSVHeader + "\n"),
+		encodeRecords: func(p senml.Pack) ([]byte, error) {
+			return codec.EncodeCSV(p)
+		},
+	}
+}
+
+// cborArrayHeaderLength returns the length of the header of a definite-length CBOR array with n items
+func cborArrayHeaderLength(n int) int {
+	switch {
+	case n < 24:
+		return 1
+	case n <= math.MaxUint8:
+		return 2
+	case n <= math.MaxUint16:
+		return 3
+	case n <= math.MaxUint32:
+		return 5
+	}
+	return 9
+}
@@ -0,0 +1,212 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
+	"github.com/gorilla/mux"
+	"github.com/linksmart/historical-datastore/common"
+	"golang.org/x/net/websocket"
+)
+
+// interval of comments sent on idle event streams to keep the connection open
+const streamKeepAliveInterval = 30 * time.Second
+
+// Stream is a handler for live subscriptions over HTTP.
+// The submitted data is pushed as Server-Sent Events or, if the client asks to upgrade the connection, as WebSocket messages.
+// Expected parameters: id(s)
+func (api *API) Stream(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	ids := strings.Split(params["id"], common.IDSeparator)
+
+	packs, unsubscribe, err := api.c.SubscribeBuffered(ids...)
+	if err != nil {
+		common.HttpErrorResponse(err, w)
+		return
+	}
+	defer unsubscribe()
+
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		api.streamWebSocket(w, r, packs)
+		return
+	}
+	api.streamEvents(w, r, packs)
+}
+
+// streamEvents sends each pack as an event with SenML JSON data
+func (api *API) streamEvents(w http.ResponseWriter, r *http.Request, packs <-chan senml.Pack) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		common.HttpErrorResponse(&common.InternalError{S: "streaming is not supported by the connection"}, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case pack, ok := <-packs:
+			if !ok {
+				log.Printf("channel closed: streams: %s", mux.Vars(r)["id"])
+				return
+			}
+			b, err := codec.EncodeJSON(pack)
+			if err != nil {
+				log.Printf("Error encoding the streamed pack: %s", err)
+				return
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// streamWebSocket upgrades the connection and sends each pack as a text message with SenML JSON
+func (api *API) streamWebSocket(w http.ResponseWriter, r *http.Request, packs <-chan senml.Pack) {
+	server := websocket.Server{
+		// browsers do not apply the same-origin policy to WebSockets
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			return api.checkOrigin(r)
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			// messages from the client are ignored, reading only detects closed connections
+			closed := make(chan struct{})
+			go func() {
+				defer close(closed)
+				var msg []byte
+				for {
+					if err := websocket.Message.Receive(ws, &msg); err != nil {
+						return
+					}
+				}
+			}()
+
+			for {
+				select {
+				case <-closed:
+					return
+				case pack, ok := <-packs:
+					if !ok {
+						log.Printf("channel closed: streams: %s", mux.Vars(r)["id"])
+						return
+					}
+					b, err := codec.EncodeJSON(pack)
+					if err != nil {
+						log.Printf("Error encoding the streamed pack: %s", err)
+						return
+					}
+					if err := websocket.Message.Send(ws, string(b)); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	server.ServeHTTP(w, r)
+}
+
+// checkOrigin checks that the origin of a WebSocket request is that of the service or an allowed one
+func (api *API) checkOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return nil
+	}
+	for _, allowed := range api.allowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin not allowed: %s", origin)
+}
+
+// queryStream writes the results of a query with chunked transfer encoding, as they are read from the storage.
+// The packs are written as a single document of the negotiated format. If the query fails after the response has started,
+// the connection is aborted so that the client does not mistake the partial response for a complete one.
+func (api *API) queryStream(w http.ResponseWriter, r *http.Request, q Query, ids []string, encoder queryEncoder) {
+	format := streamFormats[encoder.mediaType]
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		common.HttpErrorResponse(&common.InternalError{S: "streaming is not supported by the connection"}, w)
+		return
+	}
+
+	started := false
+	start := func() error {
+		started = true
+		w.Header().Set("Content-Type", format.mediaType)
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(format.begin)
+		return err
+	}
+	var sendFunc sendFunction = func(pack senml.Pack) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		b, err := format.encodeRecords(pack)
+		if err != nil {
+			return fmt.Errorf("error encoding the streamed pack: %w", err)
+		}
+		if !started {
+			err = start()
+		} else {
+			_, err = w.Write(format.separator)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	queryErr := api.c.QueryStream(r.Context(), q, ids, sendFunc)
+	if r.Context().Err() != nil {
+		// client has disconnected
+		return
+	}
+	if queryErr != nil {
+		if !started {
+			common.HttpErrorResponse(queryErr, w)
+			return
+		}
+		log.Printf("Error streaming the query results: %s", queryErr)
+		panic(http.ErrAbortHandler)
+	}
+	if !started {
+		if err := start(); err != nil {
+			return
+		}
+	}
+	w.Write(format.end)
+}
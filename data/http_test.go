@@ -3,6 +3,7 @@
 package data
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
@@ -17,8 +18,11 @@ import (
 	"time"
 
 	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
 	"github.com/linksmart/historical-datastore/common"
 	"github.com/linksmart/service-catalog/v2/utils"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/net/websocket"
 
 	"github.com/gorilla/mux"
 	"github.com/linksmart/historical-datastore/registry"
@@ -32,17 +36,15 @@ func setupHTTPAPI() (*mux.Router, []string) {
 	dss := []registry.TimeSeries{
 		{
 			Name: "http://example.com/sensor1",
-			Unit: "degC",
+			Unit: "Cel",
 			Type: registry.Float,
 		},
 		{
 			Name: "http://example.com/sensor2",
-			Unit: "flag",
 			Type: registry.Bool,
 		},
 		{
 			Name: "http://example.com/sensor3",
-			Unit: "char",
 			Type: registry.String,
 		},
 	}
@@ -59,6 +61,8 @@ func setupHTTPAPI() (*mux.Router, []string) {
 	api := NewAPI(*controller)
 
 	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
+	r.Methods("GET").Path("/data/{id:.+}/latest").HandlerFunc(api.Latest)
+	r.Methods("GET").Path("/data/{id:.+}/stream").HandlerFunc(api.Stream)
 	r.Methods("POST").Path("/data/{id:.+}").HandlerFunc(api.Submit)
 	r.Methods("GET").Path("/data/{id:.+}").HandlerFunc(api.Query)
 	r.Methods("DELETE").Path("/data/{id:.+}").HandlerFunc(api.Delete)
@@ -73,19 +77,17 @@ func TestHttpSubmit(t *testing.T) {
 	v1 := 42.0
 	r1 := senml.Record{
 		Name:  "example.com/sensor1",
-		Unit:  "degC",
+		Unit:  "Cel",
 		Value: &v1,
 	}
 	v2 := true
 	r2 := senml.Record{
 		Name:      "example.com/sensor2",
-		Unit:      "flag",
 		BoolValue: &v2,
 	}
 	v3 := "test string"
 	r3 := senml.Record{
 		Name:        "example.com/sensor3",
-		Unit:        "char",
 		StringValue: v3,
 	}
 
@@ -201,6 +203,578 @@ func TestHttpQuery(t *testing.T) {
 	//t.Error("TODO: check response body")
 }
 
+func TestHttpQuery_Formats(t *testing.T) {
+	funcName := "TestHttpQuery_Formats"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer disconnectFunc()
+
+	ts := registry.TimeSeries{Name: "http://example.com/formats", Type: registry.Float, Unit: "Cel"}
+	if _, err := regController.Add(ts); err != nil {
+		t.Fatal(err)
+	}
+	value := 22.5
+	sent := senml.Pack{
+		{Name: ts.Name, Unit: ts.Unit, Time: 1543059346, Value: &value},
+		{Name: ts.Name, Unit: ts.Unit, Time: 1543059347, Value: &value},
+		{Name: ts.Name, Unit: ts.Unit, Time: 1543059348, Value: &value},
+	}
+	_, err = dataStorage.Submit(context.Background(), map[string]senml.Pack{ts.Name: sent}, map[string]*registry.TimeSeries{ts.Name: &ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := NewController(regController, dataStorage, false)
+	router := mux.NewRouter().SkipClean(true)
+	router.Methods("GET").Path("/data/{id:.+}").HandlerFunc(NewAPI(*controller).Query)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	query := fmt.Sprintf("%s/data/%s?%s=2&%s=true", server.URL, ts.Name, common.ParamPerPage, common.ParamCount)
+	get := func(accept string) (*http.Response, []byte) {
+		req, err := http.NewRequest(http.MethodGet, query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res, b
+	}
+
+	// the default is the JSON record set
+	res, b := get("")
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, res.StatusCode, b)
+	}
+	var recordSet RecordSet
+	if err := json.Unmarshal(b, &recordSet); err != nil {
+		t.Fatal(err)
+	}
+	if len(recordSet.Data) != 2 || recordSet.NextLink == "" || recordSet.Count == nil || *recordSet.Count != 3 {
+		t.Fatalf("Unexpected record set: %s", b)
+	}
+
+	// the next page continues after the cursor
+	if !strings.Contains(recordSet.NextLink, common.ParamCursor+"=") {
+		t.Fatalf("Expected a cursor in the next link, got %s", recordSet.NextLink)
+	}
+	res, err = http.Get(server.URL + recordSet.NextLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nextPage RecordSet
+	err = json.NewDecoder(res.Body).Decode(&nextPage)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nextPage.Data) != 1 || !CompareRecords(nextPage.Data[0], sent[0]) || nextPage.NextLink != "" {
+		t.Fatalf("Unexpected next page: %v", nextPage)
+	}
+
+	formats := map[string]string{
+		"application/senml+cbor":           senml.MediaTypeSenmlCBOR,
+		"application/senml+xml":            senml.MediaTypeSenmlXML,
+		"text/csv":                         "text/csv",
+		"application/x-protobuf":           MediaTypeProtobuf,
+		"image/png, application/cbor":      senml.MediaTypeSenmlCBOR,
+		"application/json;q=0.5, text/csv": "text/csv",
+		"*/*;q=0.8, text/csv":              "text/csv",
+	}
+	decoders := map[string]codec.Decoder{
+		senml.MediaTypeSenmlCBOR: codec.DecodeCBOR,
+		senml.MediaTypeSenmlXML:  codec.DecodeXML,
+		"text/csv": func(b []byte, options ...codec.Option) (senml.Pack, error) {
+			return codec.DecodeCSV(b, codec.SetDefaultHeader)
+		},
+		MediaTypeProtobuf: codec.DecodeProtobuf,
+	}
+	for accept, expected := range formats {
+		res, b := get(accept)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Accept %s: expected status %d, got %d: %s", accept, http.StatusOK, res.StatusCode, b)
+		}
+		if contentType := res.Header.Get("Content-Type"); contentType != expected {
+			t.Fatalf("Accept %s: expected Content-Type %s, got %s", accept, expected, contentType)
+		}
+		pack, err := decoders[expected](b)
+		if err != nil {
+			t.Fatalf("Accept %s: error decoding the response: %s", accept, err)
+		}
+		pack.Normalize()
+		// sorted in descending order by default
+		if len(pack) != 2 || !CompareRecords(pack[0], sent[2]) || !CompareRecords(pack[1], sent[1]) {
+			t.Fatalf("Accept %s: unexpected records: %v", accept, pack)
+		}
+		if link := res.Header.Get("Link"); !strings.Contains(link, `rel="self"`) || !strings.Contains(link, `rel="next"`) {
+			t.Fatalf("Accept %s: expected self and next links, got %s", accept, link)
+		}
+		if count := res.Header.Get(HeaderCount); count != "3" {
+			t.Fatalf("Accept %s: expected count 3, got %s", accept, count)
+		}
+		if res.Header.Get(HeaderTook) == "" {
+			t.Fatalf("Accept %s: expected the %s header", accept, HeaderTook)
+		}
+	}
+
+	// browsers and clients which list no SenML type get the record set
+	for _, accept := range []string{
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+		"text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8",
+		"text/html",
+		"text/plain",
+		"text/*",
+		"*/*;q=0.9, text/csv;q=0.5",
+	} {
+		res, b = get(accept)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Accept %s: expected status %d, got %d: %s", accept, http.StatusOK, res.StatusCode, b)
+		}
+		var recordSet RecordSet
+		if err := json.Unmarshal(b, &recordSet); err != nil || len(recordSet.Data) != 2 {
+			t.Fatalf("Accept %s: expected the record set, got %s", accept, b)
+		}
+	}
+}
+
+func TestHttpQuery_Stream(t *testing.T) {
+	funcName := "TestHttpQuery_Stream"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer disconnectFunc()
+
+	ts := registry.TimeSeries{Name: "http://example.com/streamed", Type: registry.Float, Unit: "Cel"}
+	if _, err := regController.Add(ts); err != nil {
+		t.Fatal(err)
+	}
+	var sent senml.Pack
+	for i := 0; i < 5; i++ {
+		value := float64(i)
+		sent = append(sent, senml.Record{Name: ts.Name, Unit: ts.Unit, Time: 1543059346 + float64(i), Value: &value})
+	}
+	_, err = dataStorage.Submit(context.Background(), map[string]senml.Pack{ts.Name: sent}, map[string]*registry.TimeSeries{ts.Name: &ts})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller := NewController(regController, dataStorage, false)
+	api := NewAPI(*controller)
+	router := mux.NewRouter().SkipClean(true)
+	router.Methods("GET").Path("/data/{id:.+}").HandlerFunc(api.Query)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	// packs of 2 records, limited to 4 records
+	query := fmt.Sprintf("%s/data/%s?%s=true&%s=4&%s=2&%s=%s", server.URL, ts.Name,
+		common.ParamStream, common.ParamLimit, common.ParamPerPage, common.ParamSort, common.Asc)
+	decoders := map[string]codec.Decoder{
+		senml.MediaTypeSenmlJSON: codec.DecodeJSON,
+		senml.MediaTypeSenmlCBOR: codec.DecodeCBOR,
+		senml.MediaTypeSenmlXML:  codec.DecodeXML,
+		"text/csv": func(b []byte, options ...codec.Option) (senml.Pack, error) {
+			return codec.DecodeCSV(b, codec.SetDefaultHeader)
+		},
+		MediaTypeProtobuf: codec.DecodeProtobuf,
+	}
+	formats := map[string]string{
+		"":                       senml.MediaTypeSenmlJSON,
+		"application/senml+cbor": senml.MediaTypeSenmlCBOR,
+		"application/senml+xml":  senml.MediaTypeSenmlXML,
+		"text/csv":               "text/csv",
+		"application/x-protobuf": MediaTypeProtobuf,
+	}
+	for accept, expected := range formats {
+		req, err := http.NewRequest(http.MethodGet, query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Accept %s: expected status %d, got %d: %s", accept, http.StatusOK, res.StatusCode, b)
+		}
+		if contentType := res.Header.Get("Content-Type"); contentType != expected {
+			t.Fatalf("Accept %s: expected Content-Type %s, got %s", accept, expected, contentType)
+		}
+		if len(res.TransferEncoding) == 0 || res.TransferEncoding[0] != "chunked" {
+			t.Fatalf("Accept %s: expected chunked transfer encoding, got %v", accept, res.TransferEncoding)
+		}
+		pack, err := decoders[expected](b)
+		if err != nil {
+			t.Fatalf("Accept %s: error decoding the response: %s\n%s", accept, err, b)
+		}
+		pack.Normalize()
+		if len(pack) != 4 {
+			t.Fatalf("Accept %s: expected 4 records, got %d: %s", accept, len(pack), b)
+		}
+		for i := range pack {
+			if !CompareRecords(pack[i], sent[i]) {
+				t.Fatalf("Accept %s: expected %v, got %v", accept, sent[i], pack[i])
+			}
+		}
+	}
+
+	// errors before the first pack are reported as usual
+	res, err := http.Get(fmt.Sprintf("%s/data/nonexistent?%s=true", server.URL, common.ParamStream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected status %d, got %d", http.StatusNotFound, res.StatusCode)
+	}
+
+	// nothing is written after the client has gone
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodGet, query, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Body.Len() != 0 {
+		t.Fatalf("Expected no response for a cancelled request, got: %s", w.Body.String())
+	}
+}
+
+func TestGetFormFromQuery_AggrFunc(t *testing.T) {
+	form := getFormFromQuery(Query{AggrFunc: "mean", AggrWindow: time.Hour})
+	if aggr := form.Get(common.ParamAggr); aggr != "mean" {
+		t.Errorf("Expected the deprecated aggregation function to be requested, got %q", aggr)
+	}
+	form = getFormFromQuery(Query{AggrFuncs: []string{"min", "max"}, AggrFunc: "mean", AggrWindow: time.Hour})
+	if aggr := form.Get(common.ParamAggr); aggr != "min,max" {
+		t.Errorf("Expected the aggregation functions to take precedence, got %q", aggr)
+	}
+}
+
+func TestHttpLatest(t *testing.T) {
+	router, testIDs := setupHTTPAPI()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	all := strings.Join(testIDs, ",")
+	res, err := http.Get(ts.URL + "/data/" + all + "/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	defer res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server response is not %v but %v. \nResponse body:%s", http.StatusOK, res.StatusCode, string(b))
+	}
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/senml+json" {
+		t.Errorf("Expected Content-Type application/senml+json, got %s", contentType)
+	}
+
+	// unknown series
+	res, err = http.Get(ts.URL + "/data/" + testIDs[0] + ",http://example.com/unknown/latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("Server response is not %v but %v", http.StatusNotFound, res.StatusCode)
+	}
+}
+
+func TestHttpStream(t *testing.T) {
+	router, testIDs := setupHTTPAPI()
+	ts := httptest.NewServer(router)
+	defer ts.Close()
+
+	v1 := 42.0
+	submitted := senml.Pack{{Name: testIDs[0], Unit: "Cel", Value: &v1, Time: 1543059346.0}}
+	b, _ := json.Marshal(submitted)
+	submit := func(t *testing.T) {
+		res, err := http.Post(ts.URL+"/data/"+testIDs[0], "application/senml+json", bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatalf("Server response is not %v but %v", http.StatusNoContent, res.StatusCode)
+		}
+	}
+	all := strings.Join(testIDs, ",")
+
+	t.Run("Server-Sent Events", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/data/"+all+"/stream", nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("Server response is not %v but %v", http.StatusOK, res.StatusCode)
+		}
+		if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+			t.Fatalf("Expected Content-Type text/event-stream, got %s", contentType)
+		}
+
+		submit(t)
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			pack, err := codec.DecodeJSON([]byte(strings.TrimPrefix(line, "data: ")))
+			if err != nil {
+				t.Fatalf("Error decoding event data: %s", err)
+			}
+			if len(pack) != 1 || !CompareRecords(submitted[0], pack[0]) {
+				t.Fatalf("Expected %v, got %v", submitted, pack)
+			}
+			return
+		}
+		t.Fatalf("Stream ended without data: %v", scanner.Err())
+	})
+
+	t.Run("WebSocket", func(t *testing.T) {
+		ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/data/"+all+"/stream", "", ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+
+		submit(t)
+
+		ws.SetReadDeadline(time.Now().Add(10 * time.Second))
+		var msg string
+		err = websocket.Message.Receive(ws, &msg)
+		if err != nil {
+			t.Fatalf("Error receiving message: %s", err)
+		}
+		pack, err := codec.DecodeJSON([]byte(msg))
+		if err != nil {
+			t.Fatalf("Error decoding message: %s", err)
+		}
+		if len(pack) != 1 || !CompareRecords(submitted[0], pack[0]) {
+			t.Fatalf("Expected %v, got %v", submitted, pack)
+		}
+	})
+
+	t.Run("WebSocket from another origin", func(t *testing.T) {
+		ws, err := websocket.Dial(strings.Replace(ts.URL, "http://", "ws://", 1)+"/data/"+all+"/stream", "", "http://attacker.example.com")
+		if err == nil {
+			ws.Close()
+			t.Fatal("Expected the WebSocket of another origin to be refused")
+		}
+	})
+
+	t.Run("unknown series", func(t *testing.T) {
+		res, err := http.Get(ts.URL + "/data/http://example.com/unknown/stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Fatalf("Server response is not %v but %v", http.StatusNotFound, res.StatusCode)
+		}
+	})
+}
+
+func TestAPI_checkOrigin(t *testing.T) {
+	api := &API{}
+	api.AllowOrigins([]string{"https://dashboard.example.com/"})
+	cases := map[string]bool{
+		"":                               true,
+		"http://hds.example.com:8085":    true,
+		"https://dashboard.example.com":  true,
+		"https://attacker.example.com":   false,
+		"http://hds.example.com.evil.io": false,
+	}
+	for origin, allowed := range cases {
+		r := httptest.NewRequest(http.MethodGet, "http://hds.example.com:8085/data/a/stream", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if err := api.checkOrigin(r); (err == nil) != allowed {
+			t.Errorf("Expected origin %q to be allowed: %v, got %v", origin, allowed, err)
+		}
+	}
+	api.AllowOrigins([]string{"*"})
+	r := httptest.NewRequest(http.MethodGet, "http://hds.example.com:8085/data/a/stream", nil)
+	r.Header.Set("Origin", "https://attacker.example.com")
+	if err := api.checkOrigin(r); err != nil {
+		t.Errorf("Expected all origins to be allowed, got %s", err)
+	}
+}
+
+func TestController_SubscribeBuffered(t *testing.T) {
+	regController := registry.NewController(registry.NewMemoryStorage(common.RegConf{}))
+	_, err := regController.Add(registry.TimeSeries{Name: "sensor1", Type: registry.Float})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := NewController(*regController, &dummyDataStorage{}, false)
+
+	subscribersBefore := testutil.ToFloat64(subscribers)
+	overflowsBefore := testutil.ToFloat64(subscriptionOverflows)
+	packs, unsubscribe, subErr := controller.SubscribeBuffered("sensor1")
+	if subErr != nil {
+		t.Fatal(subErr)
+	}
+	defer unsubscribe()
+	if got := testutil.ToFloat64(subscribers); got != subscribersBefore+1 {
+		t.Fatalf("Expected %v subscribers, got %v", subscribersBefore+1, got)
+	}
+
+	// a client which does not read is unsubscribed when its buffer overflows
+	for i := 0; i <= SubscriptionBufferSize; i++ {
+		controller.pubSub.Pub(senml.Pack{{Name: "sensor1"}}, "sensor1")
+	}
+	// the last pack is delivered after it is published, and the buffer must not be read until then
+	timeout := time.After(10 * time.Second)
+	for testutil.ToFloat64(subscriptionOverflows) == overflowsBefore {
+		select {
+		case <-timeout:
+			t.Fatal("Buffer did not overflow")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	received := 0
+	for {
+		select {
+		case _, ok := <-packs:
+			if !ok {
+				if received != SubscriptionBufferSize {
+					t.Fatalf("Expected %d buffered packs, got %d", SubscriptionBufferSize, received)
+				}
+				// the overflow unsubscribes only once, regardless of the deferred unsubscribe
+				unsubscribe()
+				if got := testutil.ToFloat64(subscribers); got != subscribersBefore {
+					t.Fatalf("Expected %v subscribers after the overflow, got %v", subscribersBefore, got)
+				}
+				if got := testutil.ToFloat64(subscriptionOverflows); got != overflowsBefore+1 {
+					t.Fatalf("Expected %v overflows, got %v", overflowsBefore+1, got)
+				}
+				return
+			}
+			received++
+		case <-timeout:
+			t.Fatal("Subscription was not closed after the buffer overflow")
+		}
+	}
+}
+
+func TestController_SubscribeBuffered_Publishing(t *testing.T) {
+	regController := registry.NewController(registry.NewMemoryStorage(common.RegConf{}))
+	_, err := regController.Add(registry.TimeSeries{Name: "sensor1", Type: registry.Float})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := NewController(*regController, &dummyDataStorage{}, false)
+
+	// subscribers which do not read overflow while the submissions go on
+	const subscribers, publishers = 20, 4
+	var subscriptions []<-chan senml.Pack
+	for i := 0; i < subscribers; i++ {
+		packs, unsubscribe, subErr := controller.SubscribeBuffered("sensor1")
+		if subErr != nil {
+			t.Fatal(subErr)
+		}
+		defer unsubscribe()
+		subscriptions = append(subscriptions, packs)
+	}
+	done := make(chan common.Error, publishers)
+	for p := 0; p < publishers; p++ {
+		go func() {
+			for i := 0; i < 2*SubscriptionBufferSize; i++ {
+				value := float64(i)
+				_, err := controller.Submit(context.Background(), senml.Pack{{Name: "sensor1", Value: &value, Time: float64(i + 1)}}, nil)
+				if err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+	}
+	timeout := time.After(10 * time.Second)
+	for p := 0; p < publishers; p++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-timeout:
+			t.Fatal("Submissions were blocked by the overflowing subscribers")
+		}
+	}
+
+	for _, packs := range subscriptions {
+		received := 0
+		for range packs {
+			received++
+		}
+		if received != SubscriptionBufferSize {
+			t.Fatalf("Expected %d buffered packs, got %d", SubscriptionBufferSize, received)
+		}
+	}
+}
+
+func TestController_SubmitUnregistered(t *testing.T) {
+	regController := registry.NewController(registry.NewMemoryStorage(common.RegConf{}))
+	value := 21.5
+	pack := senml.Pack{{Name: "kitchen/temp", Unit: "Cel", Value: &value, Time: 1543059346}}
+
+	// series which are not registered are not found, unless they are registered automatically
+	controller := NewController(*regController, &dummyDataStorage{}, false)
+	_, err := controller.Submit(context.Background(), pack, nil)
+	if _, notFound := err.(*common.NotFoundError); !notFound {
+		t.Fatalf("Expected a not found error, got %v", err)
+	}
+	if _, err := regController.Get("kitchen/temp"); err == nil {
+		t.Fatal("Expected the series not to be registered")
+	}
+
+	controller = NewController(*regController, &dummyDataStorage{}, true)
+	if _, err := controller.Submit(context.Background(), pack, nil); err != nil {
+		t.Fatal(err)
+	}
+	ts, getErr := regController.Get("kitchen/temp")
+	if getErr != nil {
+		t.Fatalf("Expected the series to be registered, got %v", getErr)
+	}
+	if ts.Type != registry.Float || ts.Unit != "Cel" {
+		t.Fatalf("Unexpected registered series: %+v", ts)
+	}
+}
+
 func TestAPI_Delete(t *testing.T) {
 	router, testIDs := setupHTTPAPI()
 	ts := httptest.NewServer(router)
@@ -225,8 +799,8 @@ func TestAPI_Delete(t *testing.T) {
 
 type dummyDataStorage struct{}
 
-func (s *dummyDataStorage) Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) error {
-	return nil
+func (s *dummyDataStorage) Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) (map[string]Duplicates, error) {
+	return nil, nil
 }
 func (s *dummyDataStorage) QueryPage(ctx context.Context, q Query, series ...*registry.TimeSeries) (pack senml.Pack, total *int, err error) {
 	return senml.Pack{}, nil, nil
@@ -240,20 +814,27 @@ func (s *dummyDataStorage) Count(ctx context.Context, q Query, series ...*regist
 	return 0, nil
 }
 
+func (s *dummyDataStorage) Latest(ctx context.Context, series ...*registry.TimeSeries) (senml.Pack, error) {
+	return senml.Pack{}, nil
+}
+
 func (s *dummyDataStorage) Delete(ctx context.Context, series []*registry.TimeSeries, from time.Time, to time.Time) (err error) {
 	return nil
 }
-func (s *dummyDataStorage) Disconnect() error {
+func (s *dummyDataStorage) Start(reg registry.Controller) error {
 	return nil
 }
-func (s *dummyDataStorage) CreateHandler(ts registry.TimeSeries) error {
+func (s *dummyDataStorage) Disconnect() error {
 	return nil
 }
-func (s *dummyDataStorage) UpdateHandler(old registry.TimeSeries, new registry.TimeSeries) error {
-	return nil
+func (s *dummyDataStorage) CreateHandler(ts registry.TimeSeries) (registry.Transaction, error) {
+	return nil, nil
 }
-func (s *dummyDataStorage) DeleteHandler(ts registry.TimeSeries) error {
-	return nil
+func (s *dummyDataStorage) UpdateHandler(old registry.TimeSeries, new registry.TimeSeries) (registry.Transaction, error) {
+	return nil, nil
+}
+func (s *dummyDataStorage) DeleteHandler(ts registry.TimeSeries) (registry.Transaction, error) {
+	return nil, nil
 }
 
 func httpDoRequest(method, url string, r *bytes.Reader) (*http.Response, error) {
@@ -0,0 +1,92 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"sync"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// latestLoader retrieves the most recent record of a series from the database. It returns nil if the series has no data
+type latestLoader func(ctx context.Context, ts registry.TimeSeries) (*senml.Record, error)
+
+// latestCache keeps the most recent record of each series in memory
+type latestCache struct {
+	sync.RWMutex
+	// records by series name. A nil record means that the series has no data
+	records map[string]*senml.Record
+	load    latestLoader
+	// incremented on every modification. Loaded records are only cached if nothing changed in the meantime
+	version uint64
+}
+
+func newLatestCache(load latestLoader) *latestCache {
+	return &latestCache{
+		records: make(map[string]*senml.Record),
+		load:    load,
+	}
+}
+
+// get returns the most recent record of a series, loading it from the database if it is not cached
+func (c *latestCache) get(ctx context.Context, ts registry.TimeSeries) (*senml.Record, error) {
+	c.RLock()
+	r, found := c.records[ts.Name]
+	version := c.version
+	c.RUnlock()
+	if found {
+		return r, nil
+	}
+
+	r, err := c.load(ctx, ts)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.version == version {
+		c.records[ts.Name] = r
+	}
+	return r, nil
+}
+
+// update replaces the cached records by newer ones from the submitted data
+func (c *latestCache) update(data map[string]senml.Pack) {
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	for name, pack := range data {
+		cached, found := c.records[name]
+		if !found {
+			// unknown state, loaded from the database when requested
+			continue
+		}
+		for i := range pack {
+			if cached == nil || pack[i].Time >= cached.Time {
+				r := pack[i]
+				cached = &r
+			}
+		}
+		c.records[name] = cached
+	}
+}
+
+// invalidate removes a series from the cache so that its most recent record is loaded again when requested
+func (c *latestCache) invalidate(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	delete(c.records, name)
+}
+
+// invalidateBetween removes a series from the cache if its most recent record lies within the given time range
+func (c *latestCache) invalidateBetween(name string, from, to float64) {
+	c.Lock()
+	defer c.Unlock()
+	c.version++
+	if r, found := c.records[name]; found && r != nil && r.Time >= from && r.Time <= to {
+		delete(c.records, name)
+	}
+}
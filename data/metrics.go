@@ -0,0 +1,80 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics of the Data API
+var (
+	mqttMessages = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hds",
+		Subsystem: "mqtt",
+		Name:      "messages_total",
+		Help:      "Number of MQTT messages received per broker and topic, by result (accepted or rejected).",
+	}, []string{"broker", "topic", "result"})
+
+	storageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hds",
+		Subsystem: "storage",
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of the data storage operations (submit, query_page, query_stream, count).",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	queueRecords = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "hds",
+		Subsystem: "queue",
+		Name:      "records",
+		Help:      "Number of submitted records waiting in the ingestion queue, in memory or spilled to the file.",
+	}, []string{"location"})
+
+	queueRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "hds",
+		Subsystem: "queue",
+		Name:      "rejections_total",
+		Help:      "Number of submissions rejected or dropped because the ingestion queue was full.",
+	})
+
+	subscribers = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "hds",
+		Subsystem: "pubsub",
+		Name:      "subscribers",
+		Help:      "Number of active subscriptions to the submitted data.",
+	})
+
+	subscriptionOverflows = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "hds",
+		Subsystem: "pubsub",
+		Name:      "overflows_total",
+		Help:      "Number of subscriptions dropped because the subscriber could not keep up with the data.",
+	})
+)
+
+const (
+	mqttAccepted = "accepted"
+	mqttRejected = "rejected"
+)
+
+// observeDuration records the time elapsed since start. Usage: defer observeDuration("submit", time.Now())
+func observeDuration(operation string, start time.Time) {
+	storageDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// MetricsCollector returns a collector of the pending MQTT registrations, which are retried in the background
+func (c *MQTTConnector) MetricsCollector() prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "hds",
+		Subsystem: "mqtt",
+		Name:      "failed_registrations",
+		Help:      "Number of MQTT subscriptions which failed and are pending a retry.",
+	}, func() float64 {
+		c.Lock()
+		defer c.Unlock()
+		return float64(len(c.failedRegistrations))
+	})
+}
@@ -11,12 +11,13 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	paho "github.com/eclipse/paho.mqtt.golang"
 	"github.com/farshidtz/senml/v2"
-	"github.com/farshidtz/senml/v2/codec"
 	"github.com/linksmart/historical-datastore/registry"
 )
 
@@ -30,10 +31,13 @@ type MQTTConnector struct {
 	storage  Storage
 	clientID string
 	managers map[string]*Manager
-	// cache of resource->ts
-	cache map[string]*registry.TimeSeries
+	// cache of resource->ts, used by the message handlers which may run concurrently
+	cache      map[string]*registry.TimeSeries
+	cacheMutex sync.RWMutex
 	// failed mqtt registrations
-	failedRegistrations map[string]*registry.MQTTSource
+	failedRegistrations map[string]registry.TimeSeries
+	// deadLetters keeps the rejected messages, if set
+	deadLetters DeadLetterStore
 }
 
 type Manager struct {
@@ -49,16 +53,30 @@ type Subscription struct {
 	url       string
 	topic     string
 	qos       byte
-	receivers int
+	// series receiving the messages of the topic, whose sources set the format of the payload
+	series      map[string]registry.TimeSeries
+	seriesMutex sync.RWMutex
 }
 
-func NewMQTTConnector(storage Storage, clientID string) (*MQTTConnector, error) {
+func newSubscription(c *MQTTConnector, ts registry.TimeSeries) *Subscription {
+	return &Subscription{
+		connector: c,
+		url:       ts.Source.BrokerURL,
+		topic:     ts.Source.Topic,
+		qos:       ts.Source.QoS,
+		series:    map[string]registry.TimeSeries{ts.Name: ts},
+	}
+}
+
+// NewMQTTConnector returns a connector submitting the received data to the storage. The dead letters store is optional.
+func NewMQTTConnector(storage Storage, clientID string, deadLetters DeadLetterStore) (*MQTTConnector, error) {
 	c := &MQTTConnector{
 		storage:             storage,
+		deadLetters:         deadLetters,
 		clientID:            clientID,
 		managers:            make(map[string]*Manager),
 		cache:               make(map[string]*registry.TimeSeries),
-		failedRegistrations: make(map[string]*registry.MQTTSource),
+		failedRegistrations: make(map[string]registry.TimeSeries),
 	}
 	return c, nil
 }
@@ -75,10 +93,10 @@ func (c *MQTTConnector) Start(reg registry.Controller) error {
 
 		for _, ts := range series {
 			if ts.Source.SrcType == registry.Mqtt {
-				err := c.register(*ts.Source.MQTTSource)
+				err := c.register(ts)
 				if err != nil {
 					log.Printf("MQTT: Error registering subscription: %v. Retrying in %ds", err, mqttRetryInterval)
-					c.failedRegistrations[ts.Name] = ts.Source.MQTTSource
+					c.failedRegistrations[ts.Name] = ts
 				}
 			}
 		}
@@ -94,6 +112,8 @@ func (c *MQTTConnector) Start(reg registry.Controller) error {
 }
 
 func (c *MQTTConnector) flushCache() {
+	c.cacheMutex.Lock()
+	defer c.cacheMutex.Unlock()
 	c.cache = make(map[string]*registry.TimeSeries)
 }
 
@@ -101,8 +121,8 @@ func (c *MQTTConnector) retryRegistrations() {
 	for {
 		time.Sleep(mqttRetryInterval * time.Second)
 		c.Lock()
-		for id, mqttSource := range c.failedRegistrations {
-			err := c.register(*mqttSource)
+		for id, ts := range c.failedRegistrations {
+			err := c.register(ts)
 			if err != nil {
 				log.Printf("MQTT: Error registering subscription: %v. Retrying in %ds", err, mqttRetryInterval)
 				continue
@@ -113,7 +133,9 @@ func (c *MQTTConnector) retryRegistrations() {
 	}
 }
 
-func (c *MQTTConnector) register(source registry.MQTTSource) error {
+// register subscribes to the topic of the MQTT source of a series
+func (c *MQTTConnector) register(ts registry.TimeSeries) error {
+	source := *ts.Source.MQTTSource
 
 	if _, exists := c.managers[source.BrokerURL]; !exists { // NO CLIENT FOR THIS BROKER
 		manager := &Manager{
@@ -121,13 +143,7 @@ func (c *MQTTConnector) register(source registry.MQTTSource) error {
 			subscriptions: make(map[string]*Subscription),
 		}
 
-		manager.subscriptions[source.Topic] = &Subscription{
-			connector: c,
-			url:       source.BrokerURL,
-			topic:     source.Topic,
-			qos:       source.QoS,
-			receivers: 1,
-		}
+		manager.subscriptions[source.Topic] = newSubscription(c, ts)
 
 		opts := paho.NewClientOptions() // uses defaults: https://godoc.org/github.com/eclipse/paho.mqtt.golang#NewClientOptions
 		opts.AddBroker(source.BrokerURL)
@@ -145,6 +161,10 @@ func (c *MQTTConnector) register(source registry.MQTTSource) error {
 			return fmt.Errorf("MQTT: Error configuring TLS options for broker %v: %v", source.BrokerURL, err)
 		}
 		opts.SetTLSConfig(tlsConfig)
+		if _, queued := c.storage.(*IngestQueue); queued {
+			// the messages are handled concurrently, to be written in batches
+			opts.SetOrderMatters(false)
+		}
 
 		manager.client = paho.NewClient(opts)
 
@@ -158,13 +178,7 @@ func (c *MQTTConnector) register(source registry.MQTTSource) error {
 
 		// TODO: check if another wildcard subscription matches the topic.
 		if _, exists := manager.subscriptions[source.Topic]; !exists { // NO SUBSCRIPTION FOR THIS TOPIC
-			subscription := &Subscription{
-				connector: c,
-				url:       source.BrokerURL,
-				topic:     source.Topic,
-				qos:       source.QoS,
-				receivers: 1,
-			}
+			subscription := newSubscription(c, ts)
 			// Subscribe
 			if token := manager.client.Subscribe(subscription.topic, subscription.qos, subscription.onMessage); token.Wait() && token.Error() != nil {
 				return fmt.Errorf("MQTT: Error subscribing: %v", token.Error())
@@ -174,22 +188,31 @@ func (c *MQTTConnector) register(source registry.MQTTSource) error {
 
 		} else { // There is a subscription for this topic
 			//log.Printf("MQTT: %s: Already subscribed to %s", mqttConf.BrokerURL, mqttConf.Topic)
-			manager.subscriptions[source.Topic].receivers++
+			subscription := manager.subscriptions[source.Topic]
+			subscription.seriesMutex.Lock()
+			subscription.series[ts.Name] = ts
+			subscription.seriesMutex.Unlock()
 		}
 	}
 
 	return nil
 }
 
-func (c *MQTTConnector) unregister(mqttSource *registry.MQTTSource) error {
+// unregister removes a series from the subscription to the topic of its MQTT source, and unsubscribes if it was the last one
+func (c *MQTTConnector) unregister(ts registry.TimeSeries) error {
+	mqttSource := ts.Source.MQTTSource
 	manager := c.managers[mqttSource.BrokerURL]
 	// There may be no subscriptions due to a failed registration when HDS is restarted
-	if manager == nil {
+	if manager == nil || manager.subscriptions[mqttSource.Topic] == nil {
 		return nil
 	}
-	manager.subscriptions[mqttSource.Topic].receivers--
+	subscription := manager.subscriptions[mqttSource.Topic]
+	subscription.seriesMutex.Lock()
+	delete(subscription.series, ts.Name)
+	receivers := len(subscription.series)
+	subscription.seriesMutex.Unlock()
 
-	if manager.subscriptions[mqttSource.Topic].receivers == 0 {
+	if receivers == 0 {
 		// Unsubscribe
 		if token := manager.client.Unsubscribe(mqttSource.Topic); token.Wait() && token.Error() != nil {
 			return fmt.Errorf("MQTT: Error unsubscribing: %v", token.Error())
@@ -230,31 +253,63 @@ func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
 		log.Printf("%s %d %v %s", logHeader, code, time.Now().Sub(t1), fmt.Sprintf(format, v...))
 	}
 
-	senmlPack, err := codec.Decode(senml.MediaTypeSenmlJSON, msg.Payload())
-	if err != nil {
-		logMQTTError(http.StatusBadRequest, "Error parsing json: %s : %v", msg.Payload(), err)
+	// messages are rejected unless some data is stored
+	result := mqttRejected
+	defer func() {
+		mqttMessages.WithLabelValues(s.url, s.topic, result).Inc()
+	}()
+	senmlPack, contentType, decodeErrs := s.decode(msg.Payload(), t1)
+
+	// rejected messages are kept as dead letters, to be replayed
+	origin := DeadLetter{Arrival: t1, Source: DeadLetterMQTT, Broker: s.url, Topic: msg.Topic()}
+	reject := func(code int, format string, v ...interface{}) {
+		logMQTTError(code, format, v...)
+		letter := origin
+		letter.ContentType, letter.Payload, letter.Reason = contentType, msg.Payload(), fmt.Sprintf(format, v...)
+		if contentType != senml.MediaTypeSenmlJSON && contentType != senml.MediaTypeSenmlCBOR {
+			// the records mapped from other formats can be replayed
+			letter = senmlDeadLetter(letter, map[string]senml.Pack{"": senmlPack})
+		}
+		keepDeadLetter(s.connector.deadLetters, letter)
+	}
+
+	// the payload is kept once for each format which failed, while the records of the other formats are stored
+	for _, decodeErr := range decodeErrs {
+		logMQTTError(http.StatusBadRequest, "Error decoding the payload: %v", decodeErr.err)
+		letter := origin
+		letter.ContentType, letter.Payload, letter.Reason = decodeErr.contentType, msg.Payload(), "Error decoding the payload: "+decodeErr.err.Error()
+		keepDeadLetter(s.connector.deadLetters, letter)
+	}
+	if len(decodeErrs) != 0 && len(senmlPack) == 0 {
 		return
 	}
 
 	// Fill the data map with provided data points
-	senmlPack.Normalize()
+	var err error
 	data := make(map[string]senml.Pack)
 	series := make(map[string]*registry.TimeSeries)
+	// records of series which are not registered, kept as dead letter while the others are stored
+	unknown := make(map[string]senml.Pack)
 	for _, r := range senmlPack {
 		// Find the time series for this entry
+		s.connector.cacheMutex.RLock()
 		ts, exists := s.connector.cache[r.Name]
+		s.connector.cacheMutex.RUnlock()
 		if !exists {
 			ts, err = s.connector.registry.Get(r.Name)
 			if err != nil {
 				if errors.Is(err, registry.ErrNotFound) {
 					logMQTTError(http.StatusNotFound, "Warning: Resource not found: %v", r.Name)
-					continue
+				} else {
+					logMQTTError(http.StatusInternalServerError, "Error finding resource: %v", r.Name)
 				}
-				logMQTTError(http.StatusInternalServerError, "Error finding resource: %v", r.Name)
+				unknown[r.Name] = append(unknown[r.Name], r)
 				continue
 			}
 
+			s.connector.cacheMutex.Lock()
 			s.connector.cache[r.Name] = ts
+			s.connector.cacheMutex.Unlock()
 		}
 
 		// Check if the message is wanted
@@ -272,10 +327,11 @@ func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
 		}
 
 		err := validateRecordAgainstRegistry(r, ts)
-
+		if err == nil {
+			err = convertRecordUnit(&r, ts)
+		}
 		if err != nil {
-			logMQTTError(http.StatusBadRequest,
-				fmt.Sprintf("Error validating the record:%v", err))
+			reject(http.StatusBadRequest, "Error validating the record: %v", err)
 			return
 		}
 
@@ -287,77 +343,232 @@ func (s *Subscription) onMessage(client paho.Client, msg paho.Message) {
 		data[ts.Name] = append(data[ts.Name], r)
 	}
 
+	if len(unknown) > 0 {
+		letter := origin
+		letter.Reason = "Time series not found: " + strings.Join(sortedNames(unknown), ", ")
+		keepDeadLetter(s.connector.deadLetters, senmlDeadLetter(letter, unknown))
+	}
+
 	if len(data) > 0 {
 		// Add data to the storage
-		err = s.connector.storage.Submit(context.Background(), data, series)
+		// The message is acknowledged once this handler returns
+		var report map[string]Duplicates
+		queue, queued := s.connector.storage.(*IngestQueue)
+		switch {
+		case queued && msg.Qos() == 0:
+			// at most once: the data is dropped if the queue is full
+			err = queue.Enqueue(data, series, origin)
+		case queued:
+			// at least once: the data is written or spilled to the file first, waiting for room in the queue if needed
+			report, err = queue.SubmitDurable(context.Background(), data, series, origin)
+		default:
+			report, err = s.connector.storage.Submit(context.Background(), data, series)
+		}
 		if err != nil {
-			logMQTTError(http.StatusInternalServerError, "Error writing data to the database: %v", err)
+			if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQueueClosed) {
+				logMQTTError(http.StatusServiceUnavailable, "Dropping the data: %v", err)
+				return
+			}
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrDuplicate) {
+				code = http.StatusConflict
+			}
+			logMQTTError(code, "Error writing data to the database: %v", err)
+			letter := origin
+			letter.Reason = "Error writing data to the database: " + err.Error()
+			keepDeadLetter(s.connector.deadLetters, senmlDeadLetter(letter, data))
 			return
 		}
+		if summary := duplicatesSummary(report); summary != "" {
+			log.Printf("%s Duplicates: %s", logHeader, summary)
+		}
 
+		result = mqttAccepted
 		log.Printf("%s %d %v\n", logHeader, http.StatusAccepted, time.Now().Sub(t1))
 	}
 }
 
+// decodeError is the failure to decode a payload in the formats of a media type, for some of the series receiving the topic
+type decodeError struct {
+	contentType string
+	err         error
+}
+
+// decode turns the payload of a message into SenML records, following the payload formats of the series receiving the topic.
+// SenML payloads and json payloads whose template selects the names are decoded once for all of them,
+// while the other formats are mapped for each series.
+// It returns the media type of the payload. The records of the series whose format failed are left out,
+// and the errors are returned by media type.
+func (s *Subscription) decode(payload []byte, arrival time.Time) (senml.Pack, string, []decodeError) {
+	s.seriesMutex.RLock()
+	defer s.seriesMutex.RUnlock()
+
+	names := make([]string, 0, len(s.series))
+	types := make(map[string]registry.ValueType, len(s.series))
+	for name, ts := range s.series {
+		names = append(names, name)
+		types[name] = ts.Type
+	}
+	sort.Strings(names)
+
+	var pack senml.Pack
+	contentType := senml.MediaTypeSenmlJSON
+	decoded := make(map[string]bool)
+	var failed []string
+	failures := make(map[string][]string)
+	for i, name := range names {
+		ts := s.series[name]
+		format := mqttFormat(ts)
+		senmlFormat := format == registry.MQTTFormatSenmlJSON || format == registry.MQTTFormatSenmlCBOR
+		// the payloads resulting in the same records
+		key := format
+		if format == registry.MQTTFormatJSON && ts.Source.Template != nil && ts.Source.Template.Name != "" {
+			key = fmt.Sprintf("%s%+v", format, *ts.Source.Template)
+		} else if !senmlFormat {
+			key = ""
+		}
+		if key != "" && decoded[key] {
+			continue
+		}
+		// the payload is taken as that of the mapped formats, if any
+		if i == 0 || !senmlFormat {
+			contentType = mqttContentTypes[format]
+		}
+		records, err := decodeMQTTPayload(payload, ts, arrival, types)
+		if err != nil {
+			failedType := mqttContentTypes[format]
+			if _, found := failures[failedType]; !found {
+				failed = append(failed, failedType)
+			}
+			failures[failedType] = append(failures[failedType], fmt.Sprintf("%s of %s: %v", format, name, err))
+			continue
+		}
+		decoded[key] = true
+		pack = append(pack, records...)
+	}
+	var errs []decodeError
+	for _, failedType := range failed {
+		errs = append(errs, decodeError{contentType: failedType, err: errors.New(strings.Join(failures[failedType], "; "))})
+	}
+	return pack, contentType, errs
+}
+
+// sortedNames returns the names of the series in data, sorted
+func sortedNames(data map[string]senml.Pack) []string {
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // NOTIFICATION HANDLERS
 
 // CreateHandler handles the creation of a new time series
-func (c *MQTTConnector) CreateHandler(ts registry.TimeSeries) error {
+// The subscription is added right away and removed again if the creation is compensated
+func (c *MQTTConnector) CreateHandler(ts registry.TimeSeries) (registry.Transaction, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	if ts.Source.MQTTSource != nil {
-		err := c.register(*ts.Source.MQTTSource)
-		if err != nil {
-			return fmt.Errorf("MQTT: Error adding subscription: %v", err)
-		}
+	if ts.Source.MQTTSource == nil {
+		return nil, nil
 	}
-
-	return nil
+	err := c.register(ts)
+	if err != nil {
+		return nil, fmt.Errorf("MQTT: Error adding subscription: %v", err)
+	}
+	return registry.TransactionFuncs{
+		OnCompensate: func() error {
+			c.Lock()
+			defer c.Unlock()
+			return c.unregister(ts)
+		},
+	}, nil
 }
 
 // UpdateHandler handles updates of a time series
-func (c *MQTTConnector) UpdateHandler(oldTs registry.TimeSeries, newTS registry.TimeSeries) error {
+// The subscription is replaced right away and restored if the update is compensated
+func (c *MQTTConnector) UpdateHandler(oldTs registry.TimeSeries, newTS registry.TimeSeries) (registry.Transaction, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	if oldTs.Source.MQTTSource != newTS.Source.MQTTSource {
-		// Remove old subscription
-		if oldTs.Source.MQTTSource != nil {
-			err := c.unregister(oldTs.Source.MQTTSource)
-			if err != nil {
-				return fmt.Errorf("MQTT: Error removing subscription: %v", err)
+	if oldTs.Source.MQTTSource == newTS.Source.MQTTSource {
+		return nil, nil
+	}
+	err := c.replace(oldTs, newTS)
+	if err != nil {
+		return nil, err
+	}
+	failedRegistration, failed := c.failedRegistrations[oldTs.Name]
+	delete(c.failedRegistrations, oldTs.Name)
+
+	return registry.TransactionFuncs{
+		OnCompensate: func() error {
+			c.Lock()
+			defer c.Unlock()
+			if failed {
+				c.failedRegistrations[oldTs.Name] = failedRegistration
 			}
+			return c.replace(newTS, oldTs)
+		},
+	}, nil
+}
+
+// replace removes the old subscription of a series and adds the new one, either of which may have no MQTT source.
+// If adding the new subscription fails, the old one is restored.
+func (c *MQTTConnector) replace(oldTS, newTS registry.TimeSeries) error {
+	if oldTS.Source.MQTTSource != nil {
+		err := c.unregister(oldTS)
+		if err != nil {
+			return fmt.Errorf("MQTT: Error removing subscription: %v", err)
 		}
-		delete(c.failedRegistrations, oldTs.Name)
-		// Add new subscription
-		if newTS.Source.MQTTSource != nil {
-			err := c.register(*newTS.Source.MQTTSource)
-			if err != nil {
-				return fmt.Errorf("MQTT: Error adding subscription: %v", err)
+	}
+	if newTS.Source.MQTTSource != nil {
+		err := c.register(newTS)
+		if err != nil {
+			err = fmt.Errorf("MQTT: Error adding subscription: %v", err)
+			if oldTS.Source.MQTTSource != nil {
+				if restoreErr := c.register(oldTS); restoreErr != nil {
+					err = fmt.Errorf("%s, followed by error restoring the previous subscription: %v", err, restoreErr)
+				}
 			}
+			return err
 		}
 	}
 	return nil
 }
 
 // DeleteHandler handles deletion of a time series
-func (c *MQTTConnector) DeleteHandler(oldTS registry.TimeSeries) error {
+// The subscription is removed right away and restored if the deletion is compensated
+func (c *MQTTConnector) DeleteHandler(oldTS registry.TimeSeries) (registry.Transaction, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	c.flushCache()
-
 	// Remove old subscription
 	if oldTS.Source.MQTTSource != nil {
-		delete(c.cache, oldTS.Name)
-		err := c.unregister(oldTS.Source.MQTTSource)
+		err := c.unregister(oldTS)
 		if err != nil {
-			return fmt.Errorf("MQTT: Error removing subscription: %v", err)
+			return nil, fmt.Errorf("MQTT: Error removing subscription: %v", err)
 		}
-		delete(c.failedRegistrations, oldTS.Name)
 	}
-	return nil
+	return registry.TransactionFuncs{
+		OnCommit: func() error {
+			c.Lock()
+			defer c.Unlock()
+			c.flushCache()
+			delete(c.failedRegistrations, oldTS.Name)
+			return nil
+		},
+		OnCompensate: func() error {
+			if oldTS.Source.MQTTSource == nil {
+				return nil
+			}
+			c.Lock()
+			defer c.Unlock()
+			return c.register(oldTS)
+		},
+	}, nil
 }
 
 func pahoTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
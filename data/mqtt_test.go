@@ -0,0 +1,336 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+func mqttSeries(name string, valueType registry.ValueType, format string, template *registry.MQTTTemplate) registry.TimeSeries {
+	return registry.TimeSeries{
+		Name: name,
+		Type: valueType,
+		Source: registry.Source{
+			SrcType: registry.Mqtt,
+			MQTTSource: &registry.MQTTSource{
+				BrokerURL: "tcp://localhost:1883",
+				Topic:     "sensors/" + format,
+				Format:    format,
+				Template:  template,
+			},
+		},
+	}
+}
+
+func TestDecodeMQTTPayload(t *testing.T) {
+	arrival := time.Date(2020, 7, 6, 0, 0, 0, 0, time.UTC)
+	now := ToSenmlTime(arrival)
+	float := func(v float64) *float64 { return &v }
+	boolean := func(v bool) *bool { return &v }
+
+	t.Run("senml+json", func(t *testing.T) {
+		ts := mqttSeries("room/temp", registry.Float, "", nil)
+		pack, err := decodeMQTTPayload([]byte(`[{"bn":"room/","n":"temp","t":1594000800,"v":21.5}]`), ts, arrival, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := senml.Pack{{Name: "room/temp", Time: 1594000800, Value: float(21.5)}}
+		if !reflect.DeepEqual(pack, expected) {
+			t.Errorf("Expected %v, got %v", expected, pack)
+		}
+	})
+
+	t.Run("senml+cbor", func(t *testing.T) {
+		ts := mqttSeries("room/temp", registry.Float, registry.MQTTFormatSenmlCBOR, nil)
+		payload, err := codec.Encode(senml.MediaTypeSenmlCBOR, senml.Pack{{Name: "room/temp", Time: 1594000800, Value: float(21.5)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pack, err := decodeMQTTPayload(payload, ts, arrival, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pack) != 1 || pack[0].Name != "room/temp" || pack[0].Value == nil || *pack[0].Value != 21.5 {
+			t.Errorf("Unexpected records: %v", pack)
+		}
+		if _, err := decodeMQTTPayload([]byte(`[{"n":"room/temp","v":21.5}]`), ts, arrival, nil); err == nil {
+			t.Error("Expected an error decoding JSON as CBOR")
+		}
+	})
+
+	t.Run("raw", func(t *testing.T) {
+		cases := []struct {
+			ts       registry.TimeSeries
+			payload  string
+			expected senml.Record
+		}{
+			{mqttSeries("room/temp", registry.Float, registry.MQTTFormatRaw, nil), " 21.5\n", senml.Record{Name: "room/temp", Time: now, Value: float(21.5)}},
+			{mqttSeries("room/window", registry.Bool, registry.MQTTFormatRaw, nil), "true", senml.Record{Name: "room/window", Time: now, BoolValue: boolean(true)}},
+			{mqttSeries("room/state", registry.String, registry.MQTTFormatRaw, nil), "21", senml.Record{Name: "room/state", Time: now, StringValue: "21"}},
+			{mqttSeries("room/blob", registry.Data, registry.MQTTFormatRaw, nil), "YWJj", senml.Record{Name: "room/blob", Time: now, DataValue: "YWJj"}},
+		}
+		for _, c := range cases {
+			pack, err := decodeMQTTPayload([]byte(c.payload), c.ts, arrival, nil)
+			if err != nil {
+				t.Errorf("Error decoding %q: %s", c.payload, err)
+				continue
+			}
+			if !reflect.DeepEqual(pack, senml.Pack{c.expected}) {
+				t.Errorf("Expected %v decoded from %q, got %v", c.expected, c.payload, pack)
+			}
+		}
+		for _, payload := range []string{"", "warm"} {
+			if _, err := decodeMQTTPayload([]byte(payload), cases[0].ts, arrival, nil); err == nil {
+				t.Errorf("Expected an error decoding %q for a float series", payload)
+			}
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		cases := []struct {
+			template registry.MQTTTemplate
+			payload  string
+			expected senml.Pack
+		}{
+			{
+				registry.MQTTTemplate{Value: "$.temp"},
+				`{"temp":21.5}`,
+				senml.Pack{{Name: "room/temp", Time: now, Value: float(21.5)}},
+			},
+			{
+				registry.MQTTTemplate{Value: "$.data.temp", Time: "$.ts"},
+				`{"ts":1594000800,"data":{"temp":"21.5"}}`,
+				senml.Pack{{Name: "room/temp", Time: 1594000800, Value: float(21.5)}},
+			},
+			{
+				registry.MQTTTemplate{Records: "$.readings", Value: "$.v", Time: "$.time", Name: "$.sensor"},
+				`{"readings":[{"sensor":"room/temp","time":"2020-07-06T02:00:00Z","v":21.5},{"sensor":"room/state","time":"2020-07-06T02:00:00Z","v":"open"}]}`,
+				senml.Pack{
+					{Name: "room/temp", Time: 1594000800, Value: float(21.5)},
+					{Name: "room/state", Time: 1594000800, StringValue: "open"},
+				},
+			},
+		}
+		for _, c := range cases {
+			template := c.template
+			ts := mqttSeries("room/temp", registry.Float, registry.MQTTFormatJSON, &template)
+			pack, err := decodeMQTTPayload([]byte(c.payload), ts, arrival, nil)
+			if err != nil {
+				t.Errorf("Error decoding %s: %s", c.payload, err)
+				continue
+			}
+			if !reflect.DeepEqual(pack, c.expected) {
+				t.Errorf("Expected %v decoded from %s, got %v", c.expected, c.payload, pack)
+			}
+		}
+
+		invalid := []struct {
+			template registry.MQTTTemplate
+			payload  string
+		}{
+			{registry.MQTTTemplate{Value: "$.temp"}, `{"temp":`},
+			{registry.MQTTTemplate{Value: "$.temp"}, `{"humidity":40}`},
+			{registry.MQTTTemplate{Value: "$.temp"}, `{"temp":"warm"}`},
+			{registry.MQTTTemplate{Value: "$.temp"}, `{"temp":{"v":21.5}}`},
+			{registry.MQTTTemplate{Value: "$.temp", Time: "$.ts"}, `{"temp":21.5,"ts":"yesterday"}`},
+			{registry.MQTTTemplate{Value: "$.temp", Name: "$.id"}, `{"temp":21.5}`},
+			{registry.MQTTTemplate{Records: "$.readings", Value: "$.v"}, `{"readings":{"v":21.5}}`},
+		}
+		for _, c := range invalid {
+			template := c.template
+			ts := mqttSeries("room/temp", registry.Float, registry.MQTTFormatJSON, &template)
+			if pack, err := decodeMQTTPayload([]byte(c.payload), ts, arrival, nil); err == nil {
+				t.Errorf("Expected an error decoding %s with %+v, got %v", c.payload, c.template, pack)
+			}
+		}
+	})
+}
+
+// mqttMessage is a received message
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m mqttMessage) Duplicate() bool   { return false }
+func (m mqttMessage) Qos() byte         { return 1 }
+func (m mqttMessage) Retained() bool    { return false }
+func (m mqttMessage) Topic() string     { return m.topic }
+func (m mqttMessage) MessageID() uint16 { return 0 }
+func (m mqttMessage) Payload() []byte   { return m.payload }
+func (m mqttMessage) Ack()              {}
+
+func TestSubscription_onMessage(t *testing.T) {
+	funcName := "TestSubscription_onMessage"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	deadLetters, err := NewDeadLetterStore(dataStorage.(*SqlStorage), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector, err := NewMQTTConnector(dataStorage, "test", deadLetters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connector.registry = regController
+
+	// the series are not subscribed, as the connector is not a listener of the registry
+	add := func(ts registry.TimeSeries) *registry.TimeSeries {
+		added, addErr := regController.Add(ts)
+		if addErr != nil {
+			t.Fatal(addErr)
+		}
+		return added
+	}
+	latest := func(ts *registry.TimeSeries) senml.Pack {
+		pack, err := dataStorage.Latest(context.Background(), ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pack
+	}
+
+	t.Run("raw", func(t *testing.T) {
+		ts := add(mqttSeries("raw/temp", registry.Float, registry.MQTTFormatRaw, nil))
+		subscription := newSubscription(connector, *ts)
+		subscription.onMessage(nil, mqttMessage{topic: ts.Source.Topic, payload: []byte("21.5")})
+		if pack := latest(ts); len(pack) != 1 || pack[0].Value == nil || *pack[0].Value != 21.5 {
+			t.Errorf("Expected 21.5 to be stored, got %v", pack)
+		}
+
+		subscription.onMessage(nil, mqttMessage{topic: ts.Source.Topic, payload: []byte("warm")})
+		letters, _, err := deadLetters.List(context.Background(), DeadLetterFilter{Topic: ts.Source.Topic}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(letters) != 1 || letters[0].ContentType != "text/plain" || string(letters[0].Payload) != "warm" {
+			t.Errorf("Expected the payload to be kept as dead letter, got %v", letters)
+		}
+	})
+
+	t.Run("json to several series", func(t *testing.T) {
+		template := &registry.MQTTTemplate{Records: "$", Value: "$.value", Name: "$.name"}
+		temp := add(mqttSeries("json/temp", registry.Float, registry.MQTTFormatJSON, template))
+		window := add(mqttSeries("json/window", registry.Bool, registry.MQTTFormatJSON, template))
+		subscription := newSubscription(connector, *temp)
+		subscription.series[window.Name] = *window
+
+		payload := `[{"name":"json/temp","value":22},{"name":"json/window","value":true}]`
+		subscription.onMessage(nil, mqttMessage{topic: temp.Source.Topic, payload: []byte(payload)})
+		if pack := latest(temp); len(pack) != 1 || pack[0].Value == nil || *pack[0].Value != 22 {
+			t.Errorf("Expected 22 to be stored, got %v", pack)
+		}
+		if pack := latest(window); len(pack) != 1 || pack[0].BoolValue == nil || !*pack[0].BoolValue {
+			t.Errorf("Expected true to be stored, got %v", pack)
+		}
+		// the payload is mapped once for both series
+		total, err := dataStorage.Count(context.Background(), Query{To: time.Now()}, temp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 {
+			t.Errorf("Expected 1 record to be stored, got %d", total)
+		}
+
+		// decoded records which are rejected are kept as SenML, to be replayed
+		payload = `[{"name":"json/window","value":1}]`
+		subscription.onMessage(nil, mqttMessage{topic: temp.Source.Topic, payload: []byte(payload)})
+		letters, _, err := deadLetters.List(context.Background(), DeadLetterFilter{Topic: temp.Source.Topic}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(letters) != 1 || letters[0].ContentType != senml.MediaTypeSenmlJSON {
+			t.Fatalf("Expected the records to be kept as dead letter, got %v", letters)
+		}
+		pack, err := codec.Decode(senml.MediaTypeSenmlJSON, letters[0].Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pack) != 1 || pack[0].Name != window.Name || pack[0].Value == nil || *pack[0].Value != 1 {
+			t.Errorf("Unexpected records of the dead letter: %v", pack)
+		}
+	})
+
+	t.Run("replay after fixing the template", func(t *testing.T) {
+		fixed := mqttSeries("json/fixed", registry.Float, registry.MQTTFormatJSON, &registry.MQTTTemplate{Value: "$.temperature"})
+		fixed.Source.Topic = "sensors/fixed"
+		ts := add(fixed)
+		subscription := newSubscription(connector, *ts)
+		subscription.onMessage(nil, mqttMessage{topic: ts.Source.Topic, payload: []byte(`{"temp":23}`)})
+		letters, _, err := deadLetters.List(context.Background(), DeadLetterFilter{Topic: ts.Source.Topic}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(letters) != 1 || letters[0].ContentType != "application/json" {
+			t.Fatalf("Expected the payload to be kept as dead letter, got %v", letters)
+		}
+
+		controller := NewController(regController, dataStorage, false)
+		controller.UseDeadLetters(deadLetters)
+		if _, replayErr := controller.ReplayDeadLetter(context.Background(), letters[0].ID); replayErr == nil {
+			t.Fatalf("Expected replaying to fail before the template is fixed")
+		}
+		fixed.Source.Template = &registry.MQTTTemplate{Value: "$.temp"}
+		if _, updateErr := regController.Update(fixed.Name, fixed); updateErr != nil {
+			t.Fatal(updateErr)
+		}
+		if _, replayErr := controller.ReplayDeadLetter(context.Background(), letters[0].ID); replayErr != nil {
+			t.Fatal(replayErr)
+		}
+		if pack := latest(ts); len(pack) != 1 || pack[0].Value == nil || *pack[0].Value != 23 {
+			t.Errorf("Expected 23 to be stored, got %v", pack)
+		}
+	})
+	t.Run("formats failing for some series", func(t *testing.T) {
+		raw := mqttSeries("mixed/raw", registry.Float, registry.MQTTFormatRaw, nil)
+		raw.Source.Topic = "sensors/mixed"
+		jsonSeries := mqttSeries("mixed/json", registry.Float, registry.MQTTFormatJSON, &registry.MQTTTemplate{Value: "$.temp"})
+		jsonSeries.Source.Topic = "sensors/mixed"
+		rawTS, jsonTS := add(raw), add(jsonSeries)
+		subscription := newSubscription(connector, *rawTS)
+		subscription.series[jsonTS.Name] = *jsonTS
+
+		subscription.onMessage(nil, mqttMessage{topic: rawTS.Source.Topic, payload: []byte(`{"temp":24}`)})
+		if pack := latest(jsonTS); len(pack) != 1 || pack[0].Value == nil || *pack[0].Value != 24 {
+			t.Errorf("Expected 24 to be stored, got %v", pack)
+		}
+		letters, _, err := deadLetters.List(context.Background(), DeadLetterFilter{Topic: rawTS.Source.Topic}, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(letters) != 1 || letters[0].ContentType != "text/plain" {
+			t.Fatalf("Expected the payload to be kept as dead letter for the raw series, got %v", letters)
+		}
+
+		// replaying decodes only the series in the format of the letter
+		controller := NewController(regController, dataStorage, false)
+		controller.UseDeadLetters(deadLetters)
+		if _, replayErr := controller.ReplayDeadLetter(context.Background(), letters[0].ID); replayErr == nil {
+			t.Errorf("Expected replaying to fail for the raw series")
+		}
+		total, err := dataStorage.Count(context.Background(), Query{To: time.Now()}, jsonTS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 1 {
+			t.Errorf("Expected 1 record to be stored, got %d", total)
+		}
+	})
+}
@@ -0,0 +1,192 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/farshidtz/senml/v2/codec"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// media types of the payload formats of MQTT sources, for the dead letters
+var mqttContentTypes = map[string]string{
+	registry.MQTTFormatSenmlJSON: senml.MediaTypeSenmlJSON,
+	registry.MQTTFormatSenmlCBOR: senml.MediaTypeSenmlCBOR,
+	registry.MQTTFormatRaw:       "text/plain",
+	registry.MQTTFormatJSON:      "application/json",
+}
+
+// mqttFormat returns the payload format of the MQTT source of a series
+func mqttFormat(ts registry.TimeSeries) string {
+	if ts.Source.MQTTSource == nil || ts.Source.Format == "" {
+		return registry.MQTTFormatSenmlJSON
+	}
+	return ts.Source.Format
+}
+
+// decodeMQTTPayload turns the payload of a message into SenML records, following the format of the MQTT source of a series.
+// The records are normalized, those of the raw and json formats take the time of arrival unless the payload has one.
+// The types of the other series receiving the payload, by name, are used to parse the values of the json records named after them.
+func decodeMQTTPayload(payload []byte, ts registry.TimeSeries, arrival time.Time, types map[string]registry.ValueType) (senml.Pack, error) {
+	switch format := mqttFormat(ts); format {
+	case registry.MQTTFormatSenmlJSON, registry.MQTTFormatSenmlCBOR:
+		pack, err := codec.Decode(mqttContentTypes[format], payload)
+		if err != nil {
+			return nil, err
+		}
+		pack.Normalize()
+		return pack, nil
+	case registry.MQTTFormatRaw:
+		value := strings.TrimSpace(string(payload))
+		if value == "" {
+			return nil, fmt.Errorf("empty payload")
+		}
+		r := senml.Record{Name: ts.Name, Time: ToSenmlTime(arrival)}
+		err := setMappedValue(&r, value, &ts.Type)
+		if err != nil {
+			return nil, err
+		}
+		return senml.Pack{r}, nil
+	case registry.MQTTFormatJSON:
+		if ts.Source.Template == nil {
+			return nil, fmt.Errorf("missing template")
+		}
+		return mapJSONPayload(payload, ts, arrival, types)
+	default:
+		return nil, fmt.Errorf("unsupported payload format: %s", format)
+	}
+}
+
+// mapJSONPayload maps a JSON payload to records with the template of the MQTT source of a series
+func mapJSONPayload(payload []byte, ts registry.TimeSeries, arrival time.Time, types map[string]registry.ValueType) (senml.Pack, error) {
+	template := ts.Source.Template
+	var doc interface{}
+	err := json.Unmarshal(payload, &doc)
+	if err != nil {
+		return nil, err
+	}
+	selector := func(s string) (registry.Selector, error) {
+		sel, err := registry.ParseSelector(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %s", err)
+		}
+		return sel, nil
+	}
+
+	elements := []interface{}{doc}
+	if template.Records != "" {
+		sel, err := selector(template.Records)
+		if err != nil {
+			return nil, err
+		}
+		selected, _ := sel.Select(doc)
+		array, ok := selected.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("no array of records at %s", template.Records)
+		}
+		elements = array
+	}
+	valueSel, err := selector(template.Value)
+	if err != nil {
+		return nil, err
+	}
+	var timeSel, nameSel registry.Selector
+	if template.Time != "" {
+		if timeSel, err = selector(template.Time); err != nil {
+			return nil, err
+		}
+	}
+	if template.Name != "" {
+		if nameSel, err = selector(template.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	pack := make(senml.Pack, 0, len(elements))
+	for _, element := range elements {
+		r := senml.Record{Name: ts.Name, Time: ToSenmlTime(arrival)}
+		// the type of the values is known for the records of the series receiving the payload only
+		valueType := &ts.Type
+		if nameSel != nil {
+			name, found := nameSel.Select(element)
+			if s, ok := name.(string); !found || !ok || s == "" {
+				return nil, fmt.Errorf("no name at %s", template.Name)
+			} else if s != ts.Name {
+				r.Name, valueType = s, nil
+				if t, found := types[s]; found {
+					valueType = &t
+				}
+			}
+		}
+		if timeSel != nil {
+			t, found := timeSel.Select(element)
+			if !found {
+				return nil, fmt.Errorf("no time at %s", template.Time)
+			}
+			switch t := t.(type) {
+			case float64:
+				r.Time = t
+			case string:
+				parsed, err := time.Parse(time.RFC3339, t)
+				if err != nil {
+					return nil, fmt.Errorf("invalid time at %s: %s", template.Time, err)
+				}
+				r.Time = ToSenmlTime(parsed)
+			default:
+				return nil, fmt.Errorf("invalid time at %s: %v", template.Time, t)
+			}
+		}
+		value, found := valueSel.Select(element)
+		if !found || value == nil {
+			return nil, fmt.Errorf("no value at %s", template.Value)
+		}
+		if err := setMappedValue(&r, value, valueType); err != nil {
+			return nil, fmt.Errorf("invalid value at %s: %s", template.Value, err)
+		}
+		pack = append(pack, r)
+	}
+	return pack, nil
+}
+
+// setMappedValue sets the value of a record mapped from a payload. Strings are parsed following the type of the series,
+// if it is known, and the other values are taken as they are.
+func setMappedValue(r *senml.Record, value interface{}, valueType *registry.ValueType) error {
+	switch v := value.(type) {
+	case float64:
+		r.Value = &v
+	case bool:
+		r.BoolValue = &v
+	case string:
+		if valueType == nil {
+			r.StringValue = v
+			return nil
+		}
+		switch *valueType {
+		case registry.Float:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("not a number: %s", v)
+			}
+			r.Value = &f
+		case registry.Bool:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("not a boolean: %s", v)
+			}
+			r.BoolValue = &b
+		case registry.String:
+			r.StringValue = v
+		case registry.Data:
+			r.DataValue = v
+		}
+	default:
+		return fmt.Errorf("unsupported value: %v", v)
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"fmt"
+
+	_ "github.com/lib/pq"
+	"github.com/linksmart/historical-datastore/common"
+)
+
+// NewPostgresStorage returns a storage client for a PostgreSQL (or TimescaleDB) database.
+// Similar to SQLite, each series is stored in a separate table. Unlike SQLite, writes to the database are not serialized.
+func NewPostgresStorage(conf common.DataConf) (storage *SqlStorage, disconnect_func func() error, err error) {
+	storage, disconnect_func, err = newSqlStorage(postgresDialect{}, conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), sqlQueryTimeout)
+	defer cancel()
+	err = storage.pool.PingContext(ctx)
+	if err != nil {
+		storage.pool.Close()
+		return nil, nil, fmt.Errorf("error connecting to PostgreSQL: %s", err)
+	}
+	return storage, disconnect_func, nil
+}
@@ -0,0 +1,82 @@
+package data
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// setupPostgresTest creates a PostgreSQL storage using a fresh schema of the database given by dsn.
+// The schema is dropped on disconnect.
+func setupPostgresTest(funcName string, dsn string) (schema string, disconnectFunc func() error, dataStorage Storage, regController registry.Controller, err error) {
+	schema = "hds_test_" + strings.ToLower(funcName)
+	admin, err := sql.Open(DRIVER_POSTGRES, dsn)
+	if err != nil {
+		return "", nil, nil, registry.Controller{}, err
+	}
+	_, err = admin.Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS "%[1]s" CASCADE; CREATE SCHEMA "%[1]s"`, schema))
+	if err != nil {
+		admin.Close()
+		return "", nil, nil, registry.Controller{}, err
+	}
+
+	// use the schema for all connections of the storage
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			admin.Close()
+			return "", nil, nil, registry.Controller{}, err
+		}
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+
+	storage, disconnect, err := NewPostgresStorage(common.DataConf{Backend: common.DataBackendConf{Type: POSTGRES, DSN: dsn}})
+	if err != nil {
+		admin.Close()
+		return "", nil, nil, registry.Controller{}, err
+	}
+	disconnectFunc = func() error {
+		defer admin.Close()
+		err := disconnect()
+		if err != nil {
+			return err
+		}
+		_, err = admin.Exec(fmt.Sprintf(`DROP SCHEMA IF EXISTS "%s" CASCADE`, schema))
+		return err
+	}
+	//create a registry storage
+	regStorage := registry.NewMemoryStorage(common.RegConf{}, storage)
+	regController = *registry.NewController(regStorage)
+	return schema, disconnectFunc, storage, regController, nil
+}
+
+func TestPostgresDialect(t *testing.T) {
+	d := postgresDialect{}
+
+	stmt := d.rebind("DELETE FROM t WHERE time > ? AND time <= ?")
+	if stmt != "DELETE FROM t WHERE time > $1 AND time <= $2" {
+		t.Errorf("Unexpected statement after rebinding: %s", stmt)
+	}
+
+	short := "http://example.com/sensor1"
+	if d.table(short) != `"`+short+`"` {
+		t.Errorf("Unexpected table of %s: %s", short, d.table(short))
+	}
+	long := "http://example.com/" + strings.Repeat("building/", 10) + "sensor1"
+	if len(d.tableName(long)) > postgresMaxIdentifier {
+		t.Errorf("Table name of %s exceeds the maximum length: %s", long, d.tableName(long))
+	}
+	if d.tableName(long) == d.tableName(long+"0") {
+		t.Errorf("Table names of different series must differ")
+	}
+}
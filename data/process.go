@@ -0,0 +1,467 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// processed checks if the records of a query are processed after they are read from the storage, i.e. gap-filled or transformed.
+// The records of the other queries are converted to the unit of the query as they are read.
+func (q Query) processed() bool {
+	return q.gapFilled() || len(q.Transforms) != 0
+}
+
+// checkProcessing checks if the records of a converted or processed query are numeric, if their units can be converted,
+// and if the number of grid points of gap-filled queries is within MaxGridPoints
+func checkProcessing(q Query, series []*registry.TimeSeries) error {
+	if !q.processed() && q.Unit == "" {
+		return nil
+	}
+	for name, ts := range resultSeries(q, series) {
+		if ts.Type != registry.Float {
+			return fmt.Errorf("unit conversion, gap filling, resampling and transforms are not supported for non-numeric results %s", name)
+		}
+	}
+	if q.Unit != "" {
+		if _, err := unitConversions(q, series); err != nil {
+			return err
+		}
+	}
+	if q.gapFilled() {
+		if _, err := newGrid(q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resumeMargin is the time in seconds around a resumed cursor from which the stored data is read,
+// so that the records at the cursor are read despite the rounding of the times
+const resumeMargin = 1e-3
+
+// processing holds the parts of a processed query which are shared by the passes over its stored data
+type processing struct {
+	q         Query
+	series    []*registry.TimeSeries
+	names     []string
+	units     map[string]string
+	grid      grid
+	converter *unitConverter
+	// stored is the query of the stored data, which is narrowed to the data needed after a resumed cursor
+	stored Query
+	// resumed is the cursor from which a page continues with the state of the processing.
+	// It is nil if the page is selected out of all the processed records.
+	resumed *Cursor
+	// filler of the current pass, if the query is gap-filled
+	filler *gapFiller
+	// inputs is the position of the last record which reached the transforms in the current pass
+	inputs Cursor
+}
+
+// newProcessing prepares a processed query. The pages after a cursor are resumed at the cursor if they can.
+func newProcessing(q Query, series []*registry.TimeSeries, page bool) (*processing, error) {
+	converter, err := newUnitConverter(q, series)
+	if err != nil {
+		return nil, err
+	}
+	p := &processing{q: q, series: series, converter: converter}
+	resultNames := resultSeries(q, series)
+	p.names = make([]string, 0, len(resultNames))
+	p.units = make(map[string]string, len(resultNames))
+	for name, ts := range resultNames {
+		p.names = append(p.names, name)
+		p.units[name] = ts.Unit
+		if p.converter != nil {
+			if _, found := p.converter.conversions[name]; found {
+				p.units[name] = q.Unit
+			}
+		}
+	}
+	sort.Strings(p.names)
+	if q.gapFilled() {
+		p.grid, err = newGrid(q)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p.stored = q
+	p.stored.Unit, p.stored.Fill, p.stored.Resample, p.stored.Transforms = "", Fill{}, 0, nil
+	if q.resampled() {
+		p.stored.Calendar = CalendarPeriod{}
+	}
+	p.stored.Denormalize, p.stored.Cursor, p.stored.Count = 0, nil, false
+	p.stored.PerPage, p.stored.Limit, p.stored.Offset = MaxPerPage, 0, 0
+	if page && q.Cursor != nil && p.resumable(q.Cursor) {
+		p.resumed = q.Cursor
+		p.narrow()
+	}
+	return p, nil
+}
+
+// resumable checks if a cursor carries the state needed to continue the processing after it: the neighbours of the names
+// at a grid point for gap-filled queries, and the states of the transforms for ascending transformed queries.
+// Descending transforms need no state, as they are computed backwards.
+func (p *processing) resumable(c *Cursor) bool {
+	if p.q.gapFilled() && (c.State == nil || c.State.Fill == nil || p.grid.index(c.Time) < 0) {
+		return false
+	}
+	if p.q.SortAsc && len(p.q.Transforms) != 0 && (c.State == nil || len(c.State.Transforms) != len(p.q.Transforms) || c.State.Inputs <= 0) {
+		return false
+	}
+	return true
+}
+
+// narrow narrows the stored data to the data needed from the resumed cursor on. The windows of the aggregates at
+// and after the cursor are read entirely.
+func (p *processing) narrow() {
+	t := p.resumed.Time
+	q := p.q
+	if q.SortAsc {
+		if len(q.AggrFuncs) != 0 {
+			t = p.windowStart(t)
+		}
+		if from := FromSenmlTime(t - resumeMargin); from.After(p.stored.From) {
+			p.stored.From = from
+		}
+	} else if len(q.AggrFuncs) == 0 || q.Align == AlignEpoch || !q.Calendar.IsZero() {
+		// the windows aligned to To are kept
+		if to := FromSenmlTime(t + resumeMargin); to.Before(p.stored.To) {
+			p.stored.To = to
+		}
+	}
+}
+
+// windowStart returns the start of the aggregation window ending at a time
+func (p *processing) windowStart(end float64) float64 {
+	if p.q.Calendar.IsZero() {
+		return end - p.q.AggrWindow.Seconds()
+	}
+	loc := p.q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	return ToSenmlTime(p.q.Calendar.start(FromSenmlTime(end - resumeMargin).In(loc)))
+}
+
+// read reads the stored data in the order of the query and passes the records to be transformed to emit, which are the
+// gap-filled records of gap-filled queries. The records up to a resumed cursor are left out.
+func (p *processing) read(ctx context.Context, storage Storage, emit func(senml.Record) error) error {
+	add := emit
+	if p.resumed != nil {
+		// the records up to the cursor were processed by the previous page
+		next := add
+		filter := &cursorFilter{cursor: *p.resumed, asc: p.q.SortAsc, skip: p.resumedInputs()}
+		add = func(r senml.Record) error {
+			if !filter.after(r) {
+				return nil
+			}
+			return next(r)
+		}
+	}
+	p.inputs = Cursor{}
+	counted := add
+	add = func(r senml.Record) error {
+		p.inputs.advance(r)
+		return counted(r)
+	}
+	p.filler = nil
+	if p.q.gapFilled() {
+		start, neighbours := 0, map[string]fillNeighbour(nil)
+		if p.resumed != nil {
+			start, neighbours = p.grid.index(p.resumed.Time), p.resumed.State.Fill
+			if !p.q.SortAsc {
+				start = p.grid.n - 1 - start
+			}
+		}
+		p.filler = newGapFiller(p.grid, p.q.Fill, p.q.SortAsc, p.names, p.units, start, neighbours, add)
+		add = p.filler.add
+	}
+	if p.converter != nil {
+		next := add
+		add = func(r senml.Record) error {
+			return next(p.converter.apply(r))
+		}
+	}
+
+	err := storage.QueryStream(ctx, p.stored, func(pack senml.Pack) error {
+		for _, r := range pack {
+			if err := add(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, p.series...)
+	if err == nil && p.filler != nil {
+		err = p.filler.finish()
+	}
+	return err
+}
+
+// resumedInputs returns the number of records at the resumed cursor which reached the transforms before the cursor
+func (p *processing) resumedInputs() int {
+	c := p.resumed
+	switch {
+	case len(p.q.Transforms) == 0:
+		return c.Seq + 1
+	case p.q.SortAsc:
+		return c.State.Inputs
+	case hasDerivatives(p.q.Transforms):
+		// the derivatives leave out the records sharing a time but the earliest one, which is read last
+		return math.MaxInt
+	default:
+		// the other transforms produce the records sharing a time backwards in the order they are read
+		return c.Seq + 1
+	}
+}
+
+// cursor returns the cursor at the position of a record, with the state of the processing after it
+func (p *processing) cursor(position Cursor, forward *transformer) *Cursor {
+	c := &Cursor{Time: position.Time, Series: position.Series, Seq: position.Seq}
+	state := &processingState{}
+	if p.filler != nil {
+		state.Fill = p.filler.neighbours()
+	}
+	if forward != nil {
+		state.Transforms = forward.snapshot()
+		// the transforms produced the record from the last one they read
+		state.Inputs = p.inputs.Seq + 1
+	}
+	if state.Fill != nil || state.Transforms != nil {
+		c.State = state
+	}
+	return c
+}
+
+// cumulativeTotals returns the totals of the records of each name which reach the cumulative sums of a descending query,
+// from which the sums are computed backwards. Each cumulative sum takes a pass over the stored data.
+func (p *processing) cumulativeTotals(ctx context.Context, storage Storage) ([]map[string]float64, error) {
+	totals := make([]map[string]float64, len(p.q.Transforms))
+	for i, t := range p.q.Transforms {
+		if t.Function != TransformCumulativeSum {
+			continue
+		}
+		sums := make(map[string]float64)
+		// the transforms before the sum have their totals
+		before := newReverseTransformer(p.q.Transforms[:i], totals[:i], func(r senml.Record) error {
+			if r.Value != nil {
+				sums[r.Name] += *r.Value
+			}
+			return nil
+		})
+		err := p.read(ctx, storage, before.add)
+		if err == nil {
+			err = before.finish()
+		}
+		if err != nil {
+			return nil, err
+		}
+		totals[i] = sums
+	}
+	return totals, nil
+}
+
+// queryProcessed runs a gap-filled or transformed query. The page or the stream is selected out of the processed records, which are
+// produced in the order of the query from the stored windows or records as they are read, and converted to the unit of the query.
+// A page after a cursor carrying the state of the processing continues from the cursor, without the data before it.
+// It returns the cursor of the next page if the page is full.
+func (c Controller) queryProcessed(ctx context.Context, q Query, series []*registry.TimeSeries, sendFunc sendFunction) (senml.Pack, *int, *Cursor, error) {
+	var total *int
+	if q.Count {
+		count, err := c.countProcessed(ctx, q, series)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		total = &count
+	}
+	p, err := newProcessing(q, series, sendFunc == nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	skip, take := q.Offset, q.Limit
+	if sendFunc == nil {
+		skip, take = (q.Page-1)*q.PerPage, q.PerPage
+		if q.Cursor != nil {
+			skip = 0
+		}
+	}
+	denormMask := q.Denormalize
+	if len(p.names) > 1 {
+		denormMask &^= DenormMaskName
+	}
+	var pack senml.Pack
+	var baseRecord *senml.Record
+	var next *Cursor
+	var forward *transformer
+	// position of the last processed record, which continues from a resumed cursor
+	var position Cursor
+	var filter *cursorFilter
+	if p.resumed != nil {
+		position = Cursor{Time: p.resumed.Time, Series: p.resumed.Series, Seq: p.resumed.Seq}
+	} else if sendFunc == nil && q.Cursor != nil {
+		filter = &cursorFilter{cursor: *q.Cursor, asc: q.SortAsc, skip: q.Cursor.Seq + 1}
+	}
+	selected := 0
+	output := func(r senml.Record) error {
+		position.advance(r)
+		if filter != nil && !filter.after(r) {
+			return nil
+		}
+		if skip > 0 {
+			skip--
+			return nil
+		}
+		if sendFunc == nil && selected == take-1 {
+			// the next page continues after the last record of this one
+			next = p.cursor(position, forward)
+		}
+		denormalizeRecord(&r, &baseRecord, denormMask)
+		pack = append(pack, r)
+		selected++
+		if sendFunc != nil && len(pack) == q.PerPage {
+			if err := sendFunc(pack); err != nil {
+				return err
+			}
+			pack, baseRecord = nil, nil
+		}
+		if take != 0 && selected == take {
+			return errPageFull
+		}
+		return nil
+	}
+
+	emit := output
+	var reverse *reverseTransformer
+	if len(q.Transforms) != 0 {
+		if q.SortAsc {
+			forward = newTransformer(q.Transforms)
+			if p.resumed != nil {
+				forward.restore(p.resumed.State.Transforms)
+			}
+			emit = func(r senml.Record) error {
+				if r, ok := forward.apply(r); ok {
+					return output(r)
+				}
+				return nil
+			}
+		} else {
+			totals, err := p.cumulativeTotals(ctx, c.storage)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			reverse = newReverseTransformer(q.Transforms, totals, output)
+			emit = reverse.add
+		}
+	}
+	err = p.read(ctx, c.storage, emit)
+	if err == nil && reverse != nil {
+		err = reverse.finish()
+	}
+	if err != nil && !errors.Is(err, errPageFull) {
+		return nil, nil, nil, err
+	}
+	if sendFunc != nil && len(pack) != 0 {
+		if err := sendFunc(pack); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return pack, total, next, nil
+}
+
+// countProcessed returns the number of records of a processed query. The number of transformed records is computed from the
+// number of records of each name if the transforms leave out a known number of them, else the records are counted while they
+// are produced in ascending order.
+func (c Controller) countProcessed(ctx context.Context, q Query, series []*registry.TimeSeries) (int, error) {
+	q.SortAsc, q.Cursor = true, nil
+	p, err := newProcessing(q, series, false)
+	if err != nil {
+		return 0, err
+	}
+	counts, err := c.transformInputs(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	if counts != nil {
+		for _, n := range counts {
+			total += transformedCount(q.Transforms, n)
+		}
+		return total, nil
+	}
+	forward := newTransformer(q.Transforms)
+	err = p.read(ctx, c.storage, func(r senml.Record) error {
+		if _, ok := forward.apply(r); ok {
+			total++
+		}
+		return nil
+	})
+	return total, err
+}
+
+// transformInputs returns the number of records of each name which reach the transforms of a processed query,
+// if all of them have a value and their times differ. It returns nil otherwise.
+func (c Controller) transformInputs(ctx context.Context, p *processing) ([]int, error) {
+	q := p.q
+	var counts []int
+	switch {
+	case q.gapFilled():
+		if len(q.Transforms) != 0 && q.Fill.Method != FillConstant {
+			// the points without neighbours have no value
+			return nil, nil
+		}
+		for range p.names {
+			counts = append(counts, p.grid.n)
+		}
+	case len(q.AggrFuncs) == 0 && hasDerivatives(q.Transforms):
+		// the records of series with the sequence policy may share their times, which the derivatives leave out
+		return nil, nil
+	case len(q.Transforms) != 0 && (q.hasAggrFunc("stddev") || q.hasAggrFunc("variance")):
+		// the deviation of a single record may have no value
+		return nil, nil
+	default:
+		aggregates := len(q.AggrFuncs)
+		if aggregates == 0 {
+			aggregates = 1
+		}
+		for _, ts := range p.series {
+			n, err := c.storage.Count(ctx, p.stored, ts)
+			if err != nil {
+				return nil, err
+			}
+			for i := 0; i < aggregates; i++ {
+				counts = append(counts, n/aggregates)
+			}
+		}
+	}
+	return counts, nil
+}
+
+// hasDerivatives checks if transforms include a derivative or a rate
+func hasDerivatives(transforms []Transform) bool {
+	for _, t := range transforms {
+		if t.Function == TransformDerivative || t.Function == TransformRate {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAggrFunc checks if a query computes an aggregate
+func (q Query) hasAggrFunc(aggr string) bool {
+	for _, a := range q.AggrFuncs {
+		if a == aggr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,565 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	defaultBatchSize  = 1000
+	defaultBatchDelay = 100 // milliseconds
+	defaultRetryAfter = 1   // seconds
+)
+
+var (
+	// ErrQueueFull is returned if submitted data does not fit in the ingestion queue
+	ErrQueueFull = errors.New("the ingestion queue is full")
+	// ErrQueueClosed is returned if data is submitted after the ingestion queue was closed
+	ErrQueueClosed = errors.New("the ingestion queue is closed")
+)
+
+// IngestQueue is a Storage which queues the submitted data and writes it in batches,
+// so that many small submissions share a transaction.
+// The queued records are bounded in memory, and the MQTT data which does not fit is optionally spilled to a file.
+type IngestQueue struct {
+	Storage
+	size       int
+	batchSize  int
+	batchDelay time.Duration
+	retryAfter int
+	// deadLetters keeps the data which nobody waits for if writing it fails, if set
+	deadLetters DeadLetterStore
+
+	sync.Mutex
+	entries []*queueEntry
+	// records in entries
+	records int
+	spill   *spillFile
+	closed  bool
+	// room is signalled whenever records are written
+	room *sync.Cond
+
+	// ready is signalled when entries are queued, filled when a batch is full
+	ready, filled chan struct{}
+	stop, stopped chan struct{}
+}
+
+// queueEntry is the data of a submission
+type queueEntry struct {
+	Data   map[string]senml.Pack           `json:"data"`
+	Series map[string]*registry.TimeSeries `json:"series"`
+	// Origin of the data, which is kept as dead letter if writing it fails and nobody waits for the result
+	Origin  DeadLetter `json:"origin"`
+	records int
+	// done receives the result of writing the entry, if the submitter waits for it
+	done chan queueResult
+}
+
+type queueResult struct {
+	report map[string]Duplicates
+	err    error
+}
+
+func newQueueEntry(data map[string]senml.Pack, series map[string]*registry.TimeSeries, origin DeadLetter) *queueEntry {
+	e := &queueEntry{Data: data, Series: series, Origin: origin}
+	for _, pack := range data {
+		e.records += len(pack)
+	}
+	return e
+}
+
+// NewIngestQueue returns a queue writing to the given storage, along with the function which writes the queued data and stops it.
+// The data spilled to the file before a restart is written as well. The dead letters store is optional.
+func NewIngestQueue(storage Storage, conf common.QueueConf, deadLetters DeadLetterStore) (*IngestQueue, func() error, error) {
+	q := &IngestQueue{
+		Storage:     storage,
+		deadLetters: deadLetters,
+		size:        conf.Size,
+		batchSize:   conf.BatchSize,
+		batchDelay:  time.Duration(conf.BatchDelay) * time.Millisecond,
+		retryAfter:  conf.RetryAfter,
+		ready:       make(chan struct{}, 1),
+		filled:      make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+	if q.batchSize == 0 {
+		q.batchSize = defaultBatchSize
+	}
+	if conf.BatchDelay == 0 {
+		q.batchDelay = defaultBatchDelay * time.Millisecond
+	}
+	if q.retryAfter == 0 {
+		q.retryAfter = defaultRetryAfter
+	}
+	q.room = sync.NewCond(&q.Mutex)
+	if conf.SpillFile != "" {
+		var err error
+		q.spill, err = openSpillFile(conf.SpillFile, conf.SpillSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error opening the spill file of the queue: %s", err)
+		}
+		if q.spill.records > 0 {
+			log.Printf("Queue: writing %d records spilled before the restart", q.spill.records)
+			q.signal()
+		}
+	}
+	q.observe()
+	go q.run()
+	return q, q.close, nil
+}
+
+// Submit queues the data and waits until it is written, along with the data of other submissions.
+// It returns ErrQueueFull right away if the data does not fit in memory.
+// If the context is done before, the data may still be written.
+func (q *IngestQueue) Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) (map[string]Duplicates, error) {
+	e := newQueueEntry(data, series, DeadLetter{})
+	e.done = make(chan queueResult, 1)
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return nil, ErrQueueClosed
+	}
+	if !q.fits(e) {
+		q.Unlock()
+		queueRejections.Inc()
+		return nil, ErrQueueFull
+	}
+	q.push(e)
+	q.Unlock()
+	return q.wait(ctx, e)
+}
+
+// Enqueue queues the data without waiting for it to be written, as for MQTT messages with QoS 0.
+// It returns ErrQueueFull if the data fits neither in memory nor in the spill file.
+func (q *IngestQueue) Enqueue(data map[string]senml.Pack, series map[string]*registry.TimeSeries, origin DeadLetter) error {
+	e := newQueueEntry(data, series, origin)
+	q.Lock()
+	defer q.Unlock()
+	if q.closed {
+		return ErrQueueClosed
+	}
+	_, err := q.pushOrSpill(e)
+	if err == ErrQueueFull {
+		queueRejections.Inc()
+	}
+	return err
+}
+
+// SubmitDurable returns once the data is written or spilled to the file, as for MQTT messages with QoS 1 or 2,
+// which are acknowledged after that. It waits while the queue is full, until the context is done. The report is nil if the data was spilled.
+func (q *IngestQueue) SubmitDurable(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries, origin DeadLetter) (map[string]Duplicates, error) {
+	e := newQueueEntry(data, series, origin)
+	e.done = make(chan queueResult, 1)
+	var waiting chan struct{}
+	q.Lock()
+	for {
+		if q.closed {
+			q.Unlock()
+			return nil, ErrQueueClosed
+		}
+		spilled, err := q.pushOrSpill(e)
+		if err == ErrQueueFull {
+			if ctx.Err() != nil {
+				q.Unlock()
+				return nil, ctx.Err()
+			}
+			if waiting == nil {
+				// the wait for room is woken up when the context is done
+				waiting = make(chan struct{})
+				defer close(waiting)
+				go func() {
+					select {
+					case <-ctx.Done():
+						q.Lock()
+						q.room.Broadcast()
+						q.Unlock()
+					case <-waiting:
+					}
+				}()
+			}
+			q.room.Wait()
+			continue
+		}
+		q.Unlock()
+		if err != nil || spilled {
+			return nil, err
+		}
+		return q.wait(ctx, e)
+	}
+}
+
+// pushOrSpill queues an entry in memory, or in the spill file if it does not fit.
+// While there are records in the spill file, entries are spilled after them, to be written in order.
+func (q *IngestQueue) pushOrSpill(e *queueEntry) (spilled bool, err error) {
+	if (q.spill == nil || q.spill.records == 0) && q.fits(e) {
+		q.push(e)
+		return false, nil
+	}
+	if q.spill == nil || !q.spill.fits(e) {
+		return false, ErrQueueFull
+	}
+	err = q.spill.append(e)
+	if err != nil {
+		return false, fmt.Errorf("error spilling data to file: %s", err)
+	}
+	q.observe()
+	q.signal()
+	return true, nil
+}
+
+// fits checks if an entry fits in memory. An entry larger than the queue fits if the queue is empty.
+func (q *IngestQueue) fits(e *queueEntry) bool {
+	return q.records == 0 || q.records+e.records <= q.size
+}
+
+func (q *IngestQueue) push(e *queueEntry) {
+	q.entries = append(q.entries, e)
+	q.records += e.records
+	q.observe()
+	q.signal()
+	if q.records >= q.batchSize {
+		select {
+		case q.filled <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *IngestQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (q *IngestQueue) wait(ctx context.Context, e *queueEntry) (map[string]Duplicates, error) {
+	select {
+	case result := <-e.done:
+		return result.report, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// RetryAfter returns the time in seconds after which a submission rejected because the queue was full may be retried
+func (q *IngestQueue) RetryAfter() int {
+	return q.retryAfter
+}
+
+// policyOf returns the duplicates policy of a series, following the queued storage
+func (q *IngestQueue) policyOf(ts *registry.TimeSeries) string {
+	if storage, ok := q.Storage.(policyStorage); ok {
+		return storage.policyOf(ts)
+	}
+	return duplicatesPolicy(ts, "")
+}
+
+// run writes the queued data in batches until the queue is closed
+func (q *IngestQueue) run() {
+	defer close(q.stopped)
+	for {
+		select {
+		case <-q.ready:
+		case <-q.stop:
+			for q.writeBatch(false) {
+			}
+			return
+		}
+		// give the batch time to fill up
+		timer := time.NewTimer(q.batchDelay)
+		select {
+		case <-timer.C:
+		case <-q.filled:
+		case <-q.stop:
+		}
+		timer.Stop()
+		for q.writeBatch(true) {
+		}
+	}
+}
+
+// writeBatch writes the records of the oldest entries in memory up to the batch size,
+// or of the spilled entries if there are none in memory. It returns false if there was nothing to write.
+func (q *IngestQueue) writeBatch(spilled bool) bool {
+	q.Lock()
+	var batch []*queueEntry
+	records := 0
+	for _, e := range q.entries {
+		if len(batch) > 0 && records+e.records > q.batchSize {
+			break
+		}
+		batch = append(batch, e)
+		records += e.records
+	}
+	var next int64
+	fromSpill := false
+	// the spilled data is left for the restart once the queue is closed
+	if len(batch) == 0 && spilled && !q.closed && q.spill != nil && q.spill.records > 0 {
+		var err error
+		batch, next, err = q.spill.read(q.batchSize)
+		if err != nil {
+			q.Unlock()
+			log.Printf("Queue: error reading the spill file: %s", err)
+			return false
+		}
+		fromSpill = true
+	}
+	q.Unlock()
+	if len(batch) == 0 && !fromSpill {
+		return false
+	}
+
+	q.write(batch)
+
+	q.Lock()
+	defer q.Unlock()
+	if fromSpill {
+		err := q.spill.advance(next, batch)
+		if err != nil {
+			log.Printf("Queue: error advancing the spill file: %s", err)
+		}
+	} else {
+		q.entries = q.entries[len(batch):]
+		q.records -= records
+	}
+	q.observe()
+	q.room.Broadcast()
+	return true
+}
+
+// write writes the entries in a transaction, if the storage supports it. If that fails, the entries are written one by one,
+// so that only the failing ones are rejected. The duplicates of each entry are reported as if it was written after the ones before it.
+func (q *IngestQueue) write(batch []*queueEntry) {
+	if len(batch) == 0 {
+		return
+	}
+	if storage, ok := q.Storage.(batchStorage); ok && len(batch) > 1 {
+		data := make([]map[string]senml.Pack, len(batch))
+		series := make(map[string]*registry.TimeSeries)
+		for i, e := range batch {
+			data[i] = e.Data
+			for name := range e.Data {
+				series[name] = e.Series[name]
+			}
+		}
+		reports, err := storage.SubmitBatch(context.Background(), data, series)
+		if err == nil {
+			for i, e := range batch {
+				q.done(e, reports[i], nil)
+			}
+			return
+		}
+	}
+	for _, e := range batch {
+		report, err := q.Storage.Submit(context.Background(), e.Data, e.Series)
+		q.done(e, report, err)
+	}
+}
+
+// done delivers the result of writing an entry to its submitter. If nobody waits for it, the result is logged,
+// and the data kept as dead letter if it was rejected.
+func (q *IngestQueue) done(e *queueEntry, report map[string]Duplicates, err error) {
+	if e.done != nil {
+		e.done <- queueResult{report: report, err: err}
+		return
+	}
+	if err != nil {
+		log.Printf("Queue: error writing the data from %s %s: %s", e.Origin.Broker, e.Origin.Topic, err)
+		letter := e.Origin
+		letter.Reason = "Error writing data to the database: " + err.Error()
+		keepDeadLetter(q.deadLetters, senmlDeadLetter(letter, e.Data))
+		return
+	}
+	if summary := duplicatesSummary(report); summary != "" {
+		log.Printf("Queue: duplicates in the data from %s %s: %s", e.Origin.Broker, e.Origin.Topic, summary)
+	}
+}
+
+// close writes the data queued in memory and stops the queue
+func (q *IngestQueue) close() error {
+	q.Lock()
+	if q.closed {
+		q.Unlock()
+		return nil
+	}
+	q.closed = true
+	q.room.Broadcast()
+	q.Unlock()
+	close(q.stop)
+	<-q.stopped
+	if q.spill != nil {
+		return q.spill.close()
+	}
+	return nil
+}
+
+// observe updates the metrics of the queue depth
+func (q *IngestQueue) observe() {
+	queueRecords.WithLabelValues("memory").Set(float64(q.records))
+	if q.spill != nil {
+		queueRecords.WithLabelValues("spill").Set(float64(q.spill.records))
+	}
+}
+
+// spillFile stores queued entries as lines of JSON, from the offset of the oldest one to the end.
+// The offset is kept in a file next to it, so that the entries written before a restart are not written again.
+type spillFile struct {
+	file        *os.File
+	offsetFile  *os.File
+	size        int
+	offset, end int64
+	records     int
+}
+
+func openSpillFile(path string, size int) (*spillFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	offsetFile, err := os.OpenFile(path+".offset", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	s := &spillFile{file: file, offsetFile: offsetFile, size: size}
+	err = s.load()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the offset and counts the records of the entries after it
+func (s *spillFile) load() error {
+	b, err := io.ReadAll(s.offsetFile)
+	if err != nil {
+		return err
+	}
+	if len(bytes.TrimSpace(b)) != 0 {
+		s.offset, err = strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid offset of the spill file: %s", err)
+		}
+	}
+	reader := bufio.NewReader(s.file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		var e queueEntry
+		if err := json.Unmarshal(line, &e); err == nil && s.end >= s.offset {
+			s.records += newQueueEntry(e.Data, e.Series, e.Origin).records
+		}
+		s.end += int64(len(line))
+	}
+	if s.offset > s.end {
+		// the file was emptied before its offset was reset
+		s.offset = 0
+	}
+	// drop the entry which was being spilled when the service stopped
+	return s.file.Truncate(s.end)
+}
+
+func (s *spillFile) close() error {
+	err := s.file.Close()
+	if offsetErr := s.offsetFile.Close(); err == nil {
+		err = offsetErr
+	}
+	return err
+}
+
+func (s *spillFile) fits(e *queueEntry) bool {
+	return s.records+e.records <= s.size
+}
+
+// append writes an entry to the end of the file and syncs it to the disk
+func (s *spillFile) append(e *queueEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	_, err = s.file.WriteAt(b, s.end)
+	if err == nil {
+		err = s.file.Sync()
+	}
+	if err != nil {
+		// overwritten by the next entry
+		return err
+	}
+	s.end += int64(len(b))
+	s.records += e.records
+	return nil
+}
+
+// read returns the oldest entries up to the given number of records (at least one entry), and the offset of the ones after.
+// Entries which cannot be decoded are skipped.
+func (s *spillFile) read(records int) (entries []*queueEntry, next int64, err error) {
+	next = s.offset
+	reader := bufio.NewReader(io.NewSectionReader(s.file, s.offset, s.end-s.offset))
+	total := 0
+	for next < s.end {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, 0, err
+		}
+		var e queueEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Printf("Queue: skipping invalid entry in the spill file: %s", err)
+			next += int64(len(line))
+			continue
+		}
+		entry := newQueueEntry(e.Data, e.Series, e.Origin)
+		if len(entries) > 0 && total+entry.records > records {
+			break
+		}
+		entries = append(entries, entry)
+		total += entry.records
+		next += int64(len(line))
+	}
+	return entries, next, nil
+}
+
+// advance removes the entries before the given offset, which is synced to the disk.
+// The file is emptied once all entries are written.
+func (s *spillFile) advance(next int64, entries []*queueEntry) error {
+	s.offset = next
+	for _, e := range entries {
+		s.records -= e.records
+	}
+	if s.offset >= s.end {
+		s.offset, s.end, s.records = 0, 0, 0
+		// emptied before the offset is reset, else the entries would be written again after a restart in between
+		if err := s.file.Truncate(0); err != nil {
+			return err
+		}
+	}
+	// a fixed width, so that the previous offset is overwritten entirely
+	_, err := s.offsetFile.WriteAt([]byte(fmt.Sprintf("%020d\n", s.offset)), 0)
+	if err == nil {
+		err = s.offsetFile.Sync()
+	}
+	return err
+}
@@ -0,0 +1,377 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// countingStorage counts the submissions which reach the storage, i.e. the transactions
+type countingStorage struct {
+	Storage
+	submits int32
+}
+
+func (s *countingStorage) Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) (map[string]Duplicates, error) {
+	atomic.AddInt32(&s.submits, 1)
+	return s.Storage.Submit(ctx, data, series)
+}
+
+func (s *countingStorage) SubmitBatch(ctx context.Context, batch []map[string]senml.Pack, series map[string]*registry.TimeSeries) ([]map[string]Duplicates, error) {
+	atomic.AddInt32(&s.submits, 1)
+	return s.Storage.(batchStorage).SubmitBatch(ctx, batch, series)
+}
+
+func queuedRecord(name string, t float64) senml.Record {
+	v := t
+	return senml.Record{Name: name, Time: 1594000800 + t, Value: &v}
+}
+
+func countStored(t *testing.T, storage Storage, ts *registry.TimeSeries) int {
+	total, err := storage.Count(context.Background(), Query{To: FromSenmlTime(1594001800)}, ts)
+	if err != nil {
+		t.Fatalf("Error counting the records of %s: %s", ts.Name, err)
+	}
+	return total
+}
+
+func TestIngestQueue_Batches(t *testing.T) {
+	funcName := "TestIngestQueue_Batches"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	counting := &countingStorage{Storage: dataStorage}
+	queue, closeQueue, err := NewIngestQueue(counting, common.QueueConf{Size: 1000, BatchSize: 100, BatchDelay: 200}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeQueue()
+	controller := NewController(regController, queue, false)
+
+	ts, addErr := regController.Add(registry.TimeSeries{Name: "sensor", Type: registry.Float})
+	if addErr != nil {
+		t.Fatal(addErr)
+	}
+	rejecting, addErr := regController.Add(registry.TimeSeries{Name: "rejecting", Type: registry.Float, Duplicates: registry.DuplicatesReject})
+	if addErr != nil {
+		t.Fatal(addErr)
+	}
+
+	t.Run("coalesced", func(t *testing.T) {
+		const submissions = 20
+		var wg sync.WaitGroup
+		errs := make(chan error, submissions)
+		for i := 0; i < submissions; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				report, err := controller.Submit(context.Background(), senml.Pack{queuedRecord(ts.Name, float64(i))}, nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, found := report[ts.Name]; !found || len(report) != 1 {
+					t.Errorf("Expected the report of %s only, got %v", ts.Name, report)
+				}
+			}(i)
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Fatalf("Error submitting: %s", err)
+		}
+		if stored := countStored(t, dataStorage, ts); stored != submissions {
+			t.Errorf("Expected %d records to be stored, got %d", submissions, stored)
+		}
+		if submits := atomic.LoadInt32(&counting.submits); submits >= submissions {
+			t.Errorf("Expected the submissions to be written in fewer transactions, got %d", submits)
+		}
+	})
+
+	t.Run("duplicates of each submission", func(t *testing.T) {
+		// the submissions share a batch, and each of them gets the report of its own records
+		packs := []senml.Pack{{queuedRecord(ts.Name, 100), queuedRecord(ts.Name, 100)}, {queuedRecord(ts.Name, 200)}}
+		reports := make([]map[string]Duplicates, len(packs))
+		var wg sync.WaitGroup
+		for i, pack := range packs {
+			wg.Add(1)
+			go func(i int, pack senml.Pack) {
+				defer wg.Done()
+				var err error
+				reports[i], err = controller.Submit(context.Background(), pack, nil)
+				if err != nil {
+					t.Errorf("Error submitting: %s", err)
+				}
+			}(i, pack)
+		}
+		wg.Wait()
+		for i, count := range []int{1, 0} {
+			if reports[i][ts.Name].Count != count {
+				t.Errorf("Expected %d duplicates in submission %d, got %v", count, i, reports[i])
+			}
+		}
+	})
+
+	t.Run("failing submission in batch", func(t *testing.T) {
+		// both submissions are in a batch, which is rejected as a whole and then written one by one
+		var wg sync.WaitGroup
+		errs := make([]error, 2)
+		for i := range errs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = queue.Submit(context.Background(), map[string]senml.Pack{rejecting.Name: {queuedRecord(rejecting.Name, 0)}},
+					map[string]*registry.TimeSeries{rejecting.Name: rejecting})
+			}(i)
+		}
+		wg.Wait()
+		if (errs[0] == nil) == (errs[1] == nil) {
+			t.Fatalf("Expected one of the submissions to fail, got %v", errs)
+		}
+		for _, err := range errs {
+			if err != nil && !errors.Is(err, ErrDuplicate) {
+				t.Errorf("Expected a duplicate error, got %s", err)
+			}
+		}
+		if stored := countStored(t, dataStorage, rejecting); stored != 1 {
+			t.Errorf("Expected 1 record to be stored, got %d", stored)
+		}
+	})
+}
+
+func TestIngestQueue_Full(t *testing.T) {
+	funcName := "TestIngestQueue_Full"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	// the batch is not written before the queue is closed
+	queue, closeQueue, err := NewIngestQueue(dataStorage, common.QueueConf{Size: 2, BatchDelay: 60000, RetryAfter: 5}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := NewController(regController, queue, false)
+	ts, addErr := regController.Add(registry.TimeSeries{Name: "sensor", Type: registry.Float})
+	if addErr != nil {
+		t.Fatal(addErr)
+	}
+
+	queued := make(chan common.Error)
+	go func() {
+		_, err := controller.Submit(context.Background(), senml.Pack{queuedRecord(ts.Name, 0), queuedRecord(ts.Name, 1)}, nil)
+		queued <- err
+	}()
+	for {
+		queue.Lock()
+		records := queue.records
+		queue.Unlock()
+		if records == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	_, submitErr := controller.Submit(context.Background(), senml.Pack{queuedRecord(ts.Name, 2)}, nil)
+	unavailable, ok := submitErr.(*common.ServiceUnavailableError)
+	if !ok {
+		t.Fatalf("Expected the service to be unavailable, got %v", submitErr)
+	}
+	w := httptest.NewRecorder()
+	common.HttpErrorResponse(submitErr, w)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "5" {
+		t.Errorf("Expected status 503 with Retry-After 5, got %d with %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if unavailable.RetryAfter != 5 {
+		t.Errorf("Expected to retry after 5 seconds, got %d", unavailable.RetryAfter)
+	}
+
+	// waiting for room ends with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	data := map[string]senml.Pack{ts.Name: {queuedRecord(ts.Name, 3)}}
+	if _, err := queue.SubmitDurable(ctx, data, map[string]*registry.TimeSeries{ts.Name: ts}, DeadLetter{}); err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait for room to end with the context, got %v", err)
+	}
+
+	// closing writes the queued data
+	err = closeQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-queued; err != nil {
+		t.Fatalf("Error submitting: %s", err)
+	}
+	if stored := countStored(t, dataStorage, ts); stored != 2 {
+		t.Errorf("Expected 2 records to be stored, got %d", stored)
+	}
+	if _, err := queue.Submit(context.Background(), nil, nil); err != ErrQueueClosed {
+		t.Errorf("Expected the queue to be closed, got %v", err)
+	}
+}
+
+func TestIngestQueue_Spill(t *testing.T) {
+	funcName := "TestIngestQueue_Spill"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	spillFile := os.TempDir() + "/" + funcName + ".spill"
+	deleteFile(spillFile)
+	deleteFile(spillFile + ".offset")
+	defer deleteFile(spillFile)
+	defer deleteFile(spillFile + ".offset")
+	conf := common.QueueConf{Size: 1, BatchDelay: 60000, SpillFile: spillFile, SpillSize: 2}
+
+	queue, closeQueue, err := NewIngestQueue(dataStorage, conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, addErr := regController.Add(registry.TimeSeries{Name: "sensor", Type: registry.Float})
+	if addErr != nil {
+		t.Fatal(addErr)
+	}
+	submit := func(i float64) (map[string]senml.Pack, map[string]*registry.TimeSeries) {
+		return map[string]senml.Pack{ts.Name: {queuedRecord(ts.Name, i)}}, map[string]*registry.TimeSeries{ts.Name: ts}
+	}
+	enqueue := func(i float64) error {
+		data, series := submit(i)
+		return queue.Enqueue(data, series, DeadLetter{})
+	}
+
+	// in memory
+	if err := enqueue(0); err != nil {
+		t.Fatalf("Error queueing in memory: %s", err)
+	}
+	// spilled
+	if err := enqueue(1); err != nil {
+		t.Fatalf("Error spilling: %s", err)
+	}
+	data, series := submit(2)
+	report, err := queue.SubmitDurable(context.Background(), data, series, DeadLetter{})
+	if err != nil || report != nil {
+		t.Fatalf("Expected the data to be spilled, got %v, %v", report, err)
+	}
+	// full
+	if err := enqueue(3); err != ErrQueueFull {
+		t.Fatalf("Expected the queue to be full, got %v", err)
+	}
+
+	// closing writes the data in memory only
+	err = closeQueue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := countStored(t, dataStorage, ts); stored != 1 {
+		t.Fatalf("Expected 1 record to be stored, got %d", stored)
+	}
+
+	// the spilled data is written after a restart
+	conf.BatchDelay = 1
+	queue, closeQueue, err = NewIngestQueue(dataStorage, conf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; countStored(t, dataStorage, ts) != 3; i++ {
+		if i == 1000 {
+			t.Fatalf("Expected 3 records to be stored, got %d", countStored(t, dataStorage, ts))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	info, err := os.Stat(spillFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; info.Size() != 0; i++ {
+		if i == 1000 {
+			t.Fatalf("Expected the spill file to be emptied, got %d bytes", info.Size())
+		}
+		time.Sleep(time.Millisecond)
+		info, _ = os.Stat(spillFile)
+	}
+	if err := closeQueue(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("restart after a partial drain", func(t *testing.T) {
+		// written again, the records would be stored twice
+		sequenced, addErr := regController.Add(registry.TimeSeries{Name: "sequenced", Type: registry.Float, Duplicates: registry.DuplicatesSequence})
+		if addErr != nil {
+			t.Fatal(addErr)
+		}
+		spill, err := openSpillFile(spillFile, conf.SpillSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			e := newQueueEntry(map[string]senml.Pack{sequenced.Name: {queuedRecord(sequenced.Name, float64(i))}},
+				map[string]*registry.TimeSeries{sequenced.Name: sequenced}, DeadLetter{})
+			if err := spill.append(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// the service stops after the first entry is written
+		entries, next, err := spill.read(1)
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("Expected to read 1 entry, got %d: %v", len(entries), err)
+		}
+		if _, err := dataStorage.Submit(context.Background(), entries[0].Data, entries[0].Series); err != nil {
+			t.Fatal(err)
+		}
+		if err := spill.advance(next, entries); err != nil {
+			t.Fatal(err)
+		}
+		if err := spill.close(); err != nil {
+			t.Fatal(err)
+		}
+
+		_, closeQueue, err := NewIngestQueue(dataStorage, conf, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer closeQueue()
+		info, _ := os.Stat(spillFile)
+		for i := 0; info.Size() != 0; i++ {
+			if i == 1000 {
+				t.Fatalf("Expected the spill file to be emptied, got %d bytes", info.Size())
+			}
+			time.Sleep(time.Millisecond)
+			info, _ = os.Stat(spillFile)
+		}
+		if stored := countStored(t, dataStorage, sequenced); stored != 2 {
+			t.Errorf("Expected 2 records to be stored, got %d", stored)
+		}
+	})
+}
@@ -0,0 +1,147 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+const (
+	retentionInterval  = 10 * time.Minute // interval between two rounds of retention enforcement
+	retentionBatchSize = 1000             // max number of entries deleted in one transaction
+	retentionLogEvery  = 100              // log progress after this many batches of the same series
+)
+
+// purgeFunction deletes at most limit entries of a series which are older than the given senml time
+// and returns the number of deleted entries
+type purgeFunction func(ctx context.Context, series string, before float64, limit int) (int64, error)
+
+// retentionJanitor periodically removes the data which is older than the retention period of each series
+type retentionJanitor struct {
+	sync.Mutex
+	periods map[string]time.Duration
+	purge   purgeFunction
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newRetentionJanitor(purge purgeFunction) *retentionJanitor {
+	return &retentionJanitor{
+		periods: make(map[string]time.Duration),
+		purge:   purge,
+	}
+}
+
+// set adds, updates or removes (when empty) the retention period of a series
+func (j *retentionJanitor) set(ts registry.TimeSeries) error {
+	period, err := common.ParsePeriod(ts.Retention)
+	if err != nil {
+		return fmt.Errorf("retention of %s: %s", ts.Name, err)
+	}
+	j.Lock()
+	defer j.Unlock()
+	if period == 0 {
+		delete(j.periods, ts.Name)
+		return nil
+	}
+	j.periods[ts.Name] = period
+	return nil
+}
+
+// remove stops enforcing the retention of a series
+func (j *retentionJanitor) remove(name string) {
+	j.Lock()
+	defer j.Unlock()
+	delete(j.periods, name)
+}
+
+// start runs the janitor in the background until close is called
+func (j *retentionJanitor) start(interval time.Duration) {
+	j.Lock()
+	defer j.Unlock()
+	if j.stop != nil {
+		return // already running
+	}
+	j.stop = make(chan struct{})
+	j.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				select {
+				case <-stop:
+					cancel()
+				case <-ctx.Done():
+				}
+			}()
+			j.run(ctx)
+			cancel()
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}(j.stop, j.done)
+}
+
+// close stops the background janitor and waits for the running round to finish
+func (j *retentionJanitor) close() {
+	j.Lock()
+	stop, done := j.stop, j.done
+	j.stop, j.done = nil, nil
+	j.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// run enforces the retention of all series once
+func (j *retentionJanitor) run(ctx context.Context) {
+	j.Lock()
+	periods := make(map[string]time.Duration, len(j.periods))
+	for name, period := range j.periods {
+		periods[name] = period
+	}
+	j.Unlock()
+
+	now := time.Now()
+	for name, period := range periods {
+		if ctx.Err() != nil {
+			return
+		}
+		before := now.Add(-period)
+		var total int64
+		for batch := 1; ; batch++ {
+			n, err := j.purge(ctx, name, ToSenmlTime(before), retentionBatchSize)
+			if err != nil {
+				log.Printf("Retention: Error deleting expired data of %s: %s", name, err)
+				break
+			}
+			total += n
+			if n < retentionBatchSize {
+				break
+			}
+			if batch%retentionLogEvery == 0 {
+				log.Printf("Retention: Deleted %d entries of %s so far", total, name)
+			}
+		}
+		if total > 0 {
+			log.Printf("Retention: Deleted %d entries of %s older than %s", total, name, before.UTC().Format(time.RFC3339))
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// A rollup is a series which is continuously aggregated from a source series.
+// Each entry of a rollup covers the interval (time-interval, time] of the source series,
+// i.e. the time of an entry is the end of its interval, the same as with the aggregated queries.
+type rollup struct {
+	name      string
+	source    string
+	aggregate string
+	interval  float64 // seconds
+}
+
+func newRollup(ts registry.TimeSeries) (rollup, error) {
+	if ts.Source.SeriesSource == nil {
+		return rollup{}, fmt.Errorf("missing source of rollup series %s", ts.Name)
+	}
+	interval, err := common.ParsePeriod(ts.Source.Interval)
+	if err != nil {
+		return rollup{}, fmt.Errorf("interval of rollup series %s: %s", ts.Name, err)
+	}
+	if interval == 0 {
+		return rollup{}, fmt.Errorf("missing interval of rollup series %s", ts.Name)
+	}
+	return rollup{
+		name:      ts.Name,
+		source:    ts.Source.Series,
+		aggregate: ts.Source.Aggregate,
+		interval:  interval.Seconds(),
+	}, nil
+}
+
+// label returns the time of the rollup entry covering the given time
+func (r rollup) label(t float64) float64 {
+	return math.Ceil(t/r.interval) * r.interval
+}
+
+// labelRanges returns the ranges of consecutive rollup entries covering the given times
+func (r rollup) labelRanges(times []float64) (ranges [][2]float64) {
+	if len(times) == 0 {
+		return nil
+	}
+	labels := make([]float64, len(times))
+	for i, t := range times {
+		labels[i] = r.label(t)
+	}
+	sort.Float64s(labels)
+
+	current := [2]float64{labels[0], labels[0]}
+	for _, l := range labels[1:] {
+		if l-current[1] > r.interval*1.5 { // not adjacent
+			ranges = append(ranges, current)
+			current = [2]float64{l, l}
+		} else {
+			current[1] = l
+		}
+	}
+	return append(ranges, current)
+}
+
+// aligned checks if the aggregation windows, one of which ends at the given time, are composed of rollup entries.
+// The time is q.To for the windows aligned to the end of the query and zero for the windows aligned to the epoch.
+func (r rollup) aligned(window float64, end float64) bool {
+	return window >= r.interval && math.Mod(window, r.interval) == 0 && math.Mod(end, r.interval) == 0
+}
+
+// rollupRegistry keeps track of the rollups of each source series
+type rollupRegistry struct {
+	sync.RWMutex
+	bySource map[string][]rollup
+}
+
+func newRollupRegistry() *rollupRegistry {
+	return &rollupRegistry{bySource: make(map[string][]rollup)}
+}
+
+func (rr *rollupRegistry) add(r rollup) {
+	rr.Lock()
+	defer rr.Unlock()
+	rr.bySource[r.source] = append(rr.bySource[r.source], r)
+}
+
+func (rr *rollupRegistry) remove(name string) {
+	rr.Lock()
+	defer rr.Unlock()
+	for source, rollups := range rr.bySource {
+		for i, r := range rollups {
+			if r.name == name {
+				rr.bySource[source] = append(rollups[:i:i], rollups[i+1:]...)
+				if len(rr.bySource[source]) == 0 {
+					delete(rr.bySource, source)
+				}
+				return
+			}
+		}
+	}
+}
+
+// of returns the rollups of a source series
+func (rr *rollupRegistry) of(source string) []rollup {
+	rr.RLock()
+	defer rr.RUnlock()
+	return rr.bySource[source]
+}
+
+// best returns the coarsest rollup of the source series which can be used to answer an aggregated query
+func (rr *rollupRegistry) best(source string, window float64, end float64) *rollup {
+	var best *rollup
+	for _, r := range rr.of(source) {
+		if !r.aligned(window, end) {
+			continue
+		}
+		if best == nil || r.interval > best.interval {
+			r := r
+			best = &r
+		}
+	}
+	return best
+}
+
+// combinableAggregate checks if the aggregate can be calculated from the partial aggregates stored in the rollups
+func combinableAggregate(aggr string) bool {
+	switch aggr {
+	case "mean", "sum", "min", "max", "count", "spread":
+		return true
+	}
+	return false
+}
+
+// combinableAggregates checks if all the aggregates can be calculated from the rollups
+func combinableAggregates(aggrs []string) bool {
+	for _, aggr := range aggrs {
+		if !combinableAggregate(aggr) {
+			return false
+		}
+	}
+	return true
+}
+
+// combineRollupAggr returns the sql expression which combines the partial aggregates (sum, count, min, max) of the rollups
+func combineRollupAggr(aggr string) string {
+	switch aggr {
+	case "mean":
+		return "SUM(sum)*1.0/SUM(count)"
+	case "sum":
+		return "SUM(sum)"
+	case "min":
+		return "MIN(min)"
+	case "max":
+		return "MAX(max)"
+	case "count":
+		return "SUM(count)"
+	case "spread":
+		return "(MAX(max)-MIN(min))"
+	default:
+		panic("Invalid aggregation for rollup:" + aggr)
+	}
+}
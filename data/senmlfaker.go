@@ -96,8 +96,8 @@ func Diff_name_diff_types() senml.Pack {
 	var s = []senml.Record{
 		{BaseName: "dev123",
 			BaseTime: -45.67,
-			BaseUnit: "degC",
-			Value:    &value, Unit: "degC", Name: "temp", Time: -1.0, UpdateTime: 10.0, Sum: &sum},
+			BaseUnit: "Cel",
+			Value:    &value, Unit: "Cel", Name: "temp", Time: -1.0, UpdateTime: 10.0, Sum: &sum},
 		{StringValue: "kitchen", Name: "room", Time: -1.0},
 		{DataValue: "abc", Name: "data"},
 		{BoolValue: &vb, Name: "ok"},
@@ -4,7 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"log"
+	"math"
 	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,121 +18,326 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
+// sqlQueryTimeout bounds all queries except the streamed ones
 var sqlQueryTimeout = 30 * time.Second
 
 // SqlStorage implements a SqlDB storage client for HDS Data API
 type SqlStorage struct {
 	pool        *sql.DB
+	dialect     sqlDialect
 	updateMutex sync.Mutex
+	retention   *retentionJanitor
+	rollups     *rollupRegistry
+	latest      *latestCache
+	// duplicates is the default policy for times which are taken
+	duplicates string
+	// sequenced caches if the tables of the series have sequence numbers
+	sequenced sync.Map
 }
 
+// NewSqlStorage returns a storage client for a SQLite database file
 func NewSqlStorage(conf common.DataConf) (storage *SqlStorage, disconnect_func func() error, err error) {
-	storage = new(SqlStorage)
-	storage.pool, err = sql.Open("sqlite3", conf.Backend.DSN) //In future, this shall be made configurable.
+	return newSqlStorage(sqliteDialect{}, conf)
+}
+
+func newSqlStorage(dialect sqlDialect, conf common.DataConf) (storage *SqlStorage, disconnect_func func() error, err error) {
+	storage = &SqlStorage{dialect: dialect, duplicates: conf.Duplicates}
+	storage.pool, err = sql.Open(dialect.driver(), conf.Backend.DSN)
 	if err != nil {
 		return nil, nil, err
 	}
+	storage.retention = newRetentionJanitor(storage.purge)
+	storage.rollups = newRollupRegistry()
+	storage.latest = newLatestCache(storage.loadLatest)
 
 	return storage, storage.Disconnect, err
 }
 
-func btoi(b bool) int {
-	if b {
-		return 1
+// lockWrites serializes the modifications if required by the database. It returns the unlock function.
+func (s *SqlStorage) lockWrites() func() {
+	if !s.dialect.serializeWrites() {
+		return func() {}
 	}
-	return 0
+	s.updateMutex.Lock()
+	return s.updateMutex.Unlock
 }
 
-func (s *SqlStorage) Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) (err error) {
-	s.updateMutex.Lock()
-	defer s.updateMutex.Unlock()
+// Start loads the per-series settings and the latest values from the registry and starts the background jobs
+func (s *SqlStorage) Start(reg registry.Controller) error {
+	ctx := context.Background()
+	perPage := 100
+	for page := 1; ; page++ {
+		series, total, err := reg.GetMany(page, perPage)
+		if err != nil {
+			return fmt.Errorf("error getting time series: %v", err)
+		}
+
+		for _, ts := range series {
+			err := s.retention.set(ts)
+			if err != nil {
+				log.Printf("Retention: %s", err)
+			}
+			if ts.Source.SrcType == registry.Series {
+				r, err := newRollup(ts)
+				if err != nil {
+					log.Printf("Rollup: %s", err)
+					continue
+				}
+				s.rollups.add(r)
+			}
+			if ts.Source.SrcType == registry.Virtual {
+				continue
+			}
+			_, err = s.latest.get(ctx, ts)
+			if err != nil {
+				log.Printf("Latest: error loading the latest value of %s: %s", ts.Name, err)
+			}
+		}
+
+		if page*perPage >= total {
+			break
+		}
+	}
+
+	s.retention.start(retentionInterval)
+	return nil
+}
+
+func (s *SqlStorage) Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) (report map[string]Duplicates, err error) {
+	reports, err := s.SubmitBatch(ctx, []map[string]senml.Pack{data}, series)
+	if err != nil {
+		return nil, err
+	}
+	return reports[0], nil
+}
+
+// SubmitBatch writes several submissions in a transaction. The records of a submission whose time was taken by an earlier one
+// are handled as if it was stored before, so that each submission gets the report of its own records.
+func (s *SqlStorage) SubmitBatch(ctx context.Context, batch []map[string]senml.Pack, series map[string]*registry.TimeSeries) (reports []map[string]Duplicates, err error) {
+	defer observeDuration("submit", time.Now())
+	sequenced := make(map[string]bool, len(series))
+	for _, data := range batch {
+		for dsName := range data {
+			if _, found := sequenced[dsName]; found {
+				continue
+			}
+			sequenced[dsName], err = s.isSequenced(ctx, dsName)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	defer s.lockWrites()()
 	tx, txErr := s.pool.BeginTx(ctx, nil)
 	if txErr != nil {
-		return txErr
+		return nil, txErr
 	}
 
-	err = s.submit(tx, ctx, data, series)
+	written := make(map[string]senml.Pack, len(sequenced))
+	reports = make([]map[string]Duplicates, len(batch))
+	for i, data := range batch {
+		var submitted map[string]senml.Pack
+		submitted, reports[i], err = s.submit(tx, ctx, data, series, sequenced)
+		if err != nil {
+			break
+		}
+		for dsName, pack := range submitted {
+			written[dsName] = append(written[dsName], pack...)
+		}
+	}
+	if err == nil {
+		err = s.updateRollups(tx, ctx, written)
+	}
 
 	if err != nil {
 		rollbackErr := tx.Rollback()
-		errStr := fmt.Sprintf("error inserting: %s", err)
 		if rollbackErr != nil {
-			errStr += fmt.Sprintf(", error during rollback: %s", rollbackErr)
+			return nil, fmt.Errorf("error inserting: %w, error during rollback: %s", err, rollbackErr)
 		}
-		return fmt.Errorf(errStr)
-
+		return nil, fmt.Errorf("error inserting: %w", err)
 	}
 
-	return tx.Commit()
-
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	s.latest.update(written)
+	for dsName := range written {
+		for _, r := range s.rollups.of(dsName) {
+			s.latest.invalidate(r.name)
+		}
+	}
+	return reports, nil
 }
 
-func (s *SqlStorage) submit(tx *sql.Tx, ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) (err error) {
+// submit writes the data following the duplicates policy of each series. It returns the records which were written.
+func (s *SqlStorage) submit(tx *sql.Tx, ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries,
+	sequenced map[string]bool) (written map[string]senml.Pack, report map[string]Duplicates, err error) {
 	const MAX_ENTRIES_PER_TX = 100
+	written = make(map[string]senml.Pack, len(data))
+	report = make(map[string]Duplicates, len(data))
 	for dsName, pack := range data {
-		valueStrings := make([]string, 0, MAX_ENTRIES_PER_TX)
-		valueArgs := make([]interface{}, 0, MAX_ENTRIES_PER_TX*2)
-
-		execStmt := func() (execErr error) {
-			stmt := fmt.Sprintf("REPLACE INTO [%s] (time, value) VALUES %s",
-				dsName, strings.Join(valueStrings, ","))
-			_, execErr = tx.ExecContext(ctx, stmt, valueArgs...)
-			return execErr
-		}
-		write := func(index int, time float64, value interface{}) (writeErr error) {
-			valueStrings = append(valueStrings, "(?, ?)")
-			valueArgs = append(valueArgs, time, value)
-			if (index+1)%MAX_ENTRIES_PER_TX == 0 { //index+1 to ignore 0th index
-				writeErr = execStmt()
-				//reset the slices to empty
-				valueStrings = valueStrings[:0]
-				valueArgs = valueArgs[:0]
-			}
-			return writeErr
-		}
-		switch series[dsName].Type {
-		case registry.Float:
-			for index, r := range pack {
-				err = write(index, r.Time, *r.Value)
-				if err != nil {
-					return err
-				}
+		ts := series[dsName]
+		policy := duplicatesPolicy(ts, s.duplicates)
+		if policy == registry.DuplicatesSequence && !sequenced[dsName] {
+			return nil, nil, fmt.Errorf("the table of %s was created without sequence numbers and cannot store duplicates", dsName)
+		}
+		pack, repeated := uniqueTimes(pack, policy)
+		if policy == registry.DuplicatesReject && repeated != 0 {
+			return nil, nil, fmt.Errorf("%w: %d records of %s have the same time", ErrDuplicate, repeated, dsName)
+		}
+		duplicates := Duplicates{Policy: policy, Count: repeated}
+		table := s.dialect.table(dsName)
+		// the next sequence number of each time
+		next := make(map[float64]int)
+		for start := 0; start < len(pack); start += MAX_ENTRIES_PER_TX {
+			chunk := pack[start:]
+			if len(chunk) > MAX_ENTRIES_PER_TX {
+				chunk = chunk[:MAX_ENTRIES_PER_TX]
 			}
-		case registry.String:
-			for index, r := range pack {
-				err = write(index, r.Time, r.StringValue)
+			// the stored records are replaced without looking them up under the overwrite policy
+			var taken map[float64]int
+			if policy != registry.DuplicatesOverwrite {
+				taken, err = s.takenTimes(ctx, tx, table, sequenced[dsName], chunk)
 				if err != nil {
-					return err
+					return nil, nil, err
 				}
 			}
-		case registry.Bool:
-			for index, r := range pack {
-				err = write(index, r.Time, btoi(*r.BoolValue))
-				if err != nil {
-					return err
+			valueStrings := make([]string, 0, len(chunk))
+			valueArgs := make([]interface{}, 0, len(chunk)*3)
+			for _, r := range chunk {
+				seq, found := next[r.Time]
+				if !found {
+					seq, found = taken[r.Time]
 				}
-			}
-		case registry.Data:
-			for index, r := range pack {
-				err = write(index, r.Time, r.DataValue)
-				if err != nil {
-					return err
+				if found {
+					duplicates.Count++
+					switch policy {
+					case registry.DuplicatesReject:
+						return nil, nil, fmt.Errorf("%w: the time %f of %s is taken", ErrDuplicate, r.Time, dsName)
+					case registry.DuplicatesKeepFirst:
+						continue
+					}
 				}
+				if policy == registry.DuplicatesSequence {
+					valueStrings = append(valueStrings, "(?, ?, ?)")
+					valueArgs = append(valueArgs, r.Time, seq, storedValue(r, ts.Type))
+					next[r.Time] = seq + 1
+				} else {
+					valueStrings = append(valueStrings, "(?, ?)")
+					valueArgs = append(valueArgs, r.Time, storedValue(r, ts.Type))
+				}
+				written[dsName] = append(written[dsName], r)
 			}
-		}
-
-		if len(valueStrings) != 0 {
-			err = execStmt()
+			if len(valueStrings) == 0 {
+				continue
+			}
+			stmt := s.dialect.rebind(s.dialect.insertStmt(table, valueStrings, policy, sequenced[dsName]))
+			_, err = tx.ExecContext(ctx, stmt, valueArgs...)
 			if err != nil {
-				return err
+				return nil, nil, err
 			}
 		}
+		report[dsName] = duplicates
+	}
+	return written, report, nil
+}
 
+// storedValue returns the value of a record which is stored for a series of the given type
+func storedValue(r senml.Record, t registry.ValueType) interface{} {
+	switch t {
+	case registry.Float:
+		return *r.Value
+	case registry.String:
+		return r.StringValue
+	case registry.Bool:
+		return *r.BoolValue
 	}
-	return nil
+	return r.DataValue
+}
+
+// takenTimes returns the times of the records which are taken in a table, with the next free sequence number of each
+func (s *SqlStorage) takenTimes(ctx context.Context, tx *sql.Tx, table string, sequenced bool, pack senml.Pack) (map[float64]int, error) {
+	placeholders := make([]string, len(pack))
+	args := make([]interface{}, len(pack))
+	for i, r := range pack {
+		placeholders[i], args[i] = "?", r.Time
+	}
+	next := "1"
+	if sequenced {
+		next = "MAX(seq) + 1"
+	}
+	stmt := fmt.Sprintf("SELECT time, %s FROM %s WHERE time IN (%s) GROUP BY time", next, table, strings.Join(placeholders, ","))
+	rows, err := tx.QueryContext(ctx, s.dialect.rebind(stmt), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	taken := make(map[float64]int)
+	for rows.Next() {
+		var t float64
+		var seq int
+		if err := rows.Scan(&t, &seq); err != nil {
+			return nil, err
+		}
+		taken[t] = seq
+	}
+	return taken, rows.Err()
+}
+
+// policyOf returns the duplicates policy of a series, or the default one of the storage
+func (s *SqlStorage) policyOf(ts *registry.TimeSeries) string {
+	return duplicatesPolicy(ts, s.duplicates)
+}
+
+// isSequenced checks if the table of a series has sequence numbers, which the tables created before the duplicates policies lack
+func (s *SqlStorage) isSequenced(ctx context.Context, series string) (bool, error) {
+	if sequenced, found := s.sequenced.Load(series); found {
+		return sequenced.(bool), nil
+	}
+	table := s.dialect.table(series)
+	_, err := s.pool.ExecContext(ctx, fmt.Sprintf("SELECT seq FROM %s WHERE 1 = 0", table))
+	if err != nil {
+		// the table may not be accessible at all
+		if _, tableErr := s.pool.ExecContext(ctx, fmt.Sprintf("SELECT time FROM %s WHERE 1 = 0", table)); tableErr != nil {
+			return false, tableErr
+		}
+	}
+	s.sequenced.Store(series, err == nil)
+	return err == nil, nil
+}
+
+// seqColumn returns the column which orders the records of a series sharing a time. Only the tables of the series
+// with the sequence policy have one, the records of the other series have distinct times.
+func (s *SqlStorage) seqColumn(ts *registry.TimeSeries) (string, error) {
+	if ts.Source.SrcType == registry.Virtual {
+		return "0", nil
+	}
+	sequenced, err := s.isSequenced(context.Background(), ts.Name)
+	if err != nil || !sequenced {
+		return "0", err
+	}
+	return "seq", nil
+}
+
+// seqOrder returns the ordering by a column returned by seqColumn, which is left out if the records have distinct times
+func seqOrder(seq string, order string) string {
+	if seq != "seq" {
+		return ""
+	}
+	if order == "" {
+		return ", seq"
+	}
+	return ", seq " + order
 }
+
 func (s *SqlStorage) QueryPage(ctx context.Context, q Query, series ...*registry.TimeSeries) (pack senml.Pack, total *int, err error) {
-	if len(series) == 1 {
+	defer observeDuration("query_page", time.Now())
+	if len(q.AggrFuncs) > 1 {
+		// the records of the aggregates have different names
+		q.Denormalize &^= DenormMaskName
+	}
+	if len(series) == 1 && len(q.AggrFuncs) < 2 {
 		return s.querySingleSeries(ctx, q, *series[0])
 	} else {
 		return s.queryMultipleSeries(ctx, q, series)
@@ -137,8 +345,9 @@ func (s *SqlStorage) QueryPage(ctx context.Context, q Query, series ...*registry
 }
 
 func (s *SqlStorage) Count(ctx context.Context, q Query, series ...*registry.TimeSeries) (int, error) {
+	defer observeDuration("count", time.Now())
 	total := new(int)
-	stmt, err := makeQuery(q, true, false, series...)
+	stmt, err := s.makeQuery(q, true, false, series...)
 	if err != nil {
 		return 0, err
 	}
@@ -154,8 +363,7 @@ func (s *SqlStorage) Count(ctx context.Context, q Query, series ...*registry.Tim
 }
 
 func (s *SqlStorage) Delete(ctx context.Context, series []*registry.TimeSeries, from time.Time, to time.Time) (err error) {
-	s.updateMutex.Lock()
-	defer s.updateMutex.Unlock()
+	defer s.lockWrites()()
 	var stmt strings.Builder
 	seperator := ""
 
@@ -170,10 +378,19 @@ func (s *SqlStorage) Delete(ctx context.Context, series []*registry.TimeSeries,
 			return
 		}
 		err = tx.Commit()
+		if err != nil {
+			return
+		}
+		for _, ts := range series {
+			s.latest.invalidateBetween(ts.Name, ToSenmlTime(from), ToSenmlTime(to))
+			for _, r := range s.rollups.of(ts.Name) {
+				s.latest.invalidate(r.name)
+			}
+		}
 	}()
 
 	for _, ts := range series {
-		stmt.WriteString(fmt.Sprintf("%s DELETE FROM [%s] WHERE time BETWEEN %f and %f", seperator, ts.Name, ToSenmlTime(from), ToSenmlTime(to)))
+		stmt.WriteString(fmt.Sprintf("%s DELETE FROM %s WHERE time BETWEEN %f and %f", seperator, s.dialect.table(ts.Name), ToSenmlTime(from), ToSenmlTime(to)))
 		seperator = ";"
 	}
 
@@ -182,52 +399,317 @@ func (s *SqlStorage) Delete(ctx context.Context, series []*registry.TimeSeries,
 		return err
 	}
 
+	for _, ts := range series {
+		for _, r := range s.rollups.of(ts.Name) {
+			err = s.refreshRollup(tx, ctx, r, r.label(ToSenmlTime(from)), r.label(ToSenmlTime(to)))
+			if err != nil {
+				return fmt.Errorf("error updating rollup %s: %s", r.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// updateRollups recalculates the rollup entries affected by the submitted data
+func (s *SqlStorage) updateRollups(tx *sql.Tx, ctx context.Context, data map[string]senml.Pack) error {
+	for dsName, pack := range data {
+		rollups := s.rollups.of(dsName)
+		if len(rollups) == 0 {
+			continue
+		}
+		times := make([]float64, len(pack))
+		for i, r := range pack {
+			times[i] = r.Time
+		}
+		for _, r := range rollups {
+			for _, labels := range r.labelRanges(times) {
+				err := s.refreshRollup(tx, ctx, r, labels[0], labels[1])
+				if err != nil {
+					return fmt.Errorf("error updating rollup %s: %s", r.name, err)
+				}
+			}
+		}
+	}
 	return nil
 }
+
+// refreshRollup recalculates the rollup entries between the given entry times (inclusive) from the source series
+func (s *SqlStorage) refreshRollup(tx *sql.Tx, ctx context.Context, r rollup, first, last float64) error {
+	err := s.dialect.lockSeries(ctx, tx, r.source)
+	if err != nil {
+		return err
+	}
+	from, to := first-r.interval, last
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE time > ? AND time <= ?", s.dialect.table(r.name))
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(stmt), from, to)
+	if err != nil {
+		return err
+	}
+	label := s.dialect.ceil(fmt.Sprintf("time/%f", r.interval)) + fmt.Sprintf("*%f", r.interval)
+	stmt = fmt.Sprintf(`INSERT INTO %s (time, value, count, sum, min, max)
+							SELECT time, %s*1.0, COUNT(value), SUM(value), MIN(value), MAX(value)
+							FROM (SELECT %s AS time, time AS raw_time, value FROM %s WHERE time > ? AND time <= ?) AS src
+							GROUP BY time`,
+		s.dialect.table(r.name), aggregateExpr(s.dialect, r.aggregate, registry.Float, "value", "raw_time"), label, s.dialect.table(r.source))
+	_, err = tx.ExecContext(ctx, s.dialect.rebind(stmt), from, to)
+	return err
+}
 func (s *SqlStorage) QueryStream(ctx context.Context, q Query, sendFunc sendFunction, series ...*registry.TimeSeries) error {
-	if len(series) == 1 {
+	defer observeDuration("query_stream", time.Now())
+	if len(q.AggrFuncs) > 1 {
+		// the records of the aggregates have different names
+		q.Denormalize &^= DenormMaskName
+	}
+	if len(series) == 1 && len(q.AggrFuncs) < 2 {
 		return s.streamSingleSeries(ctx, q, sendFunc, *series[0])
 	} else {
 		return s.streamMultipleSeries(ctx, q, sendFunc, series)
 	}
 }
 
+// purge deletes the oldest entries of a series up to the given time, at most limit entries at once
+func (s *SqlStorage) purge(ctx context.Context, series string, before float64, limit int) (int64, error) {
+	defer s.lockWrites()()
+	table := s.dialect.table(series)
+	stmt := fmt.Sprintf("DELETE FROM %s WHERE time IN (SELECT time FROM %s WHERE time < ? ORDER BY time LIMIT ?)", table, table)
+	res, err := s.pool.ExecContext(ctx, s.dialect.rebind(stmt), before, limit)
+	if err != nil {
+		return 0, err
+	}
+	s.latest.invalidateBetween(series, -math.MaxFloat64, before)
+	return res.RowsAffected()
+}
+
+// Latest returns the most recent record of each series. Series without data are left out.
+func (s *SqlStorage) Latest(ctx context.Context, series ...*registry.TimeSeries) (senml.Pack, error) {
+	pack := make(senml.Pack, 0, len(series))
+	for _, ts := range series {
+		get := s.latest.get
+		if ts.Source.SrcType == registry.Virtual {
+			// computed from the latest values of the inputs, which change without a submission to the series
+			get = s.loadLatest
+		}
+		r, err := get(ctx, *ts)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the latest value of %s: %w", ts.Name, err)
+		}
+		if r != nil {
+			// only the stored fields of submitted records
+			pack = append(pack, senml.Record{Name: ts.Name, Unit: ts.Unit, Time: r.Time,
+				Value: r.Value, StringValue: r.StringValue, BoolValue: r.BoolValue, DataValue: r.DataValue})
+		}
+	}
+	return pack, nil
+}
+
+// loadLatest queries the most recent record of a series
+func (s *SqlStorage) loadLatest(ctx context.Context, ts registry.TimeSeries) (*senml.Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqlQueryTimeout)
+	defer cancel()
+	from := -math.MaxFloat64
+	if ts.Source.SrcType == registry.Virtual && ts.Source.VirtualSource != nil {
+		latest, complete, err := s.latestInputsTime(ctx, ts.Source.VirtualSource)
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			// an input without records leaves the series without records
+			return nil, nil
+		}
+		from = latest
+	}
+	record, err := s.queryLatest(ctx, ts, from)
+	if record == nil && err == nil && from != -math.MaxFloat64 {
+		// the expression has no value at the latest times of the inputs, e.g. after a division by zero
+		record, err = s.queryLatest(ctx, ts, -math.MaxFloat64)
+	}
+	return record, err
+}
+
+// latestInputsTime returns the earliest of the latest times of the inputs of a virtual series, from which on the records
+// of the series have the values of all the inputs. It returns false if any of the inputs has no records.
+func (s *SqlStorage) latestInputsTime(ctx context.Context, src *registry.VirtualSource) (float64, bool, error) {
+	latest := make([]string, 0, len(src.Inputs))
+	for _, input := range src.Inputs {
+		latest = append(latest, fmt.Sprintf("SELECT MAX(time) AS time FROM %s", s.dialect.table(input)))
+	}
+	stmt := fmt.Sprintf("SELECT MIN(time), COUNT(time) FROM (%s) AS latest", strings.Join(latest, " UNION ALL "))
+	var t sql.NullFloat64
+	var n int
+	if err := s.pool.QueryRowContext(ctx, stmt).Scan(&t, &n); err != nil {
+		return 0, false, err
+	}
+	return t.Float64, n == len(latest), nil
+}
+
+// queryLatest queries the most recent record of a series from a time on
+func (s *SqlStorage) queryLatest(ctx context.Context, ts registry.TimeSeries, from float64) (*senml.Record, error) {
+	source, err := s.source(&ts, from, math.MaxFloat64)
+	if err != nil {
+		return nil, err
+	}
+	seq, err := s.seqColumn(&ts)
+	if err != nil {
+		return nil, err
+	}
+	stmt := fmt.Sprintf("SELECT time, value FROM %s ORDER BY time DESC%s LIMIT 1", source, seqOrder(seq, common.Desc))
+	row := s.pool.QueryRowContext(ctx, stmt)
+
+	record := senml.Record{Name: ts.Name, Unit: ts.Unit}
+	switch ts.Type {
+	case registry.Float:
+		record.Value = new(float64)
+		err = row.Scan(&record.Time, record.Value)
+	case registry.String:
+		err = row.Scan(&record.Time, &record.StringValue)
+	case registry.Bool:
+		record.BoolValue = new(bool)
+		err = row.Scan(&record.Time, record.BoolValue)
+	case registry.Data:
+		err = row.Scan(&record.Time, &record.DataValue)
+	}
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
 func (s *SqlStorage) Disconnect() error {
+	s.retention.close()
 	return s.pool.Close()
 }
 
 // CreateHandler handles the creation of a new TimeSeries
-func (s *SqlStorage) CreateHandler(ts registry.TimeSeries) error {
+// The table is created right away and dropped again if the creation is compensated
+func (s *SqlStorage) CreateHandler(ts registry.TimeSeries) (registry.Transaction, error) {
 	tableName := ts.Name
 	if !validTableName(tableName) {
-		return fmt.Errorf("invalid senml name for the table %s", ts.Name)
+		return nil, fmt.Errorf("invalid senml name for the table %s", ts.Name)
+	}
+	if ts.Source.SrcType == registry.Virtual {
+		// computed from its inputs at query time
+		return nil, nil
+	}
+	compensation := registry.TransactionFuncs{
+		OnCompensate: func() error {
+			return s.dropSeries(ts)
+		},
 	}
-	typeVal := map[registry.ValueType]string{
-		registry.Float:  "DOUBLE",
-		registry.String: "TEXT",
-		registry.Bool:   "BOOLEAN",
-		registry.Data:   "TEXT",
+	if ts.Source.SrcType == registry.Series {
+		err := s.createRollup(ts)
+		if err != nil {
+			return nil, err
+		}
+		return compensation, nil
 	}
 
-	stmt := fmt.Sprintf("CREATE TABLE [%s] (time DOUBLE NOT NULL, value %s,  PRIMARY KEY (time))", tableName, typeVal[ts.Type])
-	s.updateMutex.Lock()
-	defer s.updateMutex.Unlock()
+	err := s.createTable(ts)
+	if err != nil {
+		return nil, err
+	}
+	err = s.retention.set(ts)
+	if err != nil {
+		if dropErr := s.dropSeries(ts); dropErr != nil {
+			log.Printf("Error dropping the table of %s: %s", ts.Name, dropErr)
+		}
+		return nil, err
+	}
+	return compensation, nil
+}
+
+func (s *SqlStorage) createTable(ts registry.TimeSeries) error {
+	// the sequence number is non-zero for the records which are stored with the same time as others
+	stmt := fmt.Sprintf("CREATE TABLE %s (time %s NOT NULL, seq INTEGER NOT NULL DEFAULT 0, value %s,  PRIMARY KEY (time, seq))",
+		s.dialect.table(ts.Name), s.dialect.columnType(registry.Float), s.dialect.columnType(ts.Type))
+	defer s.lockWrites()()
 	_, err := s.pool.Exec(stmt)
 	if err != nil {
 		return fmt.Errorf("error creating table: %s", err)
 	}
+	s.sequenced.Store(ts.Name, true)
 	return nil
 }
 
-// UpdateHandler handles updates of a TimeSeries
-func (s *SqlStorage) UpdateHandler(oldDS registry.TimeSeries, newDS registry.TimeSeries) error {
-	//TODO supporting retention
+// createRollup creates the table of a rollup series and fills it with the existing data of the source series
+func (s *SqlStorage) createRollup(ts registry.TimeSeries) (err error) {
+	r, err := newRollup(ts)
+	if err != nil {
+		return err
+	}
+	defer s.lockWrites()()
 
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			return
+		}
+		err = tx.Commit()
+	}()
+
+	double := s.dialect.columnType(registry.Float)
+	stmt := fmt.Sprintf("CREATE TABLE %s (time %[2]s NOT NULL, value %[2]s, count INTEGER, sum %[2]s, min %[2]s, max %[2]s, PRIMARY KEY (time))",
+		s.dialect.table(r.name), double)
+	_, err = tx.Exec(stmt)
+	if err != nil {
+		return fmt.Errorf("error creating table: %s", err)
+	}
+	err = s.refreshRollup(tx, context.Background(), r, -math.MaxFloat64, math.MaxFloat64)
+	if err != nil {
+		return fmt.Errorf("error filling rollup: %s", err)
+	}
+	err = s.retention.set(ts)
+	if err != nil {
+		return err
+	}
+	s.rollups.add(r)
 	return nil
 }
 
+// UpdateHandler handles updates of a TimeSeries
+func (s *SqlStorage) UpdateHandler(oldDS registry.TimeSeries, newDS registry.TimeSeries) (registry.Transaction, error) {
+	err := s.retention.set(newDS)
+	if err != nil {
+		return nil, err
+	}
+	return registry.TransactionFuncs{
+		OnCompensate: func() error {
+			return s.retention.set(oldDS)
+		},
+	}, nil
+}
+
 // DeleteHandler handles deletion of a TimeSeries
-func (s *SqlStorage) DeleteHandler(ts registry.TimeSeries) error {
+// Dropping the data cannot be undone, so it is done once the deletion is committed
+func (s *SqlStorage) DeleteHandler(ts registry.TimeSeries) (registry.Transaction, error) {
+	if ts.Source.SrcType == registry.Virtual {
+		return nil, nil
+	}
+	// fail early if the database is not reachable
+	_, err := s.TableExists(ts)
+	if err != nil {
+		return nil, err
+	}
+	return registry.TransactionFuncs{
+		OnCommit: func() error {
+			return s.dropSeries(ts)
+		},
+	}, nil
+}
+
+// dropSeries stops the background jobs of a series and drops its table
+func (s *SqlStorage) dropSeries(ts registry.TimeSeries) error {
+	s.retention.remove(ts.Name)
+	s.rollups.remove(ts.Name)
+	s.latest.invalidate(ts.Name)
+	s.sequenced.Delete(ts.Name)
 	tableExists, err := s.TableExists(ts)
 	if err != nil {
 		return err
@@ -235,10 +717,9 @@ func (s *SqlStorage) DeleteHandler(ts registry.TimeSeries) error {
 	if tableExists == false {
 		return nil
 	}
-	s.updateMutex.Lock()
-	defer s.updateMutex.Unlock()
-	stmt := fmt.Sprintf("DROP TABLE [%s]", ts.Name)
-	_, err = s.pool.Exec(stmt, ts.Name)
+	defer s.lockWrites()()
+	stmt := fmt.Sprintf("DROP TABLE %s", s.dialect.table(ts.Name))
+	_, err = s.pool.Exec(stmt)
 
 	if err != nil {
 		return fmt.Errorf("error dropping table: %s", err)
@@ -248,9 +729,9 @@ func (s *SqlStorage) DeleteHandler(ts registry.TimeSeries) error {
 
 func (s *SqlStorage) TableExists(ts registry.TimeSeries) (bool, error) {
 	var total int
-	stmt := "SELECT  COUNT(*) FROM sqlite_master WHERE type='table' AND name= ?"
+	stmt := s.dialect.rebind(s.dialect.tableExistsStmt())
 
-	row := s.pool.QueryRow(stmt, ts.Name)
+	row := s.pool.QueryRow(stmt, s.dialect.tableName(ts.Name))
 
 	err := row.Scan(&total)
 	if err != nil {
@@ -329,10 +810,16 @@ func (s *SqlStorage) querySingleSeries(ctx context.Context, q Query, series regi
 			return nil, nil, err
 		}
 	}
-	stmt, err := makeQuery(q, false, false, &series)
+	stmt, err := s.makeQuery(q, false, false, &series)
 	if err != nil {
 		return nil, nil, err
 	}
+	converter, err := newUnitConverter(q, []*registry.TimeSeries{&series})
+	if err != nil {
+		return nil, nil, err
+	}
+	// the records take the type and unit of the aggregate
+	series = *resultSeries(q, []*registry.TimeSeries{&series})[series.Name]
 
 	ctx, cancel := context.WithTimeout(ctx, sqlQueryTimeout)
 	defer cancel()
@@ -352,11 +839,14 @@ func (s *SqlStorage) querySingleSeries(ctx context.Context, q Query, series regi
 	case registry.Float:
 		for rows.Next() {
 			var val float64
-			err = rows.Scan(&senmlName, &timeVal, &val)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &val)
 			if err != nil {
 				return nil, nil, fmt.Errorf("error while scanning query results: %s", err)
 			}
 			record := senml.Record{Name: senmlName, Value: &val, Time: timeVal, Unit: series.Unit}
+			if converter != nil {
+				record = converter.apply(record)
+			}
 			denormalizeRecord(&record, &baseRecord, q.Denormalize)
 			records = append(records, record)
 
@@ -364,7 +854,7 @@ func (s *SqlStorage) querySingleSeries(ctx context.Context, q Query, series regi
 	case registry.String:
 		for rows.Next() {
 			var strVal string
-			err = rows.Scan(&senmlName, &timeVal, &strVal)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &strVal)
 			if err != nil {
 				return nil, nil, fmt.Errorf("error while scanning query results: %s", err)
 			}
@@ -375,7 +865,7 @@ func (s *SqlStorage) querySingleSeries(ctx context.Context, q Query, series regi
 	case registry.Bool:
 		for rows.Next() {
 			var boolVal bool
-			err = rows.Scan(&senmlName, &timeVal, &boolVal)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &boolVal)
 			if err != nil {
 				return nil, nil, fmt.Errorf("error while scanning query results: %s", err)
 			}
@@ -386,7 +876,7 @@ func (s *SqlStorage) querySingleSeries(ctx context.Context, q Query, series regi
 	case registry.Data:
 		for rows.Next() {
 			var dataVal string
-			err = rows.Scan(&senmlName, &timeVal, &dataVal)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &dataVal)
 			if err != nil {
 				return nil, nil, fmt.Errorf("error while scanning query results: %s", err)
 			}
@@ -408,7 +898,11 @@ func (s *SqlStorage) queryMultipleSeries(ctx context.Context, q Query, series []
 	}
 	var stmt string
 
-	stmt, err = makeQuery(q, false, false, series...)
+	stmt, err = s.makeQuery(q, false, false, series...)
+	if err != nil {
+		return nil, nil, err
+	}
+	converter, err := newUnitConverter(q, series)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -422,11 +916,7 @@ func (s *SqlStorage) queryMultipleSeries(ctx context.Context, q Query, series []
 
 	records := make([]senml.Record, 0, q.PerPage)
 
-	seriesMap := make(map[string]*registry.TimeSeries, len(series))
-
-	for _, ts := range series {
-		seriesMap[ts.Name] = ts
-	}
+	seriesMap := resultSeries(q, series)
 	var senmlName string
 	var timeVal float64
 	var val interface{}
@@ -435,7 +925,7 @@ func (s *SqlStorage) queryMultipleSeries(ctx context.Context, q Query, series []
 	var baseRecord *senml.Record
 
 	for rows.Next() {
-		err = rows.Scan(&senmlName, &timeVal, &val)
+		err = scanRecord(rows, q, &senmlName, &timeVal, &val)
 		if err != nil {
 			return nil, nil, fmt.Errorf("error while scanning query results: %s", err)
 		}
@@ -445,11 +935,14 @@ func (s *SqlStorage) queryMultipleSeries(ctx context.Context, q Query, series []
 
 		switch series.Type {
 		case registry.Float:
-			floatVal, ok := val.(float64)
+			floatVal, ok := scannedFloat(val)
 			if !ok {
 				return nil, nil, fmt.Errorf("error while scanning float64 query result: unexpected type obtained")
 			}
 			record = senml.Record{Name: senmlName, Value: &floatVal, Time: timeVal, Unit: series.Unit}
+			if converter != nil {
+				record = converter.apply(record)
+			}
 
 		case registry.String:
 			stringVal, ok := val.(string)
@@ -464,6 +957,8 @@ func (s *SqlStorage) queryMultipleSeries(ctx context.Context, q Query, series []
 				boolVal = val.(int64) != 0
 			case bool:
 				boolVal = val.(bool)
+			case string: // values cast to text
+				boolVal = val.(string) == "true"
 			default:
 				return nil, nil, fmt.Errorf("error while scanning boolean query result: unexpected type %v obtained", retType)
 			}
@@ -485,13 +980,18 @@ func (s *SqlStorage) queryMultipleSeries(ctx context.Context, q Query, series []
 }
 
 func (s *SqlStorage) streamSingleSeries(ctx context.Context, q Query, sendFunc sendFunction, series registry.TimeSeries) (err error) {
-	stmt, err := makeQuery(q, false, true, &series)
+	stmt, err := s.makeQuery(q, false, true, &series)
+	if err != nil {
+		return err
+	}
+	converter, err := newUnitConverter(q, []*registry.TimeSeries{&series})
 	if err != nil {
 		return err
 	}
+	// the records take the type and unit of the aggregate
+	series = *resultSeries(q, []*registry.TimeSeries{&series})[series.Name]
 
-	ctx, cancel := context.WithTimeout(ctx, sqlQueryTimeout)
-	defer cancel()
+	// streams may run for as long as the receiver keeps up, so they are only bounded by the caller's context
 	rows, err := s.pool.QueryContext(ctx, stmt)
 	if err != nil {
 		return fmt.Errorf("error while querying rows: %w", err)
@@ -508,11 +1008,14 @@ func (s *SqlStorage) streamSingleSeries(ctx context.Context, q Query, sendFunc s
 	case registry.Float:
 		for rows.Next() {
 			var val float64
-			err = rows.Scan(&senmlName, &timeVal, &val)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &val)
 			if err != nil {
 				return fmt.Errorf("error while scanning query results: %s", err)
 			}
 			record := senml.Record{Name: senmlName, Value: &val, Time: timeVal, Unit: series.Unit}
+			if converter != nil {
+				record = converter.apply(record)
+			}
 			denormalizeRecord(&record, &baseRecord, q.Denormalize)
 			records = append(records, record)
 			recordCount++
@@ -529,7 +1032,7 @@ func (s *SqlStorage) streamSingleSeries(ctx context.Context, q Query, sendFunc s
 	case registry.String:
 		for rows.Next() {
 			var strVal string
-			err = rows.Scan(&senmlName, &timeVal, &strVal)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &strVal)
 			if err != nil {
 				return fmt.Errorf("error while scanning query results: %s", err)
 			}
@@ -550,7 +1053,7 @@ func (s *SqlStorage) streamSingleSeries(ctx context.Context, q Query, sendFunc s
 	case registry.Bool:
 		for rows.Next() {
 			var boolVal bool
-			err = rows.Scan(&senmlName, &timeVal, &boolVal)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &boolVal)
 			if err != nil {
 				return fmt.Errorf("error while scanning query results: %s", err)
 			}
@@ -571,7 +1074,7 @@ func (s *SqlStorage) streamSingleSeries(ctx context.Context, q Query, sendFunc s
 	case registry.Data:
 		for rows.Next() {
 			var dataVal string
-			err = rows.Scan(&senmlName, &timeVal, &dataVal)
+			err = scanRecord(rows, q, &senmlName, &timeVal, &dataVal)
 			if err != nil {
 				return fmt.Errorf("error while scanning query results: %s", err)
 			}
@@ -600,13 +1103,16 @@ func (s *SqlStorage) streamSingleSeries(ctx context.Context, q Query, sendFunc s
 
 func (s *SqlStorage) streamMultipleSeries(ctx context.Context, q Query, sendFunc sendFunction, series []*registry.TimeSeries) error {
 
-	stmt, err := makeQuery(q, false, true, series...)
+	stmt, err := s.makeQuery(q, false, true, series...)
+	if err != nil {
+		return err
+	}
+	converter, err := newUnitConverter(q, series)
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, sqlQueryTimeout)
-	defer cancel()
+	// streams may run for as long as the receiver keeps up, so they are only bounded by the caller's context
 	rows, err := s.pool.QueryContext(ctx, stmt)
 
 	if err != nil {
@@ -616,11 +1122,7 @@ func (s *SqlStorage) streamMultipleSeries(ctx context.Context, q Query, sendFunc
 
 	records := make([]senml.Record, 0, q.PerPage)
 
-	seriesMap := make(map[string]*registry.TimeSeries, len(series))
-
-	for _, ts := range series {
-		seriesMap[ts.Name] = ts
-	}
+	seriesMap := resultSeries(q, series)
 	var senmlName string
 	var timeVal float64
 	var val interface{}
@@ -628,7 +1130,7 @@ func (s *SqlStorage) streamMultipleSeries(ctx context.Context, q Query, sendFunc
 	var baseRecord *senml.Record
 	recordCount := 0
 	for rows.Next() {
-		err = rows.Scan(&senmlName, &timeVal, &val)
+		err = scanRecord(rows, q, &senmlName, &timeVal, &val)
 		if err != nil {
 			return fmt.Errorf("error while scanning query results: %s", err)
 		}
@@ -636,11 +1138,14 @@ func (s *SqlStorage) streamMultipleSeries(ctx context.Context, q Query, sendFunc
 		var record senml.Record
 		switch series.Type {
 		case registry.Float:
-			floatVal, ok := val.(float64)
+			floatVal, ok := scannedFloat(val)
 			if !ok {
 				return fmt.Errorf("error while scanning float64 query result: unexpected type obtained")
 			}
 			record = senml.Record{Name: senmlName, Value: &floatVal, Time: timeVal, Unit: series.Unit}
+			if converter != nil {
+				record = converter.apply(record)
+			}
 
 		case registry.String:
 			stringVal, ok := val.(string)
@@ -656,6 +1161,8 @@ func (s *SqlStorage) streamMultipleSeries(ctx context.Context, q Query, sendFunc
 				boolVal = val.(int64) != 0
 			case bool:
 				boolVal = val.(bool)
+			case string: // values cast to text
+				boolVal = val.(string) == "true"
 			default:
 				return fmt.Errorf("error while scanning boolean query result: unexpected type %v obtained", retType)
 			}
@@ -691,7 +1198,7 @@ func (s *SqlStorage) streamMultipleSeries(ctx context.Context, q Query, sendFunc
 }
 
 // Gets the recursive query making the table containing ranges
-func makeQuery(q Query, count bool, stream bool, series ...*registry.TimeSeries) (stmt string, err error) {
+func (s *SqlStorage) makeQuery(q Query, count bool, stream bool, series ...*registry.TimeSeries) (stmt string, err error) {
 	fromTime := ToSenmlTime(q.From)
 	toTime := ToSenmlTime(q.To)
 	//query the entries
@@ -709,77 +1216,278 @@ func makeQuery(q Query, count bool, stream bool, series ...*registry.TimeSeries)
 		limitStr = fmt.Sprintf("LIMIT %d OFFSET %d", q.PerPage, (q.Page-1)*q.PerPage)
 	}
 
-	if q.AggrFunc != "" {
+	// records of different series with the same time are in the order of the series names, so that pages do not overlap
+	orderBy := fmt.Sprintf("time %s, %s", order, s.dialect.binaryOrder("table_name"))
+
+	// keyset pagination: the page starts after the position of the cursor instead of an offset
+	cursor := q.Cursor
+	if stream || count {
+		cursor = nil
+	}
+	var cursorTime string
+	cmp := "<"
+	if q.SortAsc {
+		cmp = ">"
+	}
+	if cursor != nil {
+		limitStr = fmt.Sprintf("LIMIT %d", q.PerPage)
+		cursorTime = strconv.FormatFloat(cursor.Time, 'g', -1, 64)
+	}
+	// afterCursor returns the condition selecting the records of a series which come after the cursor
+	afterCursor := func(name string, seq string) string {
+		if cursor == nil {
+			return ""
+		}
+		if name > cursor.Series {
+			// records at the time of the cursor come after it
+			return fmt.Sprintf(" AND time %s= %s", cmp, cursorTime)
+		}
+		if name == cursor.Series && seq == "seq" {
+			// records sharing the time of the cursor come after the ones counted by it, in the order of their sequence numbers
+			seqCmp := ">"
+			if q.SortAsc {
+				seqCmp = "<"
+			}
+			return fmt.Sprintf(" AND (time %[1]s %[2]s OR (time = %[2]s AND (SELECT COUNT(*) FROM %[3]s AS counted WHERE counted.time = %[2]s AND counted.seq %[4]s= stored.seq) > %[5]d))",
+				cmp, cursorTime, s.dialect.table(name), seqCmp, cursor.Seq+1)
+		}
+		return fmt.Sprintf(" AND time %s %s", cmp, cursorTime)
+	}
+
+	if len(q.AggrFuncs) != 0 {
 		durSec := q.AggrWindow.Seconds()
-		// create union of multiple series
-		timeAggr := fmt.Sprintf("%f- MAX(ROUND(((%f-time)/%f)-0.5),0)*%f", toTime, toTime, durSec, durSec)
+		// the windows are labelled with their end and contain it
+		timeAggr := fmt.Sprintf("%f- %s*%f", toTime, s.dialect.greatest(s.dialect.floor(fmt.Sprintf("(%f-time)/%f", toTime, durSec)), "0"), durSec)
+		// windows of the rollups are aligned to the epoch, so that rollups with a fitting interval can be used if the windows end at to
+		alignedTo := toTime
+		windowsCTE, windowsJoin := "", ""
+		if q.Align == AlignEpoch {
+			timeAggr = fmt.Sprintf("%s*%f", s.dialect.ceil(fmt.Sprintf("time/%f", durSec)), durSec)
+			alignedTo = 0
+		}
+		if !q.Calendar.IsZero() {
+			// calendar windows are computed beforehand, as their durations vary
+			boundaries, err := q.calendarWindows()
+			if err != nil {
+				return "", err
+			}
+			windows := make([]string, len(boundaries)-1)
+			for i := range windows {
+				windows[i] = fmt.Sprintf("(%f,%f)", boundaries[i], boundaries[i+1])
+			}
+			windowsCTE = fmt.Sprintf("windows(w_start,w_end) AS (VALUES %s), ", strings.Join(windows, ","))
+			windowsJoin = " JOIN windows ON time > w_start AND time <= w_end"
+			timeAggr = "CAST(w_end AS DOUBLE PRECISION)"
+		}
+		// the aggregated series share a type, so that their values can be aggregated in the same column
+		valueType := series[0].Type
+		if mixedTypes(series) {
+			return "", fmt.Errorf("aggregated series must have the same type")
+		}
+		for _, aggr := range q.AggrFuncs {
+			if _, ok := aggregateType(aggr, valueType); !ok {
+				return "", fmt.Errorf("aggregation %s is not supported for %s series", aggr, valueType)
+			}
+		}
+		// the state of a record lasts until the next one, at most until the end of its window and of the queried range.
+		// The state of the last record before a window is carried into it until its first record.
+		stateful := statefulAggregates(q.AggrFuncs)
+		stateColumns, stateNames := "", ""
+		if stateful {
+			windowStart := fmt.Sprintf("(%s-%f)", timeAggr, durSec)
+			if !q.Calendar.IsZero() {
+				windowStart = "w_start"
+			}
+			// the previous record is in an earlier window or before the range, which the window part in the range starts after
+			stateColumns = fmt.Sprintf(", %s-time AS duration, prev_value, CASE WHEN prev_time <= %s OR prev_time < %f THEN time-%s ELSE 0 END AS carried",
+				s.dialect.least(s.dialect.least(fmt.Sprintf("COALESCE(LEAD(time) OVER (ORDER BY time, seq), %[1]s)", timeAggr), timeAggr), fmt.Sprintf("%f", toTime)),
+				windowStart, fromTime, s.dialect.greatest(windowStart, fmt.Sprintf("%f", fromTime)))
+			stateNames = ",duration,prev_value,carried"
+		}
+		// use the rollups of the series wherever they match the aggregation windows
+		useRollups := false
+		rollups := make(map[string]*rollup)
+		if combinableAggregates(q.AggrFuncs) && q.Calendar.IsZero() {
+			for _, ts := range series {
+				if r := s.rollups.best(ts.Name, durSec, alignedTo); r != nil {
+					rollups[ts.Name] = r
+					useRollups = true
+				}
+			}
+		}
 		var tableUnion strings.Builder
 		unionStr := ""
 		for _, ts := range series {
-			if ts.Type != registry.Float {
-				return "", fmt.Errorf("aggregation is not supported for non-numeric series %s", ts.Name)
+			source, err := s.source(ts, fromTime, toTime)
+			if err != nil {
+				return "", err
 			}
-			tableUnion.WriteString(fmt.Sprintf(`%sSELECT  '%s' AS 'table_name' , %s AS time, value 
-														FROM [%s] 
+			if stateful {
+				seq, err := s.seqColumn(ts)
+				if err != nil {
+					return "", err
+				}
+				// the records with the previous state, starting with the last one before the range
+				source = fmt.Sprintf(`(SELECT time, value, %[4]s AS seq, LAG(value) OVER (ORDER BY time%[5]s) AS prev_value, LAG(time) OVER (ORDER BY time%[5]s) AS prev_time
+											FROM %[1]s WHERE time >= COALESCE((SELECT MAX(time) FROM %[1]s WHERE time < %[2]f), %[2]f) AND time <= %[3]f) AS states`,
+					source, fromTime, toTime, seq, seqOrder(seq, ""))
+			}
+			if !useRollups {
+				tableUnion.WriteString(fmt.Sprintf(`%sSELECT  '%s' AS table_name , %s AS time, value, time AS raw_time%s
+														FROM %s%s 
+														WHERE time BETWEEN %f AND %f`,
+					unionStr, ts.Name, timeAggr, stateColumns, source, windowsJoin, fromTime, toTime))
+			} else if r, found := rollups[ts.Name]; found {
+				// rollup entries which are fully within the queried range, raw data for the rest
+				first, last := r.label(fromTime), toTime
+				tableUnion.WriteString(fmt.Sprintf(`%sSELECT  '%s' AS table_name , %s AS time, sum, count, min, max
+														FROM (SELECT time, sum, count, min, max FROM %s WHERE time > %f AND time <= %f
+															UNION ALL
+															SELECT time, value, 1, value, value FROM %s WHERE time BETWEEN %f AND %f AND (time <= %f OR time > %f)) AS partials`,
+					unionStr, ts.Name, timeAggr, s.dialect.table(r.name), first, last, s.dialect.table(ts.Name), fromTime, toTime, first, last))
+			} else {
+				tableUnion.WriteString(fmt.Sprintf(`%sSELECT  '%s' AS table_name , %s AS time, value, 1, value, value 
+														FROM %s 
 														WHERE time BETWEEN %f AND %f`,
-				unionStr, ts.Name, timeAggr, ts.Name, fromTime, toTime))
+					unionStr, ts.Name, timeAggr, source, fromTime, toTime))
+			}
 			unionStr = " UNION ALL "
 		}
-		stmt = fmt.Sprintf(`WITH raw_data(table_name,time,value) AS (
+		// the windows are filtered after their times are computed
+		windowFilter := ""
+		if cursor != nil {
+			windowFilter = fmt.Sprintf("WHERE (time %s %s OR (time = %s AND %s > '%s'))",
+				cmp, cursorTime, cursorTime, s.dialect.binaryOrder("table_name"), cursor.Series)
+		}
+		// aggregates of different types are returned in the same column, as text by some databases
+		resultTypes := make(map[registry.ValueType]bool)
+		for _, aggr := range q.AggrFuncs {
+			t, _ := aggregateType(aggr, valueType)
+			resultTypes[t] = true
+		}
+		aggrExprs := make([]string, len(q.AggrFuncs))
+		for i, aggr := range q.AggrFuncs {
+			if useRollups {
+				aggrExprs[i] = combineRollupAggr(aggr)
+			} else {
+				aggrExprs[i] = aggregateExpr(s.dialect, aggr, valueType, "value", "raw_time")
+			}
+			if t, _ := aggregateType(aggr, valueType); t == registry.Float {
+				aggrExprs[i] += "*1.0"
+			}
+			if s.dialect.textValues() && len(resultTypes) > 1 {
+				aggrExprs[i] = fmt.Sprintf("CAST(%s AS TEXT)", aggrExprs[i])
+			}
+		}
+		if useRollups {
+			stmt = fmt.Sprintf(`WITH raw_data(table_name,time,sum,count,min,max) AS (
 										%s
                                     )`, tableUnion.String())
+		} else {
+			stmt = fmt.Sprintf(`WITH %sraw_data(table_name,time,value,raw_time%s) AS (
+										%s
+                                    )`, windowsCTE, stateNames, tableUnion.String())
+		}
 		if count {
+			// each window has a record per aggregate
 			stmt = stmt +
 				fmt.Sprintf(`
-						SELECT  COUNT(*) FROM (SELECT DISTINCT time,table_name
-						FROM raw_data  %s)`, limitStr)
-		} else {
+						SELECT  COUNT(*)*%d FROM (SELECT DISTINCT time,table_name
+						FROM raw_data  %s) AS windows`, len(aggrExprs), limitStr)
+		} else if len(aggrExprs) == 1 {
 			stmt = stmt +
 				fmt.Sprintf(`
-						SELECT  table_name, time ,%s(value)*1.0 AS value
-						FROM raw_data GROUP BY time,table_name ORDER BY time %s %s`, aggrToSqlFunc(q.AggrFunc), order, limitStr)
+						SELECT  table_name, time ,%s AS value
+						FROM raw_data %s GROUP BY time,table_name ORDER BY %s %s`, aggrExprs[0], windowFilter, orderBy, limitStr)
+		} else {
+			// all aggregates are computed in a single pass over the windows, which are then split into a record per aggregate
+			columns := make([]string, len(aggrExprs))
+			var records strings.Builder
+			for i, aggr := range q.AggrFuncs {
+				columns[i] = fmt.Sprintf("%s AS aggr%d", aggrExprs[i], i)
+				if i != 0 {
+					records.WriteString(" UNION ALL ")
+				}
+				records.WriteString(fmt.Sprintf("SELECT table_name || '%s' AS table_name, time, aggr%d AS value FROM aggregated",
+					AggregateSeparator+aggr, i))
+			}
+			stmt = stmt +
+				fmt.Sprintf(`, aggregated AS (
+						SELECT  table_name, time, %s
+						FROM raw_data GROUP BY time,table_name
+                                    )
+						SELECT * FROM (%s) AS aggregates %s ORDER BY %s %s`, strings.Join(columns, ", "), records.String(), windowFilter, orderBy, limitStr)
 		}
 	} else {
 
+		// values of different types can only be combined as text by some databases
+		value := "value"
+		if s.dialect.textValues() && mixedTypes(series) {
+			value = "CAST(value AS TEXT)"
+		}
 		// create union of multiple series
 		var tableUnion strings.Builder
 		unionStr := ""
 		for _, ts := range series {
-			tableUnion.WriteString(fmt.Sprintf("%sSELECT  '%s' as 'table_name' , time, value FROM [%s] WHERE time BETWEEN %f AND %f", unionStr, ts.Name, ts.Name, fromTime, toTime))
+			source, err := s.source(ts, fromTime, toTime)
+			if err != nil {
+				return "", err
+			}
+			seq, err := s.seqColumn(ts)
+			if err != nil {
+				return "", err
+			}
+			if seq == "seq" {
+				source += " AS stored"
+			}
+			tableUnion.WriteString(fmt.Sprintf("%sSELECT  '%s' as table_name , time, %s AS value, %s AS seq FROM %s WHERE time BETWEEN %f AND %f%s", unionStr, ts.Name, value, seq, source, fromTime, toTime, afterCursor(ts.Name, seq)))
 			unionStr = " UNION ALL "
 		}
 
 		if count == true {
-			stmt = fmt.Sprintf("SELECT COUNT(*) FROM (%s) %s", tableUnion.String(), limitStr)
+			stmt = fmt.Sprintf("SELECT COUNT(*) FROM (%s) AS data %s", tableUnion.String(), limitStr)
 		} else {
-			stmt = fmt.Sprintf("SELECT * FROM (%s) ORDER BY time %s %s", tableUnion.String(), order, limitStr)
+			// records of a series sharing a time are in the order in which they were stored, reversed for descending queries
+			// the sequence numbers are returned, so that the union is not materialized with the column types of its first series
+			stmt = fmt.Sprintf("SELECT * FROM (%s) AS data ORDER BY %s, seq %s %s", tableUnion.String(), orderBy, order, limitStr)
 		}
 	}
 	return stmt, nil
 }
 
-func aggrToSqlFunc(aggrName string) (sqlFunc string) {
-	const (
-		AGGR_AVG   = "AVG"
-		AGGR_SUM   = "SUM"
-		AGGR_MIN   = "MIN"
-		AGGR_MAX   = "MAX"
-		AGGR_COUNT = "COUNT"
-	)
-	switch aggrName {
-	case "mean":
-		return AGGR_AVG
-	case "sum":
-		return AGGR_SUM
-	case "min":
-		return AGGR_MIN
-	case "max":
-		return AGGR_MAX
-	case "count":
-		return AGGR_COUNT
-	default:
-		panic("Invalid aggregation:" + aggrName)
+// scanRecord scans a row of the records of a query. The records which are not aggregated come with their sequence numbers.
+func scanRecord(rows *sql.Rows, q Query, name *string, t *float64, value interface{}) error {
+	if len(q.AggrFuncs) != 0 {
+		return rows.Scan(name, t, value)
+	}
+	var seq int
+	return rows.Scan(name, t, value, &seq)
+}
+
+// scannedFloat returns the float value of a query result, which may have been cast to text
+func scannedFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	case []byte: // numeric results of some databases
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// mixedTypes checks if the series have different value types
+func mixedTypes(series []*registry.TimeSeries) bool {
+	for i := 1; i < len(series); i++ {
+		ts := series[i]
+		if ts.Type != series[0].Type {
+			return true
+		}
 	}
+	return false
 }
 
 // validTableName checks if the table name is a valid SenML name or not.
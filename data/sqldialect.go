@@ -0,0 +1,314 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// sqlDialect covers the differences between the SQL databases used by SqlStorage.
+// Each series is stored in its own table with the columns time and value.
+type sqlDialect interface {
+	// driver is the name of the database/sql driver
+	driver() string
+	// tableName returns the name of the table of a series
+	tableName(series string) string
+	// table returns the quoted name of the table of a series
+	table(series string) string
+	// tableExistsStmt returns a statement counting the tables with the given name, which is the only argument
+	tableExistsStmt() string
+	// columnType returns the column type for the values of a series
+	columnType(t registry.ValueType) string
+	// rebind converts the ? placeholders of a statement to the ones of the database
+	rebind(stmt string) string
+	// insertStmt returns a statement writing the given rows following a policy for the times which are taken.
+	// The rows are (time, seq, value) with the sequence policy and (time, value) otherwise. Sequenced tables
+	// have a sequence number as part of their primary key, which tables created before the policies lack.
+	insertStmt(table string, rows []string, policy string, sequenced bool) string
+	// floor, ceil, greatest and least return the expressions of the respective math functions
+	floor(expr string) string
+	ceil(expr string) string
+	greatest(a, b string) string
+	least(a, b string) string
+	// quantile, stddev, variance, first, last and mode return the expressions of the aggregates which have no standard SQL function.
+	// Quantiles are interpolated linearly, stddev and variance are those of the sample and zero for single values.
+	// First and last take the type of the values, mode returns the smallest of the most frequent values.
+	quantile(value string, q float64) string
+	stddev(value string) string
+	variance(value string) string
+	first(value, time string, t registry.ValueType) string
+	last(value, time string, t registry.ValueType) string
+	mode(value string) string
+	// math returns the expression of a math function of virtual series: sqrt, exp, ln, log10, pow, floor or ceil
+	math(function string, args ...string) string
+	// binaryOrder returns the expression ordering a text column by its bytes, as strings are compared in Go
+	binaryOrder(column string) string
+	// textValues tells if values of different series types must be cast to text when they are queried together
+	textValues() bool
+	// serializeWrites tells if all modifications must be done one after another
+	serializeWrites() bool
+	// lockSeries locks a series within a transaction, preventing concurrent updates of its rollups
+	lockSeries(ctx context.Context, tx *sql.Tx, series string) error
+	// deadLettersTableStmt returns the statement creating the table of the dead letters if it does not exist
+	deadLettersTableStmt(table string) string
+}
+
+// SQLite: one database file, modifications are serialized by the storage
+type sqliteDialect struct{}
+
+func (sqliteDialect) driver() string {
+	return DRIVER_SQLITE3_AGGR
+}
+
+func (sqliteDialect) tableName(series string) string {
+	return series
+}
+
+func (sqliteDialect) table(series string) string {
+	return "[" + series + "]"
+}
+
+func (sqliteDialect) tableExistsStmt() string {
+	return "SELECT  COUNT(*) FROM sqlite_master WHERE type='table' AND name= ?"
+}
+
+func (sqliteDialect) columnType(t registry.ValueType) string {
+	return map[registry.ValueType]string{
+		registry.Float:  "DOUBLE",
+		registry.String: "TEXT",
+		registry.Bool:   "BOOLEAN",
+		registry.Data:   "TEXT",
+	}[t]
+}
+
+func (sqliteDialect) rebind(stmt string) string {
+	return stmt
+}
+
+func (sqliteDialect) insertStmt(table string, rows []string, policy string, sequenced bool) string {
+	switch policy {
+	case registry.DuplicatesOverwrite:
+		return fmt.Sprintf("REPLACE INTO %s (time, value) VALUES %s", table, strings.Join(rows, ","))
+	case registry.DuplicatesSequence:
+		return fmt.Sprintf("INSERT INTO %s (time, seq, value) VALUES %s", table, strings.Join(rows, ","))
+	}
+	return fmt.Sprintf("INSERT OR IGNORE INTO %s (time, value) VALUES %s", table, strings.Join(rows, ","))
+}
+
+func (sqliteDialect) floor(expr string) string {
+	return fmt.Sprintf("ROUND((%s)-0.5)", expr)
+}
+
+func (sqliteDialect) ceil(expr string) string {
+	return fmt.Sprintf("(CAST(%[1]s AS INTEGER) + ((%[1]s) > CAST(%[1]s AS INTEGER)))", expr)
+}
+
+func (sqliteDialect) greatest(a, b string) string {
+	return fmt.Sprintf("MAX(%s,%s)", a, b)
+}
+
+func (sqliteDialect) least(a, b string) string {
+	return fmt.Sprintf("MIN(%s,%s)", a, b)
+}
+
+// the aggregates are implemented in Go, see aggregates.go
+
+func (sqliteDialect) quantile(value string, q float64) string {
+	return fmt.Sprintf("hds_quantile(%s, %s)", value, strconv.FormatFloat(q, 'f', -1, 64))
+}
+
+func (sqliteDialect) stddev(value string) string {
+	return fmt.Sprintf("hds_stddev(%s)", value)
+}
+
+func (sqliteDialect) variance(value string) string {
+	return fmt.Sprintf("hds_variance(%s)", value)
+}
+
+func (sqliteDialect) first(value, time string, t registry.ValueType) string {
+	return sqliteTypedAggr("hds_first", value, time, t)
+}
+
+func (sqliteDialect) last(value, time string, t registry.ValueType) string {
+	return sqliteTypedAggr("hds_last", value, time, t)
+}
+
+func (sqliteDialect) mode(value string) string {
+	return fmt.Sprintf("hds_mode(%s)", value)
+}
+
+// sqliteTypedAggr selects the variant of the first or last aggregate for the type of the values.
+// Text values have their own aggregates, booleans are stored as integers.
+func sqliteTypedAggr(aggr, value, time string, t registry.ValueType) string {
+	switch t {
+	case registry.String, registry.Data:
+		return fmt.Sprintf("%s_text(%s, %s)", aggr, value, time)
+	case registry.Bool:
+		return fmt.Sprintf("CAST(%s(%s, %s) AS INTEGER)", aggr, value, time)
+	}
+	return fmt.Sprintf("%s(%s, %s)", aggr, value, time)
+}
+
+// the math functions are implemented in Go, see virtual.go
+
+func (sqliteDialect) math(function string, args ...string) string {
+	return fmt.Sprintf("hds_%s(%s)", function, strings.Join(args, ","))
+}
+
+func (sqliteDialect) binaryOrder(column string) string {
+	return column // BINARY is the default collation
+}
+
+func (sqliteDialect) textValues() bool {
+	return false
+}
+
+func (sqliteDialect) serializeWrites() bool {
+	return true
+}
+
+func (sqliteDialect) deadLettersTableStmt(table string) string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id INTEGER PRIMARY KEY AUTOINCREMENT, arrival DOUBLE NOT NULL, source TEXT NOT NULL,
+		broker TEXT, topic TEXT, content_type TEXT, payload BLOB, reason TEXT)`, table)
+}
+
+func (sqliteDialect) lockSeries(ctx context.Context, tx *sql.Tx, series string) error {
+	return nil // writes are serialized anyway
+}
+
+// PostgreSQL (incl. TimescaleDB): concurrent writes, strictly typed unions
+type postgresDialect struct{}
+
+// maximum length of identifiers in PostgreSQL
+const postgresMaxIdentifier = 63
+
+func (postgresDialect) driver() string {
+	return DRIVER_POSTGRES
+}
+
+// tableName returns the unquoted table name of a series. Names longer than allowed by PostgreSQL are hashed.
+func (postgresDialect) tableName(series string) string {
+	if len(series) <= postgresMaxIdentifier {
+		return series
+	}
+	return fmt.Sprintf("hds_%x", sha1.Sum([]byte(series)))
+}
+
+func (d postgresDialect) table(series string) string {
+	return `"` + d.tableName(series) + `"`
+}
+
+func (postgresDialect) tableExistsStmt() string {
+	return "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?"
+}
+
+func (postgresDialect) columnType(t registry.ValueType) string {
+	return map[registry.ValueType]string{
+		registry.Float:  "DOUBLE PRECISION",
+		registry.String: "TEXT",
+		registry.Bool:   "BOOLEAN",
+		registry.Data:   "TEXT",
+	}[t]
+}
+
+func (postgresDialect) rebind(stmt string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range stmt {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (postgresDialect) insertStmt(table string, rows []string, policy string, sequenced bool) string {
+	switch policy {
+	case registry.DuplicatesOverwrite:
+		key := "time"
+		if sequenced {
+			key = "time, seq"
+		}
+		return fmt.Sprintf("INSERT INTO %s (time, value) VALUES %s ON CONFLICT (%s) DO UPDATE SET value = EXCLUDED.value", table, strings.Join(rows, ","), key)
+	case registry.DuplicatesSequence:
+		return fmt.Sprintf("INSERT INTO %s (time, seq, value) VALUES %s", table, strings.Join(rows, ","))
+	}
+	return fmt.Sprintf("INSERT INTO %s (time, value) VALUES %s ON CONFLICT DO NOTHING", table, strings.Join(rows, ","))
+}
+
+func (postgresDialect) floor(expr string) string {
+	return fmt.Sprintf("FLOOR(%s)", expr)
+}
+
+func (postgresDialect) ceil(expr string) string {
+	return fmt.Sprintf("CEIL(%s)", expr)
+}
+
+func (postgresDialect) greatest(a, b string) string {
+	return fmt.Sprintf("GREATEST(%s,%s)", a, b)
+}
+
+func (postgresDialect) least(a, b string) string {
+	return fmt.Sprintf("LEAST(%s,%s)", a, b)
+}
+
+func (postgresDialect) quantile(value string, q float64) string {
+	return fmt.Sprintf("PERCENTILE_CONT(%s) WITHIN GROUP (ORDER BY %s)", strconv.FormatFloat(q, 'f', -1, 64), value)
+}
+
+func (postgresDialect) stddev(value string) string {
+	return fmt.Sprintf("COALESCE(STDDEV_SAMP(%s), 0)", value)
+}
+
+func (postgresDialect) variance(value string) string {
+	return fmt.Sprintf("COALESCE(VAR_SAMP(%s), 0)", value)
+}
+
+func (postgresDialect) first(value, time string, _ registry.ValueType) string {
+	return fmt.Sprintf("(ARRAY_AGG(%s ORDER BY %s))[1]", value, time)
+}
+
+func (postgresDialect) last(value, time string, _ registry.ValueType) string {
+	return fmt.Sprintf("(ARRAY_AGG(%s ORDER BY %s DESC))[1]", value, time)
+}
+
+func (postgresDialect) mode(value string) string {
+	return fmt.Sprintf("MODE() WITHIN GROUP (ORDER BY %s)", value)
+}
+
+func (postgresDialect) math(function string, args ...string) string {
+	name := map[string]string{"sqrt": "SQRT", "exp": "EXP", "ln": "LN", "log10": "LOG", "pow": "POWER", "floor": "FLOOR", "ceil": "CEIL"}[function]
+	return fmt.Sprintf("%s(%s)", name, strings.Join(args, ","))
+}
+
+func (postgresDialect) binaryOrder(column string) string {
+	return column + ` COLLATE "C"`
+}
+
+func (postgresDialect) textValues() bool {
+	return true
+}
+
+func (postgresDialect) serializeWrites() bool {
+	return false
+}
+
+func (postgresDialect) deadLettersTableStmt(table string) string {
+	return fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (id BIGSERIAL PRIMARY KEY, arrival DOUBLE PRECISION NOT NULL, source TEXT NOT NULL,
+		broker TEXT, topic TEXT, content_type TEXT, payload BYTEA, reason TEXT)`, table)
+}
+
+func (postgresDialect) lockSeries(ctx context.Context, tx *sql.Tx, series string) error {
+	_, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", series)
+	return err
+}
@@ -13,11 +13,13 @@ import (
 )
 
 const (
-	INFLUXDB       = "influxdb"
-	MONGODB        = "mongodb"
-	SENMLSTORE     = "senmlstore"
-	SQLITE         = "sqlite"
-	DRIVER_SQLITE3 = "sqlite3"
+	INFLUXDB        = "influxdb"
+	MONGODB         = "mongodb"
+	SENMLSTORE      = "senmlstore"
+	SQLITE          = "sqlite"
+	POSTGRES        = "postgres"
+	DRIVER_SQLITE3  = "sqlite3"
+	DRIVER_POSTGRES = "postgres"
 )
 
 // SupportedBackends returns true if the backend is listed as true
@@ -27,6 +29,7 @@ func SupportedBackends(name string) bool {
 		MONGODB:    false, // Mongodb is not supported after HDS v0.5.3
 		SENMLSTORE: false, //SenmlStore is not supported after HDS v1.0.0-beta.5
 		SQLITE:     true,
+		POSTGRES:   true,
 	}
 	return supportedBackends[strings.ToLower(name)]
 }
@@ -38,7 +41,9 @@ type Storage interface {
 	// Adds data points for multiple time series
 	// data is a map where keys are time series ids
 	// series is a map where keys are time series ids
-	Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) error
+	// The records whose time is taken are handled following the duplicates policy of their series, as given in the report.
+	// If the policy rejects them, the error wraps ErrDuplicate.
+	Submit(ctx context.Context, data map[string]senml.Pack, series map[string]*registry.TimeSeries) (report map[string]Duplicates, err error)
 
 	// Queries data for specified time series
 	//QueryPage(q QueryPage, page, PerPage int, series ...*registry.TimeSeries) (senml.Pack, int, error)
@@ -48,13 +53,30 @@ type Storage interface {
 
 	Count(ctx context.Context, q Query, series ...*registry.TimeSeries) (total int, err error)
 
+	// Latest returns the most recent record of each of the given series
+	Latest(ctx context.Context, series ...*registry.TimeSeries) (senml.Pack, error)
+
 	// Delete the data within a given time range
 	Delete(ctx context.Context, series []*registry.TimeSeries, from time.Time, to time.Time) (err error)
 
+	// Start loads the per-series settings (e.g. retention) from the registry and starts the background jobs
+	Start(reg registry.Controller) error
+
 	// EventListener includes methods for event handling
 	registry.EventListener
 }
 
+// batchStorage is implemented by the storages which write several submissions in a transaction,
+// as if they were submitted one after another, with a report for each of them
+type batchStorage interface {
+	SubmitBatch(ctx context.Context, batch []map[string]senml.Pack, series map[string]*registry.TimeSeries) (reports []map[string]Duplicates, err error)
+}
+
+// policyStorage is implemented by the storages which have a default duplicates policy for the series which have none
+type policyStorage interface {
+	policyOf(ts *registry.TimeSeries) string
+}
+
 func validateRecordAgainstRegistry(r senml.Record, ts *registry.TimeSeries) error {
 	// Check if type of value matches the data value type in registry
 	switch ts.Type {
@@ -8,7 +8,9 @@ import (
 	"math"
 	"math/rand"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,7 +37,11 @@ func deleteFile(path string) {
 	fmt.Println("done deleting file")
 }
 
+// setupTest creates a SQLite storage, or a PostgreSQL storage if HDS_TEST_POSTGRES_DSN is set
 func setupTest(funcName string) (filename string, disconnectFunc func() error, dataStorage Storage, regController registry.Controller, err error) {
+	if dsn := os.Getenv("HDS_TEST_POSTGRES_DSN"); dsn != "" {
+		return setupPostgresTest(funcName, dsn)
+	}
 	fileName := os.TempDir() + "/" + funcName
 
 	deleteFile(fileName)
@@ -111,7 +117,7 @@ func testInsertMultiType(t *testing.T, storage Storage, regController registry.C
 		}
 	}()
 	ctx := context.Background()
-	err := storage.Submit(ctx, sentDataMap, seriesMap)
+	_, err := storage.Submit(ctx, sentDataMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -167,7 +173,7 @@ func testInsertData(t *testing.T, storage Storage, regController registry.Contro
 	recordMap := make(map[string]senml.Pack)
 	recordMap[ts.Name] = sentData
 	ctx := context.Background()
-	err = storage.Submit(ctx, recordMap, seriesMap)
+	_, err = storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -213,7 +219,7 @@ func testInsertBools(t *testing.T, storage Storage, regController registry.Contr
 	recordMap[ts.Name] = sentData
 
 	ctx := context.Background()
-	err = storage.Submit(ctx, recordMap, seriesMap)
+	_, err = storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -258,7 +264,7 @@ func testInsertStrings(t *testing.T, storage Storage, regController registry.Con
 	recordMap := make(map[string]senml.Pack)
 	recordMap[ts.Name] = sentData
 	ctx := context.Background()
-	err = storage.Submit(ctx, recordMap, seriesMap)
+	_, err = storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -304,7 +310,7 @@ func testInsertVals(t *testing.T, storage Storage, regController registry.Contro
 	recordMap[ts.Name] = sentData
 
 	ctx := context.Background()
-	err = storage.Submit(ctx, recordMap, seriesMap)
+	_, err = storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -411,7 +417,7 @@ func testAggMultipleSeries(t *testing.T, storage Storage, regController registry
 		sentDataMap[r.Name] = append(sentDataMap[r.Name], r)
 	}
 	ctx := context.Background()
-	err := storage.Submit(ctx, sentDataMap, seriesMap)
+	_, err := storage.Submit(ctx, sentDataMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -424,7 +430,7 @@ func testAggMultipleSeries(t *testing.T, storage Storage, regController registry
 		Page:       1,
 		PerPage:    expectedLen,
 		SortAsc:    true,
-		AggrFunc:   aggr,
+		AggrFuncs:  []string{aggr},
 		AggrWindow: 5 * time.Minute}, seriesArr...)
 	if err != nil {
 		t.Error(err)
@@ -476,7 +482,7 @@ func testAggSingleSeries(t *testing.T, storage Storage, regController registry.C
 	recordMap := make(map[string]senml.Pack)
 	recordMap[ts.Name] = sentData
 	ctx := context.Background()
-	err = storage.Submit(ctx, recordMap, seriesMap)
+	_, err = storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -490,7 +496,7 @@ func testAggSingleSeries(t *testing.T, storage Storage, regController registry.C
 		Page:       1,
 		PerPage:    expectedLen,
 		SortAsc:    true,
-		AggrFunc:   aggr,
+		AggrFuncs:  []string{aggr},
 		AggrWindow: 5 * time.Minute}, &ts)
 	if err != nil {
 		t.Error(err)
@@ -570,7 +576,7 @@ func testDeleteMultiType(t *testing.T, storage Storage, regController registry.C
 		}
 	}()
 	ctx := context.Background()
-	err := storage.Submit(ctx, sentDataMap, seriesMap)
+	_, err := storage.Submit(ctx, sentDataMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -635,7 +641,7 @@ func testDeleteVals(t *testing.T, storage Storage, regController registry.Contro
 	recordMap := make(map[string]senml.Pack)
 	recordMap[ts.Name] = sentData
 	ctx := context.Background()
-	err = storage.Submit(ctx, recordMap, seriesMap)
+	_, err = storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		t.Error("Error while inserting:", err)
 	}
@@ -666,6 +672,603 @@ func testDeleteVals(t *testing.T, storage Storage, regController registry.Contro
 		t.Error("Sent records and received record did not match!!")
 	}
 }
+func TestStorage_Retention(t *testing.T) {
+	//Setup for the testing
+	funcName := "TestStorage_Retention"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	storage := dataStorage.(*SqlStorage)
+
+	ts := registry.TimeSeries{Name: "Value/retained", Type: registry.Float, Unit: "Cel", Retention: "1h"}
+	_, err = regController.Add(ts)
+	if err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	// one entry every 3 seconds for the last 3 hours, i.e. 2400 entries are expired
+	now := time.Now()
+	totRec := 3600
+	pack := make(senml.Pack, totRec)
+	for i := range pack {
+		value := float64(i)
+		pack[i] = senml.Record{Name: ts.Name, Value: &value, Time: ToSenmlTime(now.Add(-time.Duration(i*3) * time.Second))}
+	}
+	ctx := context.Background()
+	_, err = storage.Submit(ctx, map[string]senml.Pack{ts.Name: pack}, map[string]*registry.TimeSeries{ts.Name: &ts})
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+
+	count := func() int {
+		total, err := storage.Count(ctx, Query{To: now.Add(time.Minute)}, &ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+
+	storage.retention.run(ctx)
+	if total := count(); total != 1200 {
+		t.Fatalf("Expected 1200 entries after enforcing retention of 1h, got %d", total)
+	}
+
+	// removing the retention keeps the data
+	ts.Retention = ""
+	_, err = regController.Update(ts.Name, ts)
+	if err != nil {
+		t.Fatal("Update failed:", err)
+	}
+	storage.retention.run(ctx)
+	if total := count(); total != 1200 {
+		t.Fatalf("Expected 1200 entries without retention, got %d", total)
+	}
+
+	// shortening the retention is applied by the next round
+	ts.Retention = "30m"
+	_, err = regController.Update(ts.Name, ts)
+	if err != nil {
+		t.Fatal("Update failed:", err)
+	}
+	storage.retention.run(ctx)
+	if total := count(); total != 600 {
+		t.Fatalf("Expected 600 entries after enforcing retention of 30m, got %d", total)
+	}
+
+	// invalid retention periods are rejected by the registry
+	ts.Retention = "1y"
+	_, err = regController.Update(ts.Name, ts)
+	if err == nil {
+		t.Fatal("Expected an error when updating with an invalid retention")
+	}
+
+	err = regController.Delete(ts.Name)
+	if err != nil {
+		t.Fatal("deletion failed:", err)
+	}
+	if len(storage.retention.periods) != 0 {
+		t.Errorf("Expected retention of deleted series to be removed")
+	}
+}
+
+func TestStorage_Rollup(t *testing.T) {
+	//Setup for the testing
+	funcName := "TestStorage_Rollup"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	storage := dataStorage.(*SqlStorage)
+	ctx := context.Background()
+
+	src := registry.TimeSeries{Name: "Value/power", Type: registry.Float, Unit: "W"}
+	mean1m := registry.TimeSeries{Name: "Value/power/mean1m", Type: registry.Float, Unit: "W",
+		Source: registry.Source{SrcType: registry.Series, SeriesSource: &registry.SeriesSource{Series: src.Name, Aggregate: "mean", Interval: "1m"}}}
+	max10m := registry.TimeSeries{Name: "Value/power/max10m", Type: registry.Float, Unit: "W",
+		Source: registry.Source{SrcType: registry.Series, SeriesSource: &registry.SeriesSource{Series: src.Name, Aggregate: "max", Interval: "10m"}}}
+
+	for _, ts := range []registry.TimeSeries{src, mean1m} {
+		_, err = regController.Add(ts)
+		if err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+	}
+
+	// two hours of data at 1Hz
+	const t0 = 1599998400.0 // aligned to full hours
+	stored := make(map[float64]float64)
+	submit := func(pack senml.Pack) {
+		_, err := storage.Submit(ctx, map[string]senml.Pack{src.Name: pack}, map[string]*registry.TimeSeries{src.Name: &src})
+		if err != nil {
+			t.Fatal("Error while inserting:", err)
+		}
+		for _, r := range pack {
+			stored[r.Time] = *r.Value
+		}
+	}
+	pack := make(senml.Pack, 7200)
+	for i := range pack {
+		value := float64((i + 1) % 100)
+		pack[i] = senml.Record{Name: src.Name, Value: &value, Time: t0 + float64(i+1)}
+	}
+	submit(pack)
+
+	// registered after the data arrived, filled with the existing data
+	_, err = regController.Add(max10m)
+	if err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	// aggregates the stored data within (to-window, to]
+	expected := func(from, to, window float64, aggr string) senml.Pack {
+		values := make(map[float64][]float64)
+		for tm, v := range stored {
+			if tm < from || tm > to {
+				continue
+			}
+			label := to - math.Floor((to-tm)/window)*window
+			values[label] = append(values[label], v)
+		}
+		var pack senml.Pack
+		for label, vals := range values {
+			var res float64
+			switch aggr {
+			case "mean":
+				for _, v := range vals {
+					res += v
+				}
+				res = res / float64(len(vals))
+			case "max":
+				res = math.Inf(-1)
+				for _, v := range vals {
+					res = math.Max(res, v)
+				}
+			}
+			value := res
+			pack = append(pack, senml.Record{Name: src.Name, Time: label, Value: &value})
+		}
+		sort.Slice(pack, func(i, j int) bool { return pack[i].Time < pack[j].Time })
+		return pack
+	}
+	compare := func(got senml.Pack, want senml.Pack) {
+		t.Helper()
+		if len(got) != len(want) {
+			t.Fatalf("Expected %d entries, got %d", len(want), len(got))
+		}
+		for i := range got {
+			if got[i].Time != want[i].Time || math.Abs(*got[i].Value-*want[i].Value) > 1e-9 {
+				t.Fatalf("Mismatch at %d: expected %v at %f, got %v at %f", i, *want[i].Value, want[i].Time, *got[i].Value, got[i].Time)
+			}
+		}
+	}
+	query := func(ts registry.TimeSeries, q Query) senml.Pack {
+		t.Helper()
+		q.PerPage, q.Page, q.SortAsc = 1000, 1, true
+		got, _, err := storage.QueryPage(ctx, q, &ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got.Normalize()
+		return got
+	}
+	checkRollups := func() {
+		t.Helper()
+		end := t0 + 7200
+		compare(query(mean1m, Query{From: FromSenmlTime(t0), To: FromSenmlTime(end)}), expected(t0, end, 60, "mean"))
+		compare(query(max10m, Query{From: FromSenmlTime(t0), To: FromSenmlTime(end)}), expected(t0, end, 600, "max"))
+	}
+	checkRollups()
+
+	// overwriting and adding data updates the affected entries
+	v1, v2 := 1000.0, -1000.0
+	submit(senml.Pack{{Name: src.Name, Value: &v1, Time: t0 + 30}, {Name: src.Name, Value: &v2, Time: t0 + 3600.5}})
+	checkRollups()
+
+	// deleting data updates the affected entries
+	err = storage.Delete(ctx, []*registry.TimeSeries{&src}, FromSenmlTime(t0+61), FromSenmlTime(t0+120))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tm := range stored {
+		if tm >= t0+61 && tm <= t0+120 {
+			delete(stored, tm)
+		}
+	}
+	checkRollups()
+
+	// aligned aggregation queries of the source read the coarsest rollup
+	q := Query{From: FromSenmlTime(t0 + 15), To: FromSenmlTime(t0 + 7200), AggrFuncs: []string{"mean"}, AggrWindow: 30 * time.Minute, PerPage: 1000, Page: 1}
+	stmt, err := storage.makeQuery(q, false, false, &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stmt, "["+max10m.Name+"]") {
+		t.Fatalf("Expected the query to read rollup %s:\n%s", max10m.Name, stmt)
+	}
+	for _, aggr := range []string{"mean", "max"} {
+		q.AggrFuncs = []string{aggr}
+		compare(query(src, q), expected(t0+15, t0+7200, 1800, aggr))
+	}
+
+	// not aligned queries read the raw data
+	q.AggrFuncs, q.To = []string{"mean"}, FromSenmlTime(t0+7000.5)
+	stmt, err = storage.makeQuery(q, false, false, &src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(stmt, "["+max10m.Name+"]") || strings.Contains(stmt, "["+mean1m.Name+"]") {
+		t.Fatalf("Expected the query not to read the rollups:\n%s", stmt)
+	}
+	compare(query(src, q), expected(t0+15, t0+7000.5, 1800, "mean"))
+
+	// rollups cannot be written to and their sources cannot be deleted
+	controller := NewController(regController, dataStorage, false)
+	_, err = controller.Submit(ctx, senml.Pack{{Name: mean1m.Name, Value: &v1, Time: t0}}, nil)
+	if err == nil {
+		t.Error("Expected an error when submitting data to a rollup series")
+	}
+	err = regController.Delete(src.Name)
+	if err == nil {
+		t.Error("Expected an error when deleting the source of a rollup series")
+	}
+
+	for _, name := range []string{mean1m.Name, max10m.Name, src.Name} {
+		err := regController.Delete(name)
+		if err != nil {
+			t.Fatal("deletion failed:", err)
+		}
+	}
+	if len(storage.rollups.bySource) != 0 {
+		t.Errorf("Expected rollups of deleted series to be removed")
+	}
+}
+
+func TestStorage_Latest(t *testing.T) {
+	//Setup for the testing
+	funcName := "TestStorage_Latest"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	storage := dataStorage.(*SqlStorage)
+
+	floatTS := registry.TimeSeries{Name: "Value/last", Type: registry.Float, Unit: "Cel"}
+	stringTS := registry.TimeSeries{Name: "String/last", Type: registry.String}
+	for _, ts := range []registry.TimeSeries{floatTS, stringTS} {
+		_, err = regController.Add(ts)
+		if err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+	}
+	ctx := context.Background()
+	series := map[string]*registry.TimeSeries{floatTS.Name: &floatTS, stringTS.Name: &stringTS}
+
+	latest := func() senml.Pack {
+		pack, err := storage.Latest(ctx, &floatTS, &stringTS)
+		if err != nil {
+			t.Fatal("Error getting the latest values:", err)
+		}
+		return pack
+	}
+	latestValue := func() float64 {
+		pack := latest()
+		if len(pack) == 0 || pack[0].Name != floatTS.Name || pack[0].Value == nil {
+			t.Fatalf("Expected the latest value of %s, got %v", floatTS.Name, pack)
+		}
+		return *pack[0].Value
+	}
+
+	if pack := latest(); len(pack) != 0 {
+		t.Fatalf("Expected no records for series without data, got %v", pack)
+	}
+
+	floats := make(senml.Pack, 10)
+	for i := range floats {
+		value := float64(i)
+		floats[i] = senml.Record{Name: floatTS.Name, Value: &value, Time: float64(1000 + i)}
+	}
+	_, err = storage.Submit(ctx, map[string]senml.Pack{floatTS.Name: floats}, series)
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+	if value := latestValue(); value != 9 {
+		t.Fatalf("Expected latest value 9, got %v", value)
+	}
+	if pack := latest(); len(pack) != 1 || pack[0].Unit != "Cel" || pack[0].Time != 1009 {
+		t.Fatalf("Expected only the latest record of %s at 1009, got %v", floatTS.Name, pack)
+	}
+
+	// older data does not replace the latest value, newer data does
+	older, newer := 100.0, 200.0
+	_, err = storage.Submit(ctx, map[string]senml.Pack{
+		floatTS.Name:  {{Name: floatTS.Name, Value: &older, Time: 500}},
+		stringTS.Name: {{Name: stringTS.Name, StringValue: "on", Time: 1000}},
+	}, series)
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+	if value := latestValue(); value != 9 {
+		t.Fatalf("Expected latest value 9 after inserting older data, got %v", value)
+	}
+	_, err = storage.Submit(ctx, map[string]senml.Pack{floatTS.Name: {{Name: floatTS.Name, Value: &newer, Time: 2000}}}, series)
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+	if value := latestValue(); value != 200 {
+		t.Fatalf("Expected latest value 200, got %v", value)
+	}
+	if pack := latest(); len(pack) != 2 || pack[1].StringValue != "on" {
+		t.Fatalf("Expected the latest string value, got %v", pack)
+	}
+
+	// deleting the latest entries falls back to the previous ones
+	err = storage.Delete(ctx, []*registry.TimeSeries{&floatTS}, FromSenmlTime(1005), FromSenmlTime(3000))
+	if err != nil {
+		t.Fatal("Error while deleting:", err)
+	}
+	if value := latestValue(); value != 4 {
+		t.Fatalf("Expected latest value 4 after deletion, got %v", value)
+	}
+
+	// the cache is warmed up at startup
+	storage.latest.invalidate(floatTS.Name)
+	err = storage.Start(regController)
+	if err != nil {
+		t.Fatal("Error starting the storage:", err)
+	}
+	if _, found := storage.latest.records[floatTS.Name]; !found {
+		t.Fatalf("Expected the latest value of %s to be loaded at startup", floatTS.Name)
+	}
+	if value := latestValue(); value != 4 {
+		t.Fatalf("Expected latest value 4 after startup, got %v", value)
+	}
+}
+
+// failingListener fails preparing the registry changes of the given series
+type failingListener struct {
+	failOn string
+}
+
+func (l *failingListener) fail(ts registry.TimeSeries) (registry.Transaction, error) {
+	if ts.Name == l.failOn {
+		return nil, fmt.Errorf("injected failure for %s", ts.Name)
+	}
+	return nil, nil
+}
+func (l *failingListener) CreateHandler(ts registry.TimeSeries) (registry.Transaction, error) {
+	return l.fail(ts)
+}
+func (l *failingListener) UpdateHandler(old registry.TimeSeries, new registry.TimeSeries) (registry.Transaction, error) {
+	return l.fail(new)
+}
+func (l *failingListener) DeleteHandler(ts registry.TimeSeries) (registry.Transaction, error) {
+	return l.fail(ts)
+}
+
+func TestStorage_QueryCursor(t *testing.T) {
+	//Setup for the testing
+	funcName := "TestStorage_QueryCursor"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	// two series with records at the same times
+	tsA := registry.TimeSeries{Name: "Value/cursor/a", Type: registry.Float}
+	tsB := registry.TimeSeries{Name: "Value/cursor/b", Type: registry.Float}
+	data := make(map[string]senml.Pack)
+	series := make(map[string]*registry.TimeSeries)
+	for _, ts := range []registry.TimeSeries{tsA, tsB} {
+		ts := ts
+		if _, err := regController.Add(ts); err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+		for i := 0; i < 5; i++ {
+			value := float64(i)
+			data[ts.Name] = append(data[ts.Name], senml.Record{Name: ts.Name, Value: &value, Time: 1543059346.1 + float64(i)})
+		}
+		series[ts.Name] = &ts
+	}
+	ctx := context.Background()
+	if _, err := dataStorage.Submit(ctx, data, series); err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+
+	type position struct {
+		time float64
+		name string
+	}
+	// walk returns the positions of all records, reading pages of 3 records after the cursor. The callback is called after each page.
+	walk := func(q Query, afterPage func()) []position {
+		q.PerPage = 3
+		q.Page = 1
+		var positions []position
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("Too many pages")
+			}
+			pack, _, err := dataStorage.QueryPage(ctx, q, &tsA, &tsB)
+			if err != nil {
+				t.Fatal("Error querying:", err)
+			}
+			for _, r := range pack {
+				positions = append(positions, position{r.Time, r.Name})
+			}
+			if len(pack) < q.PerPage {
+				return positions
+			}
+			q.Cursor = cursorAfter(pack, q.Cursor)
+			if afterPage != nil {
+				afterPage()
+			}
+		}
+	}
+
+	// descending, with new data written between the pages
+	value := 10.0
+	newer := senml.Pack{{Name: tsA.Name, Value: &value, Time: 1543059400}}
+	positions := walk(Query{To: time.Now()}, func() {
+		if _, err := dataStorage.Submit(ctx, map[string]senml.Pack{tsA.Name: newer}, series); err != nil {
+			t.Fatal("Error while inserting:", err)
+		}
+	})
+	if len(positions) != 10 {
+		t.Fatalf("Expected 10 records, got %d: %v", len(positions), positions)
+	}
+	for i, p := range positions {
+		// ties are in the order of the series names
+		expected := position{1543059346.1 + float64(4-i/2), []string{tsA.Name, tsB.Name}[i%2]}
+		if math.Abs(p.time-expected.time) > 1e-6 || p.name != expected.name {
+			t.Fatalf("Expected %v at %d, got %v", expected, i, p)
+		}
+	}
+
+	// ascending
+	positions = walk(Query{To: time.Unix(1543059351, 0), SortAsc: true}, nil)
+	if len(positions) != 10 {
+		t.Fatalf("Expected 10 records, got %d: %v", len(positions), positions)
+	}
+	for i, p := range positions {
+		expected := position{1543059346.1 + float64(i/2), []string{tsA.Name, tsB.Name}[i%2]}
+		if math.Abs(p.time-expected.time) > 1e-6 || p.name != expected.name {
+			t.Fatalf("Expected %v at %d, got %v", expected, i, p)
+		}
+	}
+
+	// aggregated windows of 2 seconds
+	positions = walk(Query{From: time.Unix(1543059346, 0), To: time.Unix(1543059351, 0), AggrFuncs: []string{"count"}, AggrWindow: 2 * time.Second}, nil)
+	if len(positions) != 6 {
+		t.Fatalf("Expected 6 windows, got %d: %v", len(positions), positions)
+	}
+	for i := 1; i < len(positions); i++ {
+		if positions[i] == positions[i-1] {
+			t.Fatalf("Window %v is repeated", positions[i])
+		}
+	}
+}
+
+func TestStorage_ListenerFailures(t *testing.T) {
+	//Setup for the testing
+	funcName := "TestStorage_ListenerFailures"
+	fileName, disconnectFunc, dataStorage, _, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up benchmark:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	storage := dataStorage.(*SqlStorage)
+	// the failing listener comes after the data storage
+	listener := &failingListener{}
+	regController := *registry.NewController(registry.NewMemoryStorage(common.RegConf{}, dataStorage, listener))
+
+	ts := registry.TimeSeries{Name: "Value/failing", Type: registry.Float}
+	tableExists := func() bool {
+		exists, err := storage.TableExists(ts)
+		if err != nil {
+			t.Fatal("Error checking the table:", err)
+		}
+		return exists
+	}
+	retention := func() time.Duration {
+		storage.retention.Lock()
+		defer storage.retention.Unlock()
+		return storage.retention.periods[ts.Name]
+	}
+
+	// the table created for a failed registration is dropped
+	listener.failOn = ts.Name
+	_, addErr := regController.Add(ts)
+	if addErr == nil {
+		t.Fatal("Expected the injected failure")
+	}
+	if tableExists() {
+		t.Fatal("Expected the table to be dropped after the failed registration")
+	}
+
+	listener.failOn = ""
+	_, addErr = regController.Add(ts)
+	if addErr != nil {
+		t.Fatal("Insertion failed:", addErr)
+	}
+	if !tableExists() {
+		t.Fatal("Expected the table to be created")
+	}
+	ctx := context.Background()
+	value := 1.0
+	_, err = storage.Submit(ctx, map[string]senml.Pack{ts.Name: {{Name: ts.Name, Value: &value, Time: 1543059346}}}, map[string]*registry.TimeSeries{ts.Name: &ts})
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+
+	// the retention of a failed update is restored
+	listener.failOn = ts.Name
+	updated := ts
+	updated.Retention = "1d"
+	_, updateErr := regController.Update(ts.Name, updated)
+	if updateErr == nil {
+		t.Fatal("Expected the injected failure")
+	}
+	if r := retention(); r != 0 {
+		t.Fatalf("Expected no retention after the failed update, got %v", r)
+	}
+
+	// the data of a failed deletion is kept
+	deleteErr := regController.Delete(ts.Name)
+	if deleteErr == nil {
+		t.Fatal("Expected the injected failure")
+	}
+	if !tableExists() {
+		t.Fatal("Expected the table to be kept after the failed deletion")
+	}
+	total, err := storage.Count(ctx, Query{To: time.Now()}, &ts)
+	if err != nil || total != 1 {
+		t.Fatalf("Expected the data to be kept after the failed deletion, got %d records (%v)", total, err)
+	}
+
+	listener.failOn = ""
+	deleteErr = regController.Delete(ts.Name)
+	if deleteErr != nil {
+		t.Fatal("Deletion failed:", deleteErr)
+	}
+	if tableExists() {
+		t.Fatal("Expected the table to be dropped after the deletion")
+	}
+}
+
 func BenchmarkCreation_OneSeries(b *testing.B) {
 	b.StopTimer()
 	//Setup for the testing
@@ -701,7 +1304,7 @@ func BenchmarkCreation_OneSeries(b *testing.B) {
 	seriesMap[series.Name] = &series
 	b.StartTimer()
 	ctx := context.Background()
-	err = dataStorage.Submit(ctx, recordMap, seriesMap)
+	_, err = dataStorage.Submit(ctx, recordMap, seriesMap)
 	//err = dataClient.Submit(barr, , series.Name)
 	if err != nil {
 		b.Error("Insetion failed", err)
@@ -742,7 +1345,7 @@ func BenchmarkCreation_OneSeriesTestGroup(b *testing.B) {
 	seriesMap := make(map[string]*registry.TimeSeries)
 	seriesMap[series.Name] = &series
 	ctx := context.Background()
-	err = dataStorage.Submit(ctx, recordMap, seriesMap)
+	_, err = dataStorage.Submit(ctx, recordMap, seriesMap)
 	//err = dataClient.Submit(barr, , series.Name)
 	if err != nil {
 		b.Error("Insetion failed:", err)
@@ -781,7 +1384,7 @@ func benchmarkInsertEnd(b *testing.B, storage Storage, _ float64, timeEnd float6
 		seriesMap[series.Name] = series
 		b.StartTimer()
 		ctx := context.Background()
-		err := storage.Submit(ctx, recordMap, seriesMap)
+		_, err := storage.Submit(ctx, recordMap, seriesMap)
 		if err != nil {
 			b.Error("insetion failed", err)
 		}
@@ -802,7 +1405,7 @@ func benchmarkInsertRandom(b *testing.B, storage Storage, timeStart float64, tim
 		seriesMap[series.Name] = series
 		b.StartTimer()
 		ctx := context.Background()
-		err := storage.Submit(ctx, recordMap, seriesMap)
+		_, err := storage.Submit(ctx, recordMap, seriesMap)
 		if err != nil {
 			b.Error("insetion failed", err)
 		}
@@ -860,7 +1463,7 @@ func BenchmarkCreation_MultiSeries(b *testing.B) {
 	}
 	b.StartTimer()
 	ctx := context.Background()
-	err = dataStorage.Submit(ctx, recordmap, seriesMap)
+	_, err = dataStorage.Submit(ctx, recordmap, seriesMap)
 	//err = dataClient.Submit(barr, , series.Name)
 	if err != nil {
 		b.Error("Insetion failed")
@@ -903,7 +1506,7 @@ func BenchmarkCreation_MultiSeriesTestGroup(b *testing.B) {
 		seriesMap[series.Name] = &series
 	}
 	ctx := context.Background()
-	err = dataStorage.Submit(ctx, recordMap, seriesMap)
+	_, err = dataStorage.Submit(ctx, recordMap, seriesMap)
 	//err = dataClient.Submit(barr, , stream.Name)
 	if err != nil {
 		b.Fatal("Insetion failed", err)
@@ -951,7 +1554,7 @@ func benchmarkCreateNewSeries(b *testing.B, storage Storage, regController regis
 	}
 	b.StartTimer()
 	ctx := context.Background()
-	err := storage.Submit(ctx, recordMap, seriesMap)
+	_, err := storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		b.Fatal("Error creating:", err)
 	}
@@ -978,7 +1581,7 @@ func benchmarkDeleteSeries(b *testing.B, storage Storage, regController registry
 		seriesMap[series.Name] = &series
 	}
 	ctx := context.Background()
-	err := storage.Submit(ctx, recordMap, seriesMap)
+	_, err := storage.Submit(ctx, recordMap, seriesMap)
 	if err != nil {
 		b.Fatal("Error creating:", err)
 	}
@@ -986,7 +1589,11 @@ func benchmarkDeleteSeries(b *testing.B, storage Storage, regController registry
 
 	for i := 0; i < b.N; i++ {
 		series := registry.TimeSeries{Name: "new" + strconv.Itoa(b.N) + strconv.Itoa(i), Type: registry.Float}
-		err := storage.DeleteHandler(series)
+		tx, err := storage.DeleteHandler(series)
+		if err != nil {
+			b.Fatal("Error deleting:", err)
+		}
+		err = tx.Commit()
 		if err != nil {
 			b.Fatal("Error deleting:", err)
 		}
@@ -1118,3 +1725,1447 @@ func sampleDataForAggregation(maxPerBlock int,
 	return rawPack, aggrPack
 
 }
+
+func TestStorage_ExtendedAggregation(t *testing.T) {
+	funcName := "TestStorage_ExtendedAggregation"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	ts := registry.TimeSeries{Name: "Value/temperature", Type: registry.Float, Unit: "Cel"}
+	_, err = regController.Add(ts)
+	if err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+
+	// a single window of one hour, submitted out of order
+	const windowStart = 1594000800
+	values := []float64{3, 1, 4, 1, 5}
+	var pack senml.Pack
+	for i := len(values) - 1; i >= 0; i-- {
+		value := values[i]
+		pack = append(pack, senml.Record{Name: ts.Name, Value: &value, Time: windowStart + float64(i*60)})
+	}
+	ctx := context.Background()
+	_, err = storage.Submit(ctx, map[string]senml.Pack{ts.Name: pack}, map[string]*registry.TimeSeries{ts.Name: &ts})
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+
+	expected := map[string]float64{
+		"median":   3,
+		"p90":      4.6,
+		"p0":       1,
+		"p100":     5,
+		"p99.9":    4.996,
+		"stddev":   math.Sqrt(3.2),
+		"variance": 3.2,
+		"first":    3,
+		"last":     5,
+		"spread":   4,
+	}
+	for aggr, want := range expected {
+		t.Run(aggr, func(t *testing.T) {
+			got, _, err := storage.QueryPage(ctx, Query{
+				From:       FromSenmlTime(windowStart),
+				To:         FromSenmlTime(windowStart + 3599),
+				Page:       1,
+				PerPage:    100,
+				AggrFuncs:  []string{aggr},
+				AggrWindow: time.Hour}, &ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].Value == nil {
+				t.Fatalf("Expected a single aggregated record, got %v", got)
+			}
+			if math.Abs(*got[0].Value-want) > 1e-9 {
+				t.Errorf("Expected %s to be %v, got %v", aggr, want, *got[0].Value)
+			}
+		})
+	}
+}
+
+func TestStorage_MultipleAggregates(t *testing.T) {
+	funcName := "TestStorage_MultipleAggregates"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	seriesMap := map[string]*registry.TimeSeries{
+		"Hall/Temperature":    {Name: "Hall/Temperature", Type: registry.Float, Unit: "Cel"},
+		"Kitchen/Temperature": {Name: "Kitchen/Temperature", Type: registry.Float, Unit: "Cel"},
+	}
+	var series []*registry.TimeSeries
+	data := make(map[string]senml.Pack)
+	// two windows of one hour, with the values 0..5 and 6..11 in Hall and 10 more in Kitchen
+	const windowStart = 1594000800
+	for i, name := range []string{"Hall/Temperature", "Kitchen/Temperature"} {
+		_, err = regController.Add(*seriesMap[name])
+		if err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+		series = append(series, seriesMap[name])
+		for j := 0; j < 12; j++ {
+			value := float64(i*10 + j)
+			data[name] = append(data[name], senml.Record{Name: name, Value: &value, Time: windowStart + float64(j*600)})
+		}
+	}
+	ctx := context.Background()
+	_, err = storage.Submit(ctx, data, seriesMap)
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+
+	q := Query{
+		From:       FromSenmlTime(windowStart),
+		To:         FromSenmlTime(windowStart + 7199),
+		SortAsc:    true,
+		Page:       1,
+		PerPage:    100,
+		Count:      true,
+		AggrFuncs:  []string{"min", "mean", "max"},
+		AggrWindow: time.Hour,
+	}
+	got, total, err := storage.QueryPage(ctx, q, series...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *total != 12 || len(got) != 12 {
+		t.Fatalf("Expected 12 records (2 windows, 2 series, 3 aggregates), got %d with total %d", len(got), *total)
+	}
+	expected := map[string]float64{
+		"Hall/Temperature:min":     0,
+		"Hall/Temperature:mean":    2.5,
+		"Hall/Temperature:max":     5,
+		"Kitchen/Temperature:min":  10,
+		"Kitchen/Temperature:mean": 12.5,
+		"Kitchen/Temperature:max":  15,
+	}
+	for _, r := range got[:6] {
+		want, found := expected[r.Name]
+		if !found {
+			t.Fatalf("Unexpected record name %s", r.Name)
+		}
+		if *r.Value != want {
+			t.Errorf("Expected %s to be %v, got %v", r.Name, want, *r.Value)
+		}
+	}
+	if got[6].Name != "Hall/Temperature:max" || *got[6].Value != 11 {
+		t.Errorf("Expected the second window to start with Hall/Temperature:max 11, got %s %v", got[6].Name, *got[6].Value)
+	}
+
+	// the records of the aggregates are paged with cursors as the records of series
+	q.Count, q.PerPage = false, 5
+	var walked senml.Pack
+	for page := 0; page < 5; page++ {
+		pack, _, err := storage.QueryPage(ctx, q, series...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		walked = append(walked, pack...)
+		if len(pack) < q.PerPage {
+			break
+		}
+		q.Cursor = cursorAfter(pack, q.Cursor)
+	}
+	if len(walked) != len(got) {
+		t.Fatalf("Expected %d records walked with the cursor, got %d", len(got), len(walked))
+	}
+	for i := range got {
+		if !CompareRecords(walked[i], got[i]) {
+			t.Errorf("Record %d walked with the cursor does not match the query: %v, expected %v", i, walked[i], got[i])
+		}
+	}
+}
+
+func TestStorage_StateAggregation(t *testing.T) {
+	funcName := "TestStorage_StateAggregation"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	door := registry.TimeSeries{Name: "Door/open", Type: registry.Bool}
+	machine := registry.TimeSeries{Name: "Machine/state", Type: registry.String}
+	for _, ts := range []registry.TimeSeries{door, machine} {
+		if _, err := regController.Add(ts); err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+	}
+
+	// two windows of 30 minutes, ending at windowStart+1799 and windowStart+3599
+	const windowStart = 1594000800
+	var doorPack senml.Pack
+	for i, open := range []bool{false, true, false, true, true} {
+		open := open
+		doorPack = append(doorPack, senml.Record{Name: door.Name, BoolValue: &open, Time: windowStart + []float64{0, 600, 1500, 2100, 3000}[i]})
+	}
+	var machinePack senml.Pack
+	for i, state := range []string{"idle", "run", "run", "stop", "run"} {
+		machinePack = append(machinePack, senml.Record{Name: machine.Name, StringValue: state, Time: windowStart + float64(i*600)})
+	}
+	ctx := context.Background()
+	_, err = storage.Submit(ctx, map[string]senml.Pack{door.Name: doorPack, machine.Name: machinePack},
+		map[string]*registry.TimeSeries{door.Name: &door, machine.Name: &machine})
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+	query := func(window time.Duration, aggrs ...string) Query {
+		return Query{
+			From:       FromSenmlTime(windowStart),
+			To:         FromSenmlTime(windowStart + 3599),
+			SortAsc:    true,
+			Page:       1,
+			PerPage:    100,
+			AggrFuncs:  aggrs,
+			AggrWindow: window}
+	}
+
+	t.Run("bool", func(t *testing.T) {
+		// the state lasts until the next record or the end of the window, and is carried into the next window
+		expected := map[string][]float64{
+			"time_true":   {900, 1499},
+			"ratio_true":  {900.0 / 1799, 1499.0 / 1800},
+			"transitions": {2, 1},
+			"count":       {3, 2},
+		}
+		for aggr, want := range expected {
+			got, _, err := storage.QueryPage(ctx, query(30*time.Minute, aggr), &door)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Fatalf("Expected %d windows of %s, got %v", len(want), aggr, got)
+			}
+			for i := range want {
+				if got[i].Value == nil || math.Abs(*got[i].Value-want[i]) > 1e-9 {
+					t.Errorf("Expected %s of window %d to be %v, got %v", aggr, i, want[i], got[i].Value)
+				}
+			}
+		}
+		// the state of the record before the range lasts until the first record in it
+		q := query(time.Hour, "time_true", "ratio_true", "transitions")
+		q.From = FromSenmlTime(windowStart + 1000)
+		got, _, err := storage.QueryPage(ctx, q, &door)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]float64{"time_true": 1999, "ratio_true": 1999.0 / 2599, "transitions": 2}
+		if len(got) != len(want) {
+			t.Fatalf("Expected %d aggregates, got %v", len(want), got)
+		}
+		for _, r := range got {
+			aggr := strings.TrimPrefix(r.Name, door.Name+AggregateSeparator)
+			if r.Value == nil || math.Abs(*r.Value-want[aggr]) > 1e-9 {
+				t.Errorf("Expected %s after the start of the range to be %v, got %v", aggr, want[aggr], *r.Value)
+			}
+		}
+
+		got, _, err = storage.QueryPage(ctx, query(time.Hour, "last"), &door)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got[0].BoolValue == nil || !*got[0].BoolValue {
+			t.Errorf("Expected the last state to be true, got %v", got)
+		}
+		if got[0].Value != nil {
+			t.Errorf("Expected the last state to be a boolean, got %v", *got[0].Value)
+		}
+	})
+
+	t.Run("string", func(t *testing.T) {
+		expected := map[string]float64{
+			"count_distinct": 3,
+			"transitions":    3,
+		}
+		for aggr, want := range expected {
+			got, _, err := storage.QueryPage(ctx, query(time.Hour, aggr), &machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].Value == nil || *got[0].Value != want {
+				t.Errorf("Expected %s to be %v, got %v", aggr, want, got)
+			}
+		}
+		for aggr, want := range map[string]string{"mode": "run", "first": "idle", "last": "run"} {
+			got, _, err := storage.QueryPage(ctx, query(time.Hour, aggr), &machine)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 1 || got[0].StringValue != want {
+				t.Errorf("Expected %s to be %s, got %v", aggr, want, got)
+			}
+		}
+	})
+
+	t.Run("multiple aggregates", func(t *testing.T) {
+		got, _, err := storage.QueryPage(ctx, query(time.Hour, "ratio_true", "last"), &door)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 {
+			t.Fatalf("Expected a record per aggregate, got %v", got)
+		}
+		for _, r := range got {
+			switch r.Name {
+			case AggregateName(door.Name, "ratio_true"):
+				if r.Value == nil || math.Abs(*r.Value-2399.0/3599) > 1e-9 || r.Unit != "/" {
+					t.Errorf("Unexpected ratio record %v", r)
+				}
+			case AggregateName(door.Name, "last"):
+				if r.BoolValue == nil || !*r.BoolValue {
+					t.Errorf("Unexpected last record %v", r)
+				}
+			default:
+				t.Errorf("Unexpected record %s", r.Name)
+			}
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		controller := NewController(regController, storage, false)
+		for _, q := range []struct {
+			aggr   string
+			series []string
+		}{
+			{"mean", []string{door.Name}},
+			{"mode", []string{door.Name}},
+			{"time_true", []string{machine.Name}},
+			{"last", []string{door.Name, machine.Name}},
+		} {
+			_, _, err := controller.QueryPage(ctx, query(time.Hour, q.aggr), q.series)
+			if _, ok := err.(*common.BadRequestError); !ok {
+				t.Errorf("Expected a bad request for %s of %v, got %v", q.aggr, q.series, err)
+			}
+		}
+	})
+}
+
+func TestController_QueryFilled(t *testing.T) {
+	funcName := "TestController_QueryFilled"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	controller := NewController(regController, storage, false)
+
+	const t0 = 1594000800
+	record := func(name string, t float64, v float64) senml.Record {
+		return senml.Record{Name: name, Unit: "Cel", Time: t0 + t, Value: &v}
+	}
+	for _, name := range []string{"a", "b"} {
+		_, err = regController.Add(registry.TimeSeries{Name: name, Type: registry.Float, Unit: "Cel"})
+		if err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+	}
+	ctx := context.Background()
+	_, submitErr := controller.Submit(ctx, senml.Pack{record("a", 0, 0), record("a", 40, 4), record("a", 100, 10), record("b", 20, 100)}, nil)
+	if submitErr != nil {
+		t.Fatal(submitErr)
+	}
+
+	// expected values of the 7 points between t0 and t0+120, every 20 seconds
+	values := func(vs ...interface{}) []*float64 {
+		var ptrs []*float64
+		for _, v := range vs {
+			if f, ok := v.(int); ok {
+				value := float64(f)
+				ptrs = append(ptrs, &value)
+			} else {
+				ptrs = append(ptrs, nil)
+			}
+		}
+		return ptrs
+	}
+	check := func(t *testing.T, got senml.Pack, name string, expected []*float64) {
+		t.Helper()
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %d records, got %d: %v", len(expected), len(got), got)
+		}
+		for i, r := range got {
+			if r.Name != name || r.Time != t0+float64(i*20) {
+				t.Fatalf("Unexpected record %d: %s at %v", i, r.Name, r.Time)
+			}
+			if (r.Value == nil) != (expected[i] == nil) || (r.Value != nil && *r.Value != *expected[i]) {
+				t.Errorf("Unexpected value of record %d: %v", i, r)
+			}
+		}
+	}
+	resampled := Query{From: FromSenmlTime(t0), To: FromSenmlTime(t0 + 120), SortAsc: true, Page: 1, PerPage: 100, Count: true, Resample: 20 * time.Second}
+	for fill, expected := range map[string][]*float64{
+		FillLinear:   values(0, 2, 4, 6, 8, 10, nil),
+		FillPrevious: values(0, 0, 4, 4, 4, 10, 10),
+		FillNull:     values(0, nil, 4, nil, nil, 10, nil),
+		"-1":         values(0, -1, 4, -1, -1, 10, -1),
+	} {
+		t.Run("resample_"+fill, func(t *testing.T) {
+			q := resampled
+			q.Fill, err = ParseFill(fill)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, total, queryErr := controller.QueryPage(ctx, q, []string{"a"})
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			if *total != 7 {
+				t.Errorf("Expected a total of 7, got %d", *total)
+			}
+			check(t, got, "a", expected)
+		})
+	}
+
+	// aggregation windows of two series, filled with the previous values
+	q := Query{From: FromSenmlTime(t0), To: FromSenmlTime(t0 + 120), Page: 1, PerPage: 100, Count: true,
+		AggrFuncs: []string{"mean"}, AggrWindow: 20 * time.Second, Fill: Fill{Method: FillPrevious}}
+	all, total, queryErr := controller.QueryPage(ctx, q, []string{"a", "b"})
+	if queryErr != nil {
+		t.Fatal(queryErr)
+	}
+	if *total != 14 || len(all) != 14 {
+		t.Fatalf("Expected 14 records, got %d with total %d", len(all), *total)
+	}
+	var a, b senml.Pack
+	for i := len(all) - 2; i >= 0; i -= 2 {
+		a, b = append(a, all[i]), append(b, all[i+1])
+	}
+	check(t, a, "a", values(0, 0, 4, 4, 4, 10, 10))
+	check(t, b, "b", values(nil, 100, 100, 100, 100, 100, 100))
+
+	t.Run("paging", func(t *testing.T) {
+		q := q
+		q.Count, q.PerPage, q.Page = false, 4, 2
+		page, _, queryErr := controller.QueryPage(ctx, q, []string{"a", "b"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		if filledString(page) != filledString(all[4:8]) {
+			t.Errorf("Expected the second page %s, got %s", filledString(all[4:8]), filledString(page))
+		}
+
+		q.Page = 1
+		var walked senml.Pack
+		for i := 0; i < 5; i++ {
+			page, _, queryErr := controller.QueryPage(ctx, q, []string{"a", "b"})
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			walked = append(walked, page...)
+			if len(page) < q.PerPage {
+				break
+			}
+			q.Cursor = cursorAfter(page, q.Cursor)
+		}
+		if filledString(walked) != filledString(all) {
+			t.Errorf("Expected the pages walked with the cursor to be %s, got %s", filledString(all), filledString(walked))
+		}
+	})
+
+	t.Run("paging with the state of the filling", func(t *testing.T) {
+		linear := resampled
+		linear.Fill, linear.Count = Fill{Method: FillLinear}, false
+		linearDesc := linear
+		linearDesc.SortAsc = false
+		for name, q := range map[string]Query{"resampled": linear, "resampled descending": linearDesc, "aggregated": q} {
+			series := []string{"a", "b"}
+			expected, _, queryErr := controller.QueryPage(ctx, q, series)
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			q.Count, q.PerPage = false, 3
+			var walked senml.Pack
+			for i := 0; i < 10; i++ {
+				page, _, next, queryErr := controller.QueryPageCursor(ctx, q, series)
+				if queryErr != nil {
+					t.Fatal(queryErr)
+				}
+				walked = append(walked, page...)
+				if len(page) < q.PerPage {
+					break
+				}
+				if next == nil || next.State == nil || len(next.State.Fill) != 2 {
+					t.Fatalf("Expected a cursor with the neighbours of the series, got %+v", next)
+				}
+				q.Cursor = next
+			}
+			if filledString(walked) != filledString(expected) {
+				t.Errorf("Expected the %s pages walked with the cursor to be %s, got %s", name, filledString(expected), filledString(walked))
+			}
+		}
+	})
+
+	t.Run("too many points", func(t *testing.T) {
+		q := resampled
+		q.Resample = time.Millisecond
+		_, _, queryErr := controller.QueryPage(ctx, q, []string{"a"})
+		if _, ok := queryErr.(*common.BadRequestError); !ok {
+			t.Errorf("Expected a bad request for %d resampled points, got %v", 120000, queryErr)
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		q := q
+		q.Count, q.PerPage, q.Offset, q.Limit = false, 3, 1, 10
+		var packs []senml.Pack
+		queryErr := controller.QueryStream(ctx, q, []string{"a", "b"}, func(pack senml.Pack) error {
+			packs = append(packs, pack)
+			return nil
+		})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		var streamed senml.Pack
+		for _, p := range packs {
+			if len(p) > 3 {
+				t.Errorf("Expected packs of at most 3 records, got %d", len(p))
+			}
+			streamed = append(streamed, p...)
+		}
+		if filledString(streamed) != filledString(all[1:11]) {
+			t.Errorf("Expected the streamed records %s, got %s", filledString(all[1:11]), filledString(streamed))
+		}
+	})
+
+	t.Run("epoch aligned", func(t *testing.T) {
+		q := Query{From: FromSenmlTime(t0 + 10), To: FromSenmlTime(t0 + 100), SortAsc: true, Page: 1, PerPage: 100,
+			AggrFuncs: []string{"max"}, AggrWindow: 30 * time.Second, Align: AlignEpoch, Fill: Fill{Method: FillPrevious}}
+		got, _, queryErr := controller.QueryPage(ctx, q, []string{"a"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		expected := "a@1.59400083e+09=null a@1.59400086e+09=4 a@1.59400089e+09=4 a@1.59400092e+09=10 "
+		if filledString(got) != expected {
+			t.Errorf("Expected %s, got %s", expected, filledString(got))
+		}
+	})
+
+	t.Run("string series", func(t *testing.T) {
+		_, err := regController.Add(registry.TimeSeries{Name: "c", Type: registry.String})
+		if err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+		_, _, queryErr := controller.QueryPage(ctx, resampled, []string{"c"})
+		if _, ok := queryErr.(*common.BadRequestError); !ok {
+			t.Errorf("Expected a bad request for resampling a string series, got %v", queryErr)
+		}
+	})
+}
+
+func TestController_QueryTransformed(t *testing.T) {
+	funcName := "TestController_QueryTransformed"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	controller := NewController(regController, storage, false)
+
+	const t0 = 1594000800
+	record := func(name string, t float64, v float64) senml.Record {
+		return senml.Record{Name: name, Unit: "Wh", Time: t0 + t, Value: &v}
+	}
+	for _, name := range []string{"meter", "b"} {
+		_, err = regController.Add(registry.TimeSeries{Name: name, Type: registry.Float, Unit: "Wh"})
+		if err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+	}
+	ctx := context.Background()
+	// the meter is reset between t0+20 and t0+30
+	_, submitErr := controller.Submit(ctx, senml.Pack{record("meter", 0, 0), record("meter", 10, 10), record("meter", 20, 30), record("meter", 30, 5),
+		record("meter", 40, 15), record("b", 0, 1), record("b", 10, 2), record("b", 20, 3)}, nil)
+	if submitErr != nil {
+		t.Fatal(submitErr)
+	}
+	query := func(transforms string) Query {
+		q := Query{From: FromSenmlTime(t0), To: FromSenmlTime(t0 + 40), SortAsc: true, Page: 1, PerPage: 100, Count: true}
+		q.Transforms, err = ParseTransforms(transforms)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+
+	for transforms, expected := range map[string]string{
+		"difference":                "meter@1.59400081e+09=10 meter@1.59400082e+09=20 meter@1.59400083e+09=-25 meter@1.59400084e+09=10 ",
+		"derivative":                "meter@1.59400081e+09=1 meter@1.59400082e+09=2 meter@1.59400083e+09=-2.5 meter@1.59400084e+09=1 ",
+		"rate":                      "meter@1.59400081e+09=1 meter@1.59400082e+09=2 meter@1.59400083e+09=0.5 meter@1.59400084e+09=1 ",
+		"cumulative_sum":            "meter@1.5940008e+09=0 meter@1.59400081e+09=10 meter@1.59400082e+09=40 meter@1.59400083e+09=45 meter@1.59400084e+09=60 ",
+		"moving_average(2)":         "meter@1.59400081e+09=5 meter@1.59400082e+09=20 meter@1.59400083e+09=17.5 meter@1.59400084e+09=10 ",
+		"moving_average(20s)":       "meter@1.5940008e+09=0 meter@1.59400081e+09=5 meter@1.59400082e+09=20 meter@1.59400083e+09=17.5 meter@1.59400084e+09=10 ",
+		"difference,cumulative_sum": "meter@1.59400081e+09=10 meter@1.59400082e+09=30 meter@1.59400083e+09=5 meter@1.59400084e+09=15 ",
+	} {
+		t.Run(transforms, func(t *testing.T) {
+			got, total, queryErr := controller.QueryPage(ctx, query(transforms), []string{"meter"})
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			if filledString(got) != expected {
+				t.Errorf("Expected %s, got %s", expected, filledString(got))
+			}
+			if *total != len(got) {
+				t.Errorf("Expected a total of %d, got %d", len(got), *total)
+			}
+		})
+	}
+
+	t.Run("unit", func(t *testing.T) {
+		got, _, queryErr := controller.QueryPage(ctx, query("rate"), []string{"meter"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		if len(got) == 0 || got[0].Unit != "Wh/s" {
+			t.Errorf("Expected the rate in Wh/s, got %v", got)
+		}
+	})
+
+	t.Run("aggregated", func(t *testing.T) {
+		// windows ending at t0, t0+20 and t0+40 with the maxima 0, 30 and 15
+		q := query("rate")
+		q.AggrFuncs, q.AggrWindow = []string{"max"}, 20*time.Second
+		got, _, queryErr := controller.QueryPage(ctx, q, []string{"meter"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		expected := "meter@1.59400082e+09=1.5 meter@1.59400084e+09=0.75 "
+		if filledString(got) != expected {
+			t.Errorf("Expected %s, got %s", expected, filledString(got))
+		}
+	})
+
+	// differences of two series, latest first
+	q := query("difference")
+	q.SortAsc = false
+	all, total, queryErr := controller.QueryPage(ctx, q, []string{"meter", "b"})
+	if queryErr != nil {
+		t.Fatal(queryErr)
+	}
+	expected := "meter@1.59400084e+09=10 meter@1.59400083e+09=-25 b@1.59400082e+09=1 meter@1.59400082e+09=20 b@1.59400081e+09=1 meter@1.59400081e+09=10 "
+	if filledString(all) != expected || *total != 6 {
+		t.Fatalf("Expected %s, got %s with total %d", expected, filledString(all), *total)
+	}
+	count, countErr := controller.Count(ctx, q, []string{"meter", "b"})
+	if countErr != nil || count != 6 {
+		t.Errorf("Expected a count of 6, got %d: %v", count, countErr)
+	}
+
+	t.Run("paging", func(t *testing.T) {
+		q := q
+		q.Count, q.PerPage, q.Page = false, 2, 2
+		page, _, queryErr := controller.QueryPage(ctx, q, []string{"meter", "b"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		if filledString(page) != filledString(all[2:4]) {
+			t.Errorf("Expected the second page %s, got %s", filledString(all[2:4]), filledString(page))
+		}
+
+		q.Page = 1
+		var walked senml.Pack
+		for i := 0; i < 5; i++ {
+			page, _, queryErr := controller.QueryPage(ctx, q, []string{"meter", "b"})
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			walked = append(walked, page...)
+			if len(page) < q.PerPage {
+				break
+			}
+			q.Cursor = cursorAfter(page, q.Cursor)
+		}
+		if filledString(walked) != filledString(all) {
+			t.Errorf("Expected the pages walked with the cursor to be %s, got %s", filledString(all), filledString(walked))
+		}
+	})
+
+	t.Run("stream", func(t *testing.T) {
+		q := q
+		q.Count, q.PerPage, q.Offset, q.Limit = false, 2, 1, 3
+		var streamed senml.Pack
+		queryErr := controller.QueryStream(ctx, q, []string{"meter", "b"}, func(pack senml.Pack) error {
+			streamed = append(streamed, pack...)
+			return nil
+		})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		if filledString(streamed) != filledString(all[1:4]) {
+			t.Errorf("Expected the streamed records %s, got %s", filledString(all[1:4]), filledString(streamed))
+		}
+	})
+
+	t.Run("descending and paged", func(t *testing.T) {
+		names := []string{"meter", "b"}
+		for _, transforms := range []string{"difference", "derivative", "rate", "cumulative_sum", "moving_average(2)", "moving_average(20s)",
+			"difference,cumulative_sum", "cumulative_sum,moving_average(2),difference"} {
+			asc := query(transforms)
+			ascending, _, queryErr := controller.QueryPage(ctx, asc, names)
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			// the transforms of descending queries are computed backwards
+			desc := asc
+			desc.SortAsc = false
+			descending, total, queryErr := controller.QueryPage(ctx, desc, names)
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			if expected := filledString(reversedTimes(ascending)); filledString(descending) != expected {
+				t.Errorf("Expected %s descending to be %s, got %s", transforms, expected, filledString(descending))
+			}
+			if *total != len(ascending) {
+				t.Errorf("Expected a total of %d records of %s, got %d", len(ascending), transforms, *total)
+			}
+
+			// the pages continue with the state of the transforms
+			for _, q := range []Query{asc, desc} {
+				q.Count, q.PerPage = false, 2
+				var walked senml.Pack
+				for i := 0; i < 10; i++ {
+					page, _, next, queryErr := controller.QueryPageCursor(ctx, q, names)
+					if queryErr != nil {
+						t.Fatal(queryErr)
+					}
+					walked = append(walked, page...)
+					if next == nil {
+						break
+					}
+					if q.SortAsc && (next.State == nil || len(next.State.Transforms) != len(q.Transforms)) {
+						t.Fatalf("Expected the cursor of %s to carry the state of the transforms, got %+v", transforms, next)
+					}
+					if q.Cursor, err = ParseCursor(next.Encode()); err != nil {
+						t.Fatal(err)
+					}
+				}
+				expected := ascending
+				if !q.SortAsc {
+					expected = descending
+				}
+				if filledString(walked) != filledString(expected) {
+					t.Errorf("Expected the pages of %s (ascending: %v) to be %s, got %s", transforms, q.SortAsc, filledString(expected), filledString(walked))
+				}
+			}
+		}
+	})
+
+	t.Run("count", func(t *testing.T) {
+		names := []string{"meter", "b"}
+		for _, transforms := range []string{"difference", "rate", "moving_average(2)", "moving_average(5)", "difference,moving_average(3)"} {
+			for _, aggregated := range []bool{false, true} {
+				q := query(transforms)
+				if aggregated {
+					q.AggrFuncs, q.AggrWindow = []string{"max", "min"}, 10*time.Second
+				}
+				q.Count = false
+				// records which are all produced
+				q.PerPage = MaxPerPage
+				got, _, queryErr := controller.QueryPage(ctx, q, names)
+				if queryErr != nil {
+					t.Fatal(queryErr)
+				}
+				count, countErr := controller.Count(ctx, q, names)
+				if countErr != nil {
+					t.Fatal(countErr)
+				}
+				if count != len(got) {
+					t.Errorf("Expected a count of %d for %s (aggregated: %v), got %d", len(got), transforms, aggregated, count)
+				}
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, s := range []string{"integral", "moving_average", "moving_average(0)", "difference(2)", "rate,"} {
+			if _, err := ParseTransforms(s); err == nil {
+				t.Errorf("Expected an error parsing %s", s)
+			}
+		}
+		_, err := regController.Add(registry.TimeSeries{Name: "c", Type: registry.String})
+		if err != nil {
+			t.Fatal("Insertion failed:", err)
+		}
+		_, _, queryErr := controller.QueryPage(ctx, query("difference"), []string{"c"})
+		if _, ok := queryErr.(*common.BadRequestError); !ok {
+			t.Errorf("Expected a bad request for transforming a string series, got %v", queryErr)
+		}
+	})
+}
+
+// reversedTimes reverses the order of the times of records, keeping the order of the names at each time
+func reversedTimes(pack senml.Pack) senml.Pack {
+	var reversed senml.Pack
+	for end := len(pack); end > 0; {
+		start := end - 1
+		for start > 0 && pack[start-1].Time == pack[end-1].Time {
+			start--
+		}
+		reversed = append(reversed, pack[start:end]...)
+		end = start
+	}
+	return reversed
+}
+
+// filledString formats the names, times and values of filled records
+func filledString(pack senml.Pack) string {
+	var b strings.Builder
+	for _, r := range pack {
+		if r.Value == nil {
+			fmt.Fprintf(&b, "%s@%v=null ", r.Name, r.Time)
+		} else {
+			fmt.Fprintf(&b, "%s@%v=%v ", r.Name, r.Time, *r.Value)
+		}
+	}
+	return b.String()
+}
+
+func TestStorage_CalendarAggregation(t *testing.T) {
+	funcName := "TestStorage_CalendarAggregation"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("Time zone database is not available: %s", err)
+	}
+
+	ts := registry.TimeSeries{Name: "meter", Type: registry.Float, Unit: "kWh"}
+	_, err = regController.Add(ts)
+	if err != nil {
+		t.Fatal("Insertion failed:", err)
+	}
+	// hourly values around the change to daylight saving time on March 29, 2020 and the end of the month
+	from := time.Date(2020, 3, 28, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2020, 4, 1, 23, 0, 0, 0, time.UTC)
+	var pack senml.Pack
+	for tm := from; !tm.After(to); tm = tm.Add(time.Hour) {
+		value := 1.0
+		pack = append(pack, senml.Record{Name: ts.Name, Value: &value, Time: ToSenmlTime(tm)})
+	}
+	ctx := context.Background()
+	_, err = storage.Submit(ctx, map[string]senml.Pack{ts.Name: pack}, map[string]*registry.TimeSeries{ts.Name: &ts})
+	if err != nil {
+		t.Fatal("Error while inserting:", err)
+	}
+
+	// expected counts of the windows ending at the given boundaries
+	expectedCounts := func(boundaries []time.Time) map[float64]float64 {
+		counts := make(map[float64]float64)
+		for _, r := range pack {
+			for i := 1; i < len(boundaries); i++ {
+				if r.Time > ToSenmlTime(boundaries[i-1]) && r.Time <= ToSenmlTime(boundaries[i]) {
+					counts[ToSenmlTime(boundaries[i])]++
+				}
+			}
+		}
+		return counts
+	}
+	var days []time.Time
+	for d := 27; d <= 34; d++ {
+		days = append(days, time.Date(2020, 3, d, 0, 0, 0, 0, berlin))
+	}
+	tests := map[string]struct {
+		q        Query
+		expected map[float64]float64
+	}{
+		"local days": {
+			Query{Calendar: CalendarPeriod{N: 1, Unit: CalendarDay}, Location: berlin},
+			expectedCounts(days),
+		},
+		"local months": {
+			Query{Calendar: CalendarPeriod{N: 1, Unit: CalendarMonth}, Location: berlin},
+			expectedCounts([]time.Time{time.Date(2020, 3, 1, 0, 0, 0, 0, berlin), time.Date(2020, 4, 1, 0, 0, 0, 0, berlin), time.Date(2020, 5, 1, 0, 0, 0, 0, berlin)}),
+		},
+		"quarters": {
+			Query{Calendar: CalendarPeriod{N: 3, Unit: CalendarMonth}},
+			expectedCounts([]time.Time{time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 4, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)}),
+		},
+		"weeks": {
+			Query{Calendar: CalendarPeriod{N: 1, Unit: CalendarWeek}, Location: berlin},
+			expectedCounts([]time.Time{time.Date(2020, 3, 23, 0, 0, 0, 0, berlin), time.Date(2020, 3, 30, 0, 0, 0, 0, berlin), time.Date(2020, 4, 6, 0, 0, 0, 0, berlin)}),
+		},
+		"epoch aligned": {
+			Query{AggrWindow: 7 * time.Hour, Align: AlignEpoch},
+			func() map[float64]float64 {
+				var boundaries []time.Time
+				// multiples of 7 hours since the epoch, rather than since the zero time
+				const window = 7 * 60 * 60
+				for tm := time.Unix(from.Unix()/window*window, 0); !tm.After(to.Add(window * time.Second)); tm = tm.Add(window * time.Second) {
+					boundaries = append(boundaries, tm)
+				}
+				return expectedCounts(boundaries)
+			}(),
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			q := test.q
+			q.From, q.To, q.SortAsc, q.Page, q.PerPage, q.Count = from, to, true, 1, 100, true
+			q.AggrFuncs = []string{"count"}
+			got, total, err := storage.QueryPage(ctx, q, &ts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(test.expected) || *total != len(test.expected) {
+				t.Fatalf("Expected %d windows, got %d with total %d: %v", len(test.expected), len(got), *total, got)
+			}
+			for _, r := range got {
+				if *r.Value != test.expected[r.Time] {
+					t.Errorf("Expected the window ending at %s to count %v, got %v", FromSenmlTime(r.Time).In(berlin), test.expected[r.Time], *r.Value)
+				}
+			}
+		})
+	}
+
+	t.Run("multiple aggregates", func(t *testing.T) {
+		q := Query{From: from, To: to, SortAsc: true, Page: 1, PerPage: 100, AggrFuncs: []string{"count", "sum"},
+			Calendar: CalendarPeriod{N: 1, Unit: CalendarMonth}, Location: berlin}
+		got, _, err := storage.QueryPage(ctx, q, &ts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := tests["local months"].expected
+		if len(got) != 2*len(expected) {
+			t.Fatalf("Expected %d records, got %v", 2*len(expected), got)
+		}
+		for _, r := range got {
+			if *r.Value != expected[r.Time] {
+				t.Errorf("Expected %s of the window ending at %s to be %v, got %v", r.Name, FromSenmlTime(r.Time).In(berlin), expected[r.Time], *r.Value)
+			}
+		}
+	})
+
+	t.Run("without from", func(t *testing.T) {
+		// the windows start at the epoch, each record is counted in one window
+		for _, calendar := range []CalendarPeriod{{N: 1, Unit: CalendarDay}, {N: 1, Unit: CalendarWeek}, {N: 1, Unit: CalendarMonth}, {N: 1, Unit: CalendarYear}} {
+			q := Query{To: to, SortAsc: true, Page: 1, PerPage: 100, AggrFuncs: []string{"count"}, Calendar: calendar, Location: berlin}
+			got, _, err := storage.QueryPage(ctx, q, &ts)
+			if err != nil {
+				t.Fatalf("Error querying %s windows: %s", calendar, err)
+			}
+			counted := 0.0
+			for _, r := range got {
+				counted += *r.Value
+			}
+			if counted != float64(len(pack)) {
+				t.Errorf("Expected %s windows to count %d records, got %v in %v", calendar, len(pack), counted, got)
+			}
+		}
+
+		q := Query{To: time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC), Calendar: CalendarPeriod{N: 1, Unit: CalendarYear}}
+		if _, err := q.calendarWindows(); err == nil {
+			t.Error("Expected an error for windows out of the supported time range")
+		}
+	})
+}
+
+func TestController_VirtualSeries(t *testing.T) {
+	funcName := "TestController_VirtualSeries"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	controller := NewController(regController, storage, false)
+
+	virtual := func(name, unit, expression string, inputs map[string]string) registry.TimeSeries {
+		return registry.TimeSeries{Name: name, Type: registry.Float, Unit: unit,
+			Source: registry.Source{SrcType: registry.Virtual, VirtualSource: &registry.VirtualSource{Inputs: inputs, Expression: expression}}}
+	}
+	vi := map[string]string{"v": "voltage", "i": "current"}
+	for _, ts := range []registry.TimeSeries{
+		{Name: "voltage", Type: registry.Float, Unit: "V"},
+		{Name: "current", Type: registry.Float, Unit: "A"},
+		{Name: "temperature", Type: registry.Float, Unit: "Cel"},
+		virtual("power", "W", "v * i", vi),
+		virtual("resistance", "Ohm", "v / i", vi),
+		virtual("overload", "", "if(i > 2.5, 1, 0)", vi),
+		virtual("fahrenheit", "[degF]", "c * 9 / 5 + 32", map[string]string{"c": "temperature"}),
+	} {
+		_, addErr := regController.Add(ts)
+		if addErr != nil {
+			t.Fatalf("Insertion of %s failed: %s", ts.Name, addErr)
+		}
+	}
+
+	const t0 = 1594000800
+	record := func(name string, t float64, v float64) senml.Record {
+		return senml.Record{Name: name, Time: t0 + t, Value: &v}
+	}
+	ctx := context.Background()
+	// the inputs are not aligned in time, and the current drops to zero at the end
+	_, submitErr := controller.Submit(ctx, senml.Pack{record("voltage", 0, 230), record("voltage", 20, 240),
+		record("current", 10, 2), record("current", 30, 3), record("current", 40, 0),
+		record("temperature", 0, 20), record("temperature", 10, -40)}, nil)
+	if submitErr != nil {
+		t.Fatal(submitErr)
+	}
+	query := func(from float64) Query {
+		return Query{From: FromSenmlTime(t0 + from), To: FromSenmlTime(t0 + 40), SortAsc: true, Page: 1, PerPage: 100, Count: true}
+	}
+
+	for name, expected := range map[string]string{
+		"power":      "power@1.59400081e+09=460 power@1.59400082e+09=480 power@1.59400083e+09=720 power@1.59400084e+09=0 ",
+		"resistance": "resistance@1.59400081e+09=115 resistance@1.59400082e+09=120 resistance@1.59400083e+09=80 ",
+		"overload":   "overload@1.59400081e+09=0 overload@1.59400082e+09=0 overload@1.59400083e+09=1 overload@1.59400084e+09=0 ",
+		"fahrenheit": "fahrenheit@1.5940008e+09=68 fahrenheit@1.59400081e+09=-40 ",
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, total, queryErr := controller.QueryPage(ctx, query(0), []string{name})
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			if filledString(got) != expected {
+				t.Errorf("Expected %s, got %s", expected, filledString(got))
+			}
+			if *total != len(got) {
+				t.Errorf("Expected a total of %d, got %d", len(got), *total)
+			}
+		})
+	}
+
+	t.Run("inputs before the range", func(t *testing.T) {
+		got, _, queryErr := controller.QueryPage(ctx, query(15), []string{"power"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		expected := "power@1.59400082e+09=480 power@1.59400083e+09=720 power@1.59400084e+09=0 "
+		if filledString(got) != expected {
+			t.Errorf("Expected %s, got %s", expected, filledString(got))
+		}
+	})
+
+	t.Run("aggregation", func(t *testing.T) {
+		q := query(0)
+		q.To = FromSenmlTime(t0 + 39)
+		q.AggrFuncs, q.AggrWindow, q.Align = []string{"mean"}, 20*time.Second, AlignEpoch
+		got, _, queryErr := controller.QueryPage(ctx, q, []string{"power"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		expected := "power@1.59400082e+09=470 power@1.59400084e+09=720 "
+		if filledString(got) != expected {
+			t.Errorf("Expected %s, got %s", expected, filledString(got))
+		}
+	})
+
+	t.Run("multiple series", func(t *testing.T) {
+		got, _, queryErr := controller.QueryPage(ctx, query(25), []string{"power", "current"})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		expected := "current@1.59400083e+09=3 power@1.59400083e+09=720 current@1.59400084e+09=0 power@1.59400084e+09=0 "
+		if filledString(got) != expected {
+			t.Errorf("Expected %s, got %s", expected, filledString(got))
+		}
+	})
+
+	t.Run("latest", func(t *testing.T) {
+		// the resistance has no value at the latest time of the inputs
+		got, latestErr := controller.Latest(ctx, []string{"power", "resistance"})
+		if latestErr != nil {
+			t.Fatal(latestErr)
+		}
+		expected := "power@1.59400084e+09=0 resistance@1.59400083e+09=80 "
+		if filledString(got) != expected {
+			t.Errorf("Expected %s, got %s", expected, filledString(got))
+		}
+	})
+
+	t.Run("submit and delete", func(t *testing.T) {
+		_, err := controller.Submit(ctx, senml.Pack{record("power", 50, 1)}, nil)
+		if _, ok := err.(*common.BadRequestError); !ok {
+			t.Errorf("Expected a bad request submitting to a virtual series, got %v", err)
+		}
+		err = controller.Delete(ctx, []string{"power"}, FromSenmlTime(t0), FromSenmlTime(t0+40))
+		if _, ok := err.(*common.BadRequestError); !ok {
+			t.Errorf("Expected a bad request deleting the data of a virtual series, got %v", err)
+		}
+		regErr := regController.Delete("current")
+		if _, ok := regErr.(*common.ConflictError); !ok {
+			t.Errorf("Expected a conflict deleting an input of a virtual series, got %v", regErr)
+		}
+		_, regErr = regController.Add(virtual("nested", "W", "p * 2", map[string]string{"p": "power"}))
+		if _, ok := regErr.(*common.BadRequestError); !ok {
+			t.Errorf("Expected a bad request adding a virtual series of a virtual series, got %v", regErr)
+		}
+		if regErr := regController.Delete("power"); regErr != nil {
+			t.Errorf("Error deleting a virtual series: %s", regErr)
+		}
+	})
+}
+
+func TestController_QueryUnit(t *testing.T) {
+	funcName := "TestController_QueryUnit"
+	fileName, disconnectFunc, storage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	controller := NewController(regController, storage, false)
+
+	for _, ts := range []registry.TimeSeries{
+		{Name: "temperature", Type: registry.Float, Unit: "Cel"},
+		{Name: "power", Type: registry.Float, Unit: "W"},
+		{Name: "energy", Type: registry.Float, Unit: "Wh"},
+	} {
+		_, addErr := regController.Add(ts)
+		if addErr != nil {
+			t.Fatalf("Insertion of %s failed: %s", ts.Name, addErr)
+		}
+	}
+	_, addErr := regController.Add(registry.TimeSeries{Name: "pressure", Type: registry.Float, Unit: "mbar"})
+	if _, ok := addErr.(*common.BadRequestError); !ok {
+		t.Errorf("Expected a bad request registering an unknown unit, got %v", addErr)
+	}
+
+	const t0 = 1594000800
+	record := func(name, unit string, t float64, v float64) senml.Record {
+		return senml.Record{Name: name, Unit: unit, Time: t0 + t, Value: &v}
+	}
+	ctx := context.Background()
+	// records in a convertible unit are stored in the unit of their series
+	_, submitErr := controller.Submit(ctx, senml.Pack{record("temperature", "Cel", 0, 20), record("temperature", "K", 10, 303.15),
+		record("temperature", "[degF]", 20, 50), record("power", "kW", 0, 1.5), record("power", "", 10, 500),
+		record("energy", "Wh", 0, 2), record("energy", "J", 10, 36000)}, nil)
+	if submitErr != nil {
+		t.Fatal(submitErr)
+	}
+	_, submitErr = controller.Submit(ctx, senml.Pack{record("temperature", "W", 30, 1)}, nil)
+	if _, ok := submitErr.(*common.BadRequestError); !ok {
+		t.Errorf("Expected a bad request submitting a record in an incompatible unit, got %v", submitErr)
+	}
+
+	for _, c := range []struct {
+		series, unit, aggr string
+		expected           string
+	}{
+		{"temperature", "", "", "temperature[Cel]@1.5940008e+09=20 temperature[Cel]@1.59400081e+09=30 temperature[Cel]@1.59400082e+09=10 "},
+		{"temperature", "K", "", "temperature[K]@1.5940008e+09=293.15 temperature[K]@1.59400081e+09=303.15 temperature[K]@1.59400082e+09=283.15 "},
+		{"temperature", "[degF]", "max", "temperature[[degF]]@1.59400082e+09=86 "},
+		{"temperature", "K", "spread", "temperature[K]@1.59400082e+09=20 "},
+		{"power", "kW", "", "power[kW]@1.5940008e+09=1.5 power[kW]@1.59400081e+09=0.5 "},
+		{"power", "kW", "count,sum", "power:count[W]@1.59400082e+09=2 power:sum[kW]@1.59400082e+09=2 "},
+		{"energy", "J", "", "energy[J]@1.5940008e+09=7200 energy[J]@1.59400081e+09=36000 "},
+	} {
+		t.Run(c.series+" "+c.unit+" "+c.aggr, func(t *testing.T) {
+			q := Query{From: FromSenmlTime(t0), To: FromSenmlTime(t0 + 20), SortAsc: true, Page: 1, PerPage: 100, Unit: c.unit}
+			if c.aggr != "" {
+				q.AggrFuncs, q.AggrWindow = strings.Split(c.aggr, ","), 30*time.Second
+			}
+			got, _, queryErr := controller.QueryPage(ctx, q, []string{c.series})
+			if queryErr != nil {
+				t.Fatal(queryErr)
+			}
+			var b strings.Builder
+			for _, r := range got {
+				fmt.Fprintf(&b, "%s[%s]@%v=%.10g ", r.Name, r.Unit, r.Time, *r.Value)
+			}
+			if b.String() != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, b.String())
+			}
+		})
+	}
+
+	t.Run("stream", func(t *testing.T) {
+		// the records are converted as they are read
+		q := Query{From: FromSenmlTime(t0), To: FromSenmlTime(t0 + 20), PerPage: 2, Unit: "K"}
+		var b strings.Builder
+		queryErr := controller.QueryStream(ctx, q, []string{"temperature", "power"}, func(pack senml.Pack) error {
+			for _, r := range pack {
+				fmt.Fprintf(&b, "%s[%s]@%v=%.10g ", r.Name, r.Unit, r.Time, *r.Value)
+			}
+			return nil
+		})
+		if _, ok := queryErr.(*common.BadRequestError); !ok {
+			t.Errorf("Expected a bad request converting power to K, got %v", queryErr)
+		}
+		queryErr = controller.QueryStream(ctx, q, []string{"temperature"}, func(pack senml.Pack) error {
+			for _, r := range pack {
+				fmt.Fprintf(&b, "%s[%s]@%v=%.10g ", r.Name, r.Unit, r.Time, *r.Value)
+			}
+			return nil
+		})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		expected := "temperature[K]@1.59400082e+09=283.15 temperature[K]@1.59400081e+09=303.15 temperature[K]@1.5940008e+09=293.15 "
+		if b.String() != expected {
+			t.Errorf("Expected %s, got %s", expected, b.String())
+		}
+	})
+
+	_, _, queryErr := controller.QueryPage(ctx, Query{To: FromSenmlTime(t0 + 20), Page: 1, PerPage: 100, Unit: "kW"}, []string{"temperature"})
+	if _, ok := queryErr.(*common.BadRequestError); !ok {
+		t.Errorf("Expected a bad request converting to an incompatible unit, got %v", queryErr)
+	}
+}
+
+func TestController_SubmitDuplicates(t *testing.T) {
+	funcName := "TestController_SubmitDuplicates"
+	fileName, disconnectFunc, dataStorage, regController, err := setupTest(funcName)
+	if err != nil {
+		t.Fatalf("Error setting up test:%s", err)
+	}
+	defer deleteFile(fileName)
+	defer func() {
+		err := disconnectFunc()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}()
+	storage := dataStorage.(*SqlStorage)
+	controller := NewController(regController, storage, false)
+	ctx := context.Background()
+
+	for _, ts := range []registry.TimeSeries{
+		{Name: "default", Type: registry.Float},
+		{Name: registry.DuplicatesOverwrite, Type: registry.Float, Duplicates: registry.DuplicatesOverwrite},
+		{Name: registry.DuplicatesKeepFirst, Type: registry.Float, Duplicates: registry.DuplicatesKeepFirst},
+		{Name: registry.DuplicatesReject, Type: registry.Float, Duplicates: registry.DuplicatesReject},
+		{Name: registry.DuplicatesSequence, Type: registry.Float, Duplicates: registry.DuplicatesSequence},
+	} {
+		_, addErr := regController.Add(ts)
+		if addErr != nil {
+			t.Fatalf("Insertion of %s failed: %s", ts.Name, addErr)
+		}
+	}
+	_, addErr := regController.Add(registry.TimeSeries{Name: "invalid", Type: registry.Float, Duplicates: "ignore"})
+	if _, ok := addErr.(*common.BadRequestError); !ok {
+		t.Errorf("Expected a bad request registering an unknown policy, got %v", addErr)
+	}
+
+	record := func(name string, t float64, v float64) senml.Record {
+		return senml.Record{Name: name, Time: 1594000800 + t, Value: &v}
+	}
+	stored := func(t *testing.T, name string) string {
+		got, _, queryErr := controller.QueryPage(ctx, Query{To: FromSenmlTime(1594000900), SortAsc: true, Page: 1, PerPage: 100}, []string{name})
+		if queryErr != nil {
+			t.Fatal(queryErr)
+		}
+		values := make([]float64, len(got))
+		for i, r := range got {
+			values[i] = *r.Value
+		}
+		sort.Float64s(values)
+		return fmt.Sprint(values)
+	}
+
+	for _, c := range []struct {
+		name         string
+		second       senml.Pack
+		count        int
+		conflict     bool
+		storedValues string
+	}{
+		// the default policy overwrites, also within a pack. Only the records repeated within the pack are counted.
+		{"default", senml.Pack{record("default", 0, 10), record("default", 0, 11), record("default", 10, 2)}, 1, false, "[2 11]"},
+		{registry.DuplicatesOverwrite, senml.Pack{record(registry.DuplicatesOverwrite, 0, 10)}, 0, false, "[2 10]"},
+		{registry.DuplicatesKeepFirst, senml.Pack{record(registry.DuplicatesKeepFirst, 0, 10), record(registry.DuplicatesKeepFirst, 20, 3),
+			record(registry.DuplicatesKeepFirst, 20, 30)}, 2, false, "[1 2 3]"},
+		{registry.DuplicatesReject, senml.Pack{record(registry.DuplicatesReject, 20, 3), record(registry.DuplicatesReject, 0, 10)}, 0, true, "[1 2]"},
+		{registry.DuplicatesSequence, senml.Pack{record(registry.DuplicatesSequence, 0, 10), record(registry.DuplicatesSequence, 0, 11)}, 2, false, "[1 2 10 11]"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			_, submitErr := controller.Submit(ctx, senml.Pack{record(c.name, 0, 1), record(c.name, 10, 2)}, nil)
+			if submitErr != nil {
+				t.Fatal(submitErr)
+			}
+			report, submitErr := controller.Submit(ctx, c.second, nil)
+			if c.conflict {
+				if _, ok := submitErr.(*common.ConflictError); !ok {
+					t.Errorf("Expected a conflict, got %v", submitErr)
+				}
+			} else if submitErr != nil {
+				t.Fatal(submitErr)
+			} else {
+				policy := c.name
+				if c.name == "default" {
+					policy = registry.DuplicatesOverwrite
+				}
+				if expected := (Duplicates{Policy: policy, Count: c.count}); report[c.name] != expected {
+					t.Errorf("Expected the report %v, got %v", expected, report[c.name])
+				}
+			}
+			if got := stored(t, c.name); got != c.storedValues {
+				t.Errorf("Expected the values %s, got %s", c.storedValues, got)
+			}
+		})
+	}
+
+	t.Run("default policy", func(t *testing.T) {
+		storage.duplicates = registry.DuplicatesKeepFirst
+		defer func() { storage.duplicates = "" }()
+		report, submitErr := controller.Submit(ctx, senml.Pack{record("default", 0, 12)}, nil)
+		if submitErr != nil {
+			t.Fatal(submitErr)
+		}
+		if expected := (Duplicates{Policy: registry.DuplicatesKeepFirst, Count: 1}); report["default"] != expected {
+			t.Errorf("Expected the report %v, got %v", expected, report["default"])
+		}
+		if got := stored(t, "default"); got != "[2 11]" {
+			t.Errorf("Expected the values [2 11], got %s", got)
+		}
+	})
+
+	t.Run("pages", func(t *testing.T) {
+		// records sharing their times are paged in the order in which they were stored, reversed for descending queries
+		for _, name := range []string{"pages", "pages/other"} {
+			if _, addErr := regController.Add(registry.TimeSeries{Name: name, Type: registry.Float, Duplicates: registry.DuplicatesSequence}); addErr != nil {
+				t.Fatal(addErr)
+			}
+		}
+		_, submitErr := controller.Submit(ctx, senml.Pack{record("pages", 0, 1), record("pages", 0, 2), record("pages", 0, 3),
+			record("pages/other", 0, 4), record("pages/other", 0, 5), record("pages", 10, 6), record("pages", 10, 7)}, nil)
+		if submitErr != nil {
+			t.Fatal(submitErr)
+		}
+		values := func(pack senml.Pack) string {
+			values := make([]float64, len(pack))
+			for i, r := range pack {
+				values[i] = *r.Value
+			}
+			return fmt.Sprint(values)
+		}
+		for _, c := range []struct {
+			name       string
+			q          Query
+			transforms []Transform
+			expected   string
+		}{
+			{"ascending", Query{SortAsc: true}, nil, "[1 2 3 4 5 6 7]"},
+			{"descending", Query{}, nil, "[7 6 3 2 1 5 4]"},
+			{"ascending cumulative sum", Query{SortAsc: true}, []Transform{{Function: TransformCumulativeSum}}, "[1 3 6 4 9 12 19]"},
+			{"descending cumulative sum", Query{}, []Transform{{Function: TransformCumulativeSum}}, "[19 12 6 3 1 9 4]"},
+			{"ascending derivative", Query{SortAsc: true}, []Transform{{Function: TransformDerivative}}, ""},
+			{"descending derivative", Query{}, []Transform{{Function: TransformDerivative}}, ""},
+			{"descending moving average", Query{}, []Transform{{Function: TransformMovingAverage, Points: 2}}, ""},
+		} {
+			t.Run(c.name, func(t *testing.T) {
+				q := c.q
+				q.To, q.Transforms, q.Page, q.PerPage = FromSenmlTime(1594000900), c.transforms, 1, 100
+				all, _, queryErr := controller.QueryPage(ctx, q, []string{"pages", "pages/other"})
+				if queryErr != nil {
+					t.Fatal(queryErr)
+				}
+				if c.expected != "" && values(all) != c.expected {
+					t.Fatalf("Expected the values %s, got %s", c.expected, values(all))
+				}
+				var walked senml.Pack
+				q.PerPage = 2
+				for pages := 0; ; pages++ {
+					if pages > 10 {
+						t.Fatal("Too many pages")
+					}
+					page, _, next, queryErr := controller.QueryPageCursor(ctx, q, []string{"pages", "pages/other"})
+					if queryErr != nil {
+						t.Fatal(queryErr)
+					}
+					walked = append(walked, page...)
+					if len(page) < q.PerPage {
+						break
+					}
+					if next == nil {
+						next = cursorAfter(page, q.Cursor)
+					}
+					// as in the links of the pages
+					q.Cursor, _ = ParseCursor(next.Encode())
+				}
+				if values(walked) != values(all) {
+					t.Errorf("Expected the pages to walk through %s, got %s", values(all), values(walked))
+				}
+			})
+		}
+	})
+
+	t.Run("table without sequence numbers", func(t *testing.T) {
+		// as created before the duplicates policies
+		legacy := registry.TimeSeries{Name: "legacy", Type: registry.Float}
+		if _, addErr := regController.Add(legacy); addErr != nil {
+			t.Fatal(addErr)
+		}
+		table := storage.dialect.table(legacy.Name)
+		if _, err := storage.pool.Exec(fmt.Sprintf("DROP TABLE %s", table)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.pool.Exec(fmt.Sprintf("CREATE TABLE %s (time REAL NOT NULL, value REAL, PRIMARY KEY (time))", table)); err != nil {
+			t.Fatal(err)
+		}
+		storage.sequenced.Delete(legacy.Name)
+
+		for _, policy := range []string{registry.DuplicatesOverwrite, registry.DuplicatesKeepFirst} {
+			legacy.Duplicates = policy
+			report, err := storage.Submit(ctx, map[string]senml.Pack{legacy.Name: {record(legacy.Name, 0, 1)}},
+				map[string]*registry.TimeSeries{legacy.Name: &legacy})
+			if err != nil {
+				t.Fatalf("Error submitting with policy %s: %s", policy, err)
+			}
+			if policy == registry.DuplicatesKeepFirst && report[legacy.Name].Count != 1 {
+				t.Errorf("Expected a duplicate, got %v", report[legacy.Name])
+			}
+		}
+		legacy.Duplicates = registry.DuplicatesSequence
+		_, err := storage.Submit(ctx, map[string]senml.Pack{legacy.Name: {record(legacy.Name, 0, 1)}},
+			map[string]*registry.TimeSeries{legacy.Name: &legacy})
+		if err == nil {
+			t.Errorf("Expected an error storing duplicates in a table without sequence numbers")
+		}
+	})
+}
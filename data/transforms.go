@@ -0,0 +1,435 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/farshidtz/senml/v2"
+)
+
+// Functions transforming the consecutive records of each series, after the aggregation and gap filling
+const (
+	// TransformMovingAverage averages the last N records or the records within a duration before each record
+	TransformMovingAverage = "moving_average"
+	// TransformDifference is the difference to the previous record
+	TransformDifference = "difference"
+	// TransformDerivative is the difference to the previous record per second
+	TransformDerivative = "derivative"
+	// TransformCumulativeSum is the sum of the records up to each record
+	TransformCumulativeSum = "cumulative_sum"
+	// TransformRate is the increase of a counter per second. A decrease is taken as a reset of the counter to zero.
+	TransformRate = "rate"
+)
+
+var transformRegexp = regexp.MustCompile(`^([a-z_]+)(?:\(([^()]*)\))?$`)
+
+// Transform is a function computed over the consecutive records of each series
+type Transform struct {
+	Function string
+	// Points or Duration is the size of the moving average
+	Points   int
+	Duration time.Duration
+}
+
+// ParseTransform parses a transform, e.g. difference, moving_average(5) or moving_average(10m)
+func ParseTransform(s string) (Transform, error) {
+	m := transformRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return Transform{}, fmt.Errorf("invalid transform: %s", s)
+	}
+	t := Transform{Function: m[1]}
+	switch t.Function {
+	case TransformMovingAverage:
+		if n, err := strconv.Atoi(m[2]); err == nil && n > 0 {
+			t.Points = n
+		} else if d, err := time.ParseDuration(m[2]); err == nil && d > 0 {
+			t.Duration = d
+		} else {
+			return Transform{}, fmt.Errorf("invalid size of %s: %s. Valid are a number of records (e.g. 5) or a duration (e.g. 10m)", t.Function, m[2])
+		}
+	case TransformDifference, TransformDerivative, TransformCumulativeSum, TransformRate:
+		if m[2] != "" {
+			return Transform{}, fmt.Errorf("%s takes no arguments", t.Function)
+		}
+	default:
+		return Transform{}, fmt.Errorf("unsupported transform: %s. Supported are %s(n or duration), %s, %s, %s and %s", s,
+			TransformMovingAverage, TransformDifference, TransformDerivative, TransformCumulativeSum, TransformRate)
+	}
+	return t, nil
+}
+
+// ParseTransforms parses a comma-separated list of transforms, which are applied in order
+func ParseTransforms(s string) ([]Transform, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var transforms []Transform
+	for _, part := range strings.Split(s, ",") {
+		t, err := ParseTransform(strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+// String returns the transform as accepted by ParseTransform
+func (t Transform) String() string {
+	switch {
+	case t.Points != 0:
+		return fmt.Sprintf("%s(%d)", t.Function, t.Points)
+	case t.Duration != 0:
+		return fmt.Sprintf("%s(%s)", t.Function, t.Duration)
+	}
+	return t.Function
+}
+
+// transformsString returns a list of transforms as accepted by ParseTransforms
+func transformsString(transforms []Transform) string {
+	parts := make([]string, len(transforms))
+	for i, t := range transforms {
+		parts[i] = t.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// transformer applies a chain of transforms to the records of each name, which are added in ascending order of time.
+// Records without a value are passed on unchanged.
+type transformer struct {
+	transforms []Transform
+	// states of the names per transform
+	states []map[string]*transformState
+}
+
+// transformState holds the records of a name which a transform needs to compute the next one
+type transformState struct {
+	HasPrev   bool    `json:"h,omitempty"`
+	PrevTime  float64 `json:"t,omitempty"`
+	PrevValue float64 `json:"v,omitempty"`
+	Sum       float64 `json:"s,omitempty"`
+	// times and values of the records within the moving average
+	WindowTimes  []float64 `json:"wt,omitempty"`
+	WindowValues []float64 `json:"wv,omitempty"`
+}
+
+// maxStateValues is the maximum number of values of the moving averages which a cursor carries
+const maxStateValues = 1000
+
+func newTransformer(transforms []Transform) *transformer {
+	states := make([]map[string]*transformState, len(transforms))
+	for i := range states {
+		states[i] = make(map[string]*transformState)
+	}
+	return &transformer{transforms: transforms, states: states}
+}
+
+// apply transforms a record, returning false if the transforms leave it out
+func (t *transformer) apply(r senml.Record) (senml.Record, bool) {
+	for i, tf := range t.transforms {
+		if r.Value == nil {
+			return r, true
+		}
+		s, found := t.states[i][r.Name]
+		if !found {
+			s = &transformState{}
+			t.states[i][r.Name] = s
+		}
+		var ok bool
+		r, ok = tf.apply(s, r)
+		if !ok {
+			return r, false
+		}
+	}
+	return r, true
+}
+
+// snapshot returns a copy of the states of the transforms, from which a transformer is restored.
+// It returns nil if the moving averages hold more than maxStateValues values, or if a value is not finite.
+func (t *transformer) snapshot() []map[string]*transformState {
+	values := 0
+	states := make([]map[string]*transformState, len(t.states))
+	for i, names := range t.states {
+		states[i] = make(map[string]*transformState, len(names))
+		for name, s := range names {
+			values += len(s.WindowValues)
+			if values > maxStateValues || !finite(s.PrevValue, s.Sum) || !finite(s.WindowValues...) {
+				return nil
+			}
+			state := *s
+			state.WindowTimes = append([]float64(nil), s.WindowTimes...)
+			state.WindowValues = append([]float64(nil), s.WindowValues...)
+			states[i][name] = &state
+		}
+	}
+	return states
+}
+
+// restore continues from the states of a snapshot
+func (t *transformer) restore(states []map[string]*transformState) {
+	for i, names := range states {
+		for name, s := range names {
+			if s != nil {
+				state := *s
+				t.states[i][name] = &state
+			}
+		}
+	}
+}
+
+// finite checks if values are neither infinite nor NaN
+func finite(values ...float64) bool {
+	for _, v := range values {
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// apply transforms the next record of a name
+func (t Transform) apply(s *transformState, r senml.Record) (senml.Record, bool) {
+	v := *r.Value
+	prevTime, prevValue, hasPrev := s.PrevTime, s.PrevValue, s.HasPrev
+	s.HasPrev, s.PrevTime, s.PrevValue = true, r.Time, v
+
+	var result float64
+	switch t.Function {
+	case TransformMovingAverage:
+		s.WindowTimes, s.WindowValues = append(s.WindowTimes, r.Time), append(s.WindowValues, v)
+		s.Sum += v
+		for (t.Points != 0 && len(s.WindowValues) > t.Points) || (t.Duration != 0 && s.WindowTimes[0] <= r.Time-t.Duration.Seconds()) {
+			s.Sum -= s.WindowValues[0]
+			s.WindowTimes, s.WindowValues = s.WindowTimes[1:], s.WindowValues[1:]
+		}
+		// the average over a number of records starts once there are enough of them
+		if len(s.WindowValues) < t.Points {
+			return r, false
+		}
+		result = s.Sum / float64(len(s.WindowValues))
+	case TransformDifference, TransformDerivative, TransformRate:
+		if !hasPrev {
+			return r, false
+		}
+		return t.difference(r, prevTime, prevValue)
+	case TransformCumulativeSum:
+		s.Sum += v
+		result = s.Sum
+	}
+	r.Value = &result
+	return r, true
+}
+
+// difference computes the difference, derivative or rate of a record to the previous record of its name,
+// returning false if the derivative is left out because the times do not increase
+func (t Transform) difference(r senml.Record, prevTime, prevValue float64) (senml.Record, bool) {
+	v := *r.Value
+	var result float64
+	if t.Function == TransformDifference {
+		result = v - prevValue
+	} else {
+		if r.Time <= prevTime {
+			return r, false
+		}
+		increase := v - prevValue
+		if t.Function == TransformRate && v < prevValue {
+			increase = v
+		}
+		result = increase / (r.Time - prevTime)
+		r.Unit = perSecond(r.Unit)
+	}
+	r.Value = &result
+	return r, true
+}
+
+// transformedCount returns the number of records which transforms produce out of n records of a name,
+// given that all of them have a value and that their times differ
+func transformedCount(transforms []Transform, n int) int {
+	for _, t := range transforms {
+		switch t.Function {
+		case TransformMovingAverage:
+			if t.Points != 0 {
+				n -= t.Points - 1
+			}
+		case TransformDifference, TransformDerivative, TransformRate:
+			n--
+		}
+		if n < 0 {
+			n = 0
+		}
+	}
+	return n
+}
+
+// maxPendingRecords is the maximum number of records of a descending query which wait for the transforms
+const maxPendingRecords = MaxGridPoints
+
+// errTransformsPending stops descending queries whose records wait for too many records before them in time,
+// e.g. of a series with few records among series with many
+var errTransformsPending = fmt.Errorf("more than %d records wait for the transforms of the descending query, which may be queried in ascending order instead", maxPendingRecords)
+
+// reverseTransformer applies a chain of transforms to the records of each name added in descending order of time,
+// with the results of a transformer in ascending order. The records are emitted in the order in which they are added, each once
+// the records before it in time which it depends on are added. The cumulative sums are computed backwards from the totals of the names.
+type reverseTransformer struct {
+	stages []*reverseStage
+	emit   func(senml.Record) error
+}
+
+// reverseStage applies a transform to the records added in descending order of time
+type reverseStage struct {
+	transform Transform
+	// records in the order in which they were added, starting with the first one which is not emitted
+	queue  []*reverseSlot
+	states map[string]*reverseState
+	// totals of the records of the names for the cumulative sum
+	totals map[string]float64
+	next   func(senml.Record) error
+}
+
+// reverseSlot is a record of a stage, which is emitted once it is resolved unless it is left out
+type reverseSlot struct {
+	r        senml.Record
+	resolved bool
+	dropped  bool
+}
+
+// reverseState holds the records of a name which wait for the records before them
+type reverseState struct {
+	waiting []*reverseSlot
+	// values of the waiting records for the moving average, and their sum
+	values []float64
+	sum    float64
+	// remaining is the cumulative sum up to the next record
+	remaining float64
+}
+
+// newReverseTransformer returns a transformer of the records added in descending order. The totals of the names are given for
+// each cumulative sum of the transforms.
+func newReverseTransformer(transforms []Transform, totals []map[string]float64, emit func(senml.Record) error) *reverseTransformer {
+	stages := make([]*reverseStage, len(transforms))
+	next := emit
+	for i := len(transforms) - 1; i >= 0; i-- {
+		stages[i] = &reverseStage{transform: transforms[i], states: make(map[string]*reverseState), next: next}
+		if i < len(totals) {
+			stages[i].totals = totals[i]
+		}
+		next = stages[i].add
+	}
+	return &reverseTransformer{stages: stages, emit: emit}
+}
+
+// add transforms the next record
+func (t *reverseTransformer) add(r senml.Record) error {
+	if len(t.stages) == 0 {
+		return t.emit(r)
+	}
+	return t.stages[0].add(r)
+}
+
+// finish resolves the records waiting for records before the queried range
+func (t *reverseTransformer) finish() error {
+	for _, s := range t.stages {
+		if err := s.finish(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *reverseStage) add(r senml.Record) error {
+	if len(s.queue) >= maxPendingRecords {
+		return errTransformsPending
+	}
+	slot := &reverseSlot{r: r}
+	s.queue = append(s.queue, slot)
+	if r.Value == nil {
+		slot.resolved = true
+		return s.flush()
+	}
+	st, found := s.states[r.Name]
+	if !found {
+		st = &reverseState{remaining: s.totals[r.Name]}
+		s.states[r.Name] = st
+	}
+	v := *r.Value
+	switch t := s.transform; t.Function {
+	case TransformCumulativeSum:
+		result := st.remaining
+		st.remaining -= v
+		slot.r.Value, slot.resolved = &result, true
+	case TransformMovingAverage:
+		// the records whose duration does not reach back to this one are averaged without it
+		for t.Duration != 0 && len(st.waiting) != 0 && st.waiting[0].r.Time-t.Duration.Seconds() >= r.Time {
+			st.resolveAverage()
+		}
+		st.waiting, st.values = append(st.waiting, slot), append(st.values, v)
+		st.sum += v
+		if t.Points != 0 && len(st.waiting) == t.Points {
+			st.resolveAverage()
+		}
+	default:
+		if len(st.waiting) != 0 {
+			w := st.waiting[0]
+			var ok bool
+			w.r, ok = t.difference(w.r, r.Time, v)
+			w.resolved, w.dropped = true, !ok
+		}
+		st.waiting = append(st.waiting[:0], slot)
+	}
+	return s.flush()
+}
+
+// resolveAverage resolves the first waiting record with the average of the waiting records
+func (st *reverseState) resolveAverage() {
+	w := st.waiting[0]
+	average := st.sum / float64(len(st.waiting))
+	w.r.Value, w.resolved = &average, true
+	st.sum -= st.values[0]
+	st.waiting, st.values = st.waiting[1:], st.values[1:]
+}
+
+// finish resolves the records which wait for records before the queried range. The averages over a duration take the
+// records of the range, the other records are left out as the first records of a transformer.
+func (s *reverseStage) finish() error {
+	for _, st := range s.states {
+		for len(st.waiting) != 0 {
+			if s.transform.Function == TransformMovingAverage && s.transform.Duration != 0 {
+				st.resolveAverage()
+				continue
+			}
+			st.waiting[0].dropped = true
+			st.waiting = st.waiting[1:]
+		}
+	}
+	return s.flush()
+}
+
+// flush emits the records at the start of the queue which are resolved
+func (s *reverseStage) flush() error {
+	for len(s.queue) != 0 && (s.queue[0].resolved || s.queue[0].dropped) {
+		slot := s.queue[0]
+		s.queue[0], s.queue = nil, s.queue[1:]
+		if slot.dropped {
+			continue
+		}
+		if err := s.next(slot.r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// perSecond returns the unit of a derivative per second
+func perSecond(unit string) string {
+	if unit == "" {
+		return "1/s"
+	}
+	return unit + "/s"
+}
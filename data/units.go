@@ -0,0 +1,97 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+
+	"github.com/farshidtz/senml/v2"
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// convertRecordUnit converts the value of a submitted record to the unit of its series.
+// Records without a unit, or of series without a unit, are taken as they are.
+func convertRecordUnit(r *senml.Record, ts *registry.TimeSeries) error {
+	if r.Unit == "" || ts.Unit == "" || r.Unit == ts.Unit {
+		return nil
+	}
+	conversion, err := common.ConvertUnit(r.Unit, ts.Unit)
+	if err != nil || ts.Type != registry.Float {
+		return fmt.Errorf("the unit %s of %s does not match the unit %s of the time series", r.Unit, r.Name, ts.Unit)
+	}
+	if r.Value != nil {
+		v := conversion.Apply(*r.Value)
+		r.Value = &v
+	}
+	if r.Sum != nil {
+		sum := conversion.Scale * *r.Sum
+		r.Sum = &sum
+	}
+	r.Unit = ts.Unit
+	return nil
+}
+
+// unitConversions returns the conversions of the records of a query to the unit of the query, by record name.
+// Offsets of units (e.g. of temperature scales) do not apply to sums and deviations, and counts are not converted.
+func unitConversions(q Query, series []*registry.TimeSeries) (map[string]common.UnitConversion, error) {
+	aggrs := q.AggrFuncs
+	if len(aggrs) == 0 {
+		aggrs = []string{""}
+	}
+	conversions := make(map[string]common.UnitConversion)
+	for _, ts := range series {
+		conversion, err := common.ConvertUnit(ts.Unit, q.Unit)
+		if err != nil {
+			return nil, fmt.Errorf("the unit of %s cannot be converted: %s", ts.Name, err)
+		}
+		for _, aggr := range aggrs {
+			name := ts.Name
+			if len(aggrs) > 1 {
+				name = AggregateName(ts.Name, aggr)
+			}
+			switch aggr {
+			case "count", "time_true", "ratio_true", "transitions", "count_distinct":
+				continue
+			case "sum", "stddev", "spread":
+				conversions[name] = common.UnitConversion{Scale: conversion.Scale}
+			case "variance":
+				conversions[name] = common.UnitConversion{Scale: conversion.Scale * conversion.Scale}
+			default:
+				conversions[name] = conversion
+			}
+		}
+	}
+	return conversions, nil
+}
+
+// newUnitConverter returns the converter of the records of a query to the unit of the query, nil if it has none
+func newUnitConverter(q Query, series []*registry.TimeSeries) (*unitConverter, error) {
+	if q.Unit == "" {
+		return nil, nil
+	}
+	conversions, err := unitConversions(q, series)
+	if err != nil {
+		return nil, err
+	}
+	return &unitConverter{unit: q.Unit, conversions: conversions}, nil
+}
+
+// unitConverter converts the values of records to the unit of a query
+type unitConverter struct {
+	unit        string
+	conversions map[string]common.UnitConversion
+}
+
+func (c unitConverter) apply(r senml.Record) senml.Record {
+	conversion, found := c.conversions[r.Name]
+	if !found {
+		return r
+	}
+	if r.Value != nil {
+		v := conversion.Apply(*r.Value)
+		r.Value = &v
+	}
+	r.Unit = c.unit
+	return r
+}
@@ -0,0 +1,181 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/historical-datastore/registry"
+)
+
+// sqliteMathFunctions implement the math functions of expressions for SQLite. Invalid results (NaN) become NULL.
+var sqliteMathFunctions = map[string]interface{}{
+	"hds_sqrt":  sqliteMath(math.Sqrt),
+	"hds_exp":   sqliteMath(math.Exp),
+	"hds_ln":    sqliteMath(math.Log),
+	"hds_log10": sqliteMath(math.Log10),
+	"hds_floor": sqliteMath(math.Floor),
+	"hds_ceil":  sqliteMath(math.Ceil),
+	"hds_pow": func(x, y interface{}) float64 {
+		a, errA := floatArg(x)
+		b, errB := floatArg(y)
+		if errA != nil || errB != nil {
+			return math.NaN()
+		}
+		return math.Pow(a, b)
+	},
+}
+
+// sqliteMath converts a math function to a SQLite function, which takes integers as well and returns NULL for a NULL argument
+func sqliteMath(f func(float64) float64) func(interface{}) float64 {
+	return func(v interface{}) float64 {
+		x, err := floatArg(v)
+		if err != nil {
+			return math.NaN()
+		}
+		return f(x)
+	}
+}
+
+// source returns the table of a series, or the subquery computing a virtual series between from and to.
+// Either has the columns time and value.
+func (s *SqlStorage) source(ts *registry.TimeSeries, from, to float64) (string, error) {
+	if ts.Source.SrcType != registry.Virtual {
+		return s.dialect.table(ts.Name), nil
+	}
+	src := ts.Source.VirtualSource
+	if src == nil {
+		return "", fmt.Errorf("virtual series %s has no inputs", ts.Name)
+	}
+	expr, err := registry.ParseExpression(src.Expression)
+	if err != nil {
+		return "", fmt.Errorf("error parsing the expression of %s: %s", ts.Name, err)
+	}
+	value, err := exprSQL(s.dialect, expr, src.Inputs)
+	if err != nil {
+		return "", fmt.Errorf("error in the expression of %s: %s", ts.Name, err)
+	}
+
+	// a record at each time of the input records, with the latest value of each input at that time
+	variables := make([]string, 0, len(src.Inputs))
+	for variable := range src.Inputs {
+		variables = append(variables, variable)
+	}
+	sort.Strings(variables)
+	var times, inputs, complete []string
+	tables := make(map[string]bool)
+	for _, variable := range variables {
+		table := s.dialect.table(src.Inputs[variable])
+		if !tables[table] {
+			tables[table] = true
+			times = append(times, fmt.Sprintf("SELECT time FROM %s WHERE time BETWEEN %s AND %s", table, sqlFloat(from), sqlFloat(to)))
+		}
+		// the latest of the input records sharing a time is the one stored last
+		seq, err := s.seqColumn(&registry.TimeSeries{Name: src.Inputs[variable]})
+		if err != nil {
+			return "", err
+		}
+		inputs = append(inputs, fmt.Sprintf("(SELECT value FROM %s WHERE time <= times.time ORDER BY time DESC%s LIMIT 1) AS v_%s", table, seqOrder(seq, common.Desc), variable))
+		complete = append(complete, fmt.Sprintf("v_%s IS NOT NULL", variable))
+	}
+	return fmt.Sprintf(`(SELECT time, value FROM (
+								SELECT time, %s AS value FROM (
+									SELECT times.time AS time, %s FROM (%s) AS times
+								) AS inputs WHERE %s
+							) AS computed WHERE value IS NOT NULL) AS computed_series`,
+		value, strings.Join(inputs, ", "), strings.Join(times, " UNION "), strings.Join(complete, " AND ")), nil
+}
+
+// exprSQL returns the SQL expression of an expression over the columns v_<variable> of the inputs.
+// Invalid operations, such as a division by zero or the square root of a negative number, result in NULL.
+func exprSQL(d sqlDialect, e *registry.Expr, inputs map[string]string) (string, error) {
+	args := make([]string, len(e.Args))
+	for i, arg := range e.Args {
+		var err error
+		args[i], err = exprSQL(d, arg, inputs)
+		if err != nil {
+			return "", err
+		}
+	}
+	// comparisons and logical operators result in 1 or 0
+	condition := func(cond string) string {
+		return fmt.Sprintf("(CASE WHEN %s THEN 1.0 ELSE 0.0 END)", cond)
+	}
+	switch e.Kind {
+	case registry.ExprNumber:
+		return sqlFloat(e.Number), nil
+	case registry.ExprVariable:
+		if _, found := inputs[e.Name]; !found || !registry.ValidExprVariable(e.Name) {
+			return "", fmt.Errorf("unknown variable %s", e.Name)
+		}
+		return "v_" + e.Name, nil
+	case registry.ExprOperator:
+		if len(args) == 1 {
+			if e.Name == "!" {
+				return condition(args[0] + " = 0"), nil
+			}
+			return fmt.Sprintf("(-%s)", args[0]), nil
+		}
+		switch e.Name {
+		case "+", "-", "*":
+			return fmt.Sprintf("(%s %s %s)", args[0], e.Name, args[1]), nil
+		case "/":
+			return fmt.Sprintf("(%s / NULLIF(%s, 0))", args[0], args[1]), nil
+		case "<", "<=", ">", ">=":
+			return condition(fmt.Sprintf("%s %s %s", args[0], e.Name, args[1])), nil
+		case "==":
+			return condition(fmt.Sprintf("%s = %s", args[0], args[1])), nil
+		case "!=":
+			return condition(fmt.Sprintf("%s <> %s", args[0], args[1])), nil
+		case "&&":
+			return condition(fmt.Sprintf("%s <> 0 AND %s <> 0", args[0], args[1])), nil
+		case "||":
+			return condition(fmt.Sprintf("%s <> 0 OR %s <> 0", args[0], args[1])), nil
+		}
+	case registry.ExprFunction:
+		switch e.Name {
+		case "abs":
+			return fmt.Sprintf("ABS(%s)", args[0]), nil
+		case "floor", "ceil", "exp":
+			return d.math(e.Name, args[0]), nil
+		case "round":
+			// halves are rounded up, as the databases differ in rounding them
+			return d.math("floor", args[0]+"+0.5"), nil
+		case "sqrt":
+			return fmt.Sprintf("(CASE WHEN %s >= 0 THEN %s END)", args[0], d.math(e.Name, args[0])), nil
+		case "ln", "log10":
+			return fmt.Sprintf("(CASE WHEN %s > 0 THEN %s END)", args[0], d.math(e.Name, args[0])), nil
+		case "pow":
+			// no complex results of negative numbers to fractional powers, and no division by zero
+			return fmt.Sprintf("(CASE WHEN %[1]s > 0 OR (%[1]s = 0 AND %[2]s >= 0) OR (%[1]s < 0 AND %[2]s = %[3]s) THEN %[4]s END)",
+				args[0], args[1], d.math("floor", args[1]), d.math(e.Name, args[0], args[1])), nil
+		case "min", "max":
+			result := args[0]
+			for _, arg := range args[1:] {
+				if e.Name == "min" {
+					result = d.least(result, arg)
+				} else {
+					result = d.greatest(result, arg)
+				}
+			}
+			return result, nil
+		case "if":
+			return fmt.Sprintf("(CASE WHEN %s <> 0 THEN %s ELSE %s END)", args[0], args[1], args[2]), nil
+		}
+	}
+	return "", fmt.Errorf("unsupported %s %s", e.Kind, e.Name)
+}
+
+// sqlFloat formats a number as floating point literal, as integer literals are divided as integers by some databases
+func sqlFloat(f float64) string {
+	s := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s
+}
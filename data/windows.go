@@ -0,0 +1,187 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package data
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Alignments of the windows with a fixed duration
+const (
+	// AlignTo aligns the windows to the end of the queried range: they end at To and every window duration before it
+	AlignTo = "to"
+	// AlignEpoch aligns the windows to the Unix epoch: they end at the multiples of the window duration, e.g. full hours
+	AlignEpoch = "epoch"
+)
+
+// Calendar units of the windows
+const (
+	CalendarDay   = "d"
+	CalendarWeek  = "w"
+	CalendarMonth = "mo"
+	CalendarYear  = "y"
+)
+
+// MaxCalendarWindows is the maximum number of calendar windows of a query
+const MaxCalendarWindows = 100000
+
+var calendarPeriodRegexp = regexp.MustCompile(`^([1-9][0-9]*)(d|w|mo|y)$`)
+
+// CalendarPeriod is a window of a number of calendar units, which may differ in duration because of the length of
+// the months or daylight saving time. Days start at midnight, weeks on Monday, months on the first day and years on the first of January.
+// Multiple units are aligned to their count since the Unix epoch, e.g. 3mo are the quarters of a year.
+type CalendarPeriod struct {
+	N    int
+	Unit string
+}
+
+// IsZero checks if the period is not set
+func (c CalendarPeriod) IsZero() bool {
+	return c.N == 0
+}
+
+func (c CalendarPeriod) String() string {
+	if c.IsZero() {
+		return ""
+	}
+	return strconv.Itoa(c.N) + c.Unit
+}
+
+// ParseCalendarPeriod parses a period of calendar units, e.g. 1d, 2w, 1mo, 3mo or 1y
+func ParseCalendarPeriod(s string) (CalendarPeriod, error) {
+	m := calendarPeriodRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return CalendarPeriod{}, fmt.Errorf("invalid calendar period: %s", s)
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return CalendarPeriod{}, fmt.Errorf("invalid calendar period %s: %s", s, err)
+	}
+	return CalendarPeriod{N: n, Unit: m[2]}, nil
+}
+
+// parseWindow parses the size of windows, either a duration (e.g. 90m) or a calendar period (e.g. 1mo)
+func parseWindow(s string) (time.Duration, CalendarPeriod, error) {
+	d, err := time.ParseDuration(s)
+	if err == nil {
+		return d, CalendarPeriod{}, nil
+	}
+	c, err := ParseCalendarPeriod(s)
+	if err != nil {
+		return 0, CalendarPeriod{}, fmt.Errorf("invalid window: %s. Valid are durations (e.g. 15m, 1h30m) and calendar periods (e.g. 1d, 1w, 1mo, 1y)", s)
+	}
+	return 0, c, nil
+}
+
+// start returns the start of the period which contains t
+func (c CalendarPeriod) start(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch c.Unit {
+	case CalendarDay, CalendarWeek:
+		start := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+		// days of the date since the epoch, independent of the time zone
+		days := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60))
+		if c.Unit == CalendarDay {
+			return start.AddDate(0, 0, -mod(days, c.N))
+		}
+		// the first Monday after the epoch is January 5, 1970
+		weekday := mod(days-4, 7)
+		return start.AddDate(0, 0, -weekday-7*mod((days-4-weekday)/7, c.N))
+	case CalendarMonth:
+		return time.Date(y, m-time.Month(mod(y*12+int(m)-1, c.N)), 1, 0, 0, 0, 0, t.Location())
+	case CalendarYear:
+		return time.Date(y-mod(y, c.N), 1, 1, 0, 0, 0, 0, t.Location())
+	}
+	panic("invalid calendar unit: " + c.Unit)
+}
+
+// next returns the start of the next period
+func (c CalendarPeriod) next(start time.Time) time.Time {
+	switch c.Unit {
+	case CalendarDay:
+		return start.AddDate(0, 0, c.N)
+	case CalendarWeek:
+		return start.AddDate(0, 0, 7*c.N)
+	case CalendarMonth:
+		return start.AddDate(0, c.N, 0)
+	case CalendarYear:
+		return start.AddDate(c.N, 0, 0)
+	}
+	panic("invalid calendar unit: " + c.Unit)
+}
+
+// mod returns the non-negative remainder of a division
+func mod(a, b int) int {
+	return (a%b + b) % b
+}
+
+// calendarWindows returns the boundaries of the calendar windows of a query, in SenML time.
+// As with the other windows, each window (b[i-1], b[i]] contains its end. The first boundary is before From and the last one not before To.
+// Without From, the windows start at the epoch, as the stored data does.
+func (q Query) calendarWindows() ([]float64, error) {
+	loc := q.Location
+	if loc == nil {
+		loc = time.UTC
+	}
+	from := q.From
+	if from.IsZero() {
+		from = time.Unix(0, 0)
+	}
+	to := q.To.In(loc)
+	b := q.Calendar.start(from.In(loc).Add(-time.Nanosecond))
+	boundaries := []float64{ToSenmlTime(b)}
+	for b.Before(to) {
+		if len(boundaries) > MaxCalendarWindows {
+			return nil, fmt.Errorf("the query covers more than %d calendar windows", MaxCalendarWindows)
+		}
+		b = q.Calendar.next(b)
+		boundaries = append(boundaries, ToSenmlTime(b))
+		// times out of the range of nanoseconds since the epoch wrap around
+		if boundaries[len(boundaries)-1] <= boundaries[len(boundaries)-2] {
+			return nil, fmt.Errorf("the calendar windows of the query are out of the supported time range")
+		}
+	}
+	return boundaries, nil
+}
+
+// resampled checks if the query returns resampled points rather than stored records or aggregates
+func (q Query) resampled() bool {
+	return len(q.AggrFuncs) == 0 && (q.Resample != 0 || !q.Calendar.IsZero())
+}
+
+// parseAlignmentParams parses the alignment and the time zone of the windows of a query, after the aggregation and fill parameters
+func parseAlignmentParams(q *Query, align, tz string) (err error) {
+	switch align {
+	case "", AlignTo, AlignEpoch:
+	default:
+		return fmt.Errorf("invalid alignment: %s. Valid are %s and %s", align, AlignTo, AlignEpoch)
+	}
+	if align != "" && len(q.AggrFuncs) == 0 && !q.resampled() {
+		return fmt.Errorf("alignment requires aggregation or resampling")
+	}
+	if align == AlignTo && !q.Calendar.IsZero() {
+		return fmt.Errorf("calendar windows are aligned to the calendar")
+	}
+	q.Align = align
+	if tz != "" {
+		if q.Calendar.IsZero() {
+			return fmt.Errorf("time zones apply to calendar windows only")
+		}
+		q.Location, err = time.LoadLocation(tz)
+		if err != nil {
+			return fmt.Errorf("unknown time zone: %s", tz)
+		}
+	}
+	return nil
+}
+
+// windowString returns the size of windows as accepted by parseWindow
+func windowString(d time.Duration, c CalendarPeriod) string {
+	if !c.IsZero() {
+		return c.String()
+	}
+	return d.String()
+}
@@ -123,7 +123,7 @@ func addString(dataController data.Controller, ts registry.TimeSeries) {
 func submitData(dataController data.Controller, ts registry.TimeSeries, record senml.Record) {
 	var senmlPack senml.Pack = []senml.Record{record}
 	seriesList := []string{ts.Name}
-	err := dataController.Submit(context.Background(), senmlPack, seriesList)
+	_, err := dataController.Submit(context.Background(), senmlPack, seriesList)
 	if err != nil {
 		log.Printf("insetion failed: %s", err)
 	}
@@ -37,6 +37,7 @@ import (
 	"github.com/linksmart/historical-datastore/demo"
 	"github.com/linksmart/historical-datastore/registry"
 	"github.com/oleksandr/bonjour"
+	"github.com/prometheus/client_golang/prometheus"
 	uuid "github.com/satori/go.uuid"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -105,6 +106,7 @@ func main() {
 		log.Println("===========================")
 
 		if !*persistentDemo {
+			conf.Data.Backend.Type = data.SQLITE
 			conf.Data.Backend.DSN = os.TempDir() + string(os.PathSeparator) + "hds_demo_" + strconv.FormatInt(time.Now().UnixNano(), 10)
 			//use memory in demo mode for registry
 			conf.Registry.Backend.Type = registry.MEMORY
@@ -123,17 +125,46 @@ func main() {
 	// Setup data and aggregation backends
 	var (
 		dataStorage data.Storage
+		sqlStorage  *data.SqlStorage
 		//aggrStorage aggregation.Storage
 	)
 
 	switch conf.Data.Backend.Type {
 	case data.SQLITE:
 		var disconnect_func func() error
-		dataStorage, disconnect_func, err = data.NewSqlStorage(conf.Data)
+		sqlStorage, disconnect_func, err = data.NewSqlStorage(conf.Data)
 		if err != nil {
 			log.Panicf("Error creating SQLite storage: %s", err)
 		}
 		defer disconnect_func()
+	case data.POSTGRES:
+		var disconnect_func func() error
+		sqlStorage, disconnect_func, err = data.NewPostgresStorage(conf.Data)
+		if err != nil {
+			log.Panicf("Error creating PostgreSQL storage: %s", err)
+		}
+		defer disconnect_func()
+	}
+	dataStorage = sqlStorage
+	// Keep the rejected submissions
+	var deadLetters data.DeadLetterStore
+	if conf.Data.DeadLetters.Size > 0 {
+		deadLetters, err = data.NewDeadLetterStore(sqlStorage, conf.Data.DeadLetters.Size)
+		if err != nil {
+			log.Panicf("Error creating the dead letters store: %s", err)
+		}
+		log.Printf("Dead letters are enabled: up to %d rejected submissions are kept.", conf.Data.DeadLetters.Size)
+	}
+	// Queue the submitted data, to write it in batches
+	submitStorage := dataStorage
+	if conf.Data.Queue.Size > 0 {
+		var closeQueue func() error
+		submitStorage, closeQueue, err = data.NewIngestQueue(dataStorage, conf.Data.Queue, deadLetters)
+		if err != nil {
+			log.Panicf("Error creating the ingestion queue: %s", err)
+		}
+		defer closeQueue()
+		log.Println("Ingestion queue is enabled: submitted data is written in batches.")
 	}
 	if conf.Data.AutoRegistration {
 		log.Println("Auto Registration is enabled: Data HTTP API will automatically create new time series.")
@@ -147,7 +178,7 @@ func main() {
 	)
 
 	// MQTT connector
-	mqttConn, err = data.NewMQTTConnector(dataStorage, conf.ServiceID)
+	mqttConn, err = data.NewMQTTConnector(submitStorage, conf.ServiceID, deadLetters)
 	if err != nil {
 		log.Panicf("Error creating MQTT Connector: %s", err)
 	}
@@ -164,9 +195,16 @@ func main() {
 
 	// Setup APIs
 	regController := registry.NewController(regStorage)
-	dataController := data.NewController(*regController, dataStorage, conf.Data.AutoRegistration)
+	dataController := data.NewController(*regController, submitStorage, conf.Data.AutoRegistration)
+	if deadLetters != nil {
+		dataController.UseDeadLetters(deadLetters)
+	}
 	regAPI := registry.NewAPI(*regController)
+	// the export then contains credentials of the sources, it must be restricted to admins by the authorization rules
+	regAPI.ExportSecrets(conf.Registry.ExportSecrets)
+	prometheus.MustRegister(regController.MetricsCollector(), mqttConn.MetricsCollector())
 	dataAPI := data.NewAPI(*dataController)
+	dataAPI.AllowOrigins(conf.HTTP.AllowedOrigins)
 	//aggrAPI := aggregation.NewAPI(regStorage, aggrStorage)
 
 	if *demomode {
@@ -175,6 +213,12 @@ func main() {
 			log.Panic("Failed to start the dummy streamer", err)
 		}
 	}
+	// Start the data storage background jobs (e.g. retention)
+	err = dataStorage.Start(*regController)
+	if err != nil {
+		log.Panicf("Error starting data storage: %s", err)
+	}
+
 	// Start MQTT connector
 	// TODO: disconnect on shutdown
 	err = mqttConn.Start(*regController)
@@ -293,10 +337,12 @@ func startGRPCServer(conf *common.Config, dataController *data.Controller, regCo
 		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(
 			grpc_recovery.StreamServerInterceptor(),
 			StreamLogInterceptor(),
+			StreamMetricsInterceptor(),
 		)),
 		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(
 			grpc_recovery.UnaryServerInterceptor(),
 			UnaryLogInterceptor(),
+			UnaryMetricsInterceptor(),
 		)))
 
 	data.RegisterGRPCAPI(srv, *dataController, conf.GRPC.RestrictedAccess)
@@ -316,6 +362,9 @@ func startHTTPServer(conf *common.Config, reg *registry.API, data *data.API) {
 	// registry api
 	router.handle(http.MethodGet, "/registry", reg.Index)
 	router.handle(http.MethodPost, "/registry", reg.Create)
+	router.handle(http.MethodPost, "/registry/batch", reg.CreateMany)
+	router.handle(http.MethodGet, "/registry/export", reg.Export)
+	router.handle(http.MethodGet, "/registry/search", reg.Search)
 	router.handle(http.MethodGet, "/registry/{type}/{path}/{op}/{value:.*}", reg.Filter) //TODO: Re-ordered this to match filtering.
 	//Filter should go for separate endpoint?
 	router.handle(http.MethodGet, "/registry/{id:.+}", reg.Retrieve)
@@ -324,10 +373,22 @@ func startHTTPServer(conf *common.Config, reg *registry.API, data *data.API) {
 
 	// data api
 	router.handle(http.MethodPost, "/data", data.SubmitWithoutID)
+	router.handle(http.MethodGet, "/data/{id:.+}/latest", data.Latest)
+	router.handle(http.MethodGet, "/data/{id:.+}/stream", data.Stream)
 	router.handle(http.MethodPost, "/data/{id:.+}", data.Submit)
 	router.handle(http.MethodGet, "/data/{id:.+}", data.Query)
 	router.handle(http.MethodDelete, "/data/{id:.+}", data.Delete)
 
+	// dead letters api
+	if conf.Data.DeadLetters.Size > 0 {
+		router.handle(http.MethodGet, "/deadletters", data.DeadLetters)
+		router.handle(http.MethodPost, "/deadletters/replay", data.ReplayDeadLetters)
+		router.handle(http.MethodGet, "/deadletters/{id:[0-9]+}", data.DeadLetter)
+		router.handle(http.MethodGet, "/deadletters/{id:[0-9]+}/payload", data.DeadLetterPayload)
+		router.handle(http.MethodPost, "/deadletters/{id:[0-9]+}/replay", data.ReplayDeadLetter)
+		router.handle(http.MethodDelete, "/deadletters/{id:[0-9]+}", data.DeleteDeadLetter)
+	}
+
 	// Append auth handler if enabled
 	if conf.Auth.Enabled {
 		// Setup ticket validator
@@ -0,0 +1,98 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/codegangsta/negroni"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Prometheus metrics of the HTTP and gRPC servers
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hds",
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "Number of HTTP requests per method, route and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hds",
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the HTTP requests per method and route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "hds",
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "Number of gRPC calls per method and status code.",
+	}, []string{"method", "code"})
+
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "hds",
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the gRPC calls per method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+// route used as label for the requests which do not match any route, to keep the number of labels bounded
+const unmatchedRoute = "unmatched"
+
+// metricsHandler records the number and duration of requests per route template (e.g. /data/{id:.+})
+func (r *router) metricsHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		t1 := time.Now()
+		nw := negroni.NewResponseWriter(w)
+		next.ServeHTTP(nw, req)
+
+		route := unmatchedRoute
+		var match mux.RouteMatch
+		if r.Match(req, &match) && match.Route != nil {
+			if tpl, err := match.Route.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		httpRequests.WithLabelValues(req.Method, route, strconv.Itoa(nw.Status())).Inc()
+		httpDuration.WithLabelValues(req.Method, route).Observe(time.Since(t1).Seconds())
+	}
+	return http.HandlerFunc(fn)
+}
+
+// Unary metrics Interceptor
+func UnaryMetricsInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		observeGRPC(info.FullMethod, start, err)
+		return resp, err
+	}
+}
+
+// Stream metrics Interceptor
+func StreamMetricsInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, stream)
+		observeGRPC(info.FullMethod, start, err)
+		return err
+	}
+}
+
+func observeGRPC(method string, start time.Time, err error) {
+	grpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	grpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
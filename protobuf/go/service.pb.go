@@ -93,7 +93,7 @@ func (x Series_ValueType) String() string {
 }
 
 func (Series_ValueType) EnumDescriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{5, 0}
+	return fileDescriptor_a0b84a42fa06f626, []int{7, 0}
 }
 
 type Void struct {
@@ -136,8 +136,14 @@ type QueryRequest struct {
 	SortAsc              bool       `protobuf:"varint,7,opt,name=sort_asc,json=sortAsc,proto3" json:"sort_asc,omitempty"`
 	Limit                int32      `protobuf:"varint,8,opt,name=limit,proto3" json:"limit,omitempty"`
 	Offset               int32      `protobuf:"varint,9,opt,name=offset,proto3" json:"offset,omitempty"`
-	Aggregator           string     `protobuf:"bytes,10,opt,name=aggregator,proto3" json:"aggregator,omitempty"`
+	Aggregator           []string   `protobuf:"bytes,10,rep,name=aggregator,proto3" json:"aggregator,omitempty"`
 	AggrInterval         string     `protobuf:"bytes,11,opt,name=aggrInterval,proto3" json:"aggrInterval,omitempty"`
+	Fill                 string     `protobuf:"bytes,12,opt,name=fill,proto3" json:"fill,omitempty"`
+	Resample             string     `protobuf:"bytes,13,opt,name=resample,proto3" json:"resample,omitempty"`
+	Align                string     `protobuf:"bytes,14,opt,name=align,proto3" json:"align,omitempty"`
+	Tz                   string     `protobuf:"bytes,15,opt,name=tz,proto3" json:"tz,omitempty"`
+	Transform            []string   `protobuf:"bytes,16,rep,name=transform,proto3" json:"transform,omitempty"`
+	Unit                 string     `protobuf:"bytes,17,opt,name=unit,proto3" json:"unit,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
 	XXX_unrecognized     []byte     `json:"-"`
 	XXX_sizecache        int32      `json:"-"`
@@ -224,11 +230,11 @@ func (m *QueryRequest) GetOffset() int32 {
 	return 0
 }
 
-func (m *QueryRequest) GetAggregator() string {
+func (m *QueryRequest) GetAggregator() []string {
 	if m != nil {
 		return m.Aggregator
 	}
-	return ""
+	return nil
 }
 
 func (m *QueryRequest) GetAggrInterval() string {
@@ -238,8 +244,51 @@ func (m *QueryRequest) GetAggrInterval() string {
 	return ""
 }
 
+func (m *QueryRequest) GetFill() string {
+	if m != nil {
+		return m.Fill
+	}
+	return ""
+}
+
+func (m *QueryRequest) GetResample() string {
+	if m != nil {
+		return m.Resample
+	}
+	return ""
+}
+
+func (m *QueryRequest) GetAlign() string {
+	if m != nil {
+		return m.Align
+	}
+	return ""
+}
+
+func (m *QueryRequest) GetTz() string {
+	if m != nil {
+		return m.Tz
+	}
+	return ""
+}
+
+func (m *QueryRequest) GetTransform() []string {
+	if m != nil {
+		return m.Transform
+	}
+	return nil
+}
+
+func (m *QueryRequest) GetUnit() string {
+	if m != nil {
+		return m.Unit
+	}
+	return ""
+}
+
 type SubscribeRequest struct {
 	Series               []string `protobuf:"bytes,1,rep,name=series,proto3" json:"series,omitempty"`
+	From                 string   `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -277,6 +326,100 @@ func (m *SubscribeRequest) GetSeries() []string {
 	return nil
 }
 
+func (m *SubscribeRequest) GetFrom() string {
+	if m != nil {
+		return m.From
+	}
+	return ""
+}
+
+// Details of the ResourceExhausted status sent to subscribers which could not keep up with the live data
+type SubscriptionOverflow struct {
+	LastTime             string            `protobuf:"bytes,1,opt,name=lastTime,proto3" json:"lastTime,omitempty"`
+	LastTimes            map[string]string `protobuf:"bytes,2,rep,name=lastTimes,proto3" json:"lastTimes,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *SubscriptionOverflow) Reset()         { *m = SubscriptionOverflow{} }
+func (m *SubscriptionOverflow) String() string { return proto.CompactTextString(m) }
+func (*SubscriptionOverflow) ProtoMessage()    {}
+func (*SubscriptionOverflow) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{3}
+}
+
+func (m *SubscriptionOverflow) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SubscriptionOverflow.Unmarshal(m, b)
+}
+func (m *SubscriptionOverflow) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SubscriptionOverflow.Marshal(b, m, deterministic)
+}
+func (m *SubscriptionOverflow) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SubscriptionOverflow.Merge(m, src)
+}
+func (m *SubscriptionOverflow) XXX_Size() int {
+	return xxx_messageInfo_SubscriptionOverflow.Size(m)
+}
+func (m *SubscriptionOverflow) XXX_DiscardUnknown() {
+	xxx_messageInfo_SubscriptionOverflow.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SubscriptionOverflow proto.InternalMessageInfo
+
+func (m *SubscriptionOverflow) GetLastTime() string {
+	if m != nil {
+		return m.LastTime
+	}
+	return ""
+}
+
+func (m *SubscriptionOverflow) GetLastTimes() map[string]string {
+	if m != nil {
+		return m.LastTimes
+	}
+	return nil
+}
+
+type LatestRequest struct {
+	Series               []string `protobuf:"bytes,1,rep,name=series,proto3" json:"series,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *LatestRequest) Reset()         { *m = LatestRequest{} }
+func (m *LatestRequest) String() string { return proto.CompactTextString(m) }
+func (*LatestRequest) ProtoMessage()    {}
+func (*LatestRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{4}
+}
+
+func (m *LatestRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_LatestRequest.Unmarshal(m, b)
+}
+func (m *LatestRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_LatestRequest.Marshal(b, m, deterministic)
+}
+func (m *LatestRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_LatestRequest.Merge(m, src)
+}
+func (m *LatestRequest) XXX_Size() int {
+	return xxx_messageInfo_LatestRequest.Size(m)
+}
+func (m *LatestRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_LatestRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_LatestRequest proto.InternalMessageInfo
+
+func (m *LatestRequest) GetSeries() []string {
+	if m != nil {
+		return m.Series
+	}
+	return nil
+}
+
 type DeleteRequest struct {
 	Series               []string `protobuf:"bytes,1,rep,name=series,proto3" json:"series,omitempty"`
 	From                 string   `protobuf:"bytes,2,opt,name=from,proto3" json:"from,omitempty"`
@@ -290,7 +433,7 @@ func (m *DeleteRequest) Reset()         { *m = DeleteRequest{} }
 func (m *DeleteRequest) String() string { return proto.CompactTextString(m) }
 func (*DeleteRequest) ProtoMessage()    {}
 func (*DeleteRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{3}
+	return fileDescriptor_a0b84a42fa06f626, []int{5}
 }
 
 func (m *DeleteRequest) XXX_Unmarshal(b []byte) error {
@@ -343,7 +486,7 @@ func (m *CountResponse) Reset()         { *m = CountResponse{} }
 func (m *CountResponse) String() string { return proto.CompactTextString(m) }
 func (*CountResponse) ProtoMessage()    {}
 func (*CountResponse) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{4}
+	return fileDescriptor_a0b84a42fa06f626, []int{6}
 }
 
 func (m *CountResponse) XXX_Unmarshal(b []byte) error {
@@ -376,6 +519,7 @@ type Series struct {
 	Type                 Series_ValueType `protobuf:"varint,2,opt,name=type,proto3,enum=data.Series_ValueType" json:"type,omitempty"`
 	Unit                 string           `protobuf:"bytes,3,opt,name=unit,proto3" json:"unit,omitempty"`
 	Meta                 *_struct.Struct  `protobuf:"bytes,4,opt,name=meta,proto3" json:"meta,omitempty"`
+	Retention            string           `protobuf:"bytes,5,opt,name=retention,proto3" json:"retention,omitempty"`
 	XXX_NoUnkeyedLiteral struct{}         `json:"-"`
 	XXX_unrecognized     []byte           `json:"-"`
 	XXX_sizecache        int32            `json:"-"`
@@ -385,7 +529,7 @@ func (m *Series) Reset()         { *m = Series{} }
 func (m *Series) String() string { return proto.CompactTextString(m) }
 func (*Series) ProtoMessage()    {}
 func (*Series) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{5}
+	return fileDescriptor_a0b84a42fa06f626, []int{7}
 }
 
 func (m *Series) XXX_Unmarshal(b []byte) error {
@@ -434,6 +578,52 @@ func (m *Series) GetMeta() *_struct.Struct {
 	return nil
 }
 
+func (m *Series) GetRetention() string {
+	if m != nil {
+		return m.Retention
+	}
+	return ""
+}
+
+type SeriesList struct {
+	Series               []*Series `protobuf:"bytes,1,rep,name=series,proto3" json:"series,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}  `json:"-"`
+	XXX_unrecognized     []byte    `json:"-"`
+	XXX_sizecache        int32     `json:"-"`
+}
+
+func (m *SeriesList) Reset()         { *m = SeriesList{} }
+func (m *SeriesList) String() string { return proto.CompactTextString(m) }
+func (*SeriesList) ProtoMessage()    {}
+func (*SeriesList) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{8}
+}
+
+func (m *SeriesList) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SeriesList.Unmarshal(m, b)
+}
+func (m *SeriesList) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SeriesList.Marshal(b, m, deterministic)
+}
+func (m *SeriesList) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SeriesList.Merge(m, src)
+}
+func (m *SeriesList) XXX_Size() int {
+	return xxx_messageInfo_SeriesList.Size(m)
+}
+func (m *SeriesList) XXX_DiscardUnknown() {
+	xxx_messageInfo_SeriesList.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SeriesList proto.InternalMessageInfo
+
+func (m *SeriesList) GetSeries() []*Series {
+	if m != nil {
+		return m.Series
+	}
+	return nil
+}
+
 type Registrations struct {
 	SeriesList           []*Series `protobuf:"bytes,1,rep,name=seriesList,proto3" json:"seriesList,omitempty"`
 	Total                int32     `protobuf:"varint,2,opt,name=total,proto3" json:"total,omitempty"`
@@ -448,7 +638,7 @@ func (m *Registrations) Reset()         { *m = Registrations{} }
 func (m *Registrations) String() string { return proto.CompactTextString(m) }
 func (*Registrations) ProtoMessage()    {}
 func (*Registrations) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{6}
+	return fileDescriptor_a0b84a42fa06f626, []int{9}
 }
 
 func (m *Registrations) XXX_Unmarshal(b []byte) error {
@@ -508,7 +698,7 @@ func (m *SeriesName) Reset()         { *m = SeriesName{} }
 func (m *SeriesName) String() string { return proto.CompactTextString(m) }
 func (*SeriesName) ProtoMessage()    {}
 func (*SeriesName) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{7}
+	return fileDescriptor_a0b84a42fa06f626, []int{10}
 }
 
 func (m *SeriesName) XXX_Unmarshal(b []byte) error {
@@ -549,7 +739,7 @@ func (m *Filterpath) Reset()         { *m = Filterpath{} }
 func (m *Filterpath) String() string { return proto.CompactTextString(m) }
 func (*Filterpath) ProtoMessage()    {}
 func (*Filterpath) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{8}
+	return fileDescriptor_a0b84a42fa06f626, []int{11}
 }
 
 func (m *Filterpath) XXX_Unmarshal(b []byte) error {
@@ -603,7 +793,7 @@ func (m *PageParams) Reset()         { *m = PageParams{} }
 func (m *PageParams) String() string { return proto.CompactTextString(m) }
 func (*PageParams) ProtoMessage()    {}
 func (*PageParams) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{9}
+	return fileDescriptor_a0b84a42fa06f626, []int{12}
 }
 
 func (m *PageParams) XXX_Unmarshal(b []byte) error {
@@ -650,7 +840,7 @@ func (m *FilterManyRequest) Reset()         { *m = FilterManyRequest{} }
 func (m *FilterManyRequest) String() string { return proto.CompactTextString(m) }
 func (*FilterManyRequest) ProtoMessage()    {}
 func (*FilterManyRequest) Descriptor() ([]byte, []int) {
-	return fileDescriptor_a0b84a42fa06f626, []int{10}
+	return fileDescriptor_a0b84a42fa06f626, []int{13}
 }
 
 func (m *FilterManyRequest) XXX_Unmarshal(b []byte) error {
@@ -685,20 +875,88 @@ func (m *FilterManyRequest) GetPageParams() *PageParams {
 	return nil
 }
 
+type SearchRequest struct {
+	Query                string      `protobuf:"bytes,1,opt,name=query,proto3" json:"query,omitempty"`
+	Sort                 []string    `protobuf:"bytes,2,rep,name=sort,proto3" json:"sort,omitempty"`
+	Fields               []string    `protobuf:"bytes,3,rep,name=fields,proto3" json:"fields,omitempty"`
+	PageParams           *PageParams `protobuf:"bytes,4,opt,name=pageParams,proto3" json:"pageParams,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}    `json:"-"`
+	XXX_unrecognized     []byte      `json:"-"`
+	XXX_sizecache        int32       `json:"-"`
+}
+
+func (m *SearchRequest) Reset()         { *m = SearchRequest{} }
+func (m *SearchRequest) String() string { return proto.CompactTextString(m) }
+func (*SearchRequest) ProtoMessage()    {}
+func (*SearchRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_a0b84a42fa06f626, []int{14}
+}
+
+func (m *SearchRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SearchRequest.Unmarshal(m, b)
+}
+func (m *SearchRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SearchRequest.Marshal(b, m, deterministic)
+}
+func (m *SearchRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SearchRequest.Merge(m, src)
+}
+func (m *SearchRequest) XXX_Size() int {
+	return xxx_messageInfo_SearchRequest.Size(m)
+}
+func (m *SearchRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SearchRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SearchRequest proto.InternalMessageInfo
+
+func (m *SearchRequest) GetQuery() string {
+	if m != nil {
+		return m.Query
+	}
+	return ""
+}
+
+func (m *SearchRequest) GetSort() []string {
+	if m != nil {
+		return m.Sort
+	}
+	return nil
+}
+
+func (m *SearchRequest) GetFields() []string {
+	if m != nil {
+		return m.Fields
+	}
+	return nil
+}
+
+func (m *SearchRequest) GetPageParams() *PageParams {
+	if m != nil {
+		return m.PageParams
+	}
+	return nil
+}
+
 func init() {
 	proto.RegisterEnum("data.DenormMask", DenormMask_name, DenormMask_value)
 	proto.RegisterEnum("data.Series_ValueType", Series_ValueType_name, Series_ValueType_value)
 	proto.RegisterType((*Void)(nil), "data.Void")
 	proto.RegisterType((*QueryRequest)(nil), "data.QueryRequest")
 	proto.RegisterType((*SubscribeRequest)(nil), "data.SubscribeRequest")
+	proto.RegisterType((*SubscriptionOverflow)(nil), "data.SubscriptionOverflow")
+	proto.RegisterMapType((map[string]string)(nil), "data.SubscriptionOverflow.LastTimesEntry")
+	proto.RegisterType((*LatestRequest)(nil), "data.LatestRequest")
 	proto.RegisterType((*DeleteRequest)(nil), "data.DeleteRequest")
 	proto.RegisterType((*CountResponse)(nil), "data.CountResponse")
 	proto.RegisterType((*Series)(nil), "data.Series")
+	proto.RegisterType((*SeriesList)(nil), "data.SeriesList")
 	proto.RegisterType((*Registrations)(nil), "data.Registrations")
 	proto.RegisterType((*SeriesName)(nil), "data.SeriesName")
 	proto.RegisterType((*Filterpath)(nil), "data.Filterpath")
 	proto.RegisterType((*PageParams)(nil), "data.PageParams")
 	proto.RegisterType((*FilterManyRequest)(nil), "data.FilterManyRequest")
+	proto.RegisterType((*SearchRequest)(nil), "data.SearchRequest")
 }
 
 func init() {
@@ -706,63 +964,80 @@ func init() {
 }
 
 var fileDescriptor_a0b84a42fa06f626 = []byte{
-	// 887 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0xdd, 0x72, 0xdb, 0x44,
-	0x14, 0xb6, 0x64, 0x5b, 0xb1, 0x8f, 0x93, 0x20, 0xb6, 0x4c, 0x23, 0x3c, 0x0c, 0x63, 0x34, 0x65,
-	0xf0, 0xa4, 0xd4, 0x29, 0x66, 0x80, 0x0e, 0x57, 0xa4, 0x64, 0xdc, 0x61, 0x20, 0x25, 0xc8, 0x6d,
-	0x2f, 0xb8, 0xe9, 0xac, 0xed, 0x63, 0x65, 0x27, 0x92, 0x56, 0xec, 0x1e, 0x85, 0xc9, 0x25, 0x2f,
-	0xc1, 0x9b, 0xf0, 0x00, 0xf0, 0x64, 0xcc, 0xee, 0xfa, 0x47, 0x6e, 0xda, 0x70, 0xc3, 0xdd, 0x9e,
-	0xb3, 0x9f, 0xf6, 0x7c, 0xe7, 0x3b, 0x3f, 0x82, 0x03, 0x8d, 0xea, 0x5a, 0xcc, 0x71, 0x54, 0x2a,
-	0x49, 0x92, 0xb5, 0x16, 0x9c, 0x78, 0xbf, 0xa7, 0xb1, 0xc8, 0x33, 0xe7, 0xea, 0x7f, 0x94, 0x4a,
-	0x99, 0x66, 0x78, 0x62, 0xad, 0x59, 0xb5, 0x3c, 0xd1, 0xa4, 0xaa, 0x39, 0xb9, 0xdb, 0x38, 0x80,
-	0xd6, 0x2b, 0x29, 0x16, 0xf1, 0x5f, 0x3e, 0xec, 0xff, 0x52, 0xa1, 0xba, 0x49, 0xf0, 0xb7, 0x0a,
-	0x35, 0xb1, 0xfb, 0x10, 0x68, 0x54, 0x02, 0x75, 0xe4, 0x0d, 0x9a, 0xc3, 0x6e, 0xb2, 0xb2, 0x18,
-	0x83, 0xd6, 0x52, 0xc9, 0x3c, 0xf2, 0x07, 0xde, 0xb0, 0x9b, 0xd8, 0x33, 0x3b, 0x04, 0x9f, 0x64,
-	0xd4, 0xb4, 0x1e, 0x9f, 0x24, 0x1b, 0xc2, 0x7b, 0x0a, 0xe7, 0x52, 0x2d, 0x2e, 0x50, 0x5d, 0xf0,
-	0xf9, 0x15, 0x52, 0xd4, 0x1e, 0x78, 0xc3, 0x76, 0xf2, 0xa6, 0x9b, 0x8d, 0xa1, 0xb7, 0xc0, 0x42,
-	0xaa, 0x9c, 0x9f, 0x73, 0x7d, 0x15, 0x05, 0x03, 0x6f, 0x78, 0x38, 0x0e, 0x47, 0x26, 0x8b, 0xd1,
-	0x99, 0xbd, 0x30, 0xfe, 0xa4, 0x0e, 0x62, 0x1f, 0x42, 0x47, 0x4b, 0x45, 0xaf, 0xb9, 0x9e, 0x47,
-	0x7b, 0x03, 0x6f, 0xd8, 0x49, 0xf6, 0x8c, 0x7d, 0xaa, 0xe7, 0xec, 0x03, 0x68, 0x67, 0x22, 0x17,
-	0x14, 0x75, 0x6c, 0x38, 0x67, 0x98, 0x54, 0xe4, 0x72, 0xa9, 0x91, 0xa2, 0xae, 0x75, 0xaf, 0x2c,
-	0xf6, 0x31, 0x00, 0x4f, 0x53, 0x85, 0x29, 0x27, 0xa9, 0x22, 0xb0, 0xf4, 0x6b, 0x1e, 0x16, 0xc3,
-	0xbe, 0xb1, 0x7e, 0x28, 0x08, 0xd5, 0x35, 0xcf, 0xa2, 0x9e, 0x45, 0xec, 0xf8, 0xe2, 0x63, 0x08,
-	0xa7, 0xd5, 0x4c, 0xcf, 0x95, 0x98, 0xe1, 0x7f, 0x48, 0x17, 0xff, 0x08, 0x07, 0x67, 0x98, 0x21,
-	0xe1, 0xff, 0xa0, 0x71, 0xfc, 0x29, 0x1c, 0x7c, 0x2f, 0xab, 0x82, 0x12, 0xd4, 0xa5, 0x2c, 0x34,
-	0x9a, 0xdc, 0x49, 0x12, 0xcf, 0x22, 0xcf, 0xe5, 0x6e, 0x8d, 0xf8, 0x6f, 0x0f, 0x82, 0xe9, 0xe6,
-	0xd5, 0x82, 0xe7, 0x68, 0xef, 0xbb, 0x89, 0x3d, 0xb3, 0x63, 0x68, 0xd1, 0x4d, 0x89, 0x36, 0xd2,
-	0xe1, 0xf8, 0xbe, 0x13, 0xde, 0xe1, 0x47, 0xaf, 0x78, 0x56, 0xe1, 0x8b, 0x9b, 0x12, 0x13, 0x8b,
-	0x31, 0xdf, 0x57, 0x85, 0xa0, 0x15, 0x07, 0x7b, 0x66, 0x0f, 0xa1, 0x95, 0x23, 0xf1, 0xa8, 0x35,
-	0xf0, 0x86, 0xbd, 0xf1, 0xd1, 0xc8, 0xf5, 0xda, 0x68, 0xdd, 0x6b, 0xa3, 0xa9, 0xed, 0xb5, 0xc4,
-	0x82, 0xe2, 0xaf, 0xa1, 0xbb, 0x79, 0x93, 0x75, 0xa1, 0x3d, 0xc9, 0x24, 0xa7, 0xb0, 0xc1, 0x00,
-	0x82, 0x29, 0x29, 0x51, 0xa4, 0xa1, 0xc7, 0x3a, 0xd0, 0x7a, 0x2a, 0x65, 0x16, 0xfa, 0xe6, 0x74,
-	0xc6, 0x89, 0x87, 0xcd, 0xf8, 0x0f, 0x0f, 0x0e, 0x12, 0x4c, 0x85, 0x26, 0xc5, 0x49, 0xc8, 0x42,
-	0xb3, 0xcf, 0x01, 0x9c, 0x54, 0x3f, 0x09, 0x4d, 0x56, 0xbc, 0xde, 0x78, 0xbf, 0x4e, 0x3e, 0xa9,
-	0xdd, 0x6f, 0x95, 0xf1, 0x6b, 0xca, 0x98, 0x74, 0x4a, 0x9e, 0xa2, 0x4d, 0xa7, 0x9d, 0xd8, 0x33,
-	0x8b, 0x60, 0xaf, 0x34, 0xbd, 0x99, 0xa2, 0xcd, 0xa8, 0x9d, 0xac, 0xcd, 0xf8, 0x01, 0x80, 0x7b,
-	0xf9, 0xb9, 0x91, 0xad, 0x5e, 0x38, 0xaf, 0x56, 0xe1, 0x09, 0xc0, 0x44, 0x64, 0x84, 0xaa, 0xe4,
-	0x74, 0xe9, 0x22, 0xd0, 0xe5, 0x5a, 0x70, 0xeb, 0x3b, 0x04, 0x5f, 0x96, 0xab, 0xc2, 0xfa, 0xb2,
-	0x34, 0xdc, 0xae, 0x8d, 0x26, 0x2b, 0x55, 0x9d, 0x11, 0x7f, 0x0b, 0x60, 0xa2, 0x5e, 0x70, 0xc5,
-	0x73, 0xbd, 0x61, 0xea, 0xbd, 0x9d, 0xa9, 0xbf, 0xcb, 0xf4, 0x77, 0x78, 0xdf, 0x71, 0x38, 0xe7,
-	0xc5, 0x66, 0x9a, 0x1f, 0x03, 0x2c, 0xad, 0xf3, 0x62, 0x4d, 0xa8, 0xb7, 0x1e, 0xb3, 0x2d, 0xe1,
-	0xa4, 0x86, 0x31, 0x5f, 0x94, 0x1b, 0x0a, 0x36, 0xc6, 0xe6, 0x8b, 0x2d, 0xb5, 0xa4, 0x86, 0x39,
-	0x3e, 0x07, 0xd8, 0x8e, 0xac, 0x29, 0xdf, 0x73, 0x59, 0x60, 0xd8, 0xb0, 0x95, 0x36, 0xaa, 0x85,
-	0x9e, 0x3d, 0xbe, 0x10, 0x39, 0x86, 0xbe, 0x3d, 0xbe, 0x2c, 0x04, 0x85, 0x2d, 0x53, 0xff, 0x89,
-	0x6d, 0x8c, 0xb0, 0x63, 0x3e, 0x9b, 0x4c, 0xab, 0x3c, 0x0c, 0xc7, 0x7f, 0xfa, 0xae, 0x01, 0xd8,
-	0x17, 0x10, 0x4c, 0xab, 0x99, 0x19, 0xe4, 0xa3, 0x91, 0x5d, 0x6c, 0xaf, 0x37, 0xed, 0x75, 0x8e,
-	0x5a, 0xf3, 0x14, 0xfb, 0xe0, 0x88, 0xd9, 0x4d, 0xd6, 0x18, 0x7a, 0xec, 0x09, 0xb4, 0xed, 0x32,
-	0x63, 0xcc, 0x5d, 0xd4, 0x37, 0x5b, 0xff, 0x5d, 0xaf, 0xc4, 0x8d, 0xc7, 0x1e, 0xfb, 0x0e, 0xba,
-	0x9b, 0x79, 0x66, 0xeb, 0x79, 0x78, 0x63, 0xc0, 0xef, 0x7e, 0x61, 0x0c, 0x6d, 0x3b, 0x98, 0x6f,
-	0x8d, 0x7d, 0xcf, 0xf9, 0x76, 0x26, 0x37, 0x6e, 0xb0, 0x87, 0x10, 0xb8, 0xcd, 0xc0, 0xee, 0xad,
-	0x77, 0x5f, 0x6d, 0x4f, 0xec, 0xa6, 0x37, 0xfe, 0xc7, 0x87, 0xce, 0x6a, 0x1c, 0x6e, 0xd8, 0x27,
-	0xd0, 0x3c, 0x5d, 0x2c, 0xd8, 0x4e, 0xf3, 0xef, 0xe2, 0x8d, 0x7e, 0xcf, 0x90, 0x4e, 0xb3, 0x8c,
-	0xdd, 0xaa, 0xdf, 0x9a, 0xcf, 0xce, 0x74, 0xc5, 0x0d, 0xf6, 0x19, 0x34, 0x9f, 0x21, 0xad, 0xf1,
-	0xdb, 0xc6, 0xef, 0xef, 0xc4, 0x89, 0x1b, 0xec, 0x11, 0x74, 0x5d, 0xff, 0xfc, 0x5c, 0x20, 0xbb,
-	0xd5, 0x50, 0xb7, 0xe0, 0x4f, 0x20, 0x70, 0xb7, 0xec, 0xa8, 0x8e, 0xad, 0x75, 0xea, 0xbb, 0x18,
-	0x3d, 0x80, 0xe0, 0x65, 0xb9, 0xe0, 0x84, 0x77, 0xa6, 0x3a, 0xdc, 0xe8, 0x78, 0x9b, 0xfa, 0x0e,
-	0xf2, 0xe9, 0x37, 0xbf, 0x7e, 0x95, 0x0a, 0xba, 0xac, 0x66, 0xa3, 0xb9, 0xcc, 0x4f, 0x32, 0x51,
-	0x5c, 0xe9, 0x9c, 0x2b, 0x3a, 0xb9, 0x14, 0x9a, 0xa4, 0x12, 0x73, 0x9e, 0x3d, 0x32, 0x70, 0x63,
-	0xd4, 0x7e, 0x9d, 0xa9, 0x9c, 0x05, 0xd6, 0xf8, 0xf2, 0xdf, 0x00, 0x00, 0x00, 0xff, 0xff, 0xe7,
-	0x5c, 0x61, 0x8c, 0x79, 0x07, 0x00, 0x00,
+	// 1153 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0xdb, 0x6e, 0xdb, 0x46,
+	0x13, 0x16, 0x49, 0x89, 0x96, 0x46, 0x96, 0xc2, 0x6c, 0x82, 0x84, 0xbf, 0x10, 0xfc, 0x50, 0x09,
+	0x17, 0x51, 0x92, 0x46, 0x4e, 0xd4, 0x93, 0x11, 0x14, 0x45, 0x9d, 0xba, 0x36, 0x8a, 0xda, 0x89,
+	0x43, 0x25, 0xb9, 0xe8, 0x4d, 0xb0, 0x92, 0x56, 0x34, 0xe1, 0x25, 0x97, 0xd9, 0x5d, 0x39, 0x50,
+	0xee, 0x8a, 0x3e, 0x4a, 0x9f, 0xa2, 0x17, 0x7d, 0x87, 0xbe, 0x41, 0x5f, 0xa5, 0xd8, 0x5d, 0x91,
+	0x22, 0x7d, 0x48, 0x8a, 0xa2, 0x77, 0x33, 0xb3, 0xc3, 0x9d, 0x6f, 0xbe, 0x39, 0x2c, 0xa1, 0x23,
+	0x08, 0x3f, 0x8b, 0xa7, 0x64, 0x98, 0x71, 0x26, 0x19, 0xaa, 0xcf, 0xb0, 0xc4, 0xbd, 0xb6, 0x20,
+	0x69, 0x42, 0x8d, 0xa9, 0x77, 0x27, 0x62, 0x2c, 0xa2, 0x64, 0x5b, 0x6b, 0x93, 0xc5, 0x7c, 0x5b,
+	0x48, 0xbe, 0x98, 0x4a, 0x73, 0x1a, 0xb8, 0x50, 0x7f, 0xcd, 0xe2, 0x59, 0xf0, 0x87, 0x03, 0x9b,
+	0x2f, 0x16, 0x84, 0x2f, 0x43, 0xf2, 0x76, 0x41, 0x84, 0x44, 0xb7, 0xc0, 0x15, 0x84, 0xc7, 0x44,
+	0xf8, 0x56, 0xdf, 0x19, 0xb4, 0xc2, 0x95, 0x86, 0x10, 0xd4, 0xe7, 0x9c, 0x25, 0xbe, 0xdd, 0xb7,
+	0x06, 0xad, 0x50, 0xcb, 0xa8, 0x0b, 0xb6, 0x64, 0xbe, 0xa3, 0x2d, 0xb6, 0x64, 0x68, 0x00, 0xd7,
+	0x38, 0x99, 0x32, 0x3e, 0x3b, 0x26, 0xfc, 0x18, 0x4f, 0x4f, 0x89, 0xf4, 0x1b, 0x7d, 0x6b, 0xd0,
+	0x08, 0xcf, 0x9b, 0xd1, 0x08, 0xda, 0x33, 0x92, 0x32, 0x9e, 0xe0, 0x23, 0x2c, 0x4e, 0x7d, 0xb7,
+	0x6f, 0x0d, 0xba, 0x23, 0x6f, 0xa8, 0xb2, 0x18, 0xee, 0xe9, 0x03, 0x65, 0x0f, 0xcb, 0x4e, 0xe8,
+	0x7f, 0xd0, 0x14, 0x8c, 0xcb, 0x37, 0x58, 0x4c, 0xfd, 0x8d, 0xbe, 0x35, 0x68, 0x86, 0x1b, 0x4a,
+	0xdf, 0x15, 0x53, 0x74, 0x13, 0x1a, 0x34, 0x4e, 0x62, 0xe9, 0x37, 0x75, 0x38, 0xa3, 0xa8, 0x54,
+	0xd8, 0x7c, 0x2e, 0x88, 0xf4, 0x5b, 0xda, 0xbc, 0xd2, 0xd0, 0xff, 0x01, 0x70, 0x14, 0x71, 0x12,
+	0x61, 0xc9, 0xb8, 0x0f, 0x3a, 0xcd, 0x92, 0x05, 0x05, 0xb0, 0xa9, 0xb4, 0x1f, 0x53, 0x49, 0xf8,
+	0x19, 0xa6, 0x7e, 0x5b, 0x27, 0x58, 0xb1, 0x69, 0x3a, 0x62, 0x4a, 0xfd, 0xcd, 0x15, 0x1d, 0x31,
+	0xa5, 0xa8, 0x07, 0x4d, 0x4e, 0x04, 0x4e, 0x32, 0x4a, 0xfc, 0x8e, 0xb6, 0x17, 0xba, 0x42, 0x88,
+	0x69, 0x1c, 0xa5, 0x7e, 0x57, 0x1f, 0x18, 0x45, 0x13, 0xf8, 0xde, 0xbf, 0xb6, 0x22, 0xf0, 0x3d,
+	0xba, 0x03, 0x2d, 0xc9, 0x71, 0x2a, 0xe6, 0x8c, 0x27, 0xbe, 0xa7, 0x81, 0xad, 0x0d, 0x2a, 0xe6,
+	0x22, 0x8d, 0xa5, 0x7f, 0xdd, 0xc4, 0x54, 0x72, 0xf0, 0x2d, 0x78, 0xe3, 0xc5, 0x44, 0x4c, 0x79,
+	0x3c, 0x21, 0xff, 0xa2, 0x84, 0xc1, 0xef, 0x16, 0xdc, 0x5c, 0x5d, 0x90, 0xc9, 0x98, 0xa5, 0xcf,
+	0xcf, 0x08, 0x9f, 0x53, 0xf6, 0x4e, 0x25, 0x43, 0xb1, 0x90, 0x2f, 0xe3, 0x84, 0xf8, 0x96, 0x49,
+	0x26, 0xd7, 0xd1, 0x01, 0xb4, 0x72, 0x59, 0xf8, 0x76, 0xdf, 0x19, 0xb4, 0x47, 0xf7, 0x4c, 0xed,
+	0x2e, 0xbb, 0x6a, 0x78, 0x98, 0xfb, 0xfe, 0x90, 0x4a, 0xbe, 0x0c, 0xd7, 0xdf, 0xf6, 0xbe, 0x81,
+	0x6e, 0xf5, 0x10, 0x79, 0xe0, 0x9c, 0x92, 0xe5, 0x2a, 0xa2, 0x12, 0x15, 0x73, 0x67, 0x98, 0x2e,
+	0xc8, 0x0a, 0xb6, 0x51, 0x9e, 0xd8, 0x3b, 0x56, 0x70, 0x17, 0x3a, 0x87, 0x58, 0x12, 0x21, 0x3f,
+	0x92, 0x78, 0xf0, 0x13, 0x74, 0xf6, 0x08, 0x25, 0x92, 0xfc, 0x07, 0x4d, 0x1e, 0x7c, 0x0a, 0x9d,
+	0xef, 0xd9, 0x22, 0x95, 0x21, 0x11, 0x19, 0x4b, 0x85, 0x2e, 0xad, 0x64, 0x12, 0x53, 0x0d, 0xba,
+	0x11, 0x1a, 0x25, 0xf8, 0xcb, 0x02, 0x77, 0x5c, 0xdc, 0x9a, 0xe2, 0x82, 0x46, 0x2d, 0xa3, 0xfb,
+	0x50, 0x97, 0xcb, 0xcc, 0x24, 0xd5, 0x1d, 0xdd, 0x5a, 0xb1, 0xa7, 0xfd, 0x87, 0xaf, 0x55, 0x86,
+	0x2f, 0x97, 0x19, 0x09, 0xb5, 0x4f, 0x51, 0x77, 0x67, 0x5d, 0x77, 0xf4, 0x00, 0xea, 0x09, 0x91,
+	0xd8, 0xaf, 0xf7, 0xad, 0x41, 0x7b, 0x74, 0x7b, 0x68, 0x86, 0x7d, 0x98, 0x0f, 0xfb, 0x70, 0xac,
+	0x87, 0x3d, 0xd4, 0x4e, 0xaa, 0xad, 0x38, 0x91, 0x24, 0x55, 0x55, 0xd1, 0x13, 0xd9, 0x0a, 0xd7,
+	0x86, 0xe0, 0x2b, 0x68, 0x15, 0x11, 0x51, 0x0b, 0x1a, 0xfb, 0x94, 0x61, 0xe9, 0xd5, 0x10, 0x80,
+	0x3b, 0x96, 0x3c, 0x4e, 0x23, 0xcf, 0x42, 0x4d, 0xa8, 0x3f, 0x65, 0x8c, 0x7a, 0xb6, 0x92, 0xf6,
+	0xb0, 0xc4, 0x9e, 0x13, 0x8c, 0x00, 0x0c, 0xe0, 0xc3, 0x58, 0x48, 0xb4, 0x55, 0xa1, 0xb4, 0x3d,
+	0xda, 0x2c, 0xa7, 0x54, 0x54, 0xe2, 0x17, 0x0b, 0x3a, 0x21, 0x89, 0x62, 0x21, 0x39, 0x56, 0xc1,
+	0x05, 0xfa, 0x0c, 0x40, 0x14, 0xb7, 0x5c, 0xfa, 0x6d, 0xe9, 0x7c, 0xcd, 0xb5, 0x5d, 0xe2, 0x5a,
+	0x11, 0x94, 0xe1, 0x88, 0x68, 0x82, 0x1a, 0xa1, 0x96, 0x91, 0x0f, 0x1b, 0x99, 0x5a, 0x37, 0x11,
+	0xd1, 0x1c, 0x35, 0xc2, 0x5c, 0x0d, 0xb6, 0x72, 0xdc, 0xcf, 0x54, 0x21, 0xca, 0xad, 0x60, 0x95,
+	0x7a, 0x66, 0x1f, 0x60, 0x3f, 0xa6, 0x92, 0xf0, 0x0c, 0xcb, 0x13, 0x13, 0x41, 0x9e, 0xe4, 0x25,
+	0xd4, 0xb6, 0x2e, 0xd8, 0x2c, 0x5b, 0xb5, 0x8a, 0xcd, 0xb2, 0x75, 0xa3, 0x3a, 0xa5, 0x46, 0x0d,
+	0x9e, 0x00, 0xa8, 0xa8, 0xc7, 0x98, 0xe3, 0x44, 0x14, 0x48, 0xad, 0xcb, 0x91, 0xda, 0x55, 0xa4,
+	0xef, 0xe0, 0xba, 0xc1, 0x70, 0x84, 0xd3, 0x62, 0x41, 0x3f, 0x02, 0x98, 0x6b, 0xe3, 0x71, 0x0e,
+	0xa8, 0x9d, 0x6f, 0xce, 0x35, 0xe0, 0xb0, 0xe4, 0xa3, 0xbe, 0xc8, 0x0a, 0x08, 0xbe, 0x5d, 0xfe,
+	0x62, 0x0d, 0x2d, 0x2c, 0xf9, 0x04, 0xbf, 0x5a, 0xd0, 0x19, 0x13, 0xcc, 0xa7, 0x27, 0x79, 0xd4,
+	0x9b, 0xd0, 0x78, 0xab, 0x9e, 0x89, 0x15, 0x03, 0x46, 0x51, 0xe9, 0xa8, 0x15, 0xac, 0x77, 0x40,
+	0x2b, 0xd4, 0xb2, 0x22, 0x74, 0x1e, 0x13, 0x3a, 0x13, 0xbe, 0x63, 0x66, 0xcb, 0x68, 0xe7, 0x50,
+	0xd4, 0x3f, 0x8e, 0xe2, 0xfe, 0x11, 0xc0, 0xfa, 0x2d, 0x50, 0x8d, 0xf7, 0x8c, 0xa5, 0xc4, 0xab,
+	0xe9, 0x1e, 0x55, 0xb5, 0xf3, 0x2c, 0x2d, 0xaa, 0xed, 0xe1, 0xd9, 0x5a, 0x7c, 0x95, 0xc6, 0xd2,
+	0xab, 0xab, 0xce, 0xdd, 0xd7, 0x2d, 0xed, 0x35, 0xd5, 0x67, 0xfb, 0xe3, 0x45, 0xe2, 0x79, 0xa3,
+	0x3f, 0x6d, 0xd3, 0xba, 0xe8, 0x31, 0xb8, 0xe3, 0xc5, 0x44, 0xbd, 0x10, 0xb7, 0x87, 0xfa, 0xc5,
+	0x7c, 0x53, 0x8c, 0xcd, 0x11, 0x11, 0x02, 0x47, 0xa4, 0x07, 0x06, 0x98, 0x7e, 0x22, 0x6b, 0x03,
+	0x0b, 0xed, 0x40, 0xe3, 0x85, 0xc9, 0xd8, 0x1c, 0x94, 0x9f, 0xcc, 0xde, 0x55, 0xb7, 0x04, 0xb5,
+	0x47, 0x16, 0xfa, 0x0e, 0x5a, 0xc5, 0x82, 0x46, 0xb7, 0x2a, 0x5b, 0x72, 0x42, 0xfe, 0xd1, 0x0d,
+	0x23, 0x68, 0xe8, 0x85, 0x73, 0x69, 0xec, 0x1b, 0xc6, 0x56, 0xd9, 0x48, 0x41, 0x0d, 0x3d, 0x00,
+	0xd7, 0x6c, 0x3c, 0x74, 0x23, 0x7f, 0x54, 0x4b, 0xfb, 0xaf, 0x9a, 0x1e, 0xda, 0x01, 0xd7, 0xec,
+	0xd1, 0xdc, 0xb9, 0xb2, 0x55, 0x3f, 0x00, 0x6e, 0xf4, 0x9b, 0x03, 0xcd, 0xd5, 0x38, 0x2f, 0xd1,
+	0x27, 0xe0, 0xec, 0xce, 0x66, 0xa8, 0x32, 0xbc, 0xe7, 0x22, 0xdd, 0x83, 0x8d, 0xdd, 0xd9, 0x4c,
+	0x75, 0x33, 0xf2, 0xca, 0x6e, 0x6a, 0xb6, 0xcf, 0xb9, 0x3e, 0x06, 0xf7, 0x80, 0xc8, 0x5d, 0x4a,
+	0xd1, 0x85, 0x26, 0xc9, 0x93, 0xae, 0x2c, 0x92, 0xa0, 0x86, 0xee, 0x82, 0x73, 0x40, 0x64, 0xf5,
+	0x66, 0xd5, 0x27, 0xbd, 0x0a, 0xa4, 0xa0, 0x86, 0x1e, 0x42, 0xcb, 0x8c, 0xca, 0xf3, 0x94, 0xa0,
+	0x0b, 0xb3, 0x73, 0xc1, 0x7d, 0x07, 0x5c, 0x73, 0x8a, 0x6e, 0x97, 0x7d, 0x4b, 0x43, 0x79, 0x15,
+	0xa2, 0x2f, 0xc0, 0x35, 0x63, 0x94, 0x33, 0x5b, 0x19, 0xaa, 0xab, 0xbe, 0xda, 0x02, 0xf7, 0x55,
+	0x36, 0xc3, 0x92, 0x7c, 0x90, 0xcb, 0x41, 0x51, 0xe2, 0x8b, 0x09, 0x57, 0x3c, 0x9f, 0x7e, 0xfd,
+	0xf3, 0x97, 0x51, 0x2c, 0x4f, 0x16, 0x93, 0xe1, 0x94, 0x25, 0xdb, 0x34, 0x4e, 0x4f, 0x45, 0x82,
+	0xb9, 0xdc, 0x3e, 0x89, 0x85, 0x64, 0x3c, 0x9e, 0x62, 0xfa, 0x50, 0xb9, 0x2b, 0xa5, 0xf4, 0xbb,
+	0x18, 0xb1, 0x89, 0xab, 0x95, 0xcf, 0xff, 0x1e, 0x00, 0x64, 0x78, 0x7a, 0xc5, 0x6d, 0x0a, 0x00,
+	0x00,
 }
 
 // Reference imports to suppress errors if they are not otherwise used.
@@ -782,6 +1057,7 @@ type DataClient interface {
 	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Data_SubscribeClient, error)
 	Count(ctx context.Context, in *QueryRequest, opts ...grpc.CallOption) (*CountResponse, error)
 	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*Void, error)
+	Latest(ctx context.Context, in *LatestRequest, opts ...grpc.CallOption) (*_go.Message, error)
 }
 
 type dataClient struct {
@@ -908,6 +1184,15 @@ func (c *dataClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc
 	return out, nil
 }
 
+func (c *dataClient) Latest(ctx context.Context, in *LatestRequest, opts ...grpc.CallOption) (*_go.Message, error) {
+	out := new(_go.Message)
+	err := c.cc.Invoke(ctx, "/data.Data/Latest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // DataServer is the server API for Data service.
 type DataServer interface {
 	Submit(Data_SubmitServer) error
@@ -915,6 +1200,7 @@ type DataServer interface {
 	Subscribe(*SubscribeRequest, Data_SubscribeServer) error
 	Count(context.Context, *QueryRequest) (*CountResponse, error)
 	Delete(context.Context, *DeleteRequest) (*Void, error)
+	Latest(context.Context, *LatestRequest) (*_go.Message, error)
 }
 
 // UnimplementedDataServer can be embedded to have forward compatible implementations.
@@ -936,6 +1222,9 @@ func (*UnimplementedDataServer) Count(ctx context.Context, req *QueryRequest) (*
 func (*UnimplementedDataServer) Delete(ctx context.Context, req *DeleteRequest) (*Void, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
 }
+func (*UnimplementedDataServer) Latest(ctx context.Context, req *LatestRequest) (*_go.Message, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Latest not implemented")
+}
 
 func RegisterDataServer(s *grpc.Server, srv DataServer) {
 	s.RegisterService(&_Data_serviceDesc, srv)
@@ -1045,6 +1334,24 @@ func _Data_Delete_Handler(srv interface{}, ctx context.Context, dec func(interfa
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Data_Latest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LatestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DataServer).Latest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/data.Data/Latest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DataServer).Latest(ctx, req.(*LatestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 var _Data_serviceDesc = grpc.ServiceDesc{
 	ServiceName: "data.Data",
 	HandlerType: (*DataServer)(nil),
@@ -1057,6 +1364,10 @@ var _Data_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Delete",
 			Handler:    _Data_Delete_Handler,
 		},
+		{
+			MethodName: "Latest",
+			Handler:    _Data_Latest_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -1083,10 +1394,12 @@ var _Data_serviceDesc = grpc.ServiceDesc{
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
 type RegistryClient interface {
 	Add(ctx context.Context, in *Series, opts ...grpc.CallOption) (*Void, error)
+	AddMany(ctx context.Context, in *SeriesList, opts ...grpc.CallOption) (*Void, error)
 	GetAll(ctx context.Context, in *PageParams, opts ...grpc.CallOption) (*Registrations, error)
 	Get(ctx context.Context, in *SeriesName, opts ...grpc.CallOption) (*Series, error)
 	FilterOne(ctx context.Context, in *Filterpath, opts ...grpc.CallOption) (*Series, error)
 	Filter(ctx context.Context, in *FilterManyRequest, opts ...grpc.CallOption) (*Registrations, error)
+	Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*Registrations, error)
 	Update(ctx context.Context, in *Series, opts ...grpc.CallOption) (*Void, error)
 	Delete(ctx context.Context, in *SeriesName, opts ...grpc.CallOption) (*Void, error)
 }
@@ -1108,6 +1421,15 @@ func (c *registryClient) Add(ctx context.Context, in *Series, opts ...grpc.CallO
 	return out, nil
 }
 
+func (c *registryClient) AddMany(ctx context.Context, in *SeriesList, opts ...grpc.CallOption) (*Void, error) {
+	out := new(Void)
+	err := c.cc.Invoke(ctx, "/data.Registry/AddMany", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *registryClient) GetAll(ctx context.Context, in *PageParams, opts ...grpc.CallOption) (*Registrations, error) {
 	out := new(Registrations)
 	err := c.cc.Invoke(ctx, "/data.Registry/GetAll", in, out, opts...)
@@ -1144,6 +1466,15 @@ func (c *registryClient) Filter(ctx context.Context, in *FilterManyRequest, opts
 	return out, nil
 }
 
+func (c *registryClient) Search(ctx context.Context, in *SearchRequest, opts ...grpc.CallOption) (*Registrations, error) {
+	out := new(Registrations)
+	err := c.cc.Invoke(ctx, "/data.Registry/Search", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *registryClient) Update(ctx context.Context, in *Series, opts ...grpc.CallOption) (*Void, error) {
 	out := new(Void)
 	err := c.cc.Invoke(ctx, "/data.Registry/Update", in, out, opts...)
@@ -1165,10 +1496,12 @@ func (c *registryClient) Delete(ctx context.Context, in *SeriesName, opts ...grp
 // RegistryServer is the server API for Registry service.
 type RegistryServer interface {
 	Add(context.Context, *Series) (*Void, error)
+	AddMany(context.Context, *SeriesList) (*Void, error)
 	GetAll(context.Context, *PageParams) (*Registrations, error)
 	Get(context.Context, *SeriesName) (*Series, error)
 	FilterOne(context.Context, *Filterpath) (*Series, error)
 	Filter(context.Context, *FilterManyRequest) (*Registrations, error)
+	Search(context.Context, *SearchRequest) (*Registrations, error)
 	Update(context.Context, *Series) (*Void, error)
 	Delete(context.Context, *SeriesName) (*Void, error)
 }
@@ -1180,6 +1513,9 @@ type UnimplementedRegistryServer struct {
 func (*UnimplementedRegistryServer) Add(ctx context.Context, req *Series) (*Void, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Add not implemented")
 }
+func (*UnimplementedRegistryServer) AddMany(ctx context.Context, req *SeriesList) (*Void, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddMany not implemented")
+}
 func (*UnimplementedRegistryServer) GetAll(ctx context.Context, req *PageParams) (*Registrations, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetAll not implemented")
 }
@@ -1192,6 +1528,9 @@ func (*UnimplementedRegistryServer) FilterOne(ctx context.Context, req *Filterpa
 func (*UnimplementedRegistryServer) Filter(ctx context.Context, req *FilterManyRequest) (*Registrations, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Filter not implemented")
 }
+func (*UnimplementedRegistryServer) Search(ctx context.Context, req *SearchRequest) (*Registrations, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Search not implemented")
+}
 func (*UnimplementedRegistryServer) Update(ctx context.Context, req *Series) (*Void, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Update not implemented")
 }
@@ -1221,6 +1560,24 @@ func _Registry_Add_Handler(srv interface{}, ctx context.Context, dec func(interf
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Registry_AddMany_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SeriesList)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).AddMany(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/data.Registry/AddMany",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).AddMany(ctx, req.(*SeriesList))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Registry_GetAll_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(PageParams)
 	if err := dec(in); err != nil {
@@ -1293,6 +1650,24 @@ func _Registry_Filter_Handler(srv interface{}, ctx context.Context, dec func(int
 	return interceptor(ctx, in, info, handler)
 }
 
+func _Registry_Search_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RegistryServer).Search(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/data.Registry/Search",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RegistryServer).Search(ctx, req.(*SearchRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _Registry_Update_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(Series)
 	if err := dec(in); err != nil {
@@ -1337,6 +1712,10 @@ var _Registry_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Add",
 			Handler:    _Registry_Add_Handler,
 		},
+		{
+			MethodName: "AddMany",
+			Handler:    _Registry_AddMany_Handler,
+		},
 		{
 			MethodName: "GetAll",
 			Handler:    _Registry_GetAll_Handler,
@@ -1353,6 +1732,10 @@ var _Registry_serviceDesc = grpc.ServiceDesc{
 			MethodName: "Filter",
 			Handler:    _Registry_Filter_Handler,
 		},
+		{
+			MethodName: "Search",
+			Handler:    _Registry_Search_Handler,
+		},
 		{
 			MethodName: "Update",
 			Handler:    _Registry_Update_Handler,
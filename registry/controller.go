@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/linksmart/historical-datastore/common"
+	"github.com/linksmart/service-catalog/v2/utils"
 )
 
 // RESTful HTTP API
@@ -33,6 +34,18 @@ func (c Controller) Add(ts TimeSeries) (*TimeSeries, common.Error) {
 	if err != nil {
 		return nil, &common.BadRequestError{S: err.Error()}
 	}
+	if ts.Source.SrcType == Series {
+		srcErr := c.validateRollupSource(ts, nil)
+		if srcErr != nil {
+			return nil, srcErr
+		}
+	}
+	if ts.Source.SrcType == Virtual {
+		srcErr := c.validateVirtualInputs(ts, nil)
+		if srcErr != nil {
+			return nil, srcErr
+		}
+	}
 	addedTs, err := c.s.add(ts)
 	if err != nil {
 		if errors.Is(err, ErrConflict) {
@@ -45,6 +58,107 @@ func (c Controller) Add(ts TimeSeries) (*TimeSeries, common.Error) {
 	}
 	return addedTs, nil
 }
+
+// AddMany validates and adds multiple time series at once. Either all or none of them are added.
+// Rollup and virtual series may refer to source series of the same batch.
+func (c Controller) AddMany(series []TimeSeries) ([]TimeSeries, common.Error) {
+	if len(series) == 0 {
+		return nil, &common.BadRequestError{S: "no time series given"}
+	}
+	batch := make(map[string]*TimeSeries, len(series))
+	for i, ts := range series {
+		err := validateCreation(ts)
+		if err != nil {
+			return nil, &common.BadRequestError{S: fmt.Sprintf("time series '%s': %s", ts.Name, err)}
+		}
+		batch[ts.Name] = &series[i]
+	}
+
+	// the sources must be created before their rollups and virtual series
+	ordered := make([]TimeSeries, 0, len(series))
+	var derived []TimeSeries
+	for _, ts := range series {
+		switch ts.Source.SrcType {
+		case Series:
+			srcErr := c.validateRollupSource(ts, batch)
+			if srcErr != nil {
+				return nil, srcErr
+			}
+			derived = append(derived, ts)
+		case Virtual:
+			srcErr := c.validateVirtualInputs(ts, batch)
+			if srcErr != nil {
+				return nil, srcErr
+			}
+			derived = append(derived, ts)
+		default:
+			ordered = append(ordered, ts)
+		}
+	}
+	ordered = append(ordered, derived...)
+
+	added, err := c.s.addMany(ordered)
+	if err != nil {
+		if errors.Is(err, ErrConflict) {
+			return nil, &common.ConflictError{S: err.Error()}
+		} else if errors.Is(err, ErrBadRequest) {
+			return nil, &common.BadRequestError{S: err.Error()}
+		} else {
+			return nil, &common.InternalError{S: "error storing time series registry: " + err.Error()}
+		}
+	}
+	return added, nil
+}
+
+// validateRollupSource checks the source of a rollup series, which is looked up in the batch first (if any) and then in the registry
+func (c Controller) validateRollupSource(ts TimeSeries, batch map[string]*TimeSeries) common.Error {
+	src, found := batch[ts.Source.Series]
+	if !found {
+		var err error
+		src, err = c.s.get(ts.Source.Series)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return &common.BadRequestError{S: fmt.Sprintf("source series '%s' is not registered", ts.Source.Series)}
+			}
+			return &common.InternalError{S: fmt.Sprintf("error retrieving source series '%s': %s", ts.Source.Series, err)}
+		}
+	}
+	if src.Type != Float {
+		return &common.BadRequestError{S: fmt.Sprintf("source series '%s' is not of float type", src.Name)}
+	}
+	if src.Source.SrcType == Series {
+		return &common.BadRequestError{S: fmt.Sprintf("source series '%s' is itself a rollup series", src.Name)}
+	}
+	if src.Source.SrcType == Virtual {
+		return &common.BadRequestError{S: fmt.Sprintf("source series '%s' is a virtual series", src.Name)}
+	}
+	return nil
+}
+
+// validateVirtualInputs checks the inputs of a virtual series, which are looked up in the batch first (if any) and then in the registry.
+// Inputs are stored float series, i.e. not virtual ones.
+func (c Controller) validateVirtualInputs(ts TimeSeries, batch map[string]*TimeSeries) common.Error {
+	for _, name := range ts.Source.Inputs {
+		input, found := batch[name]
+		if !found {
+			var err error
+			input, err = c.s.get(name)
+			if err != nil {
+				if errors.Is(err, ErrNotFound) {
+					return &common.BadRequestError{S: fmt.Sprintf("input series '%s' is not registered", name)}
+				}
+				return &common.InternalError{S: fmt.Sprintf("error retrieving input series '%s': %s", name, err)}
+			}
+		}
+		if input.Type != Float {
+			return &common.BadRequestError{S: fmt.Sprintf("input series '%s' is not of float type", input.Name)}
+		}
+		if input.Source.SrcType == Virtual {
+			return &common.BadRequestError{S: fmt.Sprintf("input series '%s' is itself a virtual series", input.Name)}
+		}
+	}
+	return nil
+}
 func (c Controller) Get(name string) (*TimeSeries, common.Error) {
 	ts, err := c.s.get(name)
 	if err != nil {
@@ -80,6 +194,21 @@ func (c Controller) Filter(path, op, value string, page, perPage int) ([]TimeSer
 	return ts, count, nil
 }
 
+// Search returns a page of the time series matching the query, together with the total number of matches
+func (c Controller) Search(q SearchQuery, page, perPage int) ([]TimeSeries, int, common.Error) {
+	series, err := c.s.search(q.Filter)
+	if err != nil {
+		return nil, 0, &common.InternalError{S: "Error processing the search request:" + err.Error()}
+	}
+	sortSeries(series, q.Sort)
+
+	offset, limit, err := utils.GetPagingAttr(len(series), page, perPage, MaxPerPage)
+	if err != nil {
+		return nil, 0, &common.BadRequestError{S: err.Error()}
+	}
+	return series[offset : offset+limit], len(series), nil
+}
+
 func (c Controller) Update(name string, ts TimeSeries) (*TimeSeries, common.Error) {
 	t, err := c.s.update(name, ts)
 	if err != nil {
@@ -94,7 +223,21 @@ func (c Controller) Update(name string, ts TimeSeries) (*TimeSeries, common.Erro
 	return t, nil
 }
 func (c Controller) Delete(name string) common.Error {
-	err := c.s.delete(name)
+	rollup, err := c.s.filterOne("source.series", utils.FOpEquals, name)
+	if err != nil {
+		return &common.InternalError{S: fmt.Sprintf("error deleting series '%s' from registry: %s", name, err.Error())}
+	}
+	if rollup != nil {
+		return &common.ConflictError{S: fmt.Sprintf("error deleting series '%s' from registry: it is the source of the rollup series '%s'", name, rollup.Name)}
+	}
+	virtual, err := c.s.search(inputOf(name))
+	if err != nil {
+		return &common.InternalError{S: fmt.Sprintf("error deleting series '%s' from registry: %s", name, err.Error())}
+	}
+	if len(virtual) != 0 {
+		return &common.ConflictError{S: fmt.Sprintf("error deleting series '%s' from registry: it is an input of the virtual series '%s'", name, virtual[0].Name)}
+	}
+	err = c.s.delete(name)
 	if err != nil {
 		if errors.Is(err, ErrNotFound) {
 			return &common.NotFoundError{S: fmt.Sprintf("error deleting series '%s' from registry: %s", name, err.Error())}
@@ -104,3 +247,18 @@ func (c Controller) Delete(name string) common.Error {
 	}
 	return nil
 }
+
+// inputOf matches the virtual series which have the given series as input
+type inputOf string
+
+func (p inputOf) match(ts *TimeSeries) bool {
+	if ts.Source.SrcType != Virtual || ts.Source.VirtualSource == nil {
+		return false
+	}
+	for _, input := range ts.Source.Inputs {
+		if input == string(p) {
+			return true
+		}
+	}
+	return false
+}
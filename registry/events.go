@@ -1,41 +1,135 @@
 package registry
 
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
 // EventListener is implemented by storage modules and connectors which need to react to changes in the registry
+//
+// Registry changes are applied in two phases. First, each handler prepares its part of the change and returns a Transaction.
+// Once all listeners have prepared and the registry has stored the change, the transactions are committed.
+// If a listener or the registry fails, the transactions prepared so far are compensated in reverse order.
+// A handler which returns an error must not leave any partial change behind. A nil Transaction has nothing to commit or compensate.
 type EventListener interface {
-	CreateHandler(new TimeSeries) error
-	UpdateHandler(old TimeSeries, new TimeSeries) error
-	DeleteHandler(old TimeSeries) error
+	CreateHandler(new TimeSeries) (Transaction, error)
+	UpdateHandler(old TimeSeries, new TimeSeries) (Transaction, error)
+	DeleteHandler(old TimeSeries) (Transaction, error)
 }
 
-// eventHandler implements sequential fav-out/fan-in of events from registry
-type eventHandler []EventListener
+// Transaction is a change prepared by an EventListener
+type Transaction interface {
+	// Commit finalizes the change. It is called after the registry has been modified and cannot undo the modification,
+	// so irreversible steps (e.g. dropping data) should be done here and errors are only logged.
+	Commit() error
+	// Compensate undoes the prepared change
+	Compensate() error
+}
 
-func (h eventHandler) created(new *TimeSeries) error {
-	for i := range h {
-		err := h[i].CreateHandler(*new)
-		if err != nil {
-			return err
+// TransactionFuncs implements a Transaction with functions, either of which may be nil
+type TransactionFuncs struct {
+	OnCommit     func() error
+	OnCompensate func() error
+}
+
+func (t TransactionFuncs) Commit() error {
+	if t.OnCommit == nil {
+		return nil
+	}
+	return t.OnCommit()
+}
+
+func (t TransactionFuncs) Compensate() error {
+	if t.OnCompensate == nil {
+		return nil
+	}
+	return t.OnCompensate()
+}
+
+// transactions are the prepared changes of a registry modification
+type transactions []Transaction
+
+// commit commits all transactions, logging the errors
+func (txs transactions) commit() {
+	for _, tx := range txs {
+		if tx == nil {
+			continue
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("registry: error committing the change of a listener: %s", err)
 		}
 	}
+}
+
+// compensate compensates all transactions in reverse order
+func (txs transactions) compensate() error {
+	var errs []string
+	for i := len(txs) - 1; i >= 0; i-- {
+		if txs[i] == nil {
+			continue
+		}
+		if err := txs[i].Compensate(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("error compensating the prepared changes: %s", strings.Join(errs, "; "))
+	}
 	return nil
 }
 
-func (h eventHandler) updated(old *TimeSeries, new *TimeSeries) error {
+// undo compensates the transactions after the failure of a registry modification and returns the failure
+func (txs transactions) undo(err error) error {
+	if compErr := txs.compensate(); compErr != nil {
+		return fmt.Errorf("%w, followed by %s", err, compErr)
+	}
+	return err
+}
+
+// eventHandler implements sequential fav-out/fan-in of events from registry
+type eventHandler []EventListener
+
+// prepare calls the handler of each listener. If one fails, the already prepared transactions are compensated
+func (h eventHandler) prepare(handle func(l EventListener) (Transaction, error)) (transactions, error) {
+	txs := make(transactions, 0, len(h))
 	for i := range h {
-		err := h[i].UpdateHandler(*old, *new)
+		tx, err := handle(h[i])
 		if err != nil {
-			return err
+			return nil, txs.undo(err)
 		}
+		txs = append(txs, tx)
 	}
-	return nil
+	return txs, nil
 }
 
-func (h eventHandler) deleted(old *TimeSeries) error {
-	for i := range h {
-		err := h[i].DeleteHandler(*old)
+func (h eventHandler) created(new *TimeSeries) (transactions, error) {
+	return h.prepare(func(l EventListener) (Transaction, error) {
+		return l.CreateHandler(*new)
+	})
+}
+
+// createdMany prepares the creation of multiple time series, in order
+func (h eventHandler) createdMany(series []TimeSeries) (transactions, error) {
+	var txs transactions
+	for i := range series {
+		prepared, err := h.created(&series[i])
 		if err != nil {
-			return err
+			return nil, txs.undo(err)
 		}
+		txs = append(txs, prepared...)
 	}
-	return nil
+	return txs, nil
+}
+
+func (h eventHandler) updated(old *TimeSeries, new *TimeSeries) (transactions, error) {
+	return h.prepare(func(l EventListener) (Transaction, error) {
+		return l.UpdateHandler(*old, *new)
+	})
+}
+
+func (h eventHandler) deleted(old *TimeSeries) (transactions, error) {
+	return h.prepare(func(l EventListener) (Transaction, error) {
+		return l.DeleteHandler(*old)
+	})
 }
@@ -0,0 +1,249 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Kinds of the nodes of an expression
+const (
+	ExprNumber   = "number"
+	ExprVariable = "variable"
+	// ExprOperator applies the operator in Name to one (-, !) or two arguments
+	// (+, -, *, /, <, <=, >, >=, ==, !=, &&, ||)
+	ExprOperator = "operator"
+	// ExprFunction calls the function in Name, see ExprFunctions
+	ExprFunction = "function"
+)
+
+// ExprFunctions are the functions of expressions with their number of arguments. Min and max take two or more (-1).
+// if(condition, then, else) returns then if the condition is not zero.
+var ExprFunctions = map[string]int{
+	"abs": 1, "sqrt": 1, "exp": 1, "ln": 1, "log10": 1, "floor": 1, "ceil": 1, "round": 1,
+	"pow": 2, "min": -1, "max": -1, "if": 3,
+}
+
+var exprVariableRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Expr is a node of an arithmetic expression over the inputs of a virtual series.
+// Comparisons and logical operators result in 1 (true) or 0 (false), and any value other than 0 is true.
+type Expr struct {
+	Kind   string
+	Number float64
+	// Name of the variable, the operator or the function
+	Name string
+	Args []*Expr
+}
+
+// ValidExprVariable checks if a name can be used as variable of an expression
+func ValidExprVariable(name string) bool {
+	return exprVariableRegexp.MatchString(name) && ExprFunctions[name] == 0
+}
+
+// ParseExpression parses an arithmetic expression, e.g. voltage * current or if(t > 0, t, 0)
+func ParseExpression(s string) (*Expr, error) {
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+	p := exprParser{tokens: tokens}
+	e, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s in expression", p.tokens[p.pos])
+	}
+	return e, nil
+}
+
+// Variables returns the names of the variables used in an expression
+func (e *Expr) Variables() map[string]bool {
+	vars := make(map[string]bool)
+	var walk func(e *Expr)
+	walk = func(e *Expr) {
+		if e.Kind == ExprVariable {
+			vars[e.Name] = true
+		}
+		for _, arg := range e.Args {
+			walk(arg)
+		}
+	}
+	walk(e)
+	return vars
+}
+
+// binary operators by precedence, from the lowest
+var exprPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+// exprOperators are the operator tokens, longer ones first
+var exprOperators = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "!", "(", ")", ","}
+
+func tokenizeExpr(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		c := rune(s[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(s) && (unicode.IsDigit(rune(s[j])) || s[j] == '.' ||
+				((s[j] == 'e' || s[j] == 'E') && j+1 < len(s)) ||
+				((s[j] == '+' || s[j] == '-') && (s[j-1] == 'e' || s[j-1] == 'E'))) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(s) && (unicode.IsLetter(rune(s[j])) || unicode.IsDigit(rune(s[j])) || s[j] == '_') {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			found := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(s[i:], op) {
+					tokens = append(tokens, op)
+					i += len(op)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("invalid character %q in expression", c)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+type exprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *exprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *exprParser) expect(token string) error {
+	if p.peek() != token {
+		if p.pos == len(p.tokens) {
+			return fmt.Errorf("expected %s at the end of the expression", token)
+		}
+		return fmt.Errorf("expected %s instead of %s in expression", token, p.peek())
+	}
+	p.pos++
+	return nil
+}
+
+// parseBinary parses the operators of the given precedence and higher ones
+func (p *exprParser) parseBinary(level int) (*Expr, error) {
+	if level == len(exprPrecedence) {
+		return p.parseUnary()
+	}
+	left, err := p.parseBinary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if !stringIn(op, exprPrecedence[level]) {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseBinary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &Expr{Kind: ExprOperator, Name: op, Args: []*Expr{left, right}}
+	}
+}
+
+func (p *exprParser) parseUnary() (*Expr, error) {
+	if op := p.peek(); op == "-" || op == "!" {
+		p.pos++
+		arg, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{Kind: ExprOperator, Name: op, Args: []*Expr{arg}}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (*Expr, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	switch {
+	case token == "(":
+		e, err := p.parseBinary(0)
+		if err != nil {
+			return nil, err
+		}
+		return e, p.expect(")")
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		n, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s in expression", token)
+		}
+		return &Expr{Kind: ExprNumber, Number: n}, nil
+	case exprVariableRegexp.MatchString(token):
+		if p.peek() != "(" {
+			return &Expr{Kind: ExprVariable, Name: token}, nil
+		}
+		arity, found := ExprFunctions[token]
+		if !found {
+			return nil, fmt.Errorf("unknown function %s in expression", token)
+		}
+		p.pos++
+		e := &Expr{Kind: ExprFunction, Name: token}
+		for p.peek() != ")" {
+			if len(e.Args) != 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseBinary(0)
+			if err != nil {
+				return nil, err
+			}
+			e.Args = append(e.Args, arg)
+		}
+		p.pos++
+		if (arity == -1 && len(e.Args) < 2) || (arity != -1 && len(e.Args) != arity) {
+			return nil, fmt.Errorf("wrong number of arguments of %s in expression: %d", token, len(e.Args))
+		}
+		return e, nil
+	}
+	return nil, fmt.Errorf("unexpected %s in expression", token)
+}
+
+func stringIn(s string, list []string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseExpression(t *testing.T) {
+	valid := map[string][]string{
+		`v * i`:                          {"i", "v"},
+		`c * 9 / 5 + 32`:                 {"c"},
+		`-(a - b) * 1.5e-3`:              {"a", "b"},
+		`if(t > 0 && !off, t, 0)`:        {"off", "t"},
+		`max(a, b, 2) - min(a, b)`:       {"a", "b"},
+		`sqrt(pow(x, 2) + pow(y_2, 2))`:  {"x", "y_2"},
+		`round(log10(p) * 10) != 3 || q`: {"p", "q"},
+	}
+	for s, vars := range valid {
+		e, err := ParseExpression(s)
+		if err != nil {
+			t.Errorf("Received unexpected error parsing %s: %v", s, err)
+			continue
+		}
+		got := make(map[string]bool)
+		for _, v := range vars {
+			got[v] = true
+		}
+		if !reflect.DeepEqual(e.Variables(), got) {
+			t.Errorf("Expected variables %v of %s, got %v", vars, s, e.Variables())
+		}
+	}
+
+	invalid := []string{
+		``,
+		`a +`,
+		`(a`,
+		`a)`,
+		`a b`,
+		`a = b`,
+		`a % b`,
+		`foo(a)`,
+		`pow(a)`,
+		`max(a)`,
+		`if(a, b)`,
+		`1.2.3`,
+		`abs(a,)`,
+	}
+	for _, s := range invalid {
+		if _, err := ParseExpression(s); err == nil {
+			t.Errorf("Expected an error parsing %s", s)
+		}
+	}
+}
+
+func TestParseExpression_Precedence(t *testing.T) {
+	e, err := ParseExpression(`a + b * -c < d || e`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := func(name string) *Expr { return &Expr{Kind: ExprVariable, Name: name} }
+	op := func(name string, args ...*Expr) *Expr { return &Expr{Kind: ExprOperator, Name: name, Args: args} }
+	expected := op("||", op("<", op("+", v("a"), op("*", v("b"), op("-", v("c")))), v("d")), v("e"))
+	if !reflect.DeepEqual(e, expected) {
+		t.Errorf("Unexpected parse tree of a + b * -c < d || e")
+	}
+}
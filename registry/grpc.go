@@ -61,9 +61,10 @@ func protobufStructToMap(s *structpb.Struct) (map[string]interface{}, error) {
 
 func marshalSeries(t TimeSeries) (pbgo.Series, error) {
 	s := pbgo.Series{
-		Name: t.Name,
-		Type: pbgo.Series_ValueType(t.Type),
-		Unit: t.Unit,
+		Name:      t.Name,
+		Type:      pbgo.Series_ValueType(t.Type),
+		Unit:      t.Unit,
+		Retention: t.Retention,
 	}
 
 	if t.Meta != nil {
@@ -78,9 +79,10 @@ func marshalSeries(t TimeSeries) (pbgo.Series, error) {
 }
 func UnmarshalSeries(s pbgo.Series) (TimeSeries, error) {
 	ts := TimeSeries{
-		Name: s.Name,
-		Type: ValueType(s.Type),
-		Unit: s.Unit,
+		Name:      s.Name,
+		Type:      ValueType(s.Type),
+		Unit:      s.Unit,
+		Retention: s.Retention,
 	}
 	if s.Meta != nil {
 		var err error
@@ -127,6 +129,18 @@ func (a GrpcAPI) Add(ctx context.Context, series *pbgo.Series) (*pbgo.Void, erro
 	return &pbgo.Void{}, nil
 }
 
+func (a GrpcAPI) AddMany(ctx context.Context, seriesList *pbgo.SeriesList) (*pbgo.Void, error) {
+	ts, err := unmarshalSeriesList(seriesList.Series)
+	if err != nil {
+		return &pbgo.Void{}, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	_, addErr := a.c.AddMany(ts)
+	if addErr != nil {
+		return &pbgo.Void{}, status.Errorf(addErr.GrpcStatus(), addErr.Error())
+	}
+	return &pbgo.Void{}, nil
+}
+
 func (a GrpcAPI) GetAll(ctx context.Context, req *pbgo.PageParams) (*pbgo.Registrations, error) {
 	page := int(req.Page)
 	perPage := int(req.PerPage)
@@ -204,6 +218,46 @@ func (a GrpcAPI) Filter(ctx context.Context, req *pbgo.FilterManyRequest) (*pbgo
 	return reg, nil
 }
 
+func (a GrpcAPI) Search(ctx context.Context, req *pbgo.SearchRequest) (*pbgo.Registrations, error) {
+	page, perPage := 1, MaxPerPage
+	if req.PageParams != nil {
+		page = int(req.PageParams.Page)
+		perPage = int(req.PageParams.PerPage)
+	}
+	err := common.ValidatePagingParams(page, perPage, MaxPerPage)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	query, err := ParseSearchQuery(req.Query, req.Sort)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Error parsing the search query: %v", err)
+	}
+	err = ValidateFields(req.Fields)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+
+	ts, total, searchErr := a.c.Search(query, page, perPage)
+	if searchErr != nil {
+		return nil, status.Errorf(searchErr.GrpcStatus(), searchErr.Error())
+	}
+	if len(req.Fields) != 0 {
+		for i := range ts {
+			ts[i] = project(ts[i], req.Fields)
+		}
+	}
+	reg := &pbgo.Registrations{
+		PerPage: int32(perPage),
+		Page:    int32(page),
+		Total:   int32(total),
+	}
+	reg.SeriesList, err = marshalSeriesList(ts)
+	if err != nil {
+		return nil, status.Errorf(codes.Unknown, "Error marshalling the time series registrations: %v", err)
+	}
+	return reg, nil
+}
+
 func (a GrpcAPI) Update(ctx context.Context, series *pbgo.Series) (*pbgo.Void, error) {
 	if a.restricted {
 		return &pbgo.Void{}, status.Errorf(codes.PermissionDenied, "registry: update is not allowed using gRPC")
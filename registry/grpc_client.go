@@ -37,6 +37,17 @@ func (c GrpcClient) Add(ts TimeSeries) error {
 	}
 	return nil
 }
+func (c GrpcClient) AddMany(series []TimeSeries) error {
+	s, err := marshalSeriesList(series)
+	if err != nil {
+		return err
+	}
+	_, err = c.Client.AddMany(context.Background(), &_go.SeriesList{Series: s})
+	if err != nil {
+		return err
+	}
+	return nil
+}
 func (c GrpcClient) Update(ts TimeSeries) error {
 	s, err := marshalSeries(ts)
 	if err != nil {
@@ -117,3 +128,27 @@ func (c GrpcClient) Filter(path, op, value string, page, perPage int) ([]TimeSer
 
 	return ts, int(registrations.Total), nil
 }
+
+// Search returns a page of the time series matching the search expression.
+// The results are ordered by the sort fields and only include the given fields, or all fields if none are given.
+func (c GrpcClient) Search(query string, sort, fields []string, page, perPage int) ([]TimeSeries, int, error) {
+	searchRequest := _go.SearchRequest{
+		Query:  query,
+		Sort:   sort,
+		Fields: fields,
+		PageParams: &_go.PageParams{
+			Page:    int32(page),
+			PerPage: int32(perPage),
+		},
+	}
+	registrations, err := c.Client.Search(context.Background(), &searchRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ts, err := unmarshalSeriesList(registrations.SeriesList)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ts, int(registrations.Total), nil
+}
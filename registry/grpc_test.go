@@ -83,6 +83,40 @@ func TestGrpcAPI_Add(t *testing.T) {
 	}
 }
 
+func TestGrpcAPI_AddMany(t *testing.T) {
+	storage, dbName, closeDB, err := setupLevelDB()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clean(dbName)
+	defer closeDB()
+	controller := *NewController(storage)
+	client := setupGrpcAPI(t, controller)
+
+	series := []TimeSeries{
+		{Name: "batch/a", Type: Float, Unit: "Cel"},
+		{Name: "batch/b", Type: String},
+	}
+	err = client.AddMany(series)
+	if err != nil {
+		t.Fatalf("Received unexpected error on addMany: %v", err.Error())
+	}
+	for _, ts := range series {
+		if _, err := client.Get(ts.Name); err != nil {
+			t.Fatalf("Received unexpected error on get: %v", err.Error())
+		}
+	}
+
+	// all or nothing
+	err = client.AddMany([]TimeSeries{{Name: "batch/c", Type: Float}, {Name: "batch/a", Type: Float}})
+	if err == nil {
+		t.Fatal("Expected a conflict")
+	}
+	if _, err := client.Get("batch/c"); err == nil {
+		t.Fatal("Expected batch/c not to be added")
+	}
+}
+
 func TestGrpcAPI_Get(t *testing.T) {
 	t.Skip("Tested in TestLevelDBAdd")
 }
@@ -308,3 +342,38 @@ func TestGrpcAPI_Filter(t *testing.T) {
 		t.Fatalf("Returned %d matches instead of %d", total, expected)
 	}
 }
+
+func TestGrpcAPI_Search(t *testing.T) {
+	storage, dbName, closeDB, err := setupLevelDB()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clean(dbName)
+	defer closeDB()
+	controller := *NewController(storage)
+	client := setupGrpcAPI(t, controller)
+
+	err = client.AddMany(searchTestSeries)
+	if err != nil {
+		t.Fatalf("Received unexpected error on addMany: %v", err)
+	}
+
+	series, total, err := client.Search(`meta.building = B1 or unit = K`, []string{"-name"}, []string{"name", "unit"}, 1, 2)
+	if err != nil {
+		t.Fatalf("Received unexpected error on search: %v", err)
+	}
+	if total != 4 || len(series) != 2 {
+		t.Fatalf("Expected 2 out of 4 time series, got %d out of %d", len(series), total)
+	}
+	if series[0].Name != "b2/room1/temp" || series[0].Unit != "K" || series[0].Meta != nil {
+		t.Fatalf("Unexpected first result: %+v", series[0])
+	}
+	if series[1].Name != "b1/room2/temp" {
+		t.Fatalf("Unexpected second result: %+v", series[1])
+	}
+
+	_, _, err = client.Search(`meta.building =`, nil, nil, 1, 10)
+	if err == nil {
+		t.Fatal("Expected an error for an invalid query")
+	}
+}
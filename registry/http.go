@@ -30,7 +30,8 @@ var (
 
 // RESTful HTTP API
 type API struct {
-	c Controller
+	c             Controller
+	exportSecrets bool
 }
 
 // Returns the configured TimeSeriesList API
@@ -40,6 +41,11 @@ func NewAPI(c Controller) *API {
 	}
 }
 
+// ExportSecrets sets whether the export includes the sensitive information of the sources, which is removed otherwise
+func (api *API) ExportSecrets(enabled bool) {
+	api.exportSecrets = enabled
+}
+
 // Handlers ///////////////////////////////////////////////////////////////////////
 
 // Index is a handler for the registry index
@@ -126,6 +132,81 @@ func (api *API) Create(w http.ResponseWriter, r *http.Request) {
 	return
 }
 
+// CreateMany is a handler for creating multiple time series at once. Either all or none of them are created.
+func (api *API) CreateMany(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		common.HttpErrorResponse(&common.BadRequestError{S: err.Error()}, w)
+		return
+	}
+
+	var series []TimeSeries
+	err = json.Unmarshal(body, &series)
+	if err != nil {
+		common.HttpErrorResponse(&common.BadRequestError{S: "Error processing input: " + err.Error()}, w)
+		return
+	}
+
+	added, addErr := api.c.AddMany(series)
+	if addErr != nil {
+		common.HttpErrorResponse(addErr, w)
+		return
+	}
+
+	registry := TimeSeriesList{
+		Series:  added,
+		Page:    1,
+		PerPage: len(added),
+		Total:   len(added),
+	}
+	registry.DataLink = dataLinkFromRegistryList(registry.Series)
+
+	b, _ := json.Marshal(&registry)
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.WriteHeader(http.StatusCreated)
+	w.Write(b)
+}
+
+// Export is a handler for exporting the whole registry. The sensitive information is included only if enabled by
+// ExportSecrets. The response is a JSON array of time series which can be imported using CreateMany.
+func (api *API) Export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	separator := "["
+	for page := 1; ; page++ {
+		series, total, err := api.c.GetMany(page, MaxPerPage)
+		if err != nil {
+			if page == 1 {
+				common.HttpErrorResponse(err, w)
+			} else {
+				// the response is incomplete JSON
+				log.Printf("Error exporting the registry: %s", err)
+			}
+			return
+		}
+		for _, ts := range series {
+			if !api.exportSecrets {
+				ts = ts.withoutSensitiveInfo()
+			}
+			b, err := ts.MarshalSensitiveJSON()
+			if err != nil {
+				log.Printf("Error exporting the registry: %s", err)
+				return
+			}
+			w.Write([]byte(separator))
+			w.Write(b)
+			separator = ","
+		}
+		if page*MaxPerPage >= total {
+			break
+		}
+	}
+	if separator == "[" { // empty registry
+		w.Write([]byte(separator))
+	}
+	w.Write([]byte("]"))
+}
+
 // Retrieve is a handler for retrieving a new DataSource
 // Expected parameters: id
 func (api *API) Retrieve(w http.ResponseWriter, r *http.Request) {
@@ -270,6 +351,84 @@ func (api *API) Filter(w http.ResponseWriter, r *http.Request) {
 	w.Write(body)
 }
 
+// Search is a handler for searching time series
+// Expected parameters: q (search expression), sort, fields, page, perPage
+func (api *API) Search(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	page, perPage, err := common.ParsePagingParams(r.Form.Get(common.ParamPage), r.Form.Get(common.ParamPerPage), MaxPerPage)
+	if err != nil {
+		common.HttpErrorResponse(&common.BadRequestError{S: "Error parsing pagination parameters:" + err.Error()}, w)
+		return
+	}
+
+	query, err := ParseSearchQuery(r.Form.Get("q"), splitParam(r.Form.Get("sort")))
+	if err != nil {
+		common.HttpErrorResponse(&common.BadRequestError{S: "Error parsing the search query: " + err.Error()}, w)
+		return
+	}
+	fields := splitParam(r.Form.Get("fields"))
+	err = ValidateFields(fields)
+	if err != nil {
+		common.HttpErrorResponse(&common.BadRequestError{S: err.Error()}, w)
+		return
+	}
+
+	timeSeries, total, searchErr := api.c.Search(query, page, perPage)
+	if searchErr != nil {
+		common.HttpErrorResponse(searchErr, w)
+		return
+	}
+
+	registry := TimeSeriesList{
+		Series:  timeSeries,
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	}
+	registry.DataLink = dataLinkFromRegistryList(registry.Series)
+
+	var body []byte
+	if len(fields) == 0 {
+		body, err = json.Marshal(&registry)
+	} else {
+		// same as the registry list, with only the requested fields of each time series
+		projected := struct {
+			TimeSeriesList
+			Series []map[string]interface{} `json:"streams"`
+		}{
+			TimeSeriesList: registry,
+			Series:         make([]map[string]interface{}, len(timeSeries)),
+		}
+		for i := range timeSeries {
+			projected.Series[i], err = projectJSON(timeSeries[i], fields)
+			if err != nil {
+				common.HttpErrorResponse(&common.InternalError{S: "Error projecting the search results: " + err.Error()}, w)
+				return
+			}
+		}
+		body, err = json.Marshal(&projected)
+	}
+	if err != nil {
+		common.HttpErrorResponse(&common.InternalError{S: "Error serializing the search results: " + err.Error()}, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", common.DefaultMIMEType)
+	w.Write(body)
+}
+
+// splitParam splits a comma-separated query parameter
+func splitParam(param string) []string {
+	if param == "" {
+		return nil
+	}
+	values := strings.Split(param, ",")
+	for i := range values {
+		values[i] = strings.TrimSpace(values[i])
+	}
+	return values
+}
+
 func dataLinkFromRegistryList(seriesList []TimeSeries) string {
 	var linkBuilder strings.Builder
 	separator := common.DataAPILoc + "/"
@@ -11,6 +11,8 @@ import (
 	"math"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -22,6 +24,9 @@ func setupRouter(regAPI *API) *mux.Router {
 	r := mux.NewRouter().StrictSlash(true).SkipClean(true)
 	r.Methods("GET").Path("/registry").HandlerFunc(regAPI.Index)
 	r.Methods("POST").Path("/registry").HandlerFunc(regAPI.Create)
+	r.Methods("POST").Path("/registry/batch").HandlerFunc(regAPI.CreateMany)
+	r.Methods("GET").Path("/registry/export").HandlerFunc(regAPI.Export)
+	r.Methods("GET").Path("/registry/search").HandlerFunc(regAPI.Search)
 	r.Methods("GET").Path("/registry/{type}/{path}/{op}/{value:.*}").HandlerFunc(regAPI.Filter)
 	r.Methods("GET").Path("/registry/{id:.+}").HandlerFunc(regAPI.Retrieve)
 	r.Methods("PUT").Path("/registry/{id:.+}").HandlerFunc(regAPI.UpdateOrCreate)
@@ -463,6 +468,137 @@ func TestHttpFilter(t *testing.T) {
 	}
 }
 
+func TestHttpCreateMany(t *testing.T) {
+	regAPI, controller := setupAPI()
+	ts := httptest.NewServer(setupRouter(regAPI))
+	defer ts.Close()
+
+	post := func(body string) *http.Response {
+		res, err := http.Post(ts.URL+common.RegistryAPILoc+"/batch", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		res.Body.Close()
+		return res
+	}
+	assertTotal := func(expected int) {
+		_, total, err := controller.GetMany(1, MaxPerPage)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if total != expected {
+			t.Fatalf("Expected %d time series in the registry, got %d", expected, total)
+		}
+	}
+
+	// a rollup may come before its source in the batch
+	res := post(`[
+		{"name": "site/temp/hourly", "dataType": "float", "source": {"type": "Series", "series": "site/temp", "aggregate": "mean", "interval": "1h"}},
+		{"name": "site/temp", "dataType": "float", "unit": "Cel"},
+		{"name": "site/state", "dataType": "string"}
+	]`)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusCreated)
+	}
+	assertTotal(3)
+
+	// one invalid entry fails the whole batch
+	res = post(`[{"name": "site/other", "dataType": "float"}, {"name": "", "dataType": "float"}]`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusBadRequest)
+	}
+	assertTotal(3)
+
+	// one existing entry fails the whole batch
+	res = post(`[{"name": "site/other", "dataType": "float"}, {"name": "site/temp", "dataType": "float"}]`)
+	if res.StatusCode != http.StatusConflict {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusConflict)
+	}
+	assertTotal(3)
+
+	res = post(`[]`)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestHttpExport(t *testing.T) {
+	regAPI, controller := setupAPI()
+	ts := httptest.NewServer(setupRouter(regAPI))
+	defer ts.Close()
+
+	_, err := generateDummyData(5, controller)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	mqttTS := TimeSeries{Name: "site/mqtt", Type: Float}
+	mqttTS.Source.SrcType = Mqtt
+	mqttTS.Source.MQTTSource = &MQTTSource{BrokerURL: "tcp://localhost:1883", Topic: "site/mqtt", Password: "secret"}
+	_, addErr := controller.Add(mqttTS)
+	if addErr != nil {
+		t.Fatalf(addErr.Error())
+	}
+
+	res, err := http.Get(ts.URL + common.RegistryAPILoc + "/export")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	b, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusOK)
+	}
+	var exported []TimeSeries
+	err = json.Unmarshal(b, &exported)
+	if err != nil {
+		t.Fatalf("Error parsing the export: %s", err)
+	}
+	if len(exported) != 6 {
+		t.Fatalf("Expected 6 exported time series, got %d", len(exported))
+	}
+	if strings.Contains(string(b), "password") {
+		t.Fatalf("Expected the export not to include the credentials:\n%s", b)
+	}
+
+	// the credentials are exported only if enabled
+	regAPI.ExportSecrets(true)
+	res, err = http.Get(ts.URL + common.RegistryAPILoc + "/export")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	b, err = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !strings.Contains(string(b), `"password":"secret"`) {
+		t.Fatalf("Expected the export to include the credentials:\n%s", b)
+	}
+
+	// the export can be imported into another registry
+	cloneAPI, cloneController := setupAPI()
+	clone := httptest.NewServer(setupRouter(cloneAPI))
+	defer clone.Close()
+	res, err = http.Post(clone.URL+common.RegistryAPILoc+"/batch", "application/json", bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("Server response is %v instead of %v", res.StatusCode, http.StatusCreated)
+	}
+	cloned, err := cloneController.Get(mqttTS.Name)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if cloned.Source.Password != "secret" {
+		t.Fatalf("Expected the credentials to be cloned, got %+v", cloned.Source.MQTTSource)
+	}
+}
+
 // A pool of bad time series
 var (
 	invalidBodies = []string{
@@ -499,6 +635,52 @@ var (
 			"name": "any_url",
 			"dataType": "some_unsupported_type"
 		}`,
+		// Name reserved for the latest values //////////
+		`{
+			"name": "kitchen/latest",
+			"dataType": "float"
+		}`,
+		// Name reserved for the streams //////////
+		`{
+			"name": "kitchen/stream",
+			"dataType": "float"
+		}`,
+		// Invalid retention //////////
+		`{
+			"name": "any_url",
+			"dataType": "float",
+			"retention": "1y"
+		}`,
+		// Invalid rollup source //////////
+		`{
+			"name": "any_url",
+			"dataType": "float",
+			"source": {"type": "Series", "series": "other_url", "aggregate": "unknown", "interval": "1h"}
+		}`,
+		// Rollup of a non-existing series //////////
+		`{
+			"name": "any_url",
+			"dataType": "float",
+			"source": {"type": "Series", "series": "other_url", "aggregate": "mean", "interval": "1h"}
+		}`,
+		// Unsupported MQTT payload format //////////
+		`{
+			"name": "any_url",
+			"dataType": "float",
+			"source": {"type": "MQTT", "url": "tcp://localhost:1883", "topic": "sensors", "format": "xml"}
+		}`,
+		// JSON payload format without template //////////
+		`{
+			"name": "any_url",
+			"dataType": "float",
+			"source": {"type": "MQTT", "url": "tcp://localhost:1883", "topic": "sensors", "format": "json"}
+		}`,
+		// Invalid selector of the template //////////
+		`{
+			"name": "any_url",
+			"dataType": "float",
+			"source": {"type": "MQTT", "url": "tcp://localhost:1883", "topic": "sensors", "format": "json", "template": {"value": "temp"}}
+		}`,
 	}
 
 	invalidPutBodies = []string{
@@ -512,3 +694,75 @@ var (
 		}`,
 	}
 )
+
+func TestHttpSearch(t *testing.T) {
+	regAPI, registryClient := setupAPI()
+	for _, ts := range searchTestSeries {
+		if _, err := registryClient.Add(ts); err != nil {
+			t.Fatalf("Received unexpected error on add: %v", err)
+		}
+	}
+
+	testServer := httptest.NewServer(setupRouter(regAPI))
+	defer testServer.Close()
+
+	search := func(params url.Values) (*http.Response, []byte) {
+		res, err := http.Get(testServer.URL + common.RegistryAPILoc + "/search?" + params.Encode())
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return res, b
+	}
+
+	// sorted and paged
+	res, b := search(url.Values{
+		"q":                 {`meta.building = B1 and dataType = float`},
+		"sort":              {"-meta.floor"},
+		common.ParamPerPage: {"1"},
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server response is %v instead of %v: %s", res.StatusCode, http.StatusOK, b)
+	}
+	var reg TimeSeriesList
+	err := json.Unmarshal(b, &reg)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if reg.Total != 2 || len(reg.Series) != 1 || reg.Series[0].Name != "b1/room2/temp" {
+		t.Fatalf("Unexpected search result: %s", b)
+	}
+
+	// projected
+	res, b = search(url.Values{
+		"q":      {`unit = K`},
+		"fields": {"name,meta.building"},
+	})
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("Server response is %v instead of %v: %s", res.StatusCode, http.StatusOK, b)
+	}
+	var projected struct {
+		Series []map[string]interface{} `json:"streams"`
+		Total  int                      `json:"total"`
+	}
+	err = json.Unmarshal(b, &projected)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	expected := []map[string]interface{}{{"name": "b2/room1/temp", "meta": map[string]interface{}{"building": "B2"}}}
+	if projected.Total != 1 || !reflect.DeepEqual(projected.Series, expected) {
+		t.Fatalf("Unexpected projected search result: %s", b)
+	}
+
+	// invalid query
+	for _, params := range []url.Values{{"q": {`unit = `}}, {"sort": {"foo"}}, {"fields": {"foo"}}} {
+		res, b = search(params)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Server response is %v instead of %v: %s", res.StatusCode, http.StatusBadRequest, b)
+		}
+	}
+}
@@ -24,6 +24,10 @@ type LevelDBStorage struct {
 	event        eventHandler
 	wg           sync.WaitGroup
 	lastModified time.Time
+	// meta fields with secondary indexes
+	indexed []string
+	// serializes the modifications, which are prepared by the listeners before being written
+	mutex sync.Mutex
 }
 
 func NewLevelDBStorage(conf common.RegConf, opts *opt.Options, listeners ...EventListener) (Storage, func() error, error) {
@@ -43,12 +47,19 @@ func NewLevelDBStorage(conf common.RegConf, opts *opt.Options, listeners ...Even
 		db:           db,
 		event:        listeners,
 		lastModified: time.Now(),
+		indexed:      indexedFields(conf.IndexedMeta),
+	}
+
+	err = s.buildIndex()
+	if err != nil {
+		db.Close()
+		return nil, nil, fmt.Errorf("error building the registry indexes: %s", err)
 	}
 
 	/*	// bootstrap
 		// Iterate over a latest snapshot of the database
 		s.wg.Add(1)
-		iter := s.db.NewIterator(nil, nil)
+		iter := s.db.NewIterator(seriesRange, nil)
 		for iter.Next() {
 			var ts TimeSeries
 			err = json.Unmarshal(iter.Value(), &ts)
@@ -76,6 +87,8 @@ func (s *LevelDBStorage) close() error {
 func (s *LevelDBStorage) add(ts TimeSeries) (*TimeSeries, error) {
 	s.wg.Add(1)
 	defer s.wg.Done()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	// Convert to json bytes
 	tsBytes, err := ts.MarshalSensitiveJSON()
 	if err != nil {
@@ -86,32 +99,70 @@ func (s *LevelDBStorage) add(ts TimeSeries) (*TimeSeries, error) {
 		return nil, fmt.Errorf("%w: Resource name not unique: %s", ErrConflict, ts.Name)
 	}
 
-	// Add the new DataSource to database
-	err = s.db.Put([]byte(ts.Name), tsBytes, nil)
+	// Prepare the create event
+	txs, err := s.event.created(&ts)
 	if err != nil {
 		return nil, err
 	}
 
-	// Send a create event
-	err = s.event.created(&ts)
-	//if create event fails, then undo creation of the event
+	// Add the new DataSource and its index entries to database
+	batch := new(leveldb.Batch)
+	batch.Put([]byte(ts.Name), tsBytes)
+	s.putIndex(batch, &ts)
+	err = s.db.Write(batch, nil)
 	if err != nil {
-		// Send a delete event
-		s.event.deleted(&ts)
-		deleteErr := s.db.Delete([]byte(ts.Name), nil)
-		if deleteErr != nil {
-			err = fmt.Errorf("%w, followed by error undoing the time series creation:%s", err, deleteErr)
+		return nil, txs.undo(err)
+	}
+
+	txs.commit()
+	s.lastModified = time.Now()
+	return &ts, nil
+}
+
+func (s *LevelDBStorage) addMany(series []TimeSeries) ([]TimeSeries, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	batch := new(leveldb.Batch)
+	names := make(map[string]bool, len(series))
+	for _, ts := range series {
+		// Convert to json bytes
+		tsBytes, err := ts.MarshalSensitiveJSON()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrBadRequest, err)
 		}
+		if has, _ := s.db.Has([]byte(ts.Name), nil); has || names[ts.Name] {
+			return nil, fmt.Errorf("%w: Resource name not unique: %s", ErrConflict, ts.Name)
+		}
+		names[ts.Name] = true
+		batch.Put([]byte(ts.Name), tsBytes)
+		s.putIndex(batch, &ts)
+	}
+
+	// Prepare the create events, the prepared ones are compensated if one fails
+	txs, err := s.event.createdMany(series)
+	if err != nil {
 		return nil, err
 	}
 
+	// Add all time series to database at once
+	err = s.db.Write(batch, nil)
+	if err != nil {
+		return nil, txs.undo(err)
+	}
+
+	txs.commit()
 	s.lastModified = time.Now()
-	return &ts, nil
+	return series, nil
 }
 
 func (s *LevelDBStorage) update(name string, ts TimeSeries) (*TimeSeries, error) {
 	s.wg.Add(1)
 	defer s.wg.Done()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	oldTS, err := s.get(name) // for comparison
 	if err == leveldb.ErrNotFound {
 		return nil, fmt.Errorf("%w: %s", ErrNotFound, err)
@@ -124,56 +175,66 @@ func (s *LevelDBStorage) update(name string, ts TimeSeries) (*TimeSeries, error)
 		return nil, fmt.Errorf("%w: %s", ErrConflict, err)
 	}
 
-	tempTS := oldTS
+	tempTS := *oldTS
 
 	// Modify writable elements
 	tempTS.Source = ts.Source
 	tempTS.Meta = ts.Meta
 	tempTS.Unit = ts.Unit
+	tempTS.Retention = ts.Retention
 
-	// Send an update event
-	err = s.event.updated(oldTS, tempTS)
+	// Convert to json bytes
+	tsBytes, err := tempTS.MarshalSensitiveJSON()
 	if err != nil {
 		return nil, err
 	}
 
-	// Convert to json bytes
-	tsBytes, err := tempTS.MarshalSensitiveJSON()
+	// Prepare the update event
+	txs, err := s.event.updated(oldTS, &tempTS)
 	if err != nil {
 		return nil, err
 	}
 
-	// Store the modified TS
-	err = s.db.Put([]byte(tempTS.Name), tsBytes, nil)
+	// Store the modified TS and replace its index entries
+	batch := new(leveldb.Batch)
+	s.deleteIndex(batch, oldTS)
+	batch.Put([]byte(tempTS.Name), tsBytes)
+	s.putIndex(batch, &tempTS)
+	err = s.db.Write(batch, nil)
 	if err != nil {
-		return nil, err
+		return nil, txs.undo(err)
 	}
 
+	txs.commit()
 	s.lastModified = time.Now()
-	return tempTS, nil
+	return &tempTS, nil
 }
 
 func (s *LevelDBStorage) delete(name string) error {
 	s.wg.Add(1)
 	defer s.wg.Done()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	ts, err := s.get(name) // for notification
 	if err != nil {
 		return err
 	}
 
-	// Send a delete event
-	err = s.event.deleted(ts)
+	// Prepare the delete event
+	txs, err := s.event.deleted(ts)
 	if err != nil {
 		return err
 	}
 
-	err = s.db.Delete([]byte(name), nil)
-	if err == leveldb.ErrNotFound {
-		return fmt.Errorf("%w: %s", ErrNotFound, err)
-	} else if err != nil {
-		return err
+	batch := new(leveldb.Batch)
+	batch.Delete([]byte(name))
+	s.deleteIndex(batch, ts)
+	err = s.db.Write(batch, nil)
+	if err != nil {
+		return txs.undo(err)
 	}
 
+	txs.commit()
 	s.lastModified = time.Now()
 	return nil
 }
@@ -206,7 +267,7 @@ func (s *LevelDBStorage) getMany(page, perPage int) ([]TimeSeries, int, error) {
 	// Extract keys from database
 	keys := make([]string, 0, total)
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(seriesRange, nil)
 	for iter.Next() {
 		keys = append(keys, string(iter.Key()))
 	}
@@ -231,8 +292,8 @@ func (s *LevelDBStorage) getMany(page, perPage int) ([]TimeSeries, int, error) {
 
 	timeSeries := make([]TimeSeries, 0, limit)
 
-	// a nil Range.Limit is treated as a key after all keys in the DB.
-	var end []byte = nil
+	// the indexes are stored after all time series
+	var end = seriesRange.Limit
 	if offset+limit < len(keys) {
 		end = []byte(keys[offset+limit])
 	}
@@ -265,7 +326,7 @@ func (s *LevelDBStorage) getTotal() (int, error) {
 	counter := 0
 
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(seriesRange, nil)
 	for iter.Next() {
 		counter++
 	}
@@ -290,7 +351,7 @@ func (s *LevelDBStorage) filterOne(path, op, value string) (*TimeSeries, error)
 
 	// return the first one found
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(seriesRange, nil)
 	for iter.Next() {
 		var ts TimeSeries
 		err := json.Unmarshal(iter.Value(), &ts)
@@ -330,7 +391,7 @@ func (s *LevelDBStorage) filter(path, op, value string, page, perPage int) ([]Ti
 	pathTknz := strings.Split(path, ".")
 
 	s.wg.Add(1)
-	iter := s.db.NewIterator(nil, nil)
+	iter := s.db.NewIterator(seriesRange, nil)
 	for iter.Next() {
 		var ts TimeSeries
 		err := json.Unmarshal(iter.Value(), &ts)
@@ -0,0 +1,238 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Secondary indexes of the LevelDB storage
+//
+// For each time series and indexed meta field, the index has a key composed of the field, the value and the series name.
+// The keys start with bytes that are not allowed in series names, so they are sorted after the time series.
+const (
+	indexPrefix = "\xff"
+	// key of the list of indexed fields, used to rebuild the indexes when the configuration changes
+	indexedFieldsKey = "\xfeindexedFields"
+)
+
+// seriesRange covers the keys of all time series, excluding the indexes
+var seriesRange = &util.Range{Limit: []byte{0xfe}}
+
+// indexedFields returns the sorted meta fields to be indexed
+func indexedFields(metaKeys []string) []string {
+	fields := make([]string, 0, len(metaKeys))
+	for _, key := range metaKeys {
+		fields = append(fields, fieldMetaPrefix+key)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+func indexKey(field, value, name string) []byte {
+	return []byte(indexPrefix + field + "\x00" + value + "\x00" + name)
+}
+
+func (s *LevelDBStorage) isIndexed(field string) bool {
+	for _, f := range s.indexed {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// putIndex adds the index entries of a time series to the batch
+func (s *LevelDBStorage) putIndex(batch *leveldb.Batch, ts *TimeSeries) {
+	for _, f := range s.indexed {
+		if value, found := fieldValue(ts, f); found {
+			batch.Put(indexKey(f, value, ts.Name), nil)
+		}
+	}
+}
+
+// deleteIndex adds the removal of the index entries of a time series to the batch
+func (s *LevelDBStorage) deleteIndex(batch *leveldb.Batch, ts *TimeSeries) {
+	for _, f := range s.indexed {
+		if value, found := fieldValue(ts, f); found {
+			batch.Delete(indexKey(f, value, ts.Name))
+		}
+	}
+}
+
+// buildIndex re-creates the indexes if the indexed fields have changed since the last start
+func (s *LevelDBStorage) buildIndex() error {
+	fields, err := json.Marshal(s.indexed)
+	if err != nil {
+		return err
+	}
+	stored, err := s.db.Get([]byte(indexedFieldsKey), nil)
+	if err == nil && bytes.Equal(stored, fields) {
+		return nil
+	} else if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(indexPrefix)), nil)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	iter = s.db.NewIterator(seriesRange, nil)
+	for iter.Next() {
+		var ts TimeSeries
+		err = json.Unmarshal(iter.Value(), &ts)
+		if err != nil {
+			iter.Release()
+			return err
+		}
+		s.putIndex(batch, &ts)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	batch.Put([]byte(indexedFieldsKey), fields)
+	return s.db.Write(batch, nil)
+}
+
+// lookup returns the names of the time series which may match the filter, using the indexes and the sorted keys.
+// The second return value is false if the filter cannot be answered this way.
+func (s *LevelDBStorage) lookup(filter Predicate) (map[string]bool, bool, error) {
+	switch p := filter.(type) {
+	case comparison:
+		return s.lookupComparison(p)
+	case allOf:
+		// intersect the candidates of the children which can be looked up
+		var candidates map[string]bool
+		for _, child := range p {
+			names, ok, err := s.lookup(child)
+			if err != nil {
+				return nil, false, err
+			}
+			if !ok {
+				continue
+			}
+			if candidates == nil {
+				candidates = names
+				continue
+			}
+			for name := range candidates {
+				if !names[name] {
+					delete(candidates, name)
+				}
+			}
+		}
+		return candidates, candidates != nil, nil
+	case anyOf:
+		// all children need to be looked up
+		candidates := make(map[string]bool)
+		for _, child := range p {
+			names, ok, err := s.lookup(child)
+			if err != nil || !ok {
+				return nil, false, err
+			}
+			for name := range names {
+				candidates[name] = true
+			}
+		}
+		return candidates, true, nil
+	}
+	return nil, false, nil
+}
+
+func (s *LevelDBStorage) lookupComparison(c comparison) (map[string]bool, bool, error) {
+	candidates := make(map[string]bool)
+
+	// series names are the keys of the database
+	if c.field == fieldName && (c.op == SOpEquals || c.op == SOpPrefix) && c.value != "" && c.value[0] < seriesRange.Limit[0] {
+		iter := s.db.NewIterator(util.BytesPrefix([]byte(c.value)), nil)
+		for iter.Next() {
+			name := string(iter.Key())
+			if c.op == SOpPrefix || name == c.value {
+				candidates[name] = true
+			}
+		}
+		iter.Release()
+		return candidates, true, iter.Error()
+	}
+
+	if !s.isIndexed(c.field) {
+		return nil, false, nil
+	}
+	var prefix string
+	switch c.op {
+	case SOpEquals:
+		prefix = indexPrefix + c.field + "\x00" + c.value + "\x00"
+	case SOpPrefix:
+		prefix = indexPrefix + c.field + "\x00" + c.value
+	case SOpExists:
+		prefix = indexPrefix + c.field + "\x00"
+	default:
+		return nil, false, nil
+	}
+	iter := s.db.NewIterator(util.BytesPrefix([]byte(prefix)), nil)
+	for iter.Next() {
+		key := string(iter.Key())
+		candidates[key[strings.LastIndexByte(key, 0)+1:]] = true
+	}
+	iter.Release()
+	return candidates, true, iter.Error()
+}
+
+func (s *LevelDBStorage) search(filter Predicate) ([]TimeSeries, error) {
+	s.wg.Add(1)
+	defer s.wg.Done()
+
+	matched := []TimeSeries{}
+	if filter != nil {
+		candidates, indexed, err := s.lookup(filter)
+		if err != nil {
+			return nil, err
+		}
+		if indexed {
+			for name := range candidates {
+				ts, err := s.get(name)
+				if errors.Is(err, ErrNotFound) {
+					// deleted in the meantime
+					continue
+				} else if err != nil {
+					return nil, err
+				}
+				// candidates are a superset of the matching series
+				if filter.match(ts) {
+					matched = append(matched, *ts)
+				}
+			}
+			return matched, nil
+		}
+	}
+
+	// scan all time series
+	iter := s.db.NewIterator(seriesRange, nil)
+	defer iter.Release()
+	for iter.Next() {
+		var ts TimeSeries
+		err := json.Unmarshal(iter.Value(), &ts)
+		if err != nil {
+			return nil, err
+		}
+		if filter == nil || filter.match(&ts) {
+			matched = append(matched, ts)
+		}
+	}
+	return matched, iter.Error()
+}
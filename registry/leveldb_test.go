@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"math"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -270,3 +272,140 @@ func TestLevelDBPathFilter(t *testing.T) {
 		t.Fatalf("Returned %d matches instead of %d", total, expected)
 	}
 }
+
+func TestLevelDBAddMany(t *testing.T) {
+	os_temp := strings.Replace(os.TempDir(), "\\", "/", -1)
+	dbName := fmt.Sprintf("%d.ldb", time.Now().UnixNano())
+	conf := common.RegConf{
+		Backend: common.RegBackendConf{
+			DSN: fmt.Sprintf("%s/hds-test/%s", os_temp, dbName),
+		},
+	}
+	listener := &recordingListener{}
+	storage, closeDB, err := NewLevelDBStorage(conf, nil, listener)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clean(dbName)
+	defer closeDB()
+
+	testAddMany(t, storage, listener)
+}
+
+func TestLevelDBSearch(t *testing.T) {
+	storage, dbName, closeDB, err := setupLevelDB()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clean(dbName)
+	defer closeDB()
+
+	testSearch(t, storage)
+}
+
+func TestLevelDBSearchIndex(t *testing.T) {
+	os_temp := strings.Replace(os.TempDir(), "\\", "/", -1)
+	dbName := fmt.Sprintf("%d.ldb", time.Now().UnixNano())
+	conf := common.RegConf{
+		Backend: common.RegBackendConf{
+			DSN: fmt.Sprintf("%s/hds-test/%s", os_temp, dbName),
+		},
+		IndexedMeta: []string{"building"},
+	}
+	defer clean(dbName)
+	storage, closeDB, err := NewLevelDBStorage(conf, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	testSearch(t, storage)
+
+	// the index entries are not time series
+	total, err := storage.getTotal()
+	if err != nil || total != len(searchTestSeries) {
+		t.Fatalf("Expected %d time series, got %d (%v)", len(searchTestSeries), total, err)
+	}
+	series, _, err := storage.getMany(1, MaxPerPage)
+	if err != nil || len(series) != len(searchTestSeries) {
+		t.Fatalf("Expected %d time series, got %d (%v)", len(searchTestSeries), len(series), err)
+	}
+
+	lookupNames := func(storage Storage, expr string) []string {
+		q, err := ParseSearchQuery(expr, nil)
+		if err != nil {
+			t.Fatalf("Received unexpected error parsing %s: %v", expr, err)
+		}
+		candidates, indexed, err := storage.(*LevelDBStorage).lookup(q.Filter)
+		if err != nil {
+			t.Fatalf("Received unexpected error on lookup %s: %v", expr, err)
+		}
+		if !indexed {
+			return nil
+		}
+		names := []string{}
+		for name := range candidates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if names := lookupNames(storage, `meta.building = B1 and unit = Cel`); !reflect.DeepEqual(names, []string{"b1/room1/temp", "b1/room2/door", "b1/room2/temp"}) {
+		t.Fatalf("Expected the index to be used for meta.building, got %v", names)
+	}
+	if names := lookupNames(storage, `meta.floor = 1`); names != nil {
+		t.Fatalf("Expected no index for meta.floor, got %v", names)
+	}
+
+	// the index follows updates and deletions
+	ts := searchTestSeries[0]
+	ts.Meta = map[string]interface{}{"building": "B2"}
+	if _, err := storage.update(ts.Name, ts); err != nil {
+		t.Fatalf("Received unexpected error on update: %v", err)
+	}
+	if err := storage.delete("b1/room2/door"); err != nil {
+		t.Fatalf("Received unexpected error on delete: %v", err)
+	}
+	if names := lookupNames(storage, `meta.building = B1`); !reflect.DeepEqual(names, []string{"b1/room2/temp"}) {
+		t.Fatalf("Expected the updated index, got %v", names)
+	}
+	if names := lookupNames(storage, `meta.building = B2`); !reflect.DeepEqual(names, []string{"b1/room1/temp", "b2/room1/temp"}) {
+		t.Fatalf("Expected the updated index, got %v", names)
+	}
+	closeDB()
+
+	// the index is rebuilt when the configuration changes
+	conf.IndexedMeta = []string{"floor"}
+	storage, closeDB, err = NewLevelDBStorage(conf, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer closeDB()
+	if names := lookupNames(storage, `meta.building = B1`); names != nil {
+		t.Fatalf("Expected no index for meta.building, got %v", names)
+	}
+	if names := lookupNames(storage, `meta.floor = 2`); !reflect.DeepEqual(names, []string{"b1/room2/temp"}) {
+		t.Fatalf("Expected the rebuilt index for meta.floor, got %v", names)
+	}
+	if names := searchNames(t, storage, `meta.floor exists`); !reflect.DeepEqual(names, []string{"b1/room2/temp"}) {
+		t.Fatalf("Expected search over the rebuilt index, got %v", names)
+	}
+}
+
+func TestLevelDBListenerFailures(t *testing.T) {
+	os_temp := strings.Replace(os.TempDir(), "\\", "/", -1)
+	dbName := fmt.Sprintf("%d.ldb", time.Now().UnixNano())
+	conf := common.RegConf{
+		Backend: common.RegBackendConf{
+			DSN: fmt.Sprintf("%s/hds-test/%s", os_temp, dbName),
+		},
+	}
+	first, second := &recordingListener{}, &recordingListener{}
+	storage, closeDB, err := NewLevelDBStorage(conf, nil, first, second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer clean(dbName)
+	defer closeDB()
+
+	testListenerFailures(t, storage, first, second)
+}
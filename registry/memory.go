@@ -36,25 +36,57 @@ func NewMemoryStorage(conf common.RegConf, listeners ...EventListener) Storage {
 }
 
 func (ms *MemoryStorage) add(ts TimeSeries) (*TimeSeries, error) {
-	ms.mutex.RLock()
-	defer ms.mutex.RUnlock()
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
 
 	if _, exists := ms.resources[ts.Name]; exists {
 		return nil, fmt.Errorf("%w: Resource name not unique: %s", ErrConflict, ts.Name)
 	}
 
+	// Prepare the create event
+	txs, err := ms.event.created(&ts)
+	if err != nil {
+		return nil, err
+	}
+
 	// Add the new time series to the map
 	ms.data[ts.Name] = &ts
 	// Add secondary index
 	ms.resources[ts.Name] = ts.Name
 
-	// Send a create event
-	err := ms.event.created(&ts)
+	txs.commit()
+	ms.lastModified = time.Now()
+	return ms.data[ts.Name], nil
+}
+
+func (ms *MemoryStorage) addMany(series []TimeSeries) ([]TimeSeries, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	names := make(map[string]bool, len(series))
+	for _, ts := range series {
+		if _, exists := ms.resources[ts.Name]; exists || names[ts.Name] {
+			return nil, fmt.Errorf("%w: Resource name not unique: %s", ErrConflict, ts.Name)
+		}
+		names[ts.Name] = true
+	}
+
+	// Prepare the create events, the prepared ones are compensated if one fails
+	txs, err := ms.event.createdMany(series)
 	if err != nil {
 		return nil, err
 	}
+
+	added := make([]TimeSeries, len(series))
+	for i := range series {
+		ts := series[i]
+		ms.data[ts.Name] = &ts
+		ms.resources[ts.Name] = ts.Name
+		added[i] = ts
+	}
+	txs.commit()
 	ms.lastModified = time.Now()
-	return ms.data[ts.Name], nil
+	return added, nil
 }
 
 func (ms *MemoryStorage) update(id string, ts TimeSeries) (*TimeSeries, error) {
@@ -78,15 +110,17 @@ func (ms *MemoryStorage) update(id string, ts TimeSeries) (*TimeSeries, error) {
 	// Modify writable elements
 	tempTS.Source = ts.Source
 	tempTS.Meta = ts.Meta
+	tempTS.Retention = ts.Retention
 
-	// Send an update event
-	err = ms.event.updated(oldTS, &tempTS)
+	// Prepare the update event
+	txs, err := ms.event.updated(oldTS, &tempTS)
 	if err != nil {
 		return nil, err
 	}
 
 	// Store the modified ts
 	ms.data[id] = &tempTS
+	txs.commit()
 
 	ms.lastModified = time.Now()
 	return ms.data[id], nil
@@ -101,14 +135,15 @@ func (ms *MemoryStorage) delete(name string) error {
 		return fmt.Errorf("%s: %w", name, ErrNotFound)
 	}
 
-	// Send a delete event
-	err := ms.event.deleted(ms.data[name])
+	// Prepare the delete event
+	txs, err := ms.event.deleted(ms.data[name])
 	if err != nil {
 		return err
 	}
 
 	delete(ms.resources, ms.data[name].Name)
 	delete(ms.data, name)
+	txs.commit()
 
 	ms.lastModified = time.Now()
 	return nil
@@ -223,3 +258,16 @@ func (ms *MemoryStorage) filter(path, op, value string, page, perPage int) ([]Ti
 
 	return ts, len(matchedIDs), nil
 }
+
+func (ms *MemoryStorage) search(filter Predicate) ([]TimeSeries, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	matched := []TimeSeries{}
+	for _, ts := range ms.data {
+		if filter == nil || filter.match(ts) {
+			matched = append(matched, *ts)
+		}
+	}
+	return matched, nil
+}
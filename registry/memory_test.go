@@ -7,6 +7,7 @@ import (
 	"math"
 	"math/rand"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -98,6 +99,35 @@ func TestMemstorageUpdate(t *testing.T) {
 	}
 }
 
+func TestMemstorageUpdateUnit(t *testing.T) {
+	controller := *NewController(setupMemStorage())
+	stored, err := controller.Add(TimeSeries{Name: "room/temp", Type: Float, Unit: "Cel"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	virtual, err := controller.Add(TimeSeries{Name: "room/fahrenheit", Type: Float, Unit: "[degF]",
+		Source: Source{SrcType: Virtual, VirtualSource: &VirtualSource{Inputs: map[string]string{"c": stored.Name}, Expression: "c * 9 / 5 + 32"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the stored values would be relabelled without being converted
+	updated := *stored
+	updated.Unit = "K"
+	if _, err := controller.Update(stored.Name, updated); err == nil {
+		t.Error("Expected an error changing the unit of a series with stored data")
+	}
+	updated = *virtual
+	updated.Unit = "[degR]"
+	if _, err := controller.Update(virtual.Name, updated); err == nil {
+		t.Error("Expected an error changing the unit of a virtual series to an unknown one")
+	}
+	updated.Unit = "K"
+	if _, err := controller.Update(virtual.Name, updated); err != nil {
+		t.Errorf("Unexpected error changing the unit of a virtual series: %s", err)
+	}
+}
+
 func TestMemstorageDelete(t *testing.T) {
 	storage := setupMemStorage()
 	controller := *NewController(storage)
@@ -220,3 +250,249 @@ func TestMemstoragePathFilter(t *testing.T) {
 		t.Fatalf("Returned %d matches instead of %d", total, expected)
 	}
 }
+
+// recordingListener records the prepared, committed and compensated changes and fails preparing the changes of the given time series
+type recordingListener struct {
+	failOn      string
+	created     []string
+	committed   []string
+	compensated []string
+}
+
+func (l *recordingListener) prepare(event string, ts TimeSeries) (Transaction, error) {
+	if ts.Name == l.failOn {
+		return nil, fmt.Errorf("failed preparing %s of %s", event, ts.Name)
+	}
+	if event == "create" {
+		l.created = append(l.created, ts.Name)
+	}
+	return TransactionFuncs{
+		OnCommit: func() error {
+			l.committed = append(l.committed, event+" "+ts.Name)
+			return nil
+		},
+		OnCompensate: func() error {
+			l.compensated = append(l.compensated, event+" "+ts.Name)
+			return nil
+		},
+	}, nil
+}
+
+func (l *recordingListener) CreateHandler(ts TimeSeries) (Transaction, error) {
+	return l.prepare("create", ts)
+}
+
+func (l *recordingListener) UpdateHandler(old TimeSeries, new TimeSeries) (Transaction, error) {
+	return l.prepare("update", new)
+}
+
+func (l *recordingListener) DeleteHandler(ts TimeSeries) (Transaction, error) {
+	return l.prepare("delete", ts)
+}
+
+func testAddMany(t *testing.T, storage Storage, listener *recordingListener) {
+	batch := []TimeSeries{
+		{Name: "batch/a", Type: Float},
+		{Name: "batch/b", Type: String},
+	}
+	added, err := storage.addMany(batch)
+	if err != nil {
+		t.Fatalf("Received unexpected error on addMany: %v", err)
+	}
+	if len(added) != len(batch) {
+		t.Fatalf("Expected %d added time series, got %d", len(batch), len(added))
+	}
+	for _, ts := range batch {
+		if _, err := storage.get(ts.Name); err != nil {
+			t.Fatalf("Received unexpected error on get: %v", err)
+		}
+	}
+	if !reflect.DeepEqual(listener.created, []string{"batch/a", "batch/b"}) {
+		t.Fatalf("Expected create events for the batch, got %v", listener.created)
+	}
+
+	assertNotAdded := func(names ...string) {
+		for _, name := range names {
+			if _, err := storage.get(name); err == nil {
+				t.Fatalf("Expected %s not to be added", name)
+			}
+		}
+		if total, _ := storage.getTotal(); total != 2 {
+			t.Fatalf("Expected 2 time series in the registry, got %d", total)
+		}
+	}
+
+	// a conflicting entry fails the whole batch without events
+	listener.created = nil
+	_, err = storage.addMany([]TimeSeries{{Name: "batch/c", Type: Float}, {Name: "batch/a", Type: Float}})
+	if err == nil || !strings.Contains(err.Error(), "not unique") {
+		t.Fatalf("Expected a conflict, got %v", err)
+	}
+	_, err = storage.addMany([]TimeSeries{{Name: "batch/c", Type: Float}, {Name: "batch/c", Type: Float}})
+	if err == nil || !strings.Contains(err.Error(), "not unique") {
+		t.Fatalf("Expected a conflict for duplicates in the batch, got %v", err)
+	}
+	assertNotAdded("batch/c")
+	if len(listener.created) != 0 {
+		t.Fatalf("Expected no create events, got %v", listener.created)
+	}
+
+	// a failing event undoes the whole batch
+	listener.failOn = "batch/e"
+	_, err = storage.addMany([]TimeSeries{{Name: "batch/c", Type: Float}, {Name: "batch/d", Type: Float}, {Name: "batch/e", Type: Float}})
+	if err == nil {
+		t.Fatal("Expected the failing event to fail the batch")
+	}
+	assertNotAdded("batch/c", "batch/d", "batch/e")
+	if !reflect.DeepEqual(listener.compensated, []string{"create batch/d", "create batch/c"}) {
+		t.Fatalf("Expected the prepared creations to be compensated, got %v", listener.compensated)
+	}
+}
+
+func TestMemstorageAddMany(t *testing.T) {
+	listener := &recordingListener{}
+	storage := NewMemoryStorage(common.RegConf{}, listener)
+	testAddMany(t, storage, listener)
+}
+
+// searchTestSeries are added to the storage by testSearch
+var searchTestSeries = []TimeSeries{
+	{Name: "b1/room1/temp", Type: Float, Unit: "Cel", Meta: map[string]interface{}{"building": "B1", "floor": 1.0}},
+	{Name: "b1/room2/temp", Type: Float, Unit: "Cel", Meta: map[string]interface{}{"building": "B1", "floor": 2.0}},
+	{Name: "b1/room2/door", Type: Bool, Meta: map[string]interface{}{"building": "B1", "floor": 2.0}},
+	{Name: "b2/room1/temp", Type: Float, Unit: "K", Meta: map[string]interface{}{"building": "B2"}},
+	{Name: "b2/room1/status", Type: String},
+}
+
+func searchNames(t *testing.T, storage Storage, expr string) []string {
+	q, err := ParseSearchQuery(expr, nil)
+	if err != nil {
+		t.Fatalf("Received unexpected error parsing %s: %v", expr, err)
+	}
+	series, err := storage.search(q.Filter)
+	if err != nil {
+		t.Fatalf("Received unexpected error on search %s: %v", expr, err)
+	}
+	sortSeries(series, nil)
+	names := []string{}
+	for _, ts := range series {
+		names = append(names, ts.Name)
+	}
+	return names
+}
+
+func testSearch(t *testing.T, storage Storage) {
+	for _, ts := range searchTestSeries {
+		if _, err := storage.add(ts); err != nil {
+			t.Fatalf("Received unexpected error on add: %v", err)
+		}
+	}
+
+	tests := map[string][]string{
+		``:                   {"b1/room1/temp", "b1/room2/door", "b1/room2/temp", "b2/room1/status", "b2/room1/temp"},
+		`meta.building = B1`: {"b1/room1/temp", "b1/room2/door", "b1/room2/temp"},
+		`meta.building = "B1" and dataType = float`:                     {"b1/room1/temp", "b1/room2/temp"},
+		`meta.building = B1 and not unit = Cel`:                         {"b1/room2/door"},
+		`meta.building = B2 or name suffix status`:                      {"b2/room1/status", "b2/room1/temp"},
+		`meta.floor >= 2`:                                               {"b1/room2/door", "b1/room2/temp"},
+		`not meta.floor exists`:                                         {"b2/room1/status", "b2/room1/temp"},
+		`meta.building != B1`:                                           {"b2/room1/status", "b2/room1/temp"},
+		`name prefix b1/room2 or (unit = K and meta.building prefix B)`: {"b1/room2/door", "b1/room2/temp", "b2/room1/temp"},
+		`name = b2/room1/temp`:                                          {"b2/room1/temp"},
+		`meta.building = B3`:                                            {},
+	}
+	for expr, expected := range tests {
+		names := searchNames(t, storage, expr)
+		if !reflect.DeepEqual(names, expected) {
+			t.Errorf("Search %s: expected %v, got %v", expr, expected, names)
+		}
+	}
+}
+
+func TestMemstorageSearch(t *testing.T) {
+	storage := setupMemStorage()
+	testSearch(t, storage)
+}
+
+// testListenerFailures injects failures of the second listener and checks that the changes of the first are compensated
+func testListenerFailures(t *testing.T, storage Storage, first, second *recordingListener) {
+	assertEvents := func(events []string, expected ...string) {
+		t.Helper()
+		if len(events) == 0 && len(expected) == 0 {
+			return
+		}
+		if !reflect.DeepEqual(events, expected) {
+			t.Fatalf("Expected events %v, got %v", expected, events)
+		}
+	}
+	reset := func() {
+		first.committed, first.compensated = nil, nil
+		second.committed, second.compensated = nil, nil
+	}
+
+	// create
+	second.failOn = "failing/a"
+	_, err := storage.add(TimeSeries{Name: "failing/a", Type: Float})
+	if err == nil {
+		t.Fatal("Expected the failing listener to fail the creation")
+	}
+	if _, err := storage.get("failing/a"); err == nil {
+		t.Fatal("Expected failing/a not to be added")
+	}
+	assertEvents(first.compensated, "create failing/a")
+	assertEvents(first.committed)
+
+	second.failOn = ""
+	reset()
+	_, err = storage.add(TimeSeries{Name: "failing/a", Type: Float, Meta: map[string]interface{}{"k": "v1"}})
+	if err != nil {
+		t.Fatalf("Received unexpected error on add: %v", err)
+	}
+	assertEvents(first.committed, "create failing/a")
+	assertEvents(second.committed, "create failing/a")
+	assertEvents(first.compensated)
+
+	// update
+	second.failOn = "failing/a"
+	reset()
+	_, err = storage.update("failing/a", TimeSeries{Name: "failing/a", Type: Float, Meta: map[string]interface{}{"k": "v2"}})
+	if err == nil {
+		t.Fatal("Expected the failing listener to fail the update")
+	}
+	ts, err := storage.get("failing/a")
+	if err != nil {
+		t.Fatalf("Received unexpected error on get: %v", err)
+	}
+	if ts.Meta["k"] != "v1" {
+		t.Fatalf("Expected the time series not to be updated, got meta %v", ts.Meta)
+	}
+	assertEvents(first.compensated, "update failing/a")
+	assertEvents(first.committed)
+
+	// delete
+	reset()
+	err = storage.delete("failing/a")
+	if err == nil {
+		t.Fatal("Expected the failing listener to fail the deletion")
+	}
+	if _, err := storage.get("failing/a"); err != nil {
+		t.Fatalf("Expected failing/a not to be deleted, got %v", err)
+	}
+	assertEvents(first.compensated, "delete failing/a")
+	assertEvents(first.committed)
+
+	second.failOn = ""
+	reset()
+	err = storage.delete("failing/a")
+	if err != nil {
+		t.Fatalf("Received unexpected error on delete: %v", err)
+	}
+	assertEvents(first.committed, "delete failing/a")
+	assertEvents(second.committed, "delete failing/a")
+}
+
+func TestMemstorageListenerFailures(t *testing.T) {
+	first, second := &recordingListener{}, &recordingListener{}
+	storage := NewMemoryStorage(common.RegConf{}, first, second)
+	testListenerFailures(t, storage, first, second)
+}
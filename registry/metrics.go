@@ -0,0 +1,26 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsCollector returns a collector of the number of registered time series, counted at each scrape
+func (c Controller) MetricsCollector() prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "hds",
+		Subsystem: "registry",
+		Name:      "time_series",
+		Help:      "Number of registered time series.",
+	}, func() float64 {
+		total, err := c.s.getTotal()
+		if err != nil {
+			log.Printf("registry: error counting the time series for metrics: %s", err)
+			return 0
+		}
+		return float64(total)
+	})
+}
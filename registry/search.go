@@ -0,0 +1,531 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Search operators
+const (
+	SOpEquals      = "="
+	SOpNotEquals   = "!="
+	SOpLess        = "<"
+	SOpLessOrEqual = "<="
+	SOpGreater     = ">"
+	SOpGreaterOrEq = ">="
+	SOpPrefix      = "prefix"
+	SOpSuffix      = "suffix"
+	SOpContains    = "contains"
+	SOpExists      = "exists"
+)
+
+// fields of a time series which can be searched, sorted and projected. Meta keys are given as meta.<key>
+const (
+	fieldName       = "name"
+	fieldUnit       = "unit"
+	fieldDataType   = "dataType"
+	fieldRetention  = "retention"
+	fieldSourceType = "source.type"
+	fieldMetaPrefix = "meta."
+)
+
+// Predicate is a condition on time series, parsed from a search expression
+type Predicate interface {
+	match(ts *TimeSeries) bool
+}
+
+// SearchQuery describes a search of time series
+type SearchQuery struct {
+	// Filter is the condition the resulting time series satisfy. Nil matches all time series
+	Filter Predicate
+	// Sort lists the fields by which the results are ordered, each prefixed with '-' for the descending order.
+	// The results are finally ordered by name.
+	Sort []string
+}
+
+// ParseSearchQuery parses a search expression and the sort fields
+// An expression combines comparisons with and, or, not and parentheses, e.g.:
+//
+//	meta.building = "B1" and (unit = Cel or not meta.floor exists)
+//
+// Supported comparisons are =, !=, <, <=, >, >=, prefix, suffix, contains and exists.
+// Values are compared as numbers if both sides are numeric and as strings otherwise.
+func ParseSearchQuery(expr string, sortFields []string) (SearchQuery, error) {
+	var q SearchQuery
+	if strings.TrimSpace(expr) != "" {
+		filter, err := parsePredicate(expr)
+		if err != nil {
+			return q, err
+		}
+		q.Filter = filter
+	}
+	for _, f := range sortFields {
+		if !validField(strings.TrimPrefix(f, "-")) {
+			return q, fmt.Errorf("invalid sort field: %s", f)
+		}
+	}
+	q.Sort = sortFields
+	return q, nil
+}
+
+// ValidateFields checks the fields of a projection
+func ValidateFields(fields []string) error {
+	for _, f := range fields {
+		if f != "source" && !validField(f) {
+			return fmt.Errorf("invalid field: %s", f)
+		}
+	}
+	return nil
+}
+
+func validField(field string) bool {
+	switch field {
+	case fieldName, fieldUnit, fieldDataType, fieldRetention, fieldSourceType:
+		return true
+	}
+	return strings.HasPrefix(field, fieldMetaPrefix) && len(field) > len(fieldMetaPrefix)
+}
+
+// fieldValue returns the value of a field as string. Meta values which are not strings are given in their JSON form.
+// The second return value is false if the meta key is not set.
+func fieldValue(ts *TimeSeries, field string) (string, bool) {
+	switch field {
+	case fieldName:
+		return ts.Name, true
+	case fieldUnit:
+		return ts.Unit, true
+	case fieldDataType:
+		return ts.Type.String(), true
+	case fieldRetention:
+		return ts.Retention, true
+	case fieldSourceType:
+		return string(ts.Source.SrcType), true
+	}
+
+	// nested meta keys are separated by dots
+	var value interface{} = ts.Meta
+	for _, key := range strings.Split(strings.TrimPrefix(field, fieldMetaPrefix), ".") {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		value, ok = m[key]
+		if !ok {
+			return "", false
+		}
+	}
+	if s, ok := value.(string); ok {
+		return s, true
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(b), true
+}
+
+// compareValues compares numerically if both values are numbers and lexically otherwise
+func compareValues(a, b string) int {
+	fa, errA := strconv.ParseFloat(a, 64)
+	fb, errB := strconv.ParseFloat(b, 64)
+	if errA == nil && errB == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// Predicates ///////////////////////////////////////////////////////////////////////
+
+type comparison struct {
+	field string
+	op    string
+	value string
+}
+
+func (c comparison) match(ts *TimeSeries) bool {
+	v, found := fieldValue(ts, c.field)
+	if !found {
+		return c.op == SOpNotEquals
+	}
+	switch c.op {
+	case SOpEquals:
+		return v == c.value
+	case SOpNotEquals:
+		return v != c.value
+	case SOpLess:
+		return compareValues(v, c.value) < 0
+	case SOpLessOrEqual:
+		return compareValues(v, c.value) <= 0
+	case SOpGreater:
+		return compareValues(v, c.value) > 0
+	case SOpGreaterOrEq:
+		return compareValues(v, c.value) >= 0
+	case SOpPrefix:
+		return strings.HasPrefix(v, c.value)
+	case SOpSuffix:
+		return strings.HasSuffix(v, c.value)
+	case SOpContains:
+		return strings.Contains(v, c.value)
+	case SOpExists:
+		return true
+	}
+	return false
+}
+
+type allOf []Predicate
+
+func (a allOf) match(ts *TimeSeries) bool {
+	for _, p := range a {
+		if !p.match(ts) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyOf []Predicate
+
+func (o anyOf) match(ts *TimeSeries) bool {
+	for _, p := range o {
+		if p.match(ts) {
+			return true
+		}
+	}
+	return false
+}
+
+type negation struct {
+	Predicate
+}
+
+func (n negation) match(ts *TimeSeries) bool {
+	return !n.Predicate.match(ts)
+}
+
+// Parser ///////////////////////////////////////////////////////////////////////
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenOperator
+	tokenOpen
+	tokenClose
+	tokenEnd
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+// keyword returns true if the token is the given unquoted word (case-insensitive)
+func (t token) keyword(word string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.text, word)
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expr)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(':
+			tokens = append(tokens, token{tokenOpen, "(", i})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{tokenClose, ")", i})
+			i++
+		case r == '"' || r == '\'':
+			var b strings.Builder
+			start := i
+			for i++; ; i++ {
+				if i == len(runes) {
+					return nil, fmt.Errorf("unterminated string at position %d", start)
+				}
+				if runes[i] == r {
+					i++
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				b.WriteRune(runes[i])
+			}
+			tokens = append(tokens, token{tokenString, b.String(), start})
+		case strings.ContainsRune("=!<>", r):
+			start := i
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			op := string(runes[start:i])
+			switch op {
+			case "==":
+				op = SOpEquals
+			case "!":
+				return nil, fmt.Errorf("invalid operator '!' at position %d", start)
+			}
+			tokens = append(tokens, token{tokenOperator, op, start})
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && !strings.ContainsRune("()\"'=!<>", runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[start:i]), start})
+		}
+	}
+	return append(tokens, token{tokenEnd, "", len(runes)}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func parsePredicate(expr string) (Predicate, error) {
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := parser{tokens: tokens}
+	pred, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected '%s' at position %d", t.text, t.pos)
+	}
+	return pred, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) parseOr() (Predicate, error) {
+	first, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	preds := anyOf{first}
+	for p.peek().keyword("or") {
+		p.next()
+		pred, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+	if len(preds) == 1 {
+		return first, nil
+	}
+	return preds, nil
+}
+
+func (p *parser) parseAnd() (Predicate, error) {
+	first, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	preds := allOf{first}
+	for p.peek().keyword("and") {
+		p.next()
+		pred, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+	if len(preds) == 1 {
+		return first, nil
+	}
+	return preds, nil
+}
+
+func (p *parser) parseNot() (Predicate, error) {
+	if p.peek().keyword("not") {
+		p.next()
+		pred, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return negation{pred}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Predicate, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenOpen:
+		pred, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.next(); closing.kind != tokenClose {
+			return nil, fmt.Errorf("expected ')' at position %d", closing.pos)
+		}
+		return pred, nil
+	case tokenWord:
+		return p.parseComparison(t)
+	case tokenEnd:
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("unexpected '%s' at position %d", t.text, t.pos)
+}
+
+func (p *parser) parseComparison(field token) (Predicate, error) {
+	if !validField(field.text) {
+		return nil, fmt.Errorf("invalid field '%s' at position %d", field.text, field.pos)
+	}
+	c := comparison{field: field.text}
+
+	op := p.next()
+	switch {
+	case op.kind == tokenOperator:
+		c.op = op.text
+	case op.keyword(SOpPrefix), op.keyword(SOpSuffix), op.keyword(SOpContains):
+		c.op = strings.ToLower(op.text)
+	case op.keyword(SOpExists):
+		if !strings.HasPrefix(c.field, fieldMetaPrefix) {
+			return nil, fmt.Errorf("operator 'exists' at position %d is only supported for meta fields", op.pos)
+		}
+		c.op = SOpExists
+		return c, nil
+	default:
+		return nil, fmt.Errorf("expected an operator after '%s' at position %d", field.text, op.pos)
+	}
+
+	value := p.next()
+	if value.kind != tokenWord && value.kind != tokenString {
+		return nil, fmt.Errorf("expected a value after '%s' at position %d", op.text, value.pos)
+	}
+	c.value = value.text
+	return c, nil
+}
+
+// Sorting and projection ///////////////////////////////////////////////////////////////////////
+
+// sortSeries orders the time series by the given fields and finally by name. Missing meta values come first.
+func sortSeries(series []TimeSeries, fields []string) {
+	sort.SliceStable(series, func(i, j int) bool {
+		for _, f := range fields {
+			desc := strings.HasPrefix(f, "-")
+			f = strings.TrimPrefix(f, "-")
+			a, foundA := fieldValue(&series[i], f)
+			b, foundB := fieldValue(&series[j], f)
+			var c int
+			switch {
+			case foundA && foundB:
+				c = compareValues(a, b)
+			case foundA:
+				c = 1
+			case foundB:
+				c = -1
+			}
+			if c != 0 {
+				return (c < 0) != desc
+			}
+		}
+		return series[i].Name < series[j].Name
+	})
+}
+
+// projectJSON returns the JSON object of a time series which only includes the given fields
+func projectJSON(ts TimeSeries, fields []string) (map[string]interface{}, error) {
+	b, err := json.Marshal(ts)
+	if err != nil {
+		return nil, err
+	}
+	var full map[string]interface{}
+	err = json.Unmarshal(b, &full)
+	if err != nil {
+		return nil, err
+	}
+
+	projected := make(map[string]interface{})
+	for _, f := range fields {
+		path := strings.Split(f, ".")
+		var value interface{} = full
+		for _, key := range path {
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = m[key]
+		}
+		if value == nil {
+			continue
+		}
+		// create the parent objects of nested fields
+		parent := projected
+		for _, key := range path[:len(path)-1] {
+			child, ok := parent[key].(map[string]interface{})
+			if !ok {
+				child = make(map[string]interface{})
+				parent[key] = child
+			}
+			parent = child
+		}
+		parent[path[len(path)-1]] = value
+	}
+	return projected, nil
+}
+
+// project returns a copy of the time series which only includes the given fields
+func project(ts TimeSeries, fields []string) TimeSeries {
+	var projected TimeSeries
+	for _, f := range fields {
+		switch f {
+		case fieldName:
+			projected.Name = ts.Name
+		case fieldUnit:
+			projected.Unit = ts.Unit
+		case fieldDataType:
+			projected.Type = ts.Type
+		case fieldRetention:
+			projected.Retention = ts.Retention
+		case "source":
+			projected.Source = ts.Source
+		case fieldSourceType:
+			projected.Source.SrcType = ts.Source.SrcType
+		default:
+			key := strings.TrimPrefix(f, fieldMetaPrefix)
+			// nested keys are projected as a whole
+			key = strings.Split(key, ".")[0]
+			if value, found := ts.Meta[key]; found {
+				if projected.Meta == nil {
+					projected.Meta = make(map[string]interface{})
+				}
+				projected.Meta[key] = value
+			}
+		}
+	}
+	return projected
+}
@@ -0,0 +1,85 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	valid := []string{
+		`name = a`,
+		`name == "a b"`,
+		`meta.building = 'B1' AND (unit = Cel OR NOT meta.floor exists)`,
+		`meta.a.b contains "x\"y"`,
+		`source.type = MQTT and retention != 1d and dataType = float`,
+	}
+	for _, expr := range valid {
+		if _, err := ParseSearchQuery(expr, []string{"-meta.floor", "name"}); err != nil {
+			t.Errorf("Received unexpected error parsing %s: %v", expr, err)
+		}
+	}
+
+	invalid := []string{
+		`name`,
+		`name =`,
+		`foo = a`,
+		`meta. = a`,
+		`name = a and`,
+		`(name = a`,
+		`name = a)`,
+		`name = "a`,
+		`name ! a`,
+		`unit exists`,
+		`name = a b`,
+	}
+	for _, expr := range invalid {
+		if _, err := ParseSearchQuery(expr, nil); err == nil {
+			t.Errorf("Expected an error parsing %s", expr)
+		}
+	}
+
+	if _, err := ParseSearchQuery("", []string{"-foo"}); err == nil {
+		t.Error("Expected an error for an invalid sort field")
+	}
+	if err := ValidateFields([]string{"name", "source", "meta.building"}); err != nil {
+		t.Errorf("Received unexpected error validating fields: %v", err)
+	}
+	if err := ValidateFields([]string{"meta"}); err == nil {
+		t.Error("Expected an error for an invalid field")
+	}
+}
+
+func TestSearchSortAndProject(t *testing.T) {
+	series := make([]TimeSeries, len(searchTestSeries))
+	copy(series, searchTestSeries)
+
+	sortSeries(series, []string{"-meta.floor", "unit"})
+	var names []string
+	for _, ts := range series {
+		names = append(names, ts.Name)
+	}
+	// floors descending, missing floors last. Then by unit and name
+	expected := []string{"b1/room2/door", "b1/room2/temp", "b1/room1/temp", "b2/room1/status", "b2/room1/temp"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected order %v, got %v", expected, names)
+	}
+
+	projected, err := projectJSON(searchTestSeries[0], []string{"name", "meta.floor", "source.type"})
+	if err != nil {
+		t.Fatalf("Received unexpected error on projection: %v", err)
+	}
+	expectedJSON := map[string]interface{}{
+		"name": "b1/room1/temp",
+		"meta": map[string]interface{}{"floor": 1.0},
+	}
+	if !reflect.DeepEqual(projected, expectedJSON) {
+		t.Fatalf("Expected projection %v, got %v", expectedJSON, projected)
+	}
+
+	ts := project(searchTestSeries[0], []string{"unit", "meta.building"})
+	if !reflect.DeepEqual(ts, TimeSeries{Unit: "Cel", Meta: map[string]interface{}{"building": "B1"}}) {
+		t.Fatalf("Unexpected projection %v", ts)
+	}
+}
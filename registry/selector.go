@@ -0,0 +1,85 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Selector is a JSONPath-style selector of a value in a JSON document, e.g. $.readings[0].temp or $['sensor-1'].value.
+// It starts with $, the document, followed by object keys (.key or ['key']) and array indexes ([0]).
+type Selector []selectorStep
+
+type selectorStep struct {
+	key   string
+	index int
+	// isIndex selects an element of an array instead of a key of an object
+	isIndex bool
+}
+
+// ParseSelector parses a JSONPath-style selector
+func ParseSelector(s string) (Selector, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, fmt.Errorf("selector %q does not start with $", s)
+	}
+	var sel Selector
+	for i := 1; i < len(s); {
+		switch s[i] {
+		case '.':
+			end := i + 1
+			for end < len(s) && s[end] != '.' && s[end] != '[' {
+				end++
+			}
+			if end == i+1 {
+				return nil, fmt.Errorf("missing key at %d of selector %q", i+1, s)
+			}
+			sel = append(sel, selectorStep{key: s[i+1 : end]})
+			i = end
+		case '[':
+			end := strings.IndexByte(s[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ] after %d of selector %q", i, s)
+			}
+			inner := s[i+1 : i+end]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				sel = append(sel, selectorStep{key: inner[1 : len(inner)-1]})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("invalid index %q in selector %q", inner, s)
+				}
+				sel = append(sel, selectorStep{index: index, isIndex: true})
+			}
+			i += end + 1
+		default:
+			return nil, fmt.Errorf("unexpected %q at %d of selector %q", s[i], i, s)
+		}
+	}
+	return sel, nil
+}
+
+// Select returns the selected value of a document decoded by encoding/json, and false if it does not exist
+func (sel Selector) Select(doc interface{}) (interface{}, bool) {
+	v := doc
+	for _, step := range sel {
+		if step.isIndex {
+			array, ok := v.([]interface{})
+			if !ok || step.index >= len(array) {
+				return nil, false
+			}
+			v = array[step.index]
+			continue
+		}
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = object[step.key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
@@ -0,0 +1,56 @@
+// Copyright 2016 Fraunhofer Institute for Applied Information Technology FIT
+
+package registry
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestSelector(t *testing.T) {
+	var doc interface{}
+	err := json.Unmarshal([]byte(`{"id":"dev1","data":{"temp":21.5,"sensor-1":{"on":true}},"readings":[{"v":1},{"v":2}]}`), &doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selected := map[string]interface{}{
+		`$`:                        doc,
+		`$.id`:                     "dev1",
+		`$.data.temp`:              21.5,
+		`$['data']["sensor-1"].on`: true,
+		`$.readings[1].v`:          2.0,
+		`$.readings[0]`:            map[string]interface{}{"v": 1.0},
+	}
+	for s, expected := range selected {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("Received unexpected error parsing %s: %v", s, err)
+			continue
+		}
+		v, found := sel.Select(doc)
+		if !found || !reflect.DeepEqual(v, expected) {
+			t.Errorf("Expected %v selected by %s, got %v (found: %v)", expected, s, v, found)
+		}
+	}
+
+	missing := []string{`$.name`, `$.data.temp.value`, `$.readings[2]`, `$.data[0]`, `$.readings.v`}
+	for _, s := range missing {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("Received unexpected error parsing %s: %v", s, err)
+			continue
+		}
+		if v, found := sel.Select(doc); found {
+			t.Errorf("Expected nothing selected by %s, got %v", s, v)
+		}
+	}
+
+	invalid := []string{``, `data.temp`, `$.`, `$..temp`, `$[`, `$[-1]`, `$[a]`, `$temp`, `$.readings[0]v`}
+	for _, s := range invalid {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("Expected an error parsing %s", s)
+		}
+	}
+}
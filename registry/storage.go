@@ -16,6 +16,8 @@ const (
 type Storage interface {
 	// CRUD
 	add(ts TimeSeries) (*TimeSeries, error)
+	// addMany adds all or none of the time series
+	addMany(series []TimeSeries) ([]TimeSeries, error)
 	update(name string, ts TimeSeries) (*TimeSeries, error)
 	get(name string) (*TimeSeries, error)
 	delete(name string) error
@@ -23,6 +25,8 @@ type Storage interface {
 	getMany(page, perPage int) ([]TimeSeries, int, error)
 	filterOne(path, op, value string) (*TimeSeries, error)
 	filter(path, op, value string, page, perPage int) ([]TimeSeries, int, error)
+	// search returns all time series matching the filter in no particular order
+	search(filter Predicate) ([]TimeSeries, error)
 	// needed internally
 	getTotal() (int, error)
 	getLastModifiedTime() (time.Time, error)
@@ -12,8 +12,31 @@ type SourceType string
 const (
 	Mqtt   = "MQTT"
 	Series = "Series"
+	// Virtual series are computed from other series when they are queried
+	Virtual = "Virtual"
 )
 
+// Policies for submitted records whose time is already taken in their series
+const (
+	// DuplicatesOverwrite replaces the stored value
+	DuplicatesOverwrite = "overwrite"
+	// DuplicatesKeepFirst keeps the stored value and drops the submitted one
+	DuplicatesKeepFirst = "keep_first"
+	// DuplicatesReject rejects the whole submission
+	DuplicatesReject = "reject"
+	// DuplicatesSequence stores both, numbered in the order of their arrival
+	DuplicatesSequence = "sequence"
+)
+
+// ValidDuplicatesPolicy checks if a policy for duplicate times is supported. Empty means the default policy.
+func ValidDuplicatesPolicy(p string) bool {
+	switch p {
+	case "", DuplicatesOverwrite, DuplicatesKeepFirst, DuplicatesReject, DuplicatesSequence:
+		return true
+	}
+	return false
+}
+
 // A TimeSeries describes a stored stream of data
 type TimeSeries struct {
 	// Name is the BrokerURL of the Registry API
@@ -28,6 +51,12 @@ type TimeSeries struct {
 	//Unit of the data
 	Unit string `json:"unit,omitempty"`
 
+	//Retention is the period for which the data is kept (eg: 30m, 12h, 7d, 4w). Empty means forever
+	Retention string `json:"retention,omitempty"`
+
+	//Duplicates is the policy for submitted records whose time is already taken (eg: keep_first). Empty means the default policy of the data API
+	Duplicates string `json:"duplicates,omitempty"`
+
 	// Meta is a hash-map with optional meta-information
 	Meta map[string]interface{} `json:"meta"`
 
@@ -37,10 +66,11 @@ type TimeSeries struct {
 // Source describes a single time series such as a sensor (LinkSmart Resource)
 type Source struct {
 	//type of the source
-	//This can be either MQTT or a series element itself
+	//This can be either MQTT, a series element itself or virtual
 	SrcType SourceType `json:"type,omitempty"`
 	*MQTTSource
 	*SeriesSource
+	*VirtualSource
 }
 
 type MQTTSource struct {
@@ -58,11 +88,63 @@ type MQTTSource struct {
 	Insecure bool   `json:"insecure,omitempty"`
 	//Avoid marshalling sensitive informations
 
+	//Format of the payload of the messages, see the MQTTFormat constants. Empty means SenML JSON.
+	Format string `json:"format,omitempty"`
+	//Template maps the JSON payloads to records, for the json format
+	Template *MQTTTemplate `json:"template,omitempty"`
 }
 
+// Payload formats of the messages of an MQTT source
+const (
+	// MQTTFormatSenmlJSON is a SenML pack in JSON
+	MQTTFormatSenmlJSON = "senml+json"
+	// MQTTFormatSenmlCBOR is a SenML pack in CBOR
+	MQTTFormatSenmlCBOR = "senml+cbor"
+	// MQTTFormatRaw is a single value in plain text (eg: 21.5), stored as a record of the series at the time of arrival
+	MQTTFormatRaw = "raw"
+	// MQTTFormatJSON is a JSON document mapped to records by the template of the source
+	MQTTFormatJSON = "json"
+)
+
+// ValidMQTTFormat checks if a payload format of MQTT messages is supported. Empty means SenML JSON.
+func ValidMQTTFormat(f string) bool {
+	switch f {
+	case "", MQTTFormatSenmlJSON, MQTTFormatSenmlCBOR, MQTTFormatRaw, MQTTFormatJSON:
+		return true
+	}
+	return false
+}
+
+// MQTTTemplate maps JSON payloads to SenML records with JSONPath-style selectors, see ParseSelector
+type MQTTTemplate struct {
+	//Records selects an array of which each element is mapped to a record (eg: $.readings). By default, the payload is a single record.
+	//The other selectors start from the element of the array if it is set.
+	Records string `json:"records,omitempty"`
+	//Value selects the value of the record (eg: $.temp)
+	Value string `json:"value"`
+	//Time selects the time as Unix time in seconds or RFC3339 string. By default, the time of arrival.
+	Time string `json:"time,omitempty"`
+	//Name selects the name of the record. By default, the name of the series.
+	Name string `json:"name,omitempty"`
+}
+
+// SeriesSource describes a rollup series which is continuously aggregated from another (raw) series
 type SeriesSource struct {
-	//name of the time series
-	URL string `json:name`
+	//name of the source time series
+	Series string `json:"series"`
+	//Aggregate applied to the source data within each interval (eg: mean, min, max, count, sum)
+	Aggregate string `json:"aggregate"`
+	//Interval of the rollup (eg: 5m, 1h, 1d)
+	Interval string `json:"interval"`
+}
+
+// VirtualSource describes a series which is not stored but computed by an expression over other series when it is queried.
+// The inputs are aligned in time: there is a record at each time of an input record, computed from the latest value of each input.
+type VirtualSource struct {
+	//Inputs maps the variables of the expression to the names of the input series (eg: {"v": "voltage", "i": "current"})
+	Inputs map[string]string `json:"inputs"`
+	//Expression computing the value, see ParseExpression (eg: v * i)
+	Expression string `json:"expression"`
 }
 
 func (ts TimeSeries) copy() TimeSeries {
@@ -75,8 +157,10 @@ func (ts TimeSeries) copy() TimeSeries {
 // MarshalJSON masks sensitive information when using the default marshaller
 func (ts TimeSeries) MarshalJSON() ([]byte, error) {
 	if !ts.keepSensitiveInfo {
-		if ts.Source.SrcType == Mqtt {
-			// mask MQTT credentials and key paths
+		if ts.Source.SrcType == Mqtt && ts.Source.MQTTSource != nil {
+			// mask MQTT credentials and key paths of a copy, the source is shared with the original
+			mqttSource := *ts.Source.MQTTSource
+			ts.Source.MQTTSource = &mqttSource
 			if ts.Source.Username != "" {
 				ts.Source.Username = "*****"
 			}
@@ -102,6 +186,20 @@ func (ts TimeSeries) MarshalJSON() ([]byte, error) {
 	return json.Marshal((*Alias)(&ts))
 }
 
+// withoutSensitiveInfo returns a copy of the time series whose MQTT credentials and key paths are removed
+func (ts TimeSeries) withoutSensitiveInfo() TimeSeries {
+	if ts.Source.SrcType == Mqtt && ts.Source.MQTTSource != nil {
+		mqttSource := *ts.Source.MQTTSource
+		mqttSource.Username = ""
+		mqttSource.Password = ""
+		mqttSource.CaFile = ""
+		mqttSource.CertFile = ""
+		mqttSource.KeyFile = ""
+		ts.Source.MQTTSource = &mqttSource
+	}
+	return ts
+}
+
 // MarshalSensitiveJSON serializes the datasource including the sensitive information
 func (ts TimeSeries) MarshalSensitiveJSON() ([]byte, error) {
 	ts.keepSensitiveInfo = true
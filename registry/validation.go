@@ -4,19 +4,23 @@ package registry
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
 
 	"github.com/linksmart/historical-datastore/common"
 )
 
+// reservedNameSuffixes end the paths of the data API which follow the names of the series, e.g. /data/{name}/latest
+var reservedNameSuffixes = []string{"/latest", "/stream"}
+
 // DataSource writability:
 // id: readonly
 // url: readonly
 // data: readonly
 // resource: mandatory, fixed
 // meta: n/a
-// retention: n/a
+// retention: optional, supported period
 // aggregation: id/data readonly
 // type: mandatory, fixed
 // format: mandatory
@@ -35,8 +39,33 @@ func validateCreation(ts TimeSeries) error {
 	if !validSenmlName.MatchString(ts.Name) {
 		e.invalid = append(e.invalid, "name")
 	}
+	for _, suffix := range reservedNameSuffixes {
+		if strings.HasSuffix(ts.Name, suffix) {
+			e.other = append(e.other, fmt.Sprintf("Names ending with %s are reserved for the data API", suffix))
+		}
+	}
 
 	//validate source
+	if ts.Source.SrcType == Mqtt {
+		validateMQTTSource(ts, &e)
+	}
+	if ts.Source.SrcType == Series {
+		validateSeriesSource(ts, &e)
+	}
+	if ts.Source.SrcType == Virtual {
+		validateVirtualSource(ts, &e)
+	}
+
+	// retention
+	if !common.SupportedPeriod(ts.Retention) {
+		e.invalid = append(e.invalid, "retention")
+	}
+
+	validateUnit(ts, &e)
+
+	if !ValidDuplicatesPolicy(ts.Duplicates) {
+		e.invalid = append(e.invalid, "duplicates")
+	}
 
 	if e.Err() {
 		return e
@@ -57,6 +86,37 @@ func validateUpdate(ts TimeSeries, oldTS TimeSeries, conf common.RegConf) error
 		e.readOnly = append(e.readOnly, "type")
 	}
 
+	// source of a rollup or virtual series
+	derived := func(t SourceType) bool { return t == Series || t == Virtual }
+	if (derived(ts.Source.SrcType) || derived(oldTS.Source.SrcType)) && !reflect.DeepEqual(ts.Source, oldTS.Source) {
+		e.readOnly = append(e.readOnly, "source")
+	}
+	if ts.Source.SrcType == Virtual && ts.Retention != "" {
+		e.other = append(e.other, "Virtual series have no retention")
+	}
+	if ts.Source.SrcType == Mqtt {
+		validateMQTTSource(ts, &e)
+	}
+
+	// retention
+	if !common.SupportedPeriod(ts.Retention) {
+		e.invalid = append(e.invalid, "retention")
+	}
+
+	// units registered before they were validated are kept. The stored values are not converted,
+	// so that only the unit of virtual series, which are computed at query time, may change.
+	if ts.Unit != oldTS.Unit {
+		if ts.Source.SrcType == Virtual {
+			validateUnit(ts, &e)
+		} else {
+			e.readOnly = append(e.readOnly, "unit")
+		}
+	}
+
+	if !ValidDuplicatesPolicy(ts.Duplicates) {
+		e.invalid = append(e.invalid, "duplicates")
+	}
+
 	//TODO: add validation logics
 	/*
 
@@ -75,12 +135,6 @@ func validateUpdate(ts TimeSeries, oldTS TimeSeries, conf common.RegConf) error
 			e.readOnly = append(e.readOnly, "resource")
 		}
 
-		// retention
-		if !common.SupportedPeriod(ts.Retention) {
-			e.invalid = append(e.invalid, "retention")
-		}
-
-
 
 		// aggregation
 		if ts.Type != common.FLOAT && len(ts.Aggregation) != 0 {
@@ -124,6 +178,69 @@ func validateUpdate(ts TimeSeries, oldTS TimeSeries, conf common.RegConf) error
 	return nil
 }
 
+// validateSeriesSource validates the source of a rollup series
+func validateSeriesSource(ts TimeSeries, e *validationError) {
+	src := ts.Source.SeriesSource
+	if src == nil {
+		e.mandatory = append(e.mandatory, "source.series", "source.aggregate", "source.interval")
+		return
+	}
+	if src.Series == "" {
+		e.mandatory = append(e.mandatory, "source.series")
+	} else if src.Series == ts.Name {
+		e.invalid = append(e.invalid, "source.series")
+	}
+	if src.Aggregate == "" {
+		e.mandatory = append(e.mandatory, "source.aggregate")
+	} else if !common.NumericAggregate(src.Aggregate) {
+		e.invalid = append(e.invalid, "source.aggregate")
+	}
+	if src.Interval == "" {
+		e.mandatory = append(e.mandatory, "source.interval")
+	} else if !common.SupportedPeriod(src.Interval) {
+		e.invalid = append(e.invalid, "source.interval")
+	}
+	if ts.Type != Float {
+		e.other = append(e.other, "Rollup series must be of float type")
+	}
+}
+
+// validateMQTTSource validates the payload format of an MQTT source and its template
+func validateMQTTSource(ts TimeSeries, e *validationError) {
+	src := ts.Source.MQTTSource
+	if src == nil {
+		return
+	}
+	if !ValidMQTTFormat(src.Format) {
+		e.invalid = append(e.invalid, "source.format")
+		return
+	}
+	if src.Format != MQTTFormatJSON {
+		if src.Template != nil {
+			e.other = append(e.other, "Only sources of json format have a template")
+		}
+		return
+	}
+	if src.Template == nil || src.Template.Value == "" {
+		e.mandatory = append(e.mandatory, "source.template.value")
+		return
+	}
+	selectors := map[string]string{
+		"records": src.Template.Records,
+		"value":   src.Template.Value,
+		"time":    src.Template.Time,
+		"name":    src.Template.Name,
+	}
+	for _, field := range []string{"records", "value", "time", "name"} {
+		if selectors[field] == "" {
+			continue
+		}
+		if _, err := ParseSelector(selectors[field]); err != nil {
+			e.invalid = append(e.invalid, "source.template."+field)
+		}
+	}
+}
+
 // Custom error formatting
 type validationError struct {
 	readOnly  []string
@@ -152,3 +269,40 @@ func (e validationError) Error() string {
 func (e validationError) Err() bool {
 	return len(e.readOnly)+len(e.mandatory)+len(e.invalid)+len(e.other) > 0
 }
+
+// validateVirtualSource validates the inputs and the expression of a virtual series
+func validateVirtualSource(ts TimeSeries, e *validationError) {
+	src := ts.Source.VirtualSource
+	if src == nil || len(src.Inputs) == 0 || src.Expression == "" {
+		e.mandatory = append(e.mandatory, "source.inputs", "source.expression")
+		return
+	}
+	for variable, series := range src.Inputs {
+		if !ValidExprVariable(variable) || series == "" || series == ts.Name {
+			e.invalid = append(e.invalid, "source.inputs."+variable)
+		}
+	}
+	expr, err := ParseExpression(src.Expression)
+	if err != nil {
+		e.other = append(e.other, "Invalid source.expression: "+err.Error())
+	} else {
+		for variable := range expr.Variables() {
+			if _, found := src.Inputs[variable]; !found {
+				e.other = append(e.other, fmt.Sprintf("Variable %s of source.expression is not an input", variable))
+			}
+		}
+	}
+	if ts.Type != Float {
+		e.other = append(e.other, "Virtual series must be of float type")
+	}
+	if ts.Retention != "" {
+		e.other = append(e.other, "Virtual series have no retention")
+	}
+}
+
+// validateUnit checks that the unit is in the SenML units registry, or a supported UCUM customary unit
+func validateUnit(ts TimeSeries, e *validationError) {
+	if !common.ValidUnit(ts.Unit) {
+		e.other = append(e.other, fmt.Sprintf("Unknown unit %q. Units are those of the SenML units registry, e.g. Cel, W or kWh, or UCUM customary units, e.g. [degF]", ts.Unit))
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
 	"github.com/linksmart/historical-datastore/common"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 )
 
@@ -30,10 +31,12 @@ func newRouter() *router {
 
 	// default handler(s)
 	r.handle(http.MethodGet, "/health", healthHandler)
+	r.Methods(http.MethodGet).Path("/metrics").Handler(promhttp.Handler())
 	// middleware chain for handler, used when calling chained()
 	r.Chain = alice.New(
 		context.ClearHandler,
 		loggingHandler,
+		r.metricsHandler,
 		recoverHandler,
 		cors.AllowAll().Handler,
 	)
@@ -73,6 +76,10 @@ func recoverHandler(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if r := recover(); r != nil {
+				if r == http.ErrAbortHandler {
+					// the handler aborts the response on purpose
+					panic(r)
+				}
 				log.Printf("PANIC: %v\n%v", r, string(debug.Stack()))
 				http.Error(w, http.StatusText(500), 500)
 			}